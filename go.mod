@@ -9,6 +9,7 @@ require (
 	github.com/containerd/containerd v1.3.0
 	github.com/containerd/continuity v0.0.0-20190815185530-f2a389ac0a02 // indirect
 	github.com/docker/docker v0.0.0-20190404075923-dbe4a30928d4
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/linuxkit/virtsock v0.0.0-20180830132707-8e79449dea07
 	github.com/mattn/go-shellwords v1.0.5
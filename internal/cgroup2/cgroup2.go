@@ -0,0 +1,251 @@
+// +build linux
+
+// Package cgroup2 manages cgroups on the cgroup v2 unified hierarchy.
+package cgroup2
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Mountpoint is where the unified hierarchy is mounted.
+const Mountpoint = "/sys/fs/cgroup"
+
+// controllers are the controllers enabled for the children of every cgroup
+// created by `New` if the kernel supports them.
+var controllers = []string{"cpu", "cpuset", "io", "memory", "pids"}
+
+var (
+	unifiedOnce sync.Once
+	unified     bool
+)
+
+// IsUnified returns true if `Mountpoint` is the cgroup v2 unified hierarchy
+// rather than the cgroup v1 controller hierarchies.
+func IsUnified() bool {
+	unifiedOnce.Do(func() {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(Mountpoint, &st); err == nil {
+			unified = st.Type == unix.CGROUP2_SUPER_MAGIC
+		}
+	})
+	return unified
+}
+
+// Manager manages a single cgroup on the unified hierarchy.
+type Manager struct {
+	path string
+}
+
+// New creates the cgroup `group`, which is relative to `Mountpoint`, and
+// applies `resources` to it. The controllers needed to apply the resources are
+// enabled in every ancestor of the group.
+func New(group string, resources *oci.LinuxResources) (*Manager, error) {
+	path := filepath.Join(Mountpoint, group)
+	if err := enableControllers(Mountpoint, filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create cgroup %s", group)
+	}
+	m := &Manager{path: path}
+	if err := m.Update(resources); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Load returns the manager of the existing cgroup `group`, which is relative
+// to `Mountpoint`.
+func Load(group string) (*Manager, error) {
+	path := filepath.Join(Mountpoint, group)
+	if _, err := os.Stat(path); err != nil {
+		return nil, errors.Wrapf(err, "failed to load cgroup %s", group)
+	}
+	return &Manager{path: path}, nil
+}
+
+// enableControllers enables the supported `controllers` in the subtree of
+// every cgroup from `root` down to and including `path`.
+func enableControllers(root, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return errors.Wrapf(err, "cgroup %s is not under %s", path, root)
+	}
+	dir := root
+	elems := []string{}
+	if rel != "." {
+		elems = strings.Split(rel, string(filepath.Separator))
+	}
+	for i := 0; ; i++ {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrapf(err, "failed to create cgroup %s", dir)
+		}
+		available, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+		if err != nil {
+			return errors.Wrapf(err, "failed to read controllers of cgroup %s", dir)
+		}
+		var enable []string
+		for _, c := range controllers {
+			for _, a := range strings.Fields(string(available)) {
+				if a == c {
+					enable = append(enable, "+"+c)
+				}
+			}
+		}
+		if len(enable) != 0 {
+			if err := writeFile(dir, "cgroup.subtree_control", strings.Join(enable, " ")); err != nil {
+				return err
+			}
+		}
+		if i == len(elems) {
+			return nil
+		}
+		dir = filepath.Join(dir, elems[i])
+	}
+}
+
+// Path returns the path of the cgroup in the unified hierarchy.
+func (m *Manager) Path() string {
+	return m.path
+}
+
+// AddProc moves the process `pid` into the cgroup.
+func (m *Manager) AddProc(pid int) error {
+	return writeFile(m.path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// Delete removes the cgroup. It must not contain any processes or children.
+func (m *Manager) Delete() error {
+	if err := os.Remove(m.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to delete cgroup %s", m.path)
+	}
+	return nil
+}
+
+// Update applies the CPU, memory and pids limits in `resources` to the cgroup
+// using the v2 equivalents of the v1 controller files.
+func (m *Manager) Update(resources *oci.LinuxResources) error {
+	if resources == nil {
+		return nil
+	}
+	var cpuMax string
+	if cpu := resources.CPU; cpu != nil && (cpu.Quota != nil || cpu.Period != nil) {
+		// cpu.max holds both the quota and period but an update may only
+		// change one of them.
+		b, err := ioutil.ReadFile(filepath.Join(m.path, "cpu.max"))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to read cpu.max of cgroup %s", m.path)
+		}
+		cpuMax = string(b)
+	}
+	for _, f := range resourceFiles(resources, cpuMax) {
+		if err := writeFile(m.path, f.name, f.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type resourceFile struct {
+	name, value string
+}
+
+// resourceFiles returns the cgroup files and values that apply `resources`.
+// `cpuMax` is the current content of cpu.max, if known, whose quota or period
+// is kept unless `resources` sets it.
+func resourceFiles(resources *oci.LinuxResources, cpuMax string) []resourceFile {
+	var files []resourceFile
+	add := func(name, value string) {
+		files = append(files, resourceFile{name, value})
+	}
+	if mem := resources.Memory; mem != nil {
+		if mem.Reservation != nil {
+			add("memory.low", limitValue(*mem.Reservation))
+		}
+		if mem.Limit != nil {
+			add("memory.max", limitValue(*mem.Limit))
+		}
+		// The v1 swap limit is of memory and swap combined where the v2 limit
+		// is of swap alone.
+		if mem.Swap != nil {
+			swap := *mem.Swap
+			if swap > 0 && mem.Limit != nil && *mem.Limit > 0 {
+				swap -= *mem.Limit
+			}
+			add("memory.swap.max", limitValue(swap))
+		}
+	}
+	if cpu := resources.CPU; cpu != nil {
+		if cpu.Shares != nil && *cpu.Shares != 0 {
+			add("cpu.weight", strconv.FormatUint(sharesToWeight(*cpu.Shares), 10))
+		}
+		if cpu.Quota != nil || cpu.Period != nil {
+			quota, period := "max", "100000"
+			if fields := strings.Fields(cpuMax); len(fields) == 2 {
+				quota, period = fields[0], fields[1]
+			}
+			if cpu.Quota != nil {
+				quota = "max"
+				if *cpu.Quota > 0 {
+					quota = strconv.FormatInt(*cpu.Quota, 10)
+				}
+			}
+			if cpu.Period != nil && *cpu.Period != 0 {
+				period = strconv.FormatUint(*cpu.Period, 10)
+			}
+			add("cpu.max", quota+" "+period)
+		}
+		if cpu.Cpus != "" {
+			add("cpuset.cpus", cpu.Cpus)
+		}
+		if cpu.Mems != "" {
+			add("cpuset.mems", cpu.Mems)
+		}
+	}
+	if pids := resources.Pids; pids != nil {
+		// Unlike the memory limits a pids limit of 0 is unlimited as in runC.
+		limit := pids.Limit
+		if limit == 0 {
+			limit = -1
+		}
+		add("pids.max", limitValue(limit))
+	}
+	return files
+}
+
+// limitValue returns `limit` as written to a v2 limit file where a negative
+// value is unlimited. A limit of 0 is written as is.
+func limitValue(limit int64) string {
+	if limit < 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// sharesToWeight converts v1 cpu.shares in [2, 262144] to a v2 cpu.weight in
+// [1, 10000].
+func sharesToWeight(shares uint64) uint64 {
+	if shares < 2 {
+		shares = 2
+	} else if shares > 262144 {
+		shares = 262144
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
+
+func writeFile(dir, name, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0); err != nil {
+		return errors.Wrapf(err, "failed to write %s of cgroup %s", name, dir)
+	}
+	return nil
+}
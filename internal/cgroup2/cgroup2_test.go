@@ -0,0 +1,241 @@
+// +build linux
+
+package cgroup2
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func Test_resourceFiles(t *testing.T) {
+	i64 := func(v int64) *int64 { return &v }
+	u64 := func(v uint64) *uint64 { return &v }
+	tests := []struct {
+		name      string
+		resources *oci.LinuxResources
+		// cpuMax is the current content of cpu.max.
+		cpuMax   string
+		expected []resourceFile
+	}{
+		{
+			name: "Limits",
+			resources: &oci.LinuxResources{
+				Memory: &oci.LinuxMemory{
+					Limit: i64(1024 * 1024 * 1024),
+					Swap:  i64(1536 * 1024 * 1024),
+				},
+				CPU: &oci.LinuxCPU{
+					Shares: u64(1024),
+					Quota:  i64(50000),
+					Period: u64(100000),
+				},
+				Pids: &oci.LinuxPids{Limit: 100},
+			},
+			expected: []resourceFile{
+				{"memory.max", "1073741824"},
+				{"memory.swap.max", "536870912"},
+				{"cpu.weight", "39"},
+				{"cpu.max", "50000 100000"},
+				{"pids.max", "100"},
+			},
+		},
+		{
+			name: "Unlimited",
+			resources: &oci.LinuxResources{
+				Memory: &oci.LinuxMemory{Limit: i64(-1), Swap: i64(-1)},
+				CPU:    &oci.LinuxCPU{Quota: i64(-1)},
+				Pids:   &oci.LinuxPids{Limit: 0},
+			},
+			expected: []resourceFile{
+				{"memory.max", "max"},
+				{"memory.swap.max", "max"},
+				{"cpu.max", "max 100000"},
+				{"pids.max", "max"},
+			},
+		},
+		{
+			// The container may not use any swap.
+			name: "SwapEqualsLimit",
+			resources: &oci.LinuxResources{
+				Memory: &oci.LinuxMemory{
+					Limit: i64(1024 * 1024 * 1024),
+					Swap:  i64(1024 * 1024 * 1024),
+				},
+			},
+			expected: []resourceFile{
+				{"memory.max", "1073741824"},
+				{"memory.swap.max", "0"},
+			},
+		},
+		{
+			// Only the period is changed.
+			name: "PeriodOnly",
+			resources: &oci.LinuxResources{
+				CPU: &oci.LinuxCPU{Period: u64(200000)},
+			},
+			cpuMax: "50000 100000\n",
+			expected: []resourceFile{
+				{"cpu.max", "50000 200000"},
+			},
+		},
+		{
+			// Only the quota is changed.
+			name: "QuotaOnly",
+			resources: &oci.LinuxResources{
+				CPU: &oci.LinuxCPU{Quota: i64(50000)},
+			},
+			cpuMax: "max 200000\n",
+			expected: []resourceFile{
+				{"cpu.max", "50000 200000"},
+			},
+		},
+		{
+			name: "ReservationZero",
+			resources: &oci.LinuxResources{
+				Memory: &oci.LinuxMemory{Reservation: i64(0)},
+			},
+			expected: []resourceFile{
+				{"memory.low", "0"},
+			},
+		},
+	}
+	for _, test := range tests {
+		if files := resourceFiles(test.resources, test.cpuMax); !reflect.DeepEqual(files, test.expected) {
+			t.Fatalf("expected %s %v got: %v", test.name, test.expected, files)
+		}
+	}
+}
+
+func Test_Manager_Update_PeriodOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"cpu.max": "50000 100000\n"})
+
+	period := uint64(200000)
+	m := &Manager{path: dir}
+	if err := m.Update(&oci.LinuxResources{CPU: &oci.LinuxCPU{Period: &period}}); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if s := readFile(t, filepath.Join(dir, "cpu.max")); s != "50000 200000" {
+		t.Fatalf("expected the quota to be kept got: %q", s)
+	}
+}
+
+func Test_sharesToWeight(t *testing.T) {
+	for shares, weight := range map[uint64]uint64{0: 1, 2: 1, 1024: 39, 262144: 10000, 1 << 20: 10000} {
+		if w := sharesToWeight(shares); w != weight {
+			t.Fatalf("expected weight %d for shares %d got: %d", weight, shares, w)
+		}
+	}
+}
+
+func Test_enableControllers(t *testing.T) {
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	pod := filepath.Join(root, "containers")
+	if err := os.MkdirAll(pod, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, root, map[string]string{"cgroup.controllers": "cpuset cpu io memory hugetlb pids rdma\n"})
+	writeFiles(t, pod, map[string]string{"cgroup.controllers": "cpu memory\n"})
+
+	if err := enableControllers(root, pod); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if s := readFile(t, filepath.Join(root, "cgroup.subtree_control")); s != "+cpu +cpuset +io +memory +pids" {
+		t.Fatalf("unexpected root subtree_control: %q", s)
+	}
+	if s := readFile(t, filepath.Join(pod, "cgroup.subtree_control")); s != "+cpu +memory" {
+		t.Fatalf("unexpected containers subtree_control: %q", s)
+	}
+}
+
+func Test_Manager_Stat(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"cpu.stat":            "usage_usec 3000\nuser_usec 2000\nsystem_usec 1000\nnr_periods 10\nnr_throttled 2\nthrottled_usec 500\n",
+		"memory.stat":         "anon 4096\nfile 8192\npgfault 7\npgmajfault 1\n",
+		"memory.current":      "12288\n",
+		"memory.max":          "max\n",
+		"memory.events":       "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n",
+		"memory.swap.current": "0\n",
+		"memory.swap.max":     "max\n",
+		"pids.current":        "4\n",
+		"pids.max":            "100\n",
+		"io.stat":             "8:0 rbytes=1024 wbytes=2048 rios=1 wios=2 dbytes=0 dios=0\n",
+	})
+
+	metrics, err := (&Manager{path: dir}).Stat()
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if u := metrics.CPU.Usage; u.Total != 3000000 || u.User != 2000000 || u.Kernel != 1000000 {
+		t.Fatalf("unexpected cpu usage: %+v", u)
+	}
+	if th := metrics.CPU.Throttling; th.Periods != 10 || th.ThrottledPeriods != 2 || th.ThrottledTime != 500000 {
+		t.Fatalf("unexpected cpu throttling: %+v", th)
+	}
+	m := metrics.Memory
+	if m.RSS != 4096 || m.Cache != 8192 || m.PgFault != 7 || m.PgMajFault != 1 {
+		t.Fatalf("unexpected memory stat: %+v", m)
+	}
+	if m.Usage.Usage != 12288 || m.Usage.Limit != 0 || m.Usage.Failcnt != 3 {
+		t.Fatalf("unexpected memory usage: %+v", m.Usage)
+	}
+	if metrics.Pids.Current != 4 || metrics.Pids.Limit != 100 {
+		t.Fatalf("unexpected pids: %+v", metrics.Pids)
+	}
+	if len(metrics.Blkio.IoServiceBytesRecursive) != 2 || len(metrics.Blkio.IoServicedRecursive) != 2 {
+		t.Fatalf("unexpected blkio: %+v", metrics.Blkio)
+	}
+	if e := metrics.Blkio.IoServiceBytesRecursive[1]; e.Op != "Write" || e.Major != 8 || e.Minor != 0 || e.Value != 2048 {
+		t.Fatalf("unexpected blkio write bytes: %+v", e)
+	}
+
+	// Controllers that are not enabled are skipped.
+	empty, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(empty)
+	metrics, err = (&Manager{path: empty}).Stat()
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if metrics.CPU != nil || metrics.Memory != nil || metrics.Pids != nil || metrics.Blkio != nil {
+		t.Fatalf("expected no metrics got: %+v", metrics)
+	}
+}
@@ -0,0 +1,209 @@
+// +build linux
+
+package cgroup2
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	v1 "github.com/containerd/cgroups/stats/v1"
+	"github.com/pkg/errors"
+)
+
+// Stat returns the metrics of the cgroup mapped onto the v1 metrics so that
+// they are reported the same way regardless of the hierarchy. Unlimited
+// memory and pids limits are reported as 0. Controllers that are not enabled
+// for the cgroup are skipped.
+func (m *Manager) Stat() (*v1.Metrics, error) {
+	metrics := &v1.Metrics{}
+
+	cpu, err := readKeyValues(m.path, "cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	if cpu != nil {
+		// The v2 times are in microseconds and the v1 times in nanoseconds.
+		metrics.CPU = &v1.CPUStat{
+			Usage: &v1.CPUUsage{
+				Total:  cpu["usage_usec"] * 1000,
+				User:   cpu["user_usec"] * 1000,
+				Kernel: cpu["system_usec"] * 1000,
+			},
+			Throttling: &v1.Throttle{
+				Periods:          cpu["nr_periods"],
+				ThrottledPeriods: cpu["nr_throttled"],
+				ThrottledTime:    cpu["throttled_usec"] * 1000,
+			},
+		}
+	}
+
+	mem, err := readKeyValues(m.path, "memory.stat")
+	if err != nil {
+		return nil, err
+	}
+	if mem != nil {
+		stat := &v1.MemoryStat{
+			Cache:        mem["file"],
+			RSS:          mem["anon"],
+			RSSHuge:      mem["anon_thp"],
+			MappedFile:   mem["file_mapped"],
+			Dirty:        mem["file_dirty"],
+			Writeback:    mem["file_writeback"],
+			PgFault:      mem["pgfault"],
+			PgMajFault:   mem["pgmajfault"],
+			InactiveAnon: mem["inactive_anon"],
+			ActiveAnon:   mem["active_anon"],
+			InactiveFile: mem["inactive_file"],
+			ActiveFile:   mem["active_file"],
+			Unevictable:  mem["unevictable"],
+			Usage:        &v1.MemoryEntry{},
+			Swap:         &v1.MemoryEntry{},
+		}
+		if stat.Usage.Usage, err = readUint(m.path, "memory.current"); err != nil {
+			return nil, err
+		}
+		if stat.Usage.Limit, err = readUint(m.path, "memory.max"); err != nil {
+			return nil, err
+		}
+		events, err := readKeyValues(m.path, "memory.events")
+		if err != nil {
+			return nil, err
+		}
+		stat.Usage.Failcnt = events["max"]
+		if stat.Swap.Usage, err = readUint(m.path, "memory.swap.current"); err != nil {
+			return nil, err
+		}
+		if stat.Swap.Limit, err = readUint(m.path, "memory.swap.max"); err != nil {
+			return nil, err
+		}
+		metrics.Memory = stat
+	}
+
+	if _, err := os.Stat(filepath.Join(m.path, "pids.current")); err == nil {
+		metrics.Pids = &v1.PidsStat{}
+		if metrics.Pids.Current, err = readUint(m.path, "pids.current"); err != nil {
+			return nil, err
+		}
+		if metrics.Pids.Limit, err = readUint(m.path, "pids.max"); err != nil {
+			return nil, err
+		}
+	}
+
+	if metrics.Blkio, err = readIOStat(m.path); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// readUint returns the single value in the cgroup file `name`. "max" and a
+// missing file are returned as 0.
+func readUint(dir, name string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "failed to read %s of cgroup %s", name, dir)
+	}
+	v := strings.TrimSpace(string(data))
+	if v == "max" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s of cgroup %s", name, dir)
+	}
+	return n, nil
+}
+
+// readKeyValues returns the "key value" lines of the cgroup file `name` or nil
+// if it does not exist.
+func readKeyValues(dir, name string) (map[string]uint64, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read %s of cgroup %s", name, dir)
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s of cgroup %s", name, dir)
+		}
+		values[fields[0]] = n
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s of cgroup %s", name, dir)
+	}
+	return values, nil
+}
+
+// readIOStat maps the per device "MAJ:MIN key=value..." lines of io.stat onto
+// the v1 recursive blkio entries. It returns nil if the io controller is not
+// enabled.
+func readIOStat(dir string) (*v1.BlkIOStat, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "io.stat"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read io.stat of cgroup %s", dir)
+	}
+	stat := &v1.BlkIOStat{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		var major, minor uint64
+		dev := strings.SplitN(fields[0], ":", 2)
+		if len(dev) != 2 {
+			continue
+		}
+		if major, err = strconv.ParseUint(dev[0], 10, 64); err != nil {
+			continue
+		}
+		if minor, err = strconv.ParseUint(dev[1], 10, 64); err != nil {
+			continue
+		}
+		for _, kv := range fields[1:] {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			value, err := strconv.ParseUint(parts[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			entry := &v1.BlkIOEntry{Major: major, Minor: minor, Value: value}
+			switch parts[0] {
+			case "rbytes":
+				entry.Op = "Read"
+				stat.IoServiceBytesRecursive = append(stat.IoServiceBytesRecursive, entry)
+			case "wbytes":
+				entry.Op = "Write"
+				stat.IoServiceBytesRecursive = append(stat.IoServiceBytesRecursive, entry)
+			case "rios":
+				entry.Op = "Read"
+				stat.IoServicedRecursive = append(stat.IoServicedRecursive, entry)
+			case "wios":
+				entry.Op = "Write"
+				stat.IoServicedRecursive = append(stat.IoServicedRecursive, entry)
+			}
+		}
+	}
+	return stat, nil
+}
@@ -0,0 +1,424 @@
+// +build linux
+
+// Package memevents watches cgroups for out of memory and memory pressure
+// events through the notification interfaces of the kernel.
+//
+// On the cgroup v1 hierarchy an eventfd is registered for memory.oom_control
+// and for the critical level of memory.pressure_level of every cgroup. On the
+// cgroup v2 unified hierarchy memory.events is watched with inotify and the
+// changes in its counters are reported.
+package memevents
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/cgroup2"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Kind is the kind of a memory event.
+type Kind int
+
+const (
+	// OOM is reported when the cgroup reached its memory limit and the OOM
+	// killer was invoked to kill one of its processes.
+	OOM Kind = iota
+	// CriticalPressure is reported when the cgroup is about to reach its
+	// memory limit and the kernel must reclaim its memory to continue.
+	CriticalPressure
+)
+
+func (k Kind) String() string {
+	switch k {
+	case OOM:
+		return "OOM"
+	case CriticalPressure:
+		return "CriticalPressure"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event is a memory event of a watched cgroup.
+type Event struct {
+	// ID is the ID the cgroup was added to the `Watcher` with.
+	ID string
+	// Group is the path of the cgroup relative to the hierarchy root.
+	Group string
+	Kind  Kind
+}
+
+// eventsBuffer is the number of events that can be waiting to be received
+// from `Watcher.Events`. Events are dropped once it is full.
+const eventsBuffer = 64
+
+// Test dependencies
+var (
+	isUnified    = cgroup2.IsUnified
+	v1MemoryRoot = "/sys/fs/cgroup/memory"
+	v2Root       = cgroup2.Mountpoint
+	// pressureInterval is the minimum time between two `CriticalPressure`
+	// events of a cgroup. The v1 critical pressure eventfd is signaled on
+	// every reclaim so a cgroup at its limit would flood the receiver.
+	pressureInterval = 5 * time.Second
+)
+
+// source is a file descriptor registered with the epoll instance of the
+// `Watcher` that becomes readable when the cgroup has an event.
+type source struct {
+	id    string
+	group string
+	fd    int
+	// dir is the directory of the cgroup. The source is removed once it no
+	// longer exists.
+	dir string
+	// file is the v1 control file the eventfd is registered for. It must be
+	// kept open for the registration to remain.
+	file *os.File
+	// kind is the kind of event signaled by a v1 eventfd.
+	kind Kind
+	// counts are the last counters read from the v2 memory.events file.
+	counts map[string]uint64
+	// lastPressure is when the last `CriticalPressure` event was sent.
+	lastPressure time.Time
+}
+
+// Watcher reports the memory events of a set of cgroups. A nil *Watcher
+// watches nothing.
+type Watcher struct {
+	epfd   int
+	stopfd int
+	done   chan struct{}
+	events chan Event
+
+	m       sync.Mutex
+	sources map[int]*source
+}
+
+// NewWatcher returns a watcher with no cgroups.
+func NewWatcher() (_ *Watcher, err error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create epoll instance")
+	}
+	defer func() {
+		if err != nil {
+			unix.Close(epfd)
+		}
+	}()
+	stopfd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create eventfd")
+	}
+	if err := epollAdd(epfd, stopfd); err != nil {
+		unix.Close(stopfd)
+		return nil, err
+	}
+	w := &Watcher{
+		epfd:    epfd,
+		stopfd:  stopfd,
+		done:    make(chan struct{}),
+		events:  make(chan Event, eventsBuffer),
+		sources: make(map[int]*source),
+	}
+	go w.run()
+	return w, nil
+}
+
+func epollAdd(epfd, fd int) error {
+	ev := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)}
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		return errors.Wrapf(err, "failed to add fd %d to epoll instance", fd)
+	}
+	return nil
+}
+
+// Events returns the channel the events of all watched cgroups are sent on.
+// It is closed by `Close`.
+func (w *Watcher) Events() <-chan Event {
+	if w == nil {
+		return nil
+	}
+	return w.events
+}
+
+// Add watches the cgroup `group`, which is relative to the hierarchy root,
+// and reports its events with `id`. The cgroup is no longer watched once it is
+// deleted or `Remove` is called with `id`.
+func (w *Watcher) Add(id, group string) (err error) {
+	if w == nil {
+		return nil
+	}
+	var sources []*source
+	defer func() {
+		if err != nil {
+			for _, s := range sources {
+				s.close()
+			}
+		}
+	}()
+	if isUnified() {
+		s, err := newV2Source(id, group)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, s)
+	} else {
+		s, err := newV1Source(id, group, "memory.oom_control", "", OOM)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, s)
+		s, err = newV1Source(id, group, "memory.pressure_level", "critical", CriticalPressure)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, s)
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	for i, s := range sources {
+		if err := epollAdd(w.epfd, s.fd); err != nil {
+			for _, added := range sources[:i] {
+				w.removeLocked(added)
+			}
+			return err
+		}
+		w.sources[s.fd] = s
+	}
+	return nil
+}
+
+// newV1Source registers an eventfd for the v1 control file `name` of `group`
+// through cgroup.event_control with the optional `arg`.
+func newV1Source(id, group, name, arg string, kind Kind) (_ *source, err error) {
+	dir := filepath.Join(v1MemoryRoot, group)
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create eventfd")
+	}
+	s := &source{id: id, group: group, fd: efd, dir: dir, kind: kind}
+	defer func() {
+		if err != nil {
+			s.close()
+		}
+	}()
+	if s.file, err = os.Open(filepath.Join(dir, name)); err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s of cgroup %s", name, group)
+	}
+	control := fmt.Sprintf("%d %d", efd, s.file.Fd())
+	if arg != "" {
+		control += " " + arg
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.event_control"), []byte(control), 0); err != nil {
+		return nil, errors.Wrapf(err, "failed to register for %s of cgroup %s", name, group)
+	}
+	return s, nil
+}
+
+// newV2Source watches memory.events of `group` with inotify.
+func newV2Source(id, group string) (_ *source, err error) {
+	dir := filepath.Join(v2Root, group)
+	ifd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create inotify instance")
+	}
+	s := &source{id: id, group: group, fd: ifd, dir: dir}
+	defer func() {
+		if err != nil {
+			s.close()
+		}
+	}()
+	path := filepath.Join(dir, "memory.events")
+	if _, err := unix.InotifyAddWatch(ifd, path, unix.IN_MODIFY); err != nil {
+		return nil, errors.Wrapf(err, "failed to watch memory.events of cgroup %s", group)
+	}
+	if s.counts, err = readMemoryEvents(path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Remove stops watching all cgroups added with `id`.
+func (w *Watcher) Remove(id string) {
+	if w == nil {
+		return
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	for _, s := range w.sources {
+		if s.id == id {
+			w.removeLocked(s)
+		}
+	}
+}
+
+func (w *Watcher) removeLocked(s *source) {
+	unix.EpollCtl(w.epfd, unix.EPOLL_CTL_DEL, s.fd, nil)
+	delete(w.sources, s.fd)
+	s.close()
+}
+
+func (s *source) close() {
+	if s.file != nil {
+		s.file.Close()
+	}
+	unix.Close(s.fd)
+}
+
+// Close stops watching all cgroups and closes the `Events` channel.
+func (w *Watcher) Close() error {
+	if w == nil {
+		return nil
+	}
+	var one [8]byte
+	binary.LittleEndian.PutUint64(one[:], 1)
+	if _, err := unix.Write(w.stopfd, one[:]); err != nil {
+		return errors.Wrap(err, "failed to stop watcher")
+	}
+	<-w.done
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	for _, s := range w.sources {
+		w.removeLocked(s)
+	}
+	unix.Close(w.stopfd)
+	unix.Close(w.epfd)
+	close(w.events)
+	return nil
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+
+	events := make([]unix.EpollEvent, 16)
+	for {
+		n, err := unix.EpollWait(w.epfd, events, -1)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			logrus.WithError(err).Error("memevents: failed to wait for cgroup events")
+			return
+		}
+		for _, ev := range events[:n] {
+			fd := int(ev.Fd)
+			if fd == w.stopfd {
+				return
+			}
+			w.m.Lock()
+			if s, ok := w.sources[fd]; ok {
+				w.handleLocked(s)
+			}
+			w.m.Unlock()
+		}
+	}
+}
+
+// handleLocked reads the pending notification of `s` and sends its events.
+func (w *Watcher) handleLocked(s *source) {
+	// Drain the eventfd or inotify events so that epoll does not report the
+	// source again until the next notification.
+	buf := make([]byte, 4096)
+	for {
+		if _, err := unix.Read(s.fd, buf); err != nil {
+			break
+		}
+	}
+	// The kernel signals v1 eventfds when the cgroup is deleted.
+	if _, err := os.Stat(s.dir); os.IsNotExist(err) {
+		w.removeLocked(s)
+		return
+	}
+
+	if s.counts == nil {
+		if s.kind == CriticalPressure {
+			w.sendPressure(s)
+		} else {
+			w.send(Event{ID: s.id, Group: s.group, Kind: s.kind})
+		}
+		return
+	}
+	counts, err := readMemoryEvents(filepath.Join(s.dir, "memory.events"))
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			w.removeLocked(s)
+			return
+		}
+		logrus.WithError(err).WithField("cgroup", s.group).Warning("memevents: failed to read memory events")
+		return
+	}
+	if counts["oom_kill"] > s.counts["oom_kill"] {
+		w.send(Event{ID: s.id, Group: s.group, Kind: OOM})
+	}
+	// max counts the times the cgroup was about to exceed memory.max and
+	// had to be reclaimed.
+	if counts["max"] > s.counts["max"] {
+		w.sendPressure(s)
+	}
+	s.counts = counts
+}
+
+// sendPressure sends a `CriticalPressure` event for `s` unless one was sent
+// less than `pressureInterval` ago.
+func (w *Watcher) sendPressure(s *source) {
+	now := time.Now()
+	if !s.lastPressure.IsZero() && now.Sub(s.lastPressure) < pressureInterval {
+		return
+	}
+	s.lastPressure = now
+	w.send(Event{ID: s.id, Group: s.group, Kind: CriticalPressure})
+}
+
+func (w *Watcher) send(e Event) {
+	select {
+	case w.events <- e:
+	default:
+		logrus.WithFields(logrus.Fields{
+			"id":     e.ID,
+			"cgroup": e.Group,
+			"kind":   e.Kind,
+		}).Warning("memevents: dropping event, receiver is not keeping up")
+	}
+}
+
+// readMemoryEvents returns the counters in the v2 memory.events file at
+// `path`.
+func readMemoryEvents(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer f.Close()
+
+	counts := make(map[string]uint64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", path)
+		}
+		counts[fields[0]] = n
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return counts, nil
+}
@@ -0,0 +1,167 @@
+// +build linux
+
+package memevents
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// overwrite replaces the contents of `path` in place so that a reader never
+// sees a truncated file.
+func overwrite(t *testing.T, path, content string) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte(content), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, w *Watcher) Event {
+	select {
+	case e := <-w.Events():
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return Event{}
+}
+
+func Test_Watcher_V2(t *testing.T) {
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	origIsUnified, origV2Root := isUnified, v2Root
+	isUnified = func() bool { return true }
+	v2Root = root
+	defer func() {
+		isUnified = origIsUnified
+		v2Root = origV2Root
+	}()
+
+	dir := filepath.Join(root, "containers", "abcdef")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	events := filepath.Join(dir, "memory.events")
+	if err := ioutil.WriteFile(events, []byte("low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	defer w.Close()
+	if err := w.Add("abcdef", "/containers/abcdef"); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+
+	overwrite(t, events, "low 0\nhigh 0\nmax 1\noom 0\noom_kill 0\n")
+	if e := receive(t, w); e.ID != "abcdef" || e.Group != "/containers/abcdef" || e.Kind != CriticalPressure {
+		t.Fatalf("expected critical pressure event got: %+v", e)
+	}
+	overwrite(t, events, "low 0\nhigh 0\nmax 1\noom 1\noom_kill 1\n")
+	if e := receive(t, w); e.Kind != OOM {
+		t.Fatalf("expected OOM event got: %+v", e)
+	}
+
+	w.Remove("abcdef")
+	w.m.Lock()
+	n := len(w.sources)
+	w.m.Unlock()
+	if n != 0 {
+		t.Fatalf("expected no sources after remove got: %d", n)
+	}
+	overwrite(t, events, "low 0\nhigh 0\nmax 2\noom 2\noom_kill 2\n")
+	select {
+	case e := <-w.Events():
+		t.Fatalf("expected no event after remove got: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_Watcher_V2_PressureThrottled(t *testing.T) {
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	origIsUnified, origV2Root, origPressureInterval := isUnified, v2Root, pressureInterval
+	isUnified = func() bool { return true }
+	v2Root = root
+	pressureInterval = time.Hour
+	defer func() {
+		isUnified = origIsUnified
+		v2Root = origV2Root
+		pressureInterval = origPressureInterval
+	}()
+
+	dir := filepath.Join(root, "containers", "abcdef")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	events := filepath.Join(dir, "memory.events")
+	if err := ioutil.WriteFile(events, []byte("low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	defer w.Close()
+	if err := w.Add("abcdef", "/containers/abcdef"); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+
+	overwrite(t, events, "low 0\nhigh 0\nmax 1\noom 0\noom_kill 0\n")
+	if e := receive(t, w); e.Kind != CriticalPressure {
+		t.Fatalf("expected critical pressure event got: %+v", e)
+	}
+	// Pressure within the interval is dropped but an OOM is still sent.
+	overwrite(t, events, "low 0\nhigh 0\nmax 2\noom 0\noom_kill 0\n")
+	overwrite(t, events, "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n")
+	if e := receive(t, w); e.Kind != OOM {
+		t.Fatalf("expected OOM event got: %+v", e)
+	}
+	select {
+	case e := <-w.Events():
+		t.Fatalf("expected no more events got: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_Watcher_Close(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Fatal("expected events channel to be closed")
+	}
+}
+
+func Test_Watcher_Nil(t *testing.T) {
+	var w *Watcher
+	if err := w.Add("abcdef", "/containers/abcdef"); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	w.Remove("abcdef")
+	if w.Events() != nil {
+		t.Fatal("expected nil events channel")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/Microsoft/opengcs/internal/log"
 	"github.com/Microsoft/opengcs/internal/storage"
@@ -14,7 +15,6 @@ import (
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
 	"github.com/Microsoft/opengcs/service/gcs/transport"
-	"github.com/containerd/cgroups"
 	v1 "github.com/containerd/cgroups/stats/v1"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
@@ -25,24 +25,147 @@ type Container struct {
 	id    string
 	vsock transport.Transport
 
-	spec      *oci.Spec
-	isSandbox bool
+	spec       *oci.Spec
+	bundlePath string
+	isSandbox  bool
+	// sandboxID is the id of the CRI sandbox of a workload container or of
+	// the pod an ephemeral container is attached to.
+	sandboxID string
+	// targetID is the id of the container an ephemeral container is attached
+	// to.
+	targetID string
+	// stopping is true once a sandbox is being killed or deleted with its
+	// pod. It is protected by the `Host` containersMutex.
+	stopping bool
+	// namespaceID is the id of the network namespace assigned to the
+	// container if any.
+	namespaceID string
+	// restored is true if the container was restored from a checkpoint. Its
+	// init process is already running so it starts in `ContainerStateRunning`
+	// and `Start` only connects its stdio.
+	restored bool
+	// attached is true once `Start` connected the stdio of a restored
+	// container. It is protected by stateL.
+	attached bool
+	// starting is true while `Start` connects the stdio of a created
+	// container so that only one `Start` relays it. It is protected by stateL.
+	starting bool
+	// deleted is closed by `Delete` to stop the goroutine of
+	// `killWithTarget` if there is one. It is protected by stateL.
+	deleted chan struct{}
+	// adopted is true if the container was created by a previous instance of
+	// the GCS and recovered by `Host.Recover`. Its stdio cannot be connected.
+	adopted bool
 
 	container   runtime.Container
 	initProcess *containerProcess
 
 	etL      sync.Mutex
 	exitType prot.NotificationType
+	// stopReason is how `Host.StopContainer` stopped the container if it
+	// did. It is protected by etL.
+	stopReason prot.StopReason
+
+	// stateL protects state and stateTimes.
+	stateL sync.Mutex
+	// state is the lifecycle state of the container. Every change is
+	// validated against `containerTransitions`.
+	state ContainerState
+	// stateTimes is the time the container last entered each state.
+	stateTimes map[ContainerState]time.Time
 
 	processesMutex sync.Mutex
 	processes      map[uint32]*containerProcess
 }
 
+// ID returns the id of the container.
+func (c *Container) ID() string {
+	return c.id
+}
+
 func (c *Container) Start(ctx context.Context, conSettings stdio.ConnectionSettings) (int, error) {
-	stdioSet, err := stdio.Connect(c.vsock, conSettings)
+	if c.adopted {
+		return -1, gcserr.WrapHresult(errors.Errorf("container %s was recovered and is already started", c.id), gcserr.HrVmcomputeInvalidState)
+	}
+	if c.restored {
+		return c.attach(ctx, conSettings)
+	}
+	c.stateL.Lock()
+	if err := c.checkStateLocked("start", ContainerStateCreated); err != nil {
+		c.stateL.Unlock()
+		return -1, err
+	}
+	if c.starting {
+		c.stateL.Unlock()
+		return -1, gcserr.WrapHresult(errors.Errorf("container %s is already starting", c.id), gcserr.HrVmcomputeInvalidState)
+	}
+	c.starting = true
+	c.stateL.Unlock()
+	defer func() {
+		c.stateL.Lock()
+		c.starting = false
+		c.stateL.Unlock()
+	}()
+
+	// Connecting stdio can block on the host. Don't start the container if
+	// the request is cancelled in the meantime.
+	stdioSet, err := stdio.Connect(ctx, c.vsock, conSettings)
+	if err != nil {
+		return -1, err
+	}
+
+	c.stateL.Lock()
+	defer c.stateL.Unlock()
+
+	// The container may have stopped or been deleted while stdio was
+	// connecting.
+	if err := c.checkStateLocked("start", ContainerStateCreated); err != nil {
+		stdioSet.Close()
+		return -1, err
+	}
+	if err := c.container.Start(); err != nil {
+		stdioSet.Close()
+		return -1, err
+	}
+	c.startRelay(stdioSet)
+	if err := c.setStateLocked(ContainerStateRunning); err != nil {
+		return -1, err
+	}
+	return int(c.initProcess.pid), nil
+}
+
+// attach connects the stdio of the restored container `c` whose init process
+// is already running. Like `Start` it succeeds only once.
+func (c *Container) attach(ctx context.Context, conSettings stdio.ConnectionSettings) (_ int, err error) {
+	c.stateL.Lock()
+	if err := c.checkStateLocked("start", ContainerStateRunning, ContainerStatePaused); err != nil {
+		c.stateL.Unlock()
+		return -1, err
+	}
+	if c.attached {
+		c.stateL.Unlock()
+		return -1, gcserr.WrapHresult(errors.Errorf("container %s is already started", c.id), gcserr.HrVmcomputeInvalidState)
+	}
+	c.attached = true
+	c.stateL.Unlock()
+	defer func() {
+		if err != nil {
+			c.stateL.Lock()
+			c.attached = false
+			c.stateL.Unlock()
+		}
+	}()
+
+	stdioSet, err := stdio.Connect(ctx, c.vsock, conSettings)
 	if err != nil {
 		return -1, err
 	}
+	c.startRelay(stdioSet)
+	return int(c.initProcess.pid), nil
+}
+
+// startRelay relays the stdio of the init process of `c` to `stdioSet`.
+func (c *Container) startRelay(stdioSet *stdio.ConnectionSet) {
 	if c.initProcess.spec.Terminal {
 		ttyr := c.container.Tty()
 		ttyr.ReplaceConnectionSet(stdioSet)
@@ -53,15 +176,13 @@ func (c *Container) Start(ctx context.Context, conSettings stdio.ConnectionSetti
 		pr.CloseUnusedPipes()
 		pr.Start()
 	}
-	err = c.container.Start()
-	if err != nil {
-		stdioSet.Close()
-	}
-	return int(c.initProcess.pid), err
 }
 
 func (c *Container) ExecProcess(ctx context.Context, process *oci.Process, conSettings stdio.ConnectionSettings) (int, error) {
-	stdioSet, err := stdio.Connect(c.vsock, conSettings)
+	if err := c.checkState("exec", ContainerStateRunning); err != nil {
+		return -1, err
+	}
+	stdioSet, err := stdio.Connect(ctx, c.vsock, conSettings)
 	if err != nil {
 		return -1, err
 	}
@@ -110,23 +231,153 @@ func (c *Container) GetAllProcessPids(ctx context.Context) ([]int, error) {
 }
 
 // Kill sends 'signal' to the container process.
+//
+// Unlike other operations this is allowed while the container is paused so
+// that it can always be shut down. If `signal` will take down the container it
+// is also resumed so that the signal is delivered.
 func (c *Container) Kill(ctx context.Context, signal syscall.Signal) error {
+	if err := c.checkState("kill", ContainerStateCreated, ContainerStateRunning, ContainerStatePaused); err != nil {
+		return err
+	}
 	err := c.container.Kill(signal)
 	if err != nil {
 		return err
 	}
 	c.setExitType(signal)
+
+	if signal == syscall.SIGTERM || signal == syscall.SIGKILL {
+		c.stateL.Lock()
+		defer c.stateL.Unlock()
+		if c.state == ContainerStatePaused {
+			if err := c.container.Resume(); err != nil {
+				return errors.Wrapf(err, "failed to resume container %s after kill", c.id)
+			}
+			if err := c.setStateLocked(ContainerStateRunning); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Pause freezes all processes in the container.
+func (c *Container) Pause(ctx context.Context) error {
+	_, span := trace.StartSpan(ctx, "opengcs::Container::Pause")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("cid", c.id))
+
+	c.stateL.Lock()
+	defer c.stateL.Unlock()
+
+	if err := c.checkStateLocked("pause", ContainerStateRunning); err != nil {
+		return err
+	}
+	if err := c.container.Pause(); err != nil {
+		return err
+	}
+	return c.setStateLocked(ContainerStatePaused)
+}
+
+// Resume thaws all processes in the container frozen by `Pause`.
+func (c *Container) Resume(ctx context.Context) error {
+	_, span := trace.StartSpan(ctx, "opengcs::Container::Resume")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("cid", c.id))
+
+	c.stateL.Lock()
+	defer c.stateL.Unlock()
+
+	if err := c.checkStateLocked("resume", ContainerStatePaused); err != nil {
+		return err
+	}
+	if err := c.container.Resume(); err != nil {
+		return err
+	}
+	return c.setStateLocked(ContainerStateRunning)
+}
+
+// Checkpoint writes the state of the container to `opts.ImagePath` so that it
+// can be restored with `Host.RestoreContainer`. Unless `opts.LeaveRunning` is
+// set the container exits once the checkpoint is written, which is reported as
+// a graceful exit.
+func (c *Container) Checkpoint(ctx context.Context, opts runtime.CheckpointOptions) (err error) {
+	_, span := trace.StartSpan(ctx, "opengcs::Container::Checkpoint")
+	defer span.End()
+	span.AddAttributes(
+		trace.StringAttribute("cid", c.id),
+		trace.StringAttribute("imagePath", opts.ImagePath),
+		trace.BoolAttribute("leaveRunning", opts.LeaveRunning))
+
+	if opts.ImagePath == "" {
+		return gcserr.WrapHresult(errors.New("checkpoint requires an image path"), gcserr.HrErrInvalidArg)
+	}
+	if err := c.checkState("checkpoint", ContainerStateRunning); err != nil {
+		return err
+	}
+	if !opts.LeaveRunning {
+		// Set before the checkpoint so that the exit is never seen as
+		// unexpected.
+		c.etL.Lock()
+		prev := c.exitType
+		c.exitType = prot.NtGracefulExit
+		c.etL.Unlock()
+		defer func() {
+			if err != nil {
+				c.etL.Lock()
+				c.exitType = prev
+				c.etL.Unlock()
+			}
+		}()
+	}
+	if err := c.container.Checkpoint(opts); err != nil {
+		return errors.Wrapf(err, "failed to checkpoint container %s", c.id)
+	}
+	return nil
+}
+
+// CheckNotPaused returns an `HrVmcomputeInvalidState` error naming `op` if
+// the container is paused.
+func (c *Container) CheckNotPaused(op string) error {
+	c.stateL.Lock()
+	defer c.stateL.Unlock()
+
+	if c.state == ContainerStatePaused {
+		return gcserr.WrapHresult(errors.Errorf("cannot %s in container %s while it is paused", op, c.id), gcserr.HrVmcomputeInvalidState)
+	}
 	return nil
 }
 
 func (c *Container) Delete(ctx context.Context) error {
+	c.stateL.Lock()
+	defer c.stateL.Unlock()
+
+	if err := c.checkStateLocked("delete", ContainerStateCreated, ContainerStateStopped); err != nil {
+		return err
+	}
 	if c.isSandbox {
 		// remove user mounts in sandbox container
 		if err := storage.UnmountAllInPath(ctx, getSandboxMountsDir(c.id), true); err != nil {
 			log.G(ctx).WithError(err).Error("failed to unmount sandbox mounts")
 		}
+		// remove the pod shm
+		if err := storage.UnmountPath(ctx, getSandboxShmPath(c.id), true); err != nil {
+			log.G(ctx).WithError(err).Error("failed to unmount sandbox shm")
+		}
+	}
+	if err := c.container.Delete(); err != nil {
+		return err
+	}
+	if c.isSandbox {
+		// The pod cgroup can only be removed once all of its containers are.
+		if err := deleteCgroup(getPodCgroupPath(c.id)); err != nil {
+			log.G(ctx).WithError(err).Warning("failed to delete pod cgroup")
+		}
+	}
+	if c.deleted != nil {
+		close(c.deleted)
+		c.deleted = nil
 	}
-	return c.container.Delete()
+	return c.setStateLocked(ContainerStateDeleted)
 }
 
 // Wait waits for the container's init process to exit.
@@ -141,6 +392,20 @@ func (c *Container) Wait() prot.NotificationType {
 	return c.exitType
 }
 
+// ExitStatus returns how the container's init process exited. It is only
+// valid once `Wait` has returned.
+func (c *Container) ExitStatus() *prot.ExitStatus {
+	es := c.initProcess.ExitStatus()
+	c.etL.Lock()
+	defer c.etL.Unlock()
+	if es == nil || c.stopReason == "" {
+		return es
+	}
+	withReason := *es
+	withReason.StopReason = c.stopReason
+	return &withReason
+}
+
 // setExitType sets `c.exitType` to the appropriate value based on `signal` if
 // `signal` will take down the container.
 func (c *Container) setExitType(signal syscall.Signal) {
@@ -154,17 +419,28 @@ func (c *Container) setExitType(signal syscall.Signal) {
 	}
 }
 
+// record returns the state of `c` to be kept in the `journal`.
+func (c *Container) record() *containerRecord {
+	return &containerRecord{
+		ID:          c.id,
+		Spec:        c.spec,
+		BundlePath:  c.bundlePath,
+		IsSandbox:   c.isSandbox,
+		SandboxID:   c.sandboxID,
+		TargetID:    c.targetID,
+		NamespaceID: c.namespaceID,
+	}
+}
+
 // GetStats returns the cgroup metrics for the container.
 func (c *Container) GetStats(ctx context.Context) (*v1.Metrics, error) {
 	_, span := trace.StartSpan(ctx, "opengcs::Container::GetStats")
 	defer span.End()
 	span.AddAttributes(trace.StringAttribute("cid", c.id))
 
-	cgroupPath := c.spec.Linux.CgroupsPath
-	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(cgroupPath))
+	stats, err := cgroupStats(c.spec.Linux.CgroupsPath)
 	if err != nil {
 		return nil, errors.Errorf("failed to get container stats for %v: %v", c.id, err)
 	}
-
-	return cg.Stat(cgroups.IgnoreNotExist)
+	return stats, nil
 }
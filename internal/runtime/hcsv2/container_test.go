@@ -0,0 +1,190 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	"github.com/Microsoft/opengcs/service/gcs/transport"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func newMockContainer(t *testing.T) *Container {
+	con, err := mockruntime.NewRuntime("").CreateContainer(t.Name(), "", nil)
+	if err != nil {
+		t.Fatalf("failed to create mock container: %v", err)
+	}
+	c := &Container{
+		id:        t.Name(),
+		container: con,
+		exitType:  prot.NtUnexpectedExit,
+		processes: make(map[uint32]*containerProcess),
+	}
+	c.initState(ContainerStateRunning)
+	return c
+}
+
+func verifyInvalidState(t *testing.T, err error) {
+	hr, herr := gcserr.GetHresult(err)
+	if herr != nil || hr != gcserr.HrVmcomputeInvalidState {
+		t.Fatalf("expected HrVmcomputeInvalidState got: %v", err)
+	}
+}
+
+func Test_Container_PauseResume(t *testing.T) {
+	ctx := context.Background()
+	c := newMockContainer(t)
+
+	verifyInvalidState(t, c.Resume(ctx))
+	if err := c.Pause(ctx); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	verifyInvalidState(t, c.Pause(ctx))
+	_, err := c.ExecProcess(ctx, &oci.Process{}, stdio.ConnectionSettings{})
+	verifyInvalidState(t, err)
+	verifyInvalidState(t, c.CheckNotPaused("wait on process"))
+
+	if err := c.Resume(ctx); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if err := c.CheckNotPaused("wait on process"); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+}
+
+func Test_Container_Kill_Paused_Resumes(t *testing.T) {
+	ctx := context.Background()
+	c := newMockContainer(t)
+
+	if err := c.Pause(ctx); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if err := c.Kill(ctx, syscall.SIGKILL); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if err := c.CheckNotPaused("wait on process"); err != nil {
+		t.Fatalf("expected container to be resumed after kill got: %v", err)
+	}
+}
+
+func Test_Container_Checkpoint_ExitType(t *testing.T) {
+	ctx := context.Background()
+	c := newMockContainer(t)
+
+	err := c.Checkpoint(ctx, runtime.CheckpointOptions{})
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrInvalidArg {
+		t.Fatalf("expected HrErrInvalidArg got: %v", err)
+	}
+	if err := c.Checkpoint(ctx, runtime.CheckpointOptions{ImagePath: "/checkpoint", LeaveRunning: true}); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if c.exitType != prot.NtUnexpectedExit {
+		t.Fatalf("expected %s after checkpoint leaving the container running got: %s", prot.NtUnexpectedExit, c.exitType)
+	}
+	if err := c.Checkpoint(ctx, runtime.CheckpointOptions{ImagePath: "/checkpoint"}); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if c.exitType != prot.NtGracefulExit {
+		t.Fatalf("expected %s after checkpoint got: %s", prot.NtGracefulExit, c.exitType)
+	}
+}
+
+// gatedTransport is a `transport.MockTransport` whose dials block until
+// release is closed.
+type gatedTransport struct {
+	transport.MockTransport
+	dialed  chan struct{}
+	release chan struct{}
+}
+
+func (t *gatedTransport) Dial(port uint32) (transport.Connection, error) {
+	t.dialed <- struct{}{}
+	<-t.release
+	return t.MockTransport.Dial(port)
+}
+
+func Test_Container_Start_Concurrent_KeepsWinnerRelay(t *testing.T) {
+	vsock := &gatedTransport{
+		MockTransport: transport.MockTransport{Channel: make(chan *transport.MockConnection, 2)},
+		dialed:        make(chan struct{}, 2),
+		release:       make(chan struct{}),
+	}
+	c := newMockContainer(t)
+	c.vsock = vsock
+	c.spec = &oci.Spec{Process: &oci.Process{}}
+	c.initProcess = newProcess(c, c.spec.Process, c.container.(runtime.Process), uint32(c.container.Pid()), true)
+	c.initState(ContainerStateCreated)
+
+	port := uint32(1)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := c.Start(context.Background(), stdio.ConnectionSettings{StdOut: &port})
+			errs <- err
+		}()
+	}
+	// Hold the first start while it connects stdio until the second one
+	// either connects too or fails.
+	var results []error
+	timeout := time.After(5 * time.Second)
+	for dials := 0; dials < 2 && len(results) == 0; {
+		select {
+		case <-vsock.dialed:
+			dials++
+		case err := <-errs:
+			results = append(results, err)
+		case <-timeout:
+			t.Fatal("timed out waiting for the starts to connect stdio")
+		}
+	}
+	close(vsock.release)
+	for len(results) < 2 {
+		select {
+		case err := <-errs:
+			results = append(results, err)
+		case <-timeout:
+			t.Fatal("timed out waiting for the starts")
+		}
+	}
+	close(vsock.Channel)
+	var servers []*transport.MockConnection
+	for s := range vsock.Channel {
+		defer s.Close()
+		servers = append(servers, s)
+	}
+	if results[0] != nil {
+		results[0], results[1] = results[1], results[0]
+	}
+	if results[0] != nil {
+		t.Fatalf("expected one start to succeed got: %v", results[0])
+	}
+	verifyInvalidState(t, results[1])
+
+	// The output of the init process must reach the connection of the
+	// winner.
+	fs, err := c.container.PipeRelay().Files()
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	defer fs.Out.Close()
+	if _, err := fs.Out.Write([]byte("hello")); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	for _, s := range servers {
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(s, b); err == nil && string(b) == "hello" {
+			return
+		}
+	}
+	t.Fatal("expected the output to reach the winner's stdout connection")
+}
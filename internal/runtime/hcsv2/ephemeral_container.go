@@ -0,0 +1,140 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+// EphemeralTargetAnnotation is the ID of the container an "ephemeral"
+// `io.kubernetes.cri.container-type` debug container is attached to.
+const EphemeralTargetAnnotation = "io.microsoft.lcow.ephemeral-target"
+
+// ephemeralNamespaces are the namespaces of the target an ephemeral container
+// joins.
+var ephemeralNamespaces = []oci.LinuxNamespaceType{
+	oci.PIDNamespace,
+	oci.NetworkNamespace,
+	oci.IPCNamespace,
+}
+
+// validateEphemeralTarget returns an error if an ephemeral container cannot be
+// attached to `target`.
+func validateEphemeralTarget(target *Container) error {
+	if target.targetID != "" {
+		return gcserr.WrapHresult(errors.Errorf("ephemeral container %v cannot be the target of another ephemeral container", target.id), gcserr.HrErrInvalidArg)
+	}
+	if err := target.CheckNotPaused("attach an ephemeral container"); err != nil {
+		return err
+	}
+	if pid := target.container.Pid(); pid <= 0 || !processExists(pid) {
+		return gcserr.WrapHresult(errors.Errorf("target container %v is not running", target.id), gcserr.HrVmcomputeInvalidState)
+	}
+	return nil
+}
+
+// setupEphemeralContainerSpec prepares `spec` to run the ephemeral container
+// `id` in the PID, network and IPC namespaces of `target`. It shares the
+// /etc/hostname, /etc/hosts, /etc/resolv.conf and /dev/shm of `target` and, if
+// `target` is in a pod, the pod cgroup.
+func setupEphemeralContainerSpec(ctx context.Context, target *Container, id string, spec *oci.Spec) (err error) {
+	_, span := trace.StartSpan(ctx, "hcsv2::setupEphemeralContainerSpec")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(
+		trace.StringAttribute("targetID", target.id),
+		trace.StringAttribute("cid", id))
+
+	// Verify no hostname
+	if spec.Hostname != "" {
+		return errors.Errorf("ephemeral container must not change hostname: %s", spec.Hostname)
+	}
+
+	pid := target.container.Pid()
+	for _, nsType := range ephemeralNamespaces {
+		setNamespace(spec, nsType, pid)
+	}
+
+	// The shm of the IPC namespace joined above.
+	setShmMount(spec, getTargetShmSource(target, pid))
+	if sbid := target.podID(); sbid != "" {
+		addEtcBindMounts(spec, getSandboxHostnamePath(sbid), getSandboxHostsPath(sbid), getSandboxResolvPath(sbid))
+		spec.Linux.CgroupsPath = getPodContainerCgroupPath(sbid, id)
+	} else {
+		addEtcBindMounts(spec, getStandaloneHostnamePath(target.id), getStandaloneHostsPath(target.id), getStandaloneResolvPath(target.id))
+		spec.Linux.CgroupsPath = "/containers/" + id
+	}
+
+	if userstr, ok := spec.Annotations["io.microsoft.lcow.userstr"]; ok {
+		if err := setUserStr(spec, userstr); err != nil {
+			return err
+		}
+	}
+
+	// Clear the windows section as we dont want to forward to runc
+	spec.Windows = nil
+
+	return nil
+}
+
+// getTargetShmSource returns the /dev/shm of `target`, whose init process is
+// `pid`. It is the pod or UVM shm bound by the spec of `target` for
+// `IPCModePod` and `IPCModeNode` or, for `IPCModeContainer`, the shm in the
+// mount namespace of `target`.
+func getTargetShmSource(target *Container, pid int) string {
+	if target.spec != nil {
+		for _, m := range target.spec.Mounts {
+			if m.Destination == "/dev/shm" && m.Type == "bind" {
+				return m.Source
+			}
+		}
+	}
+	return fmt.Sprintf("/proc/%d/root/dev/shm", pid)
+}
+
+// podID returns the ID of the sandbox of the pod `c` is in or "" if it is not
+// in a pod.
+func (c *Container) podID() string {
+	if c.isSandbox {
+		return c.id
+	}
+	return c.sandboxID
+}
+
+// killWithTarget kills the ephemeral container `c` once the init process of
+// its target exits. Its processes are already gone with the PID namespace of
+// the target but it must not keep running, or be started, without it. It stops
+// waiting for the target once `c` is deleted.
+func (c *Container) killWithTarget(target *Container) {
+	deleted := make(chan struct{})
+	c.stateL.Lock()
+	c.deleted = deleted
+	c.stateL.Unlock()
+	go func() {
+		select {
+		case <-target.initProcess.exited:
+		case <-deleted:
+			return
+		}
+		ctx := context.Background()
+		entry := log.G(ctx).WithFields(logrus.Fields{
+			"cid":      c.id,
+			"targetID": target.id,
+		})
+		entry.Debug("target of ephemeral container exited")
+		// This fails if the ephemeral container has already exited.
+		if err := c.Kill(ctx, syscall.SIGKILL); err != nil {
+			entry.WithError(err).Debug("failed to kill ephemeral container")
+		}
+	}()
+}
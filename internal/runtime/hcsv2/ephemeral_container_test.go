@@ -0,0 +1,153 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_validateEphemeralTarget(t *testing.T) {
+	origProcessExists := processExists
+	defer func() { processExists = origProcessExists }()
+	running := true
+	processExists = func(int) bool { return running }
+
+	ctx := context.Background()
+	target := newMockContainer(t)
+	if err := validateEphemeralTarget(target); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+
+	if err := target.Pause(ctx); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	verifyInvalidState(t, validateEphemeralTarget(target))
+	if err := target.Resume(ctx); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+
+	running = false
+	verifyInvalidState(t, validateEphemeralTarget(target))
+	running = true
+
+	target.targetID = "other"
+	err := validateEphemeralTarget(target)
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrInvalidArg {
+		t.Fatalf("expected HrErrInvalidArg for ephemeral target got: %v", err)
+	}
+}
+
+func Test_setupEphemeralContainerSpec_Pod(t *testing.T) {
+	target := newMockContainer(t)
+	target.sandboxID = "sandbox"
+	spec := &oci.Spec{
+		Linux: &oci.Linux{
+			Namespaces: []oci.LinuxNamespace{
+				{Type: oci.PIDNamespace},
+				{Type: oci.NetworkNamespace},
+				{Type: oci.IPCNamespace},
+				{Type: oci.MountNamespace},
+			},
+		},
+		Windows: &oci.Windows{},
+	}
+	if err := setupEphemeralContainerSpec(context.Background(), target, "debug", spec); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+
+	paths := make(map[oci.LinuxNamespaceType]string)
+	for _, ns := range spec.Linux.Namespaces {
+		paths[ns.Type] = ns.Path
+	}
+	for nsType, p := range map[oci.LinuxNamespaceType]string{
+		oci.PIDNamespace:     "/proc/101/ns/pid",
+		oci.NetworkNamespace: "/proc/101/ns/net",
+		oci.IPCNamespace:     "/proc/101/ns/ipc",
+		oci.MountNamespace:   "",
+	} {
+		if paths[nsType] != p {
+			t.Fatalf("expected %s namespace %q got: %q", nsType, p, paths[nsType])
+		}
+	}
+	if spec.Linux.CgroupsPath != "/containers/sandbox/debug" {
+		t.Fatalf("expected pod cgroup got: %s", spec.Linux.CgroupsPath)
+	}
+	for _, dest := range []string{"/etc/hostname", "/etc/hosts", "/etc/resolv.conf", "/dev/shm"} {
+		if !isInMounts(dest, spec.Mounts) {
+			t.Fatalf("expected %s to be mounted", dest)
+		}
+	}
+	if spec.Windows != nil {
+		t.Fatal("expected windows section to be cleared")
+	}
+
+	spec.Hostname = "debug"
+	if err := setupEphemeralContainerSpec(context.Background(), target, "debug", spec); err == nil {
+		t.Fatal("expected error for ephemeral container changing hostname")
+	}
+}
+
+func Test_getTargetShmSource(t *testing.T) {
+	tests := []struct {
+		mode     IPCMode
+		mounts   []oci.Mount
+		expected string
+	}{
+		{IPCModePod, []oci.Mount{{Destination: "/dev/shm", Type: "bind", Source: getSandboxShmPath("sandbox")}}, getSandboxShmPath("sandbox")},
+		{IPCModeNode, []oci.Mount{{Destination: "/dev/shm", Type: "bind", Source: "/dev/shm"}}, "/dev/shm"},
+		{IPCModeContainer, []oci.Mount{{Destination: "/dev/shm", Type: "tmpfs", Source: "shm"}}, "/proc/101/root/dev/shm"},
+	}
+	for _, test := range tests {
+		target := newMockContainer(t)
+		target.spec = &oci.Spec{Mounts: test.mounts}
+		if source := getTargetShmSource(target, 101); source != test.expected {
+			t.Fatalf("expected %s shm %s got: %s", test.mode, test.expected, source)
+		}
+	}
+}
+
+func Test_Container_killWithTarget(t *testing.T) {
+	ctx := context.Background()
+	h := NewHost(mockruntime.NewRuntime(""), nil)
+	target := addMockContainer(t, h, "target", "")
+	c := addMockContainer(t, h, "debug", "")
+	c.killWithTarget(target)
+
+	if err := target.Kill(ctx, syscall.SIGKILL); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	// The ephemeral container only exits once it is killed with its target.
+	c.initProcess.exitWg.Wait()
+	if c.exitType != prot.NtForcedExit {
+		t.Fatalf("expected forced exit got: %s", c.exitType)
+	}
+}
+
+func Test_Container_killWithTarget_Delete(t *testing.T) {
+	ctx := context.Background()
+	h := NewHost(mockruntime.NewRuntime(""), nil)
+	target := addMockContainer(t, h, "target", "")
+	c := addMockContainer(t, h, "debug", "")
+	c.killWithTarget(target)
+	deleted := c.deleted
+
+	if err := c.Kill(ctx, syscall.SIGKILL); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	c.initProcess.exitWg.Wait()
+	if err := c.Delete(ctx); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	select {
+	case <-deleted:
+	default:
+		t.Fatal("expected delete to stop waiting for the target")
+	}
+}
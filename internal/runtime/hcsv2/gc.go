@@ -0,0 +1,386 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/cgroup2"
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+// DefaultOrphanMinAge is how long a resource must have been found without an
+// owner to be collected by `CollectOrphansPeriodically`. It leaves the host
+// time to create the container it prepared the resource for.
+const DefaultOrphanMinAge = 10 * time.Minute
+
+// Test dependencies
+var (
+	// containersRootDir holds the bundle and sandbox root directory of every
+	// container.
+	containersRootDir = "/run/gcs/c"
+	listAllMounts = storage.ListMounts
+	// listCgroupChildren returns the names of the child cgroups of `path`.
+	listCgroupChildren = func(path string) ([]string, error) {
+		root := cgroupMemoryRoot
+		if cgroup2.IsUnified() {
+			root = cgroup2.Mountpoint
+		}
+		infos, err := ioutil.ReadDir(filepath.Join(root, path))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var names []string
+		for _, info := range infos {
+			if info.IsDir() {
+				names = append(names, info.Name())
+			}
+		}
+		return names, nil
+	}
+	timeNow = time.Now
+)
+
+// owners are the resources owned by the containers of a `Host`.
+type owners struct {
+	ids        map[string]bool
+	sandboxes  map[string]bool
+	bundles    map[string]bool
+	namespaces map[string]bool
+	// mountSources are the sources of the mounts in the container specs.
+	mountSources []string
+}
+
+// isUnder returns true if `p` is `root` or a path under it.
+func isUnder(p, root string) bool {
+	return p == root || strings.HasPrefix(p, root+"/")
+}
+
+// getOwners returns the resources owned by the containers of `h`.
+func (h *Host) getOwners() *owners {
+	h.containersMutex.Lock()
+	defer h.containersMutex.Unlock()
+
+	o := &owners{
+		ids:        make(map[string]bool),
+		sandboxes:  make(map[string]bool),
+		bundles:    make(map[string]bool),
+		namespaces: make(map[string]bool),
+	}
+	for id, c := range h.containers {
+		o.ids[id] = true
+		if c.isSandbox {
+			o.sandboxes[id] = true
+		}
+		if c.bundlePath != "" {
+			o.bundles[filepath.Clean(c.bundlePath)] = true
+		}
+		if c.namespaceID != "" {
+			o.namespaces[strings.ToLower(c.namespaceID)] = true
+		}
+		if c.spec != nil {
+			for _, m := range c.spec.Mounts {
+				o.mountSources = append(o.mountSources, m.Source)
+			}
+		}
+	}
+	return o
+}
+
+// ownsDir returns true if the directory `p` under `containersRootDir` is the
+// root directory or holds the bundle of a container.
+func (o *owners) ownsDir(p string) bool {
+	if o.ids[filepath.Base(p)] {
+		return true
+	}
+	for b := range o.bundles {
+		if isUnder(b, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// referenced returns true if the host mount `target` is a layer of another
+// mount, such as the overlay of a container, or a volume of a container.
+func (o *owners) referenced(target string, mounts []storage.MountInfo) bool {
+	for _, m := range mounts {
+		for _, opt := range m.Options {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			for _, p := range strings.Split(kv[1], ":") {
+				if isUnder(p, target) {
+					return true
+				}
+			}
+		}
+	}
+	for _, s := range o.mountSources {
+		if isUnder(s, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// findUnownedDirs returns the directories under `containersRootDir` not owned
+// by a container, each preceded by the mounts under it in the order they must
+// be unmounted.
+func findUnownedDirs(o *owners, mounts []storage.MountInfo) ([]prot.Orphan, error) {
+	infos, err := ioutil.ReadDir(containersRootDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read %s", containersRootDir)
+	}
+	var unowned []prot.Orphan
+	for _, info := range infos {
+		p := filepath.Join(containersRootDir, info.Name())
+		if !info.IsDir() || o.ownsDir(p) {
+			continue
+		}
+		for i := len(mounts) - 1; i >= 0; i-- {
+			if isUnder(mounts[i].Target, p) {
+				unowned = append(unowned, prot.Orphan{Kind: prot.OkMount, ID: mounts[i].Target})
+			}
+		}
+		unowned = append(unowned, prot.Orphan{Kind: prot.OkDirectory, ID: p})
+	}
+	return unowned, nil
+}
+
+// trackHostMount records the SCSI, pmem and plan9 mount `path` the host added
+// or removed with a request of type `rt`.
+func (h *Host) trackHostMount(rt prot.ModifyRequestType, path string) {
+	if path == "" {
+		return
+	}
+	h.hostMountsMutex.Lock()
+	defer h.hostMountsMutex.Unlock()
+
+	switch rt {
+	case prot.MreqtAdd:
+		h.hostMounts[path] = true
+	case prot.MreqtRemove:
+		delete(h.hostMounts, path)
+	}
+}
+
+// getHostMounts returns the mounts the host added and never removed.
+func (h *Host) getHostMounts() map[string]bool {
+	h.hostMountsMutex.Lock()
+	defer h.hostMountsMutex.Unlock()
+
+	added := make(map[string]bool, len(h.hostMounts))
+	for p := range h.hostMounts {
+		added[p] = true
+	}
+	return added
+}
+
+// findUnownedHostMounts returns the mounts of `added`, those the host added
+// and never removed, that are not used by any other mount or container. Any
+// other mount, including those added before the GCS restarted, is left alone.
+func findUnownedHostMounts(o *owners, added map[string]bool, mounts []storage.MountInfo) []prot.Orphan {
+	var unowned []prot.Orphan
+	for i := len(mounts) - 1; i >= 0; i-- {
+		target := mounts[i].Target
+		if added[target] && !o.referenced(target, mounts) {
+			unowned = append(unowned, prot.Orphan{Kind: prot.OkMount, ID: target})
+		}
+	}
+	return unowned
+}
+
+// findUnownedCgroups returns the cgroups under /containers not owned by a
+// container or pod. The cgroups of a pod are preceded by those of its
+// containers.
+func findUnownedCgroups(o *owners) ([]prot.Orphan, error) {
+	names, err := listCgroupChildren("/containers")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list container cgroups")
+	}
+	var unowned []prot.Orphan
+	for _, name := range names {
+		p := "/containers/" + name
+		if o.ids[name] && !o.sandboxes[name] {
+			continue
+		}
+		children, err := listCgroupChildren(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list %s cgroups", p)
+		}
+		for _, child := range children {
+			if !o.sandboxes[name] || !o.ids[child] {
+				unowned = append(unowned, prot.Orphan{Kind: prot.OkCgroup, ID: p + "/" + child})
+			}
+		}
+		if !o.sandboxes[name] {
+			unowned = append(unowned, prot.Orphan{Kind: prot.OkCgroup, ID: p})
+		}
+	}
+	return unowned, nil
+}
+
+// findUnownedNamespaces returns the network namespaces that are not assigned
+// to a container and whose container has exited. Namespaces that were never
+// assigned are still waiting for the host to create their sandbox.
+func findUnownedNamespaces(o *owners) []prot.Orphan {
+	namespaceSync.Lock()
+	defer namespaceSync.Unlock()
+
+	var unowned []prot.Orphan
+	for id, ns := range namespaces {
+		ns.m.Lock()
+		pid := ns.pid
+		ns.m.Unlock()
+		if !o.namespaces[id] && pid != 0 && !processExists(pid) {
+			unowned = append(unowned, prot.Orphan{Kind: prot.OkNetworkNamespace, ID: id})
+		}
+	}
+	return unowned
+}
+
+// CollectOrphans finds the bundle and sandbox root directories, overlay
+// mounts, host mounts that were never removed, cgroups and network namespaces
+// that are not owned by any container of `h`. A resource is only an orphan once it has been found
+// without an owner for at least `minAge` over successive calls so that the
+// resources the host prepares before creating a container are left alone.
+//
+// Unless `dryRun` is set the orphans are also cleaned up. A directory is only
+// removed once nothing is mounted under it.
+func (h *Host) CollectOrphans(ctx context.Context, minAge time.Duration, dryRun bool) (_ []prot.Orphan, err error) {
+	ctx, span := trace.StartSpan(ctx, "opengcs::Host::CollectOrphans")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(
+		trace.Int64Attribute("minAgeMs", int64(minAge/time.Millisecond)),
+		trace.BoolAttribute("dryRun", dryRun))
+
+	h.orphansMutex.Lock()
+	defer h.orphansMutex.Unlock()
+
+	o := h.getOwners()
+	mounts, err := listAllMounts()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list mounts")
+	}
+	unowned, err := findUnownedDirs(o, mounts)
+	if err != nil {
+		return nil, err
+	}
+	unowned = append(unowned, findUnownedHostMounts(o, h.getHostMounts(), mounts)...)
+	cgroups, err := findUnownedCgroups(o)
+	if err != nil {
+		return nil, err
+	}
+	unowned = append(unowned, cgroups...)
+	unowned = append(unowned, findUnownedNamespaces(o)...)
+
+	now := timeNow()
+	seen := make(map[prot.Orphan]time.Time, len(unowned))
+	var orphans []prot.Orphan
+	for _, r := range unowned {
+		first, ok := h.orphansSeen[r]
+		if !ok {
+			first = now
+		}
+		seen[r] = first
+		if now.Sub(first) >= minAge {
+			orphans = append(orphans, r)
+		}
+	}
+	h.orphansSeen = seen
+
+	for i := range orphans {
+		entry := log.G(ctx).WithFields(logrus.Fields{
+			"kind":   orphans[i].Kind,
+			"id":     orphans[i].ID,
+			"dryRun": dryRun,
+		})
+		entry.Info("found orphaned resource")
+		if dryRun {
+			continue
+		}
+		if err := h.removeOrphan(ctx, orphans[i]); err != nil {
+			entry.WithError(err).Warning("failed to remove orphaned resource")
+			orphans[i].Error = err.Error()
+			continue
+		}
+		entry.Info("removed orphaned resource")
+		orphans[i].Removed = true
+		delete(h.orphansSeen, prot.Orphan{Kind: orphans[i].Kind, ID: orphans[i].ID})
+	}
+	log.G(ctx).WithFields(logrus.Fields{
+		"unowned": len(unowned),
+		"orphans": len(orphans),
+		"dryRun":  dryRun,
+	}).Debug("collected orphaned resources")
+	return orphans, nil
+}
+
+// removeOrphan cleans up the orphaned resource `r`.
+func (h *Host) removeOrphan(ctx context.Context, r prot.Orphan) error {
+	switch r.Kind {
+	case prot.OkMount:
+		if err := storage.UnmountPath(ctx, r.ID, false); err != nil {
+			return err
+		}
+		h.trackHostMount(prot.MreqtRemove, r.ID)
+		return nil
+	case prot.OkDirectory:
+		// Removing a directory with a mount under it would remove the
+		// contents of the mount.
+		mountPoints, err := listMountPoints(r.ID + "/")
+		if err != nil {
+			return errors.Wrap(err, "failed to list mounts")
+		}
+		if len(mountPoints) > 0 {
+			return errors.Errorf("%d mounts remain under %s", len(mountPoints), r.ID)
+		}
+		return os.RemoveAll(r.ID)
+	case prot.OkCgroup:
+		return deleteCgroup(r.ID)
+	case prot.OkNetworkNamespace:
+		namespaceSync.Lock()
+		delete(namespaces, r.ID)
+		namespaceSync.Unlock()
+		return h.journal.remove(journalNamespacesDir, r.ID)
+	default:
+		return errors.Errorf("unknown orphan kind %s", r.Kind)
+	}
+}
+
+// CollectOrphansPeriodically calls `CollectOrphans` every `interval` until
+// `ctx` is done.
+func (h *Host) CollectOrphansPeriodically(ctx context.Context, interval, minAge time.Duration, dryRun bool) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if _, err := h.CollectOrphans(ctx, minAge, dryRun); err != nil {
+			log.G(ctx).WithError(err).Warning("failed to collect orphaned resources")
+		}
+	}
+}
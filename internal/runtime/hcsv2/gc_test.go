@@ -0,0 +1,154 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/storage"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// setupOrphanTest points the orphan collector at a temporary containers root
+// directory with the live container directory "live" and the orphaned "gone".
+func setupOrphanTest(t *testing.T, mounts []storage.MountInfo, cgroups map[string][]string) (root string, cleanup func()) {
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"live", "gone"} {
+		if err := os.Mkdir(filepath.Join(root, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	origRoot, origListAllMounts := containersRootDir, listAllMounts
+	origListCgroupChildren, origListMountPoints := listCgroupChildren, listMountPoints
+	origProcessExists, origTimeNow := processExists, timeNow
+	containersRootDir = root
+	listAllMounts = func() ([]storage.MountInfo, error) { return mounts, nil }
+	listCgroupChildren = func(path string) ([]string, error) { return cgroups[path], nil }
+	listMountPoints = func(string) ([]string, error) { return nil, nil }
+	processExists = func(pid int) bool { return pid == 100 }
+	return root, func() {
+		containersRootDir, listAllMounts = origRoot, origListAllMounts
+		listCgroupChildren, listMountPoints = origListCgroupChildren, origListMountPoints
+		processExists, timeNow = origProcessExists, origTimeNow
+		os.RemoveAll(root)
+	}
+}
+
+// addOrphanTestNamespaces adds a network namespace assigned to each pid of
+// `pids` and returns a function that removes them.
+func addOrphanTestNamespaces(pids map[string]int) func() {
+	for id, pid := range pids {
+		getOrAddNetworkNamespace(id).pid = pid
+	}
+	return func() {
+		namespaceSync.Lock()
+		defer namespaceSync.Unlock()
+		for id := range pids {
+			delete(namespaces, id)
+		}
+	}
+}
+
+func Test_Host_CollectOrphans_DryRun(t *testing.T) {
+	mounts := []storage.MountInfo{
+		{Target: "/run/mounts/m1"},
+		{Target: "/run/mounts/m2"},
+		{Target: "/run/mounts/m3"},
+		{Target: "/run/mounts/m4"},
+		{Target: "/run/mounts/m5"},
+	}
+	root, cleanup := setupOrphanTest(t, nil, map[string][]string{
+		"/containers":     {"live", "pod", "stale"},
+		"/containers/pod": {"pod", "exited"},
+	})
+	defer cleanup()
+	mounts = append(mounts,
+		storage.MountInfo{Target: filepath.Join(root, "gone", "rootfs"), FSType: "overlay", Options: []string{"rw", "lowerdir=/run/mounts/m1"}},
+		storage.MountInfo{Target: filepath.Join(root, "gone", "rootfs", "data")})
+	listAllMounts = func() ([]storage.MountInfo, error) { return mounts, nil }
+
+	defer addOrphanTestNamespaces(map[string]int{"live-ns": 100, "dead-ns": 200, "pending-ns": 0})()
+
+	h := NewHost(nil, nil)
+	h.containers["live"] = &Container{
+		id:          "live",
+		bundlePath:  filepath.Join(root, "live"),
+		namespaceID: "LIVE-NS",
+		spec:        &oci.Spec{Mounts: []oci.Mount{{Source: "/run/mounts/m3/volume"}}},
+	}
+	h.containers["pod"] = &Container{id: "pod", isSandbox: true, spec: &oci.Spec{}}
+	// Only the mounts the host added and did not remove are collected.
+	for _, p := range []string{"/run/mounts/m1", "/run/mounts/m2", "/run/mounts/m3", "/run/mounts/m5"} {
+		h.trackHostMount(prot.MreqtAdd, p)
+	}
+	h.trackHostMount(prot.MreqtRemove, "/run/mounts/m5")
+
+	start := time.Now()
+	timeNow = func() time.Time { return start }
+	orphans, err := h.CollectOrphans(context.Background(), time.Minute, true)
+	if err != nil || len(orphans) != 0 {
+		t.Fatalf("expected no orphans before the minimum age got: %+v %v", orphans, err)
+	}
+
+	timeNow = func() time.Time { return start.Add(2 * time.Minute) }
+	orphans, err = h.CollectOrphans(context.Background(), time.Minute, true)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	expected := []prot.Orphan{
+		{Kind: prot.OkMount, ID: filepath.Join(root, "gone", "rootfs", "data")},
+		{Kind: prot.OkMount, ID: filepath.Join(root, "gone", "rootfs")},
+		{Kind: prot.OkDirectory, ID: filepath.Join(root, "gone")},
+		{Kind: prot.OkMount, ID: "/run/mounts/m2"},
+		{Kind: prot.OkCgroup, ID: "/containers/pod/exited"},
+		{Kind: prot.OkCgroup, ID: "/containers/stale"},
+		{Kind: prot.OkNetworkNamespace, ID: "dead-ns"},
+	}
+	if !reflect.DeepEqual(orphans, expected) {
+		t.Fatalf("expected %+v got: %+v", expected, orphans)
+	}
+	if _, err := os.Stat(filepath.Join(root, "gone")); err != nil {
+		t.Fatalf("expected dry run to leave the directory got: %v", err)
+	}
+}
+
+func Test_Host_CollectOrphans_Removes(t *testing.T) {
+	root, cleanup := setupOrphanTest(t, nil, nil)
+	defer cleanup()
+	defer addOrphanTestNamespaces(map[string]int{"dead-ns": 200})()
+
+	h := NewHost(nil, nil)
+	h.containers["live"] = &Container{id: "live", spec: &oci.Spec{}}
+
+	orphans, err := h.CollectOrphans(context.Background(), 0, false)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	expected := []prot.Orphan{
+		{Kind: prot.OkDirectory, ID: filepath.Join(root, "gone"), Removed: true},
+		{Kind: prot.OkNetworkNamespace, ID: "dead-ns", Removed: true},
+	}
+	if !reflect.DeepEqual(orphans, expected) {
+		t.Fatalf("expected %+v got: %+v", expected, orphans)
+	}
+	if _, err := os.Stat(filepath.Join(root, "gone")); !os.IsNotExist(err) {
+		t.Fatalf("expected the directory to be removed got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "live")); err != nil {
+		t.Fatalf("expected the live directory to remain got: %v", err)
+	}
+	if _, err := getNetworkNamespace("dead-ns"); err == nil {
+		t.Fatal("expected the network namespace to be removed")
+	}
+}
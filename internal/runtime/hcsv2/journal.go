@@ -0,0 +1,223 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// DefaultJournalPath is the directory the `Host` state journal is kept in. It
+// is on a tmpfs so that it survives a restart of the GCS but not of the UVM.
+const DefaultJournalPath = "/run/gcs/journal"
+
+const (
+	journalContainersDir = "containers"
+	journalNamespacesDir = "namespaces"
+)
+
+// containerRecord is the state of a `Container` needed to adopt it after the
+// GCS restarts.
+type containerRecord struct {
+	ID          string
+	Spec        *oci.Spec
+	BundlePath  string
+	IsSandbox   bool   `json:",omitempty"`
+	SandboxID   string `json:",omitempty"`
+	TargetID    string `json:",omitempty"`
+	NamespaceID string `json:",omitempty"`
+}
+
+// nicRecord is the state of a `nicInNamespace`.
+type nicRecord struct {
+	Adapter     *prot.NetworkAdapterV2
+	Ifname      string
+	AssignedPid int `json:",omitempty"`
+}
+
+// namespaceRecord is the state of a `namespace`.
+type namespaceRecord struct {
+	ID   string
+	Pid  int `json:",omitempty"`
+	Nics []nicRecord
+}
+
+// journal persists the records of the containers and network namespaces known
+// to a `Host` as one JSON file each. A nil *journal records nothing.
+type journal struct {
+	dir string
+}
+
+// newJournal returns a journal kept in `dir`, creating it if needed.
+func newJournal(dir string) (*journal, error) {
+	for _, d := range []string{journalContainersDir, journalNamespacesDir} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			return nil, errors.Wrapf(err, "failed to create journal directory %s", dir)
+		}
+	}
+	return &journal{dir: dir}, nil
+}
+
+// path returns the path of the record `id` in `kind`.
+func (j *journal) path(kind, id string) string {
+	return filepath.Join(j.dir, kind, strings.ToLower(id)+".json")
+}
+
+// write atomically replaces the record `id` in `kind` with `v`.
+func (j *journal) write(kind, id string, v interface{}) error {
+	if j == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal journal record %s", id)
+	}
+	p := j.path(kind, id)
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create journal record %s", id)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to write journal record %s", id)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write journal record %s", id)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return errors.Wrapf(err, "failed to commit journal record %s", id)
+	}
+	return nil
+}
+
+// remove removes the record `id` in `kind` if it exists.
+func (j *journal) remove(kind, id string) error {
+	if j == nil {
+		return nil
+	}
+	if err := os.Remove(j.path(kind, id)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove journal record %s", id)
+	}
+	return nil
+}
+
+// read calls `fn` with the contents of every record in `kind`.
+func (j *journal) read(kind string, fn func(name string, b []byte) error) error {
+	dir := filepath.Join(j.dir, kind)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read journal directory %s", dir)
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return errors.Wrapf(err, "failed to read journal record %s", f.Name())
+		}
+		if err := fn(f.Name(), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *journal) writeContainer(r *containerRecord) error {
+	return j.write(journalContainersDir, r.ID, r)
+}
+
+func (j *journal) removeContainer(id string) error {
+	return j.remove(journalContainersDir, id)
+}
+
+// containers returns all container records. Records that cannot be decoded
+// are skipped and returned by name in `invalid`.
+func (j *journal) containers() (records []*containerRecord, invalid []string, err error) {
+	err = j.read(journalContainersDir, func(name string, b []byte) error {
+		var r containerRecord
+		if err := json.Unmarshal(b, &r); err != nil || r.ID == "" {
+			invalid = append(invalid, name)
+			return nil
+		}
+		records = append(records, &r)
+		return nil
+	})
+	return records, invalid, err
+}
+
+// writeNamespace records the current state of the namespace `id` or removes
+// its record if it no longer exists.
+func (j *journal) writeNamespace(id string) error {
+	if j == nil {
+		return nil
+	}
+	ns, err := getNetworkNamespace(id)
+	if err != nil {
+		return j.remove(journalNamespacesDir, id)
+	}
+	return j.write(journalNamespacesDir, ns.ID(), ns.record())
+}
+
+// namespaces returns all namespace records. Records that cannot be decoded
+// are skipped and returned by name in `invalid`.
+func (j *journal) namespaces() (records []*namespaceRecord, invalid []string, err error) {
+	err = j.read(journalNamespacesDir, func(name string, b []byte) error {
+		var r namespaceRecord
+		if err := json.Unmarshal(b, &r); err != nil || r.ID == "" {
+			invalid = append(invalid, name)
+			return nil
+		}
+		records = append(records, &r)
+		return nil
+	})
+	return records, invalid, err
+}
+
+// record returns the state of `n` to be kept in the `journal`.
+func (n *namespace) record() *namespaceRecord {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	r := &namespaceRecord{
+		ID:   n.id,
+		Pid:  n.pid,
+		Nics: make([]nicRecord, len(n.nics)),
+	}
+	for i, nin := range n.nics {
+		r.Nics[i] = nicRecord{
+			Adapter:     nin.adapter,
+			Ifname:      nin.ifname,
+			AssignedPid: nin.assignedPid,
+		}
+	}
+	return r
+}
+
+// restoreNetworkNamespace adds the namespace in `r` without configuring any of
+// its adapters again. It is used to recover the namespaces after the GCS
+// restarts.
+func restoreNetworkNamespace(r *namespaceRecord) *namespace {
+	ns := getOrAddNetworkNamespace(r.ID)
+	ns.m.Lock()
+	defer ns.m.Unlock()
+
+	ns.pid = r.Pid
+	ns.nics = make([]*nicInNamespace, len(r.Nics))
+	for i, nr := range r.Nics {
+		ns.nics[i] = &nicInNamespace{
+			adapter:     nr.Adapter,
+			ifname:      nr.Ifname,
+			assignedPid: nr.AssignedPid,
+		}
+	}
+	return ns
+}
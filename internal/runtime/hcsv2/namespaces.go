@@ -0,0 +1,68 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"fmt"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// PIDModeAnnotation selects the PID namespace of a workload container. It is
+// one of the `PIDMode` values and defaults to `PIDModeContainer`. It is set
+// for all containers of a pod with shareProcessNamespace.
+const PIDModeAnnotation = "io.microsoft.lcow.pid-mode"
+
+// PIDMode is the PID namespace mode of a workload container.
+type PIDMode string
+
+const (
+	// PIDModePod joins the PID namespace of the sandbox init process so that
+	// the processes of all containers in the pod can see each other.
+	PIDModePod = PIDMode("pod")
+	// PIDModeContainer gives the container its own PID namespace.
+	PIDModeContainer = PIDMode("container")
+)
+
+// getPIDMode returns the PID mode set by `PIDModeAnnotation`.
+func getPIDMode(annotations map[string]string) (PIDMode, error) {
+	v, ok := annotations[PIDModeAnnotation]
+	if !ok {
+		return PIDModeContainer, nil
+	}
+	switch mode := PIDMode(v); mode {
+	case PIDModePod, PIDModeContainer:
+		return mode, nil
+	default:
+		return "", gcserr.WrapHresult(errors.Errorf("invalid '%s' annotation: '%s'", PIDModeAnnotation, v), gcserr.HrErrInvalidArg)
+	}
+}
+
+// nsProcNames are the names in /proc/<pid>/ns of the namespace types.
+var nsProcNames = map[oci.LinuxNamespaceType]string{
+	oci.PIDNamespace:     "pid",
+	oci.NetworkNamespace: "net",
+	oci.IPCNamespace:     "ipc",
+	oci.UTSNamespace:     "uts",
+	oci.MountNamespace:   "mnt",
+}
+
+// setNamespace sets the `nsType` namespace of `spec` to that of the process
+// `pid`, or to the namespace of the UVM if `pid` is 0.
+func setNamespace(spec *oci.Spec, nsType oci.LinuxNamespaceType, pid int) {
+	namespaces := spec.Linux.Namespaces[:0]
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type != nsType {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	if pid != 0 {
+		namespaces = append(namespaces, oci.LinuxNamespace{
+			Type: nsType,
+			Path: fmt.Sprintf("/proc/%d/ns/%s", pid, nsProcNames[nsType]),
+		})
+	}
+	spec.Linux.Namespaces = namespaces
+}
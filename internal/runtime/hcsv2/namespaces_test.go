@@ -0,0 +1,55 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_getPIDMode(t *testing.T) {
+	if mode, err := getPIDMode(nil); err != nil || mode != PIDModeContainer {
+		t.Fatalf("expected container mode got: %s %v", mode, err)
+	}
+	if mode, err := getPIDMode(map[string]string{PIDModeAnnotation: "pod"}); err != nil || mode != PIDModePod {
+		t.Fatalf("expected pod mode got: %s %v", mode, err)
+	}
+	_, err := getPIDMode(map[string]string{PIDModeAnnotation: "node"})
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrInvalidArg {
+		t.Fatalf("expected HrErrInvalidArg got: %v", err)
+	}
+}
+
+func Test_setNamespace(t *testing.T) {
+	spec := &oci.Spec{
+		Linux: &oci.Linux{
+			Namespaces: []oci.LinuxNamespace{
+				{Type: oci.PIDNamespace},
+				{Type: oci.IPCNamespace},
+				{Type: oci.MountNamespace},
+			},
+		},
+	}
+	setNamespace(spec, oci.IPCNamespace, 100)
+	setNamespace(spec, oci.PIDNamespace, 100)
+	expected := []oci.LinuxNamespace{
+		{Type: oci.MountNamespace},
+		{Type: oci.IPCNamespace, Path: "/proc/100/ns/ipc"},
+		{Type: oci.PIDNamespace, Path: "/proc/100/ns/pid"},
+	}
+	if !reflect.DeepEqual(spec.Linux.Namespaces, expected) {
+		t.Fatalf("expected %+v got: %+v", expected, spec.Linux.Namespaces)
+	}
+
+	setNamespace(spec, oci.IPCNamespace, 0)
+	expected = []oci.LinuxNamespace{
+		{Type: oci.MountNamespace},
+		{Type: oci.PIDNamespace, Path: "/proc/100/ns/pid"},
+	}
+	if !reflect.DeepEqual(spec.Linux.Namespaces, expected) {
+		t.Fatalf("expected node namespaces %+v got: %+v", expected, spec.Linux.Namespaces)
+	}
+}
@@ -0,0 +1,136 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"path"
+	"strconv"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	v1 "github.com/containerd/cgroups/stats/v1"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// The pod resource annotations set the limits of the pod cgroup shared by a
+// sandbox container and all of its workload containers. They are read from
+// the spec of the sandbox container.
+const (
+	// PodMemoryLimitAnnotation is the memory limit of the pod in bytes.
+	PodMemoryLimitAnnotation = "io.microsoft.lcow.pod.memory-limit-in-bytes"
+	// PodCPUSharesAnnotation is the relative CPU weight of the pod.
+	PodCPUSharesAnnotation = "io.microsoft.lcow.pod.cpu-shares"
+	// PodCPUQuotaAnnotation is the CPU time in microseconds the pod can use in
+	// every `PodCPUPeriodAnnotation`.
+	PodCPUQuotaAnnotation = "io.microsoft.lcow.pod.cpu-quota"
+	// PodCPUPeriodAnnotation is the CPU period in microseconds.
+	PodCPUPeriodAnnotation = "io.microsoft.lcow.pod.cpu-period"
+	// PodPidsLimitAnnotation is the maximum number of processes in the pod.
+	PodPidsLimitAnnotation = "io.microsoft.lcow.pod.pids-limit"
+)
+
+// getPodCgroupPath returns the cgroup of the pod of the sandbox `sbid`. The
+// sandbox and workload containers of the pod are in its child cgroups.
+func getPodCgroupPath(sbid string) string {
+	return path.Join("/containers", sbid)
+}
+
+// getPodContainerCgroupPath returns the cgroup of the container `id` in the
+// pod of the sandbox `sbid`.
+func getPodContainerCgroupPath(sbid, id string) string {
+	return path.Join(getPodCgroupPath(sbid), id)
+}
+
+// podResources returns the pod resources set by the annotations of the
+// sandbox container.
+func podResources(annotations map[string]string) (*oci.LinuxResources, error) {
+	invalid := func(annotation string, err error) error {
+		return gcserr.WrapHresult(errors.Wrapf(err, "invalid '%s' annotation", annotation), gcserr.HrErrInvalidArg)
+	}
+	parseInt := func(annotation string) (*int64, error) {
+		v, ok := annotations[annotation]
+		if !ok {
+			return nil, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, invalid(annotation, err)
+		}
+		return &n, nil
+	}
+	parseUint := func(annotation string) (*uint64, error) {
+		v, ok := annotations[annotation]
+		if !ok {
+			return nil, nil
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, invalid(annotation, err)
+		}
+		return &n, nil
+	}
+
+	resources := &oci.LinuxResources{}
+	limit, err := parseInt(PodMemoryLimitAnnotation)
+	if err != nil {
+		return nil, err
+	}
+	if limit != nil {
+		resources.Memory = &oci.LinuxMemory{Limit: limit}
+	}
+	shares, err := parseUint(PodCPUSharesAnnotation)
+	if err != nil {
+		return nil, err
+	}
+	quota, err := parseInt(PodCPUQuotaAnnotation)
+	if err != nil {
+		return nil, err
+	}
+	period, err := parseUint(PodCPUPeriodAnnotation)
+	if err != nil {
+		return nil, err
+	}
+	if shares != nil || quota != nil || period != nil {
+		resources.CPU = &oci.LinuxCPU{Shares: shares, Quota: quota, Period: period}
+	}
+	pids, err := parseInt(PodPidsLimitAnnotation)
+	if err != nil {
+		return nil, err
+	}
+	if pids != nil {
+		resources.Pids = &oci.LinuxPids{Limit: *pids}
+	}
+	return resources, nil
+}
+
+// createPodCgroup creates the pod cgroup of the sandbox `sbid` with the pod
+// resources in `annotations`.
+func createPodCgroup(sbid string, annotations map[string]string) error {
+	resources, err := podResources(annotations)
+	if err != nil {
+		return err
+	}
+	if err := newCgroup(getPodCgroupPath(sbid), resources); err != nil {
+		return errors.Wrapf(err, "failed to create cgroup for pod %s", sbid)
+	}
+	return nil
+}
+
+// GetPodStats returns the cgroup metrics aggregated over all the containers in
+// the pod of the sandbox container `c`.
+func (c *Container) GetPodStats(ctx context.Context) (*v1.Metrics, error) {
+	_, span := trace.StartSpan(ctx, "opengcs::Container::GetPodStats")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("cid", c.id))
+
+	if !c.isSandbox {
+		return nil, gcserr.WrapHresult(errors.Errorf("container %s is not a sandbox", c.id), gcserr.HrErrInvalidArg)
+	}
+	stats, err := cgroupStats(getPodCgroupPath(c.id))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get pod stats for %s", c.id)
+	}
+	return stats, nil
+}
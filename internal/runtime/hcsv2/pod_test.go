@@ -0,0 +1,62 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+)
+
+func Test_getPodContainerCgroupPath(t *testing.T) {
+	if p := getPodContainerCgroupPath("sandbox", "sandbox"); p != "/containers/sandbox/sandbox" {
+		t.Fatalf("unexpected sandbox cgroup: %s", p)
+	}
+	if p := getPodContainerCgroupPath("sandbox", "workload"); p != "/containers/sandbox/workload" {
+		t.Fatalf("unexpected workload cgroup: %s", p)
+	}
+}
+
+func Test_podResources(t *testing.T) {
+	resources, err := podResources(map[string]string{
+		PodMemoryLimitAnnotation: "1073741824",
+		PodCPUSharesAnnotation:   "512",
+		PodCPUQuotaAnnotation:    "50000",
+		PodCPUPeriodAnnotation:   "100000",
+		PodPidsLimitAnnotation:   "200",
+	})
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if *resources.Memory.Limit != 1073741824 {
+		t.Fatalf("unexpected memory limit: %d", *resources.Memory.Limit)
+	}
+	if *resources.CPU.Shares != 512 || *resources.CPU.Quota != 50000 || *resources.CPU.Period != 100000 {
+		t.Fatalf("unexpected cpu resources: %+v", resources.CPU)
+	}
+	if resources.Pids.Limit != 200 {
+		t.Fatalf("unexpected pids limit: %d", resources.Pids.Limit)
+	}
+
+	resources, err = podResources(nil)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if resources.Memory != nil || resources.CPU != nil || resources.Pids != nil {
+		t.Fatalf("expected no resources got: %+v", resources)
+	}
+
+	_, err = podResources(map[string]string{PodMemoryLimitAnnotation: "1G"})
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrInvalidArg {
+		t.Fatalf("expected HrErrInvalidArg got: %v", err)
+	}
+}
+
+func Test_Container_GetPodStats_NotSandbox(t *testing.T) {
+	c := &Container{id: "workload"}
+	_, err := c.GetPodStats(context.Background())
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrInvalidArg {
+		t.Fatalf("expected HrErrInvalidArg got: %v", err)
+	}
+}
@@ -8,9 +8,11 @@ import (
 	"os/exec"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/Microsoft/opengcs/internal/log"
 	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
@@ -32,6 +34,28 @@ type Process interface {
 	// and gather the exit code. The second channel must be signaled from the
 	// caller when the caller has completed its use of this call to Wait.
 	Wait() (<-chan int, chan<- bool)
+	// ExitStatus returns how the process exited. It is only valid once the
+	// exit code has been received from `Wait`.
+	ExitStatus() *prot.ExitStatus
+}
+
+// newExitStatus returns the `prot.ExitStatus` of a process that exited with
+// `exitCode`. `rs` is the status reported by the runtime if any.
+func newExitStatus(exitCode int, rs *runtime.ExitStatus, oomKilled bool) *prot.ExitStatus {
+	es := &prot.ExitStatus{
+		ExitCode:  uint32(exitCode),
+		OOMKilled: oomKilled,
+	}
+	if rs != nil {
+		es.Signal = int32(rs.Signal)
+		if !rs.StartTime.IsZero() {
+			es.StartTime = rs.StartTime.UTC().Format(time.RFC3339Nano)
+		}
+		if !rs.ExitTime.IsZero() {
+			es.ExitTime = rs.ExitTime.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return es
 }
 
 // Process is a struct that defines the lifetime and operations associated with
@@ -49,8 +73,11 @@ type containerProcess struct {
 	init bool
 
 	// This is only valid post the exitWg
-	exitCode int
-	exitWg   sync.WaitGroup
+	exitCode   int
+	exitStatus *prot.ExitStatus
+	exitWg     sync.WaitGroup
+	// exited is closed with exitWg.
+	exited chan struct{}
 
 	// Used to allow addtion/removal to the writersWg after an initial wait has
 	// already been issued. It is not safe to call Add/Done without holding this
@@ -76,6 +103,7 @@ func newProcess(c *Container, spec *oci.Process, process runtime.Process, pid ui
 		init:    init,
 		cid:     c.id,
 		pid:     pid,
+		exited:  make(chan struct{}),
 	}
 	p.exitWg.Add(1)
 	p.writersWg.Add(1)
@@ -86,16 +114,31 @@ func newProcess(c *Container, spec *oci.Process, process runtime.Process, pid ui
 			trace.StringAttribute("cid", p.cid),
 			trace.Int64Attribute("pid", int64(p.pid)))
 
+		// OOM kills are counted for the whole container so only those since
+		// the process started can have killed it.
+		oomKills := c.oomKillCount()
+
 		// Wait for the process to exit
 		exitCode, err := p.process.Wait()
 		if err != nil {
 			log.G(ctx).WithError(err).Error("failed to wait for runc process")
 		}
 		p.exitCode = exitCode
-		log.G(ctx).WithField("exitCode", p.exitCode).Debug("process exited")
+		rs := p.process.ExitStatus()
+		oomKilled := rs != nil && rs.Signal == syscall.SIGKILL && c.oomKillCount() > oomKills
+		p.exitStatus = newExitStatus(exitCode, rs, oomKilled)
+		log.G(ctx).WithFields(logrus.Fields{
+			"exitCode":  p.exitCode,
+			"oomKilled": oomKilled,
+		}).Debug("process exited")
+
+		if p.init {
+			c.setStopped(ctx)
+		}
 
 		// Free any process waiters
 		p.exitWg.Done()
+		close(p.exited)
 
 		// Schedule the removal of this process object from the map once at
 		// least one waiter has read the result
@@ -120,6 +163,9 @@ func newProcess(c *Container, spec *oci.Process, process runtime.Process, pid ui
 //
 // If the process has already exited returns `gcserr.HrErrNotFound` by contract.
 func (p *containerProcess) Kill(ctx context.Context, signal syscall.Signal) error {
+	if err := p.c.CheckNotPaused("signal process"); err != nil {
+		return err
+	}
 	// When a container contains more than one process we can fail to unblock
 	// the wait if we only signal the init process. Instead we issue a `runc
 	// kill --all` which then signals all processes in the container.
@@ -152,6 +198,12 @@ func (p *containerProcess) Pid() int {
 	return int(p.pid)
 }
 
+// ExitStatus returns how the process exited. It is only valid once the exit
+// code has been received from `Wait`.
+func (p *containerProcess) ExitStatus() *prot.ExitStatus {
+	return p.exitStatus
+}
+
 // ResizeConsole resizes the tty to `height`x`width` for the process.
 func (p *containerProcess) ResizeConsole(ctx context.Context, height, width uint16) error {
 	tty := p.process.Tty()
@@ -237,12 +289,18 @@ func newExternalProcess(ctx context.Context, cmd *exec.Cmd, tty *stdio.TtyRelay,
 	if err := cmd.Start(); err != nil {
 		return nil, errors.Wrap(err, "failed to call Start for external process")
 	}
+	rs := &runtime.ExitStatus{StartTime: time.Now()}
 	if tty != nil {
 		tty.Start()
 	}
 	go func() {
 		cmd.Wait()
+		rs.ExitTime = time.Now()
 		ep.exitCode = cmd.ProcessState.ExitCode()
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			rs.Signal = ws.Signal()
+		}
+		ep.exitStatus = newExitStatus(ep.exitCode, rs, false)
 		log.G(ctx).WithFields(logrus.Fields{
 			"pid":      cmd.Process.Pid,
 			"exitCode": ep.exitCode,
@@ -259,8 +317,9 @@ type externalProcess struct {
 	cmd *exec.Cmd
 	tty *stdio.TtyRelay
 
-	waitBlock chan struct{}
-	exitCode  int
+	waitBlock  chan struct{}
+	exitCode   int
+	exitStatus *prot.ExitStatus
 
 	removeOnce sync.Once
 	remove     func(pid int)
@@ -280,6 +339,12 @@ func (ep *externalProcess) Pid() int {
 	return ep.cmd.Process.Pid
 }
 
+// ExitStatus returns how the process exited. It is only valid once the exit
+// code has been received from `Wait`.
+func (ep *externalProcess) ExitStatus() *prot.ExitStatus {
+	return ep.exitStatus
+}
+
 func (ep *externalProcess) ResizeConsole(ctx context.Context, height, width uint16) error {
 	if ep.tty == nil {
 		return fmt.Errorf("pid: %d, is not a tty and cannot be resized", ep.cmd.Process.Pid)
@@ -0,0 +1,61 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+)
+
+func Test_newExitStatus(t *testing.T) {
+	start := time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	es := newExitStatus(137, &runtime.ExitStatus{
+		Code:      137,
+		Signal:    syscall.SIGKILL,
+		StartTime: start,
+		ExitTime:  start.Add(1500 * time.Millisecond),
+	}, true)
+	if es.ExitCode != 137 || es.Signal != int32(syscall.SIGKILL) || !es.OOMKilled {
+		t.Fatalf("unexpected exit status: %+v", es)
+	}
+	if es.StartTime != "2019-06-01T10:00:00Z" || es.ExitTime != "2019-06-01T10:00:01.5Z" {
+		t.Fatalf("unexpected exit status times: %+v", es)
+	}
+
+	es = newExitStatus(1, nil, false)
+	if es.ExitCode != 1 || es.Signal != 0 || es.StartTime != "" || es.ExitTime != "" {
+		t.Fatalf("unexpected exit status without runtime status: %+v", es)
+	}
+}
+
+func Test_readOOMKillCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "memory.oom_control")
+	if n := readOOMKillCount(p); n != 0 {
+		t.Fatalf("expected 0 for missing file got: %d", n)
+	}
+	if err := ioutil.WriteFile(p, []byte("oom_kill_disable 0\nunder_oom 0\noom_kill 3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n := readOOMKillCount(p); n != 3 {
+		t.Fatalf("expected 3 got: %d", n)
+	}
+	// Kernels before 4.13 do not report the count.
+	if err := ioutil.WriteFile(p, []byte("oom_kill_disable 0\nunder_oom 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n := readOOMKillCount(p); n != 0 {
+		t.Fatalf("expected 0 without count got: %d", n)
+	}
+}
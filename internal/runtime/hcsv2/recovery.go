@@ -0,0 +1,181 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Test dependencies
+var (
+	listMountPoints = storage.ListMountPointsUnderPath
+	processExists   = func(pid int) bool {
+		_, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid)))
+		return err == nil
+	}
+)
+
+// Recover rebuilds the state of `h` from the journal in `dir` left by a
+// previous instance of the GCS and then keeps the journal up to date. It must
+// be called before the bridge serves any request.
+//
+// Every journaled container that still exists in its runtime is adopted so that
+// it can be signaled, waited on, queried and deleted again. The stdio of its
+// processes cannot be reconnected and, as they are no longer children of the
+// GCS, their exit codes are reported as -1. Containers that no longer exist
+// are dropped from the journal. External processes are not recovered.
+func (h *Host) Recover(ctx context.Context, dir string) (err error) {
+	ctx, span := trace.StartSpan(ctx, "opengcs::Host::Recover")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(trace.StringAttribute("dir", dir))
+
+	j, err := newJournal(dir)
+	if err != nil {
+		return err
+	}
+	nsRecords, invalidNs, err := j.namespaces()
+	if err != nil {
+		return err
+	}
+	records, invalid, err := j.containers()
+	if err != nil {
+		return err
+	}
+	for _, name := range invalidNs {
+		log.G(ctx).WithField("record", name).Warning("removing invalid network namespace journal record")
+		os.Remove(filepath.Join(dir, journalNamespacesDir, name))
+	}
+	for _, name := range invalid {
+		log.G(ctx).WithField("record", name).Warning("removing invalid container journal record")
+		os.Remove(filepath.Join(dir, journalContainersDir, name))
+	}
+
+	mountPoints, err := listMountPoints("/")
+	if err != nil {
+		return errors.Wrap(err, "failed to list mounts")
+	}
+	mounted := make(map[string]bool, len(mountPoints))
+	for _, m := range mountPoints {
+		mounted[m] = true
+	}
+
+	h.containersMutex.Lock()
+	defer h.containersMutex.Unlock()
+
+	states := make(map[runtime.Runtime]map[string]runtime.ContainerState)
+	for _, r := range records {
+		entry := log.G(ctx).WithField("cid", r.ID)
+		drop := func(err error, msg string) {
+			e := entry
+			if err != nil {
+				e = e.WithError(err)
+			}
+			e.Warning(msg)
+			if err := j.removeContainer(r.ID); err != nil {
+				entry.WithError(err).Warning("failed to remove container from journal")
+			}
+		}
+		if r.Spec == nil {
+			drop(nil, "dropping journaled container without a spec")
+			continue
+		}
+
+		rtime, err := h.getRuntime(r.Spec)
+		if err != nil {
+			drop(err, "dropping journaled container with an unknown runtime")
+			continue
+		}
+		if _, ok := states[rtime]; !ok {
+			list, err := rtime.ListContainerStates()
+			if err != nil {
+				return errors.Wrap(err, "failed to list runtime containers")
+			}
+			states[rtime] = make(map[string]runtime.ContainerState, len(list))
+			for _, s := range list {
+				states[rtime][s.ID] = s
+			}
+		}
+		state, ok := states[rtime][r.ID]
+		if !ok {
+			drop(nil, "dropping journaled container that no longer exists")
+			continue
+		}
+
+		if r.Spec.Root != nil {
+			rootfs := r.Spec.Root.Path
+			if !filepath.IsAbs(rootfs) {
+				rootfs = filepath.Join(r.BundlePath, rootfs)
+			}
+			if !mounted[rootfs] {
+				// The container can still be signaled and deleted.
+				entry.WithField("rootfs", rootfs).Warning("rootfs of recovered container is not mounted")
+			}
+		}
+
+		con, err := rtime.LoadContainer(r.ID)
+		if err != nil {
+			drop(err, "dropping journaled container that cannot be loaded")
+			continue
+		}
+		c := &Container{
+			id:          r.ID,
+			vsock:       h.vsock,
+			spec:        r.Spec,
+			bundlePath:  r.BundlePath,
+			isSandbox:   r.IsSandbox,
+			sandboxID:   r.SandboxID,
+			targetID:    r.TargetID,
+			namespaceID: r.NamespaceID,
+			adopted:     true,
+			container:   con,
+			exitType:    prot.NtUnexpectedExit,
+			processes:   make(map[uint32]*containerProcess),
+		}
+		c.initState(containerStateFromStatus(state.Status))
+		c.initProcess = newProcess(c, r.Spec.Process, con.(runtime.Process), uint32(con.Pid()), true)
+		h.containers[r.ID] = c
+		h.watchMemory(ctx, c)
+		entry.WithField("status", state.Status).Info("recovered container")
+	}
+
+	// Ephemeral containers are killed with their target again.
+	for _, c := range h.containers {
+		if c.targetID == "" {
+			continue
+		}
+		if target, ok := h.containers[c.targetID]; ok {
+			c.killWithTarget(target)
+		} else if err := c.Kill(ctx, syscall.SIGKILL); err != nil {
+			log.G(ctx).WithError(err).WithField("cid", c.id).Warning("failed to kill ephemeral container without target")
+		}
+	}
+
+	for _, r := range nsRecords {
+		if r.Pid != 0 && !processExists(r.Pid) {
+			// The container owning the namespace, and so its adapters, is
+			// gone.
+			log.G(ctx).WithField("namespace", r.ID).Warning("dropping journaled network namespace of exited container")
+			if err := j.remove(journalNamespacesDir, r.ID); err != nil {
+				log.G(ctx).WithError(err).Warning("failed to remove network namespace from journal")
+			}
+			continue
+		}
+		restoreNetworkNamespace(r)
+	}
+
+	h.journal = j
+	return nil
+}
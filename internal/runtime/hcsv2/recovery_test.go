@@ -0,0 +1,96 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_Host_Recover(t *testing.T) {
+	origListMountPoints, origProcessExists := listMountPoints, processExists
+	listMountPoints = func(string) ([]string, error) { return nil, nil }
+	processExists = func(pid int) bool { return pid == 100 }
+	defer func() {
+		listMountPoints = origListMountPoints
+		processExists = origProcessExists
+	}()
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := newJournal(dir)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	spec := &oci.Spec{Process: &oci.Process{}}
+	// The mock runtime only knows about container "abcdef".
+	for _, id := range []string{"abcdef", "gone"} {
+		if err := j.writeContainer(&containerRecord{ID: id, Spec: spec, NamespaceID: t.Name() + "-live"}); err != nil {
+			t.Fatalf("expected nil error got: %v", err)
+		}
+	}
+	invalid := filepath.Join(dir, journalContainersDir, "invalid.json")
+	if err := ioutil.WriteFile(invalid, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*namespaceRecord{{ID: t.Name() + "-live", Pid: 100}, {ID: t.Name() + "-dead", Pid: 200}} {
+		if err := j.write(journalNamespacesDir, r.ID, r); err != nil {
+			t.Fatalf("expected nil error got: %v", err)
+		}
+	}
+	defer removeNetworkNamespace(context.Background(), t.Name()+"-live")
+
+	h := NewHost(mockruntime.NewRuntime(""), nil)
+	if err := h.Recover(context.Background(), dir); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+
+	c, err := h.GetContainer("abcdef")
+	if err != nil {
+		t.Fatalf("expected recovered container got: %v", err)
+	}
+	if c.namespaceID != t.Name()+"-live" {
+		t.Fatalf("expected namespace %s got: %s", t.Name()+"-live", c.namespaceID)
+	}
+	_, err = c.Start(context.Background(), stdio.ConnectionSettings{})
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrVmcomputeInvalidState {
+		t.Fatalf("expected HrVmcomputeInvalidState starting a recovered container got: %v", err)
+	}
+	if _, err := h.GetContainer("gone"); err == nil {
+		t.Fatal("expected container that no longer exists to be dropped")
+	}
+	for _, p := range []string{j.path(journalContainersDir, "gone"), invalid, j.path(journalNamespacesDir, t.Name()+"-dead")} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed got: %v", p, err)
+		}
+	}
+
+	ns, err := getNetworkNamespace(t.Name() + "-live")
+	if err != nil {
+		t.Fatalf("expected recovered namespace got: %v", err)
+	}
+	if ns.pid != 100 {
+		t.Fatalf("expected namespace pid 100 got: %d", ns.pid)
+	}
+	if _, err := getNetworkNamespace(t.Name() + "-dead"); err == nil {
+		t.Fatal("expected namespace of exited container to be dropped")
+	}
+
+	// The journal is kept up to date once recovered.
+	h.RemoveContainer("abcdef")
+	if _, err := os.Stat(j.path(journalContainersDir, "abcdef")); !os.IsNotExist(err) {
+		t.Fatalf("expected removed container to be removed from the journal got: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+
+	"github.com/Microsoft/opengcs/internal/cgroup2"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/containerd/cgroups"
+	v1 "github.com/containerd/cgroups/stats/v1"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+const (
+	// minCPUShares and maxCPUShares are the bounds the kernel applies to
+	// cpu.shares.
+	minCPUShares = 2
+	maxCPUShares = 262144
+	// minCPUPeriod and maxCPUPeriod are the bounds in microseconds the kernel
+	// applies to cpu.cfs_period_us.
+	minCPUPeriod = 1000
+	maxCPUPeriod = 1000000
+)
+
+// cgroupMemoryRoot is the mount of the cgroup v1 memory controller.
+var cgroupMemoryRoot = "/sys/fs/cgroup/memory"
+
+// oomKillCount returns the number of processes in the container killed by the
+// kernel because it ran out of memory. It returns 0 if the count cannot be
+// read.
+func (c *Container) oomKillCount() uint64 {
+	if c.spec == nil || c.spec.Linux == nil || c.spec.Linux.CgroupsPath == "" {
+		return 0
+	}
+	if cgroup2.IsUnified() {
+		return readOOMKillCount(filepath.Join(cgroup2.Mountpoint, c.spec.Linux.CgroupsPath, "memory.events"))
+	}
+	return readOOMKillCount(filepath.Join(cgroupMemoryRoot, c.spec.Linux.CgroupsPath, "memory.oom_control"))
+}
+
+// readOOMKillCount returns the `oom_kill` count in the v1 memory.oom_control or
+// v2 memory.events file at `path` or 0 if it cannot be read. The count is only
+// reported by kernels 4.13 and later.
+func readOOMKillCount(path string) uint64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.ParseUint(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// Update applies `resources` to the cgroup of the running container. Only the
+// CPU, memory and pids limits can be updated and they must fit within the
+// limits of every parent cgroup up to `/containers`, including that of the
+// pod for a workload container.
+func (c *Container) Update(ctx context.Context, resources *oci.LinuxResources) (err error) {
+	_, span := trace.StartSpan(ctx, "opengcs::Container::Update")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("cid", c.id))
+
+	if err := c.checkState("update", ContainerStateCreated, ContainerStateRunning, ContainerStatePaused); err != nil {
+		return err
+	}
+	for parent := path.Dir(c.spec.Linux.CgroupsPath); ; parent = path.Dir(parent) {
+		parentStats, err := cgroupStats(parent)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get the %s cgroup limits", parent)
+		}
+		if err := validateResources(resources, parentStats, goruntime.NumCPU()); err != nil {
+			return err
+		}
+		if parent == "/containers" || parent == "/" {
+			break
+		}
+	}
+
+	if err := updateCgroup(c.spec.Linux.CgroupsPath, resources); err != nil {
+		return errors.Wrapf(err, "failed to update cgroup for container %s", c.id)
+	}
+	return nil
+}
+
+// cgroupStats returns the metrics of the cgroup `path` on the cgroup v2
+// unified hierarchy if the UVM uses it or the v1 hierarchies otherwise.
+func cgroupStats(path string) (*v1.Metrics, error) {
+	if cgroup2.IsUnified() {
+		cg, err := cgroup2.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		return cg.Stat()
+	}
+	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(path))
+	if err != nil {
+		return nil, err
+	}
+	return cg.Stat(cgroups.IgnoreNotExist)
+}
+
+// newCgroup creates the cgroup `path` with `resources` on the hierarchy the UVM
+// uses.
+func newCgroup(path string, resources *oci.LinuxResources) error {
+	if cgroup2.IsUnified() {
+		_, err := cgroup2.New(path, resources)
+		return err
+	}
+	_, err := cgroups.New(cgroups.V1, cgroups.StaticPath(path), resources)
+	return err
+}
+
+// deleteCgroup deletes the cgroup `path` on the hierarchy the UVM uses. It
+// must not contain any processes.
+func deleteCgroup(path string) error {
+	if cgroup2.IsUnified() {
+		cg, err := cgroup2.Load(path)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				return nil
+			}
+			return err
+		}
+		return cg.Delete()
+	}
+	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(path))
+	if err != nil {
+		if err == cgroups.ErrCgroupDeleted {
+			return nil
+		}
+		return err
+	}
+	return cg.Delete()
+}
+
+// updateCgroup applies `resources` to the cgroup `path` on the hierarchy the
+// UVM uses.
+func updateCgroup(path string, resources *oci.LinuxResources) error {
+	if cgroup2.IsUnified() {
+		cg, err := cgroup2.Load(path)
+		if err != nil {
+			return err
+		}
+		return cg.Update(resources)
+	}
+	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(path))
+	if err != nil {
+		return err
+	}
+	return cg.Update(resources)
+}
+
+// validateResources returns an `HrErrInvalidArg` error if `resources` cannot
+// be applied to a container under a parent cgroup with the limits in
+// `parent` on a UVM with `cpus` processors.
+func validateResources(resources *oci.LinuxResources, parent *v1.Metrics, cpus int) error {
+	invalid := func(format string, args ...interface{}) error {
+		return gcserr.WrapHresult(errors.Errorf(format, args...), gcserr.HrErrInvalidArg)
+	}
+
+	if resources == nil {
+		return invalid("no resources to update")
+	}
+	if len(resources.Devices) != 0 || resources.BlockIO != nil || len(resources.HugepageLimits) != 0 ||
+		resources.Network != nil || len(resources.Rdma) != 0 {
+		return invalid("only the cpu, memory and pids resources of a container can be updated")
+	}
+
+	if m := resources.Memory; m != nil && m.Limit != nil {
+		limit := *m.Limit
+		if limit < -1 || limit == 0 {
+			return invalid("invalid memory limit %d", limit)
+		}
+		if limit > 0 && parent.Memory != nil && parent.Memory.Usage != nil &&
+			parent.Memory.Usage.Limit != 0 && uint64(limit) > parent.Memory.Usage.Limit {
+			return invalid("memory limit %d exceeds the containers limit %d", limit, parent.Memory.Usage.Limit)
+		}
+	}
+
+	if cpu := resources.CPU; cpu != nil {
+		if cpu.Shares != nil && (*cpu.Shares < minCPUShares || *cpu.Shares > maxCPUShares) {
+			return invalid("cpu shares %d must be between %d and %d", *cpu.Shares, minCPUShares, maxCPUShares)
+		}
+		if cpu.Period != nil && (*cpu.Period < minCPUPeriod || *cpu.Period > maxCPUPeriod) {
+			return invalid("cpu period %d must be between %d and %d", *cpu.Period, minCPUPeriod, maxCPUPeriod)
+		}
+		if cpu.Quota != nil && *cpu.Quota > 0 {
+			if *cpu.Quota < minCPUPeriod {
+				return invalid("cpu quota %d must be at least %d", *cpu.Quota, minCPUPeriod)
+			}
+			if cpu.Period != nil && *cpu.Quota > int64(*cpu.Period)*int64(cpus) {
+				return invalid("cpu quota %d exceeds the %d processors of the UVM", *cpu.Quota, cpus)
+			}
+		}
+	}
+
+	if p := resources.Pids; p != nil && p.Limit > 0 {
+		if parent.Pids != nil && parent.Pids.Limit != 0 && uint64(p.Limit) > parent.Pids.Limit {
+			return invalid("pids limit %d exceeds the containers limit %d", p.Limit, parent.Pids.Limit)
+		}
+	}
+	return nil
+}
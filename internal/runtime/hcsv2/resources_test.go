@@ -0,0 +1,61 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	v1 "github.com/containerd/cgroups/stats/v1"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_validateResources(t *testing.T) {
+	i64 := func(v int64) *int64 { return &v }
+	u64 := func(v uint64) *uint64 { return &v }
+	parent := &v1.Metrics{
+		Memory: &v1.MemoryStat{Usage: &v1.MemoryEntry{Limit: 1024 * 1024 * 1024}},
+		Pids:   &v1.PidsStat{Limit: 1000},
+	}
+
+	testcases := []struct {
+		name      string
+		resources *oci.LinuxResources
+		valid     bool
+	}{
+		{"Nil", nil, false},
+		{"Empty", &oci.LinuxResources{}, true},
+		{"Memory", &oci.LinuxResources{Memory: &oci.LinuxMemory{Limit: i64(512 * 1024 * 1024)}}, true},
+		{"MemoryUnlimited", &oci.LinuxResources{Memory: &oci.LinuxMemory{Limit: i64(-1)}}, true},
+		{"MemoryZero", &oci.LinuxResources{Memory: &oci.LinuxMemory{Limit: i64(0)}}, false},
+		{"MemoryOverParent", &oci.LinuxResources{Memory: &oci.LinuxMemory{Limit: i64(2 * 1024 * 1024 * 1024)}}, false},
+		{"Shares", &oci.LinuxResources{CPU: &oci.LinuxCPU{Shares: u64(512)}}, true},
+		{"SharesTooLow", &oci.LinuxResources{CPU: &oci.LinuxCPU{Shares: u64(1)}}, false},
+		{"SharesTooHigh", &oci.LinuxResources{CPU: &oci.LinuxCPU{Shares: u64(maxCPUShares + 1)}}, false},
+		{"Quota", &oci.LinuxResources{CPU: &oci.LinuxCPU{Period: u64(100000), Quota: i64(200000)}}, true},
+		{"QuotaUnlimited", &oci.LinuxResources{CPU: &oci.LinuxCPU{Period: u64(100000), Quota: i64(-1)}}, true},
+		{"QuotaOverCPUs", &oci.LinuxResources{CPU: &oci.LinuxCPU{Period: u64(100000), Quota: i64(300000)}}, false},
+		{"PeriodTooLow", &oci.LinuxResources{CPU: &oci.LinuxCPU{Period: u64(999)}}, false},
+		{"Pids", &oci.LinuxResources{Pids: &oci.LinuxPids{Limit: 100}}, true},
+		{"PidsOverParent", &oci.LinuxResources{Pids: &oci.LinuxPids{Limit: 1001}}, false},
+		{"Devices", &oci.LinuxResources{Devices: []oci.LinuxDeviceCgroup{{Allow: true}}}, false},
+		{"BlockIO", &oci.LinuxResources{BlockIO: &oci.LinuxBlockIO{}}, false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateResources(tc.resources, parent, 2)
+			if tc.valid {
+				if err != nil {
+					t.Fatalf("expected nil error got: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected error got nil")
+			}
+			if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrInvalidArg {
+				t.Fatalf("expected HrErrInvalidArg got: %v", err)
+			}
+		})
+	}
+}
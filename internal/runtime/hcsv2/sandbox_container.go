@@ -93,12 +93,18 @@ func setupSandboxContainerSpec(ctx context.Context, id string, spec *oci.Spec) (
 		}
 	}
 
-	// TODO: JTERRY75 /dev/shm is not properly setup for LCOW I believe. CRI
-	// also has a concept of a sandbox/shm file when the IPC NamespaceMode !=
-	// NODE.
+	// Mount the /dev/shm shared by the containers of the pod
+	shmSize, err := getShmSize(spec.Annotations)
+	if err != nil {
+		return err
+	}
+	if err := setupSandboxShm(id, shmSize); err != nil {
+		return err
+	}
+	setShmMount(spec, getSandboxShmPath(id))
 
-	// Force the parent cgroup into our /containers root
-	spec.Linux.CgroupsPath = "/containers/" + id
+	// Force the cgroup into the pod cgroup in our /containers root
+	spec.Linux.CgroupsPath = getPodContainerCgroupPath(id, id)
 
 	// Clear the windows section as we dont want to forward to runc
 	spec.Windows = nil
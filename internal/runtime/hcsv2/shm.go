@@ -0,0 +1,111 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ShmSizeAnnotation is the size in bytes of the /dev/shm tmpfs shared by
+	// the containers of a pod. It is read from the spec of the sandbox
+	// container.
+	ShmSizeAnnotation = "io.microsoft.lcow.shm-size-in-bytes"
+	// IPCModeAnnotation selects the IPC namespace of a workload container. It
+	// is one of the `IPCMode` values and defaults to `IPCModePod`.
+	IPCModeAnnotation = "io.microsoft.lcow.ipc-mode"
+)
+
+// defaultShmSize is the size of the pod /dev/shm if the sandbox does not set
+// `ShmSizeAnnotation`. It matches the default of Docker and CRI.
+const defaultShmSize = 64 * 1024 * 1024
+
+// IPCMode is the IPC namespace mode of a workload container.
+type IPCMode string
+
+const (
+	// IPCModePod joins the IPC namespace of the sandbox and shares its
+	// /dev/shm.
+	IPCModePod = IPCMode("pod")
+	// IPCModeContainer gives the container its own IPC namespace and
+	// /dev/shm as set by its spec.
+	IPCModeContainer = IPCMode("container")
+	// IPCModeNode uses the IPC namespace of the UVM.
+	IPCModeNode = IPCMode("node")
+)
+
+// Test dependencies
+var (
+	osMkdirAll = os.MkdirAll
+	unixMount  = unix.Mount
+)
+
+func getSandboxShmPath(id string) string {
+	return filepath.Join(getSandboxRootDir(id), "shm")
+}
+
+// getShmSize returns the pod /dev/shm size set by `ShmSizeAnnotation`.
+func getShmSize(annotations map[string]string) (uint64, error) {
+	v, ok := annotations[ShmSizeAnnotation]
+	if !ok {
+		return defaultShmSize, nil
+	}
+	size, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || size == 0 {
+		return 0, gcserr.WrapHresult(errors.Errorf("invalid '%s' annotation: '%s'", ShmSizeAnnotation, v), gcserr.HrErrInvalidArg)
+	}
+	return size, nil
+}
+
+// getIPCMode returns the IPC mode set by `IPCModeAnnotation`.
+func getIPCMode(annotations map[string]string) (IPCMode, error) {
+	v, ok := annotations[IPCModeAnnotation]
+	if !ok {
+		return IPCModePod, nil
+	}
+	switch mode := IPCMode(v); mode {
+	case IPCModePod, IPCModeContainer, IPCModeNode:
+		return mode, nil
+	default:
+		return "", gcserr.WrapHresult(errors.Errorf("invalid '%s' annotation: '%s'", IPCModeAnnotation, v), gcserr.HrErrInvalidArg)
+	}
+}
+
+// setupSandboxShm mounts the tmpfs of `size` bytes shared as /dev/shm by the
+// containers of the pod of sandbox `id`.
+func setupSandboxShm(id string, size uint64) error {
+	shmPath := getSandboxShmPath(id)
+	if err := osMkdirAll(shmPath, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create sandbox shm directory %q", shmPath)
+	}
+	data := fmt.Sprintf("mode=1777,size=%d", size)
+	if err := unixMount("shm", shmPath, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, data); err != nil {
+		return errors.Wrapf(err, "failed to mount sandbox shm at %q", shmPath)
+	}
+	return nil
+}
+
+// setShmMount replaces any /dev/shm mount in `spec` with a bind mount of the
+// shm `source`.
+func setShmMount(spec *oci.Spec, source string) {
+	mounts := spec.Mounts[:0]
+	for _, m := range spec.Mounts {
+		if m.Destination != "/dev/shm" {
+			mounts = append(mounts, m)
+		}
+	}
+	spec.Mounts = append(mounts, oci.Mount{
+		Destination: "/dev/shm",
+		Type:        "bind",
+		Source:      source,
+		Options:     []string{"rbind", "nosuid", "nodev", "noexec"},
+	})
+}
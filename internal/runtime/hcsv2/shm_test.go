@@ -0,0 +1,85 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_getShmSize(t *testing.T) {
+	if size, err := getShmSize(nil); err != nil || size != defaultShmSize {
+		t.Fatalf("expected default size got: %d %v", size, err)
+	}
+	if size, err := getShmSize(map[string]string{ShmSizeAnnotation: "1048576"}); err != nil || size != 1048576 {
+		t.Fatalf("expected 1048576 got: %d %v", size, err)
+	}
+	for _, v := range []string{"0", "-1", "64m"} {
+		_, err := getShmSize(map[string]string{ShmSizeAnnotation: v})
+		if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrInvalidArg {
+			t.Fatalf("expected HrErrInvalidArg for %q got: %v", v, err)
+		}
+	}
+}
+
+func Test_getIPCMode(t *testing.T) {
+	if mode, err := getIPCMode(nil); err != nil || mode != IPCModePod {
+		t.Fatalf("expected pod mode got: %s %v", mode, err)
+	}
+	if mode, err := getIPCMode(map[string]string{IPCModeAnnotation: "node"}); err != nil || mode != IPCModeNode {
+		t.Fatalf("expected node mode got: %s %v", mode, err)
+	}
+	_, err := getIPCMode(map[string]string{IPCModeAnnotation: "host"})
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrInvalidArg {
+		t.Fatalf("expected HrErrInvalidArg got: %v", err)
+	}
+}
+
+func Test_setupSandboxShm(t *testing.T) {
+	origMkdirAll, origUnixMount := osMkdirAll, unixMount
+	defer func() {
+		osMkdirAll = origMkdirAll
+		unixMount = origUnixMount
+	}()
+
+	var dir, source, target, fstype, data string
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		dir = path
+		return nil
+	}
+	unixMount = func(s, tgt, f string, flags uintptr, d string) error {
+		source, target, fstype, data = s, tgt, f, d
+		return nil
+	}
+	id := t.Name()
+	if err := setupSandboxShm(id, 1024); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if dir != getSandboxShmPath(id) {
+		t.Fatalf("expected %s to be created got: %s", getSandboxShmPath(id), dir)
+	}
+	if source != "shm" || target != getSandboxShmPath(id) || fstype != "tmpfs" || data != "mode=1777,size=1024" {
+		t.Fatalf("unexpected mount %s %s %s %s", source, target, fstype, data)
+	}
+}
+
+func Test_setShmMount(t *testing.T) {
+	spec := &oci.Spec{
+		Mounts: []oci.Mount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"size=65536k"}},
+		},
+	}
+	setShmMount(spec, "/run/gcs/c/sandbox/shm")
+	expected := []oci.Mount{
+		{Destination: "/proc", Type: "proc", Source: "proc"},
+		{Destination: "/dev/shm", Type: "bind", Source: "/run/gcs/c/sandbox/shm", Options: []string{"rbind", "nosuid", "nodev", "noexec"}},
+	}
+	if !reflect.DeepEqual(spec.Mounts, expected) {
+		t.Fatalf("expected %+v got: %+v", expected, spec.Mounts)
+	}
+}
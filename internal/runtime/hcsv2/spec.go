@@ -40,6 +40,31 @@ func isInMounts(target string, mounts []oci.Mount) bool {
 	return false
 }
 
+// addEtcBindMounts adds read only, if the root is, bind mounts of the files at
+// `hostnamePath`, `hostsPath` and `resolvPath` for /etc/hostname, /etc/hosts
+// and /etc/resolv.conf unless `spec` already mounts them.
+func addEtcBindMounts(spec *oci.Spec, hostnamePath, hostsPath, resolvPath string) {
+	for _, m := range []struct{ destination, source string }{
+		{"/etc/hostname", hostnamePath},
+		{"/etc/hosts", hostsPath},
+		{"/etc/resolv.conf", resolvPath},
+	} {
+		if isInMounts(m.destination, spec.Mounts) {
+			continue
+		}
+		mt := oci.Mount{
+			Destination: m.destination,
+			Type:        "bind",
+			Source:      m.source,
+			Options:     []string{"bind"},
+		}
+		if isRootReadonly(spec) {
+			mt.Options = append(mt.Options, "ro")
+		}
+		spec.Mounts = append(spec.Mounts, mt)
+	}
+}
+
 func setProcess(spec *oci.Spec) {
 	if spec.Process == nil {
 		spec.Process = &oci.Process{}
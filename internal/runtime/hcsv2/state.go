@@ -0,0 +1,144 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ContainerState is the lifecycle state of a `Container`.
+type ContainerState string
+
+const (
+	// ContainerStateCreated is the state of a container whose init process
+	// has not been started.
+	ContainerStateCreated = ContainerState("created")
+	// ContainerStateRunning is the state of a started container.
+	ContainerStateRunning = ContainerState("running")
+	// ContainerStatePaused is the state of a container frozen by `Pause`.
+	ContainerStatePaused = ContainerState("paused")
+	// ContainerStateStopped is the state of a container whose init process
+	// has exited.
+	ContainerStateStopped = ContainerState("stopped")
+	// ContainerStateDeleted is the state of a container removed from its
+	// runtime by `Delete`.
+	ContainerStateDeleted = ContainerState("deleted")
+)
+
+// containerTransitions are the states a container can move to from each
+// state.
+var containerTransitions = map[ContainerState][]ContainerState{
+	ContainerStateCreated: {ContainerStateRunning, ContainerStateStopped, ContainerStateDeleted},
+	ContainerStateRunning: {ContainerStatePaused, ContainerStateStopped},
+	ContainerStatePaused:  {ContainerStateRunning, ContainerStateStopped},
+	ContainerStateStopped: {ContainerStateDeleted},
+}
+
+// containerStateFromStatus returns the state of a container with the runtime
+// `status`.
+func containerStateFromStatus(status string) ContainerState {
+	switch status {
+	case "created":
+		return ContainerStateCreated
+	case "paused":
+		return ContainerStatePaused
+	case "stopped":
+		return ContainerStateStopped
+	default:
+		return ContainerStateRunning
+	}
+}
+
+// initState sets the state of the new container `c` to `state`. It must be
+// called before the container is shared.
+func (c *Container) initState(state ContainerState) {
+	c.state = state
+	c.stateTimes = map[ContainerState]time.Time{state: time.Now()}
+}
+
+// stateErrorLocked returns the error for `op` not being valid in the current
+// state of `c`. Operations on a stopped or deleted container fail with
+// `HrVmcomputeSystemNotFound`, which `containerProcess.Kill` reports as
+// `HrErrNotFound` for the init process. Any other invalid operation fails with
+// `HrVmcomputeInvalidState`.
+func (c *Container) stateErrorLocked(op string) error {
+	switch c.state {
+	case ContainerStateStopped:
+		return gcserr.WrapHresult(errors.Errorf("cannot %s in container %s after it has stopped", op, c.id), gcserr.HrVmcomputeSystemNotFound)
+	case ContainerStateDeleted:
+		return gcserr.WrapHresult(errors.Errorf("cannot %s in container %s after it has been deleted", op, c.id), gcserr.HrVmcomputeSystemNotFound)
+	default:
+		return gcserr.WrapHresult(errors.Errorf("cannot %s in container %s while it is %s", op, c.id, c.state), gcserr.HrVmcomputeInvalidState)
+	}
+}
+
+// checkStateLocked returns an error naming `op` unless `c` is in one of
+// `states`.
+func (c *Container) checkStateLocked(op string, states ...ContainerState) error {
+	for _, s := range states {
+		if c.state == s {
+			return nil
+		}
+	}
+	return c.stateErrorLocked(op)
+}
+
+// checkState is `checkStateLocked` for callers not holding `c.stateL`.
+func (c *Container) checkState(op string, states ...ContainerState) error {
+	c.stateL.Lock()
+	defer c.stateL.Unlock()
+
+	return c.checkStateLocked(op, states...)
+}
+
+// setStateLocked moves `c` to `state` and records when it did. It returns an
+// `HrVmcomputeInvalidState` error if `c` cannot move to `state`.
+func (c *Container) setStateLocked(state ContainerState) error {
+	for _, s := range containerTransitions[c.state] {
+		if s == state {
+			c.state = state
+			c.stateTimes[state] = time.Now()
+			return nil
+		}
+	}
+	return gcserr.WrapHresult(errors.Errorf("container %s cannot move from %s to %s", c.id, c.state, state), gcserr.HrVmcomputeInvalidState)
+}
+
+// setStopped moves `c` to `ContainerStateStopped` once its init process has
+// exited.
+func (c *Container) setStopped(ctx context.Context) {
+	c.stateL.Lock()
+	defer c.stateL.Unlock()
+
+	// This fails for a container that was already stopped when recovered or
+	// that was deleted while created.
+	if err := c.setStateLocked(ContainerStateStopped); err != nil {
+		log.G(ctx).WithError(err).WithFields(logrus.Fields{
+			"cid":   c.id,
+			"state": c.state,
+		}).Debug("ignoring exit of container")
+	}
+}
+
+// GetState returns the current state of `c` and the time it last entered each
+// state.
+func (c *Container) GetState() *prot.ContainerStateInfo {
+	c.stateL.Lock()
+	defer c.stateL.Unlock()
+
+	info := &prot.ContainerStateInfo{
+		State:      string(c.state),
+		Timestamps: make(map[string]string, len(c.stateTimes)),
+	}
+	for s, t := range c.stateTimes {
+		info.Timestamps[string(s)] = t.UTC().Format(time.RFC3339Nano)
+	}
+	return info
+}
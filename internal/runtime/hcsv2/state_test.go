@@ -0,0 +1,117 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func verifyHresult(t *testing.T, err error, expected gcserr.Hresult) {
+	hr, herr := gcserr.GetHresult(err)
+	if herr != nil || hr != expected {
+		t.Fatalf("expected HRESULT 0x%x got: %v", uint32(expected), err)
+	}
+}
+
+func Test_Container_setStateLocked(t *testing.T) {
+	tests := []struct {
+		from, to ContainerState
+		valid    bool
+	}{
+		{ContainerStateCreated, ContainerStateRunning, true},
+		{ContainerStateCreated, ContainerStateDeleted, true},
+		{ContainerStateCreated, ContainerStatePaused, false},
+		{ContainerStateRunning, ContainerStateRunning, false},
+		{ContainerStateRunning, ContainerStatePaused, true},
+		{ContainerStateRunning, ContainerStateDeleted, false},
+		{ContainerStatePaused, ContainerStateRunning, true},
+		{ContainerStatePaused, ContainerStateStopped, true},
+		{ContainerStateStopped, ContainerStateRunning, false},
+		{ContainerStateStopped, ContainerStateDeleted, true},
+		{ContainerStateDeleted, ContainerStateStopped, false},
+	}
+	for _, test := range tests {
+		c := &Container{id: t.Name()}
+		c.initState(test.from)
+		err := c.setStateLocked(test.to)
+		if test.valid {
+			if err != nil || c.state != test.to {
+				t.Fatalf("expected %s -> %s to be valid got: %s %v", test.from, test.to, c.state, err)
+			}
+			if _, ok := c.stateTimes[test.to]; !ok {
+				t.Fatalf("expected a timestamp for %s", test.to)
+			}
+		} else {
+			verifyInvalidState(t, err)
+			if c.state != test.from {
+				t.Fatalf("expected state to remain %s got: %s", test.from, c.state)
+			}
+		}
+	}
+}
+
+func Test_Container_checkState_Hresults(t *testing.T) {
+	c := &Container{id: t.Name()}
+	for state, expected := range map[ContainerState]gcserr.Hresult{
+		ContainerStateCreated: gcserr.HrVmcomputeInvalidState,
+		ContainerStatePaused:  gcserr.HrVmcomputeInvalidState,
+		ContainerStateStopped: gcserr.HrVmcomputeSystemNotFound,
+		ContainerStateDeleted: gcserr.HrVmcomputeSystemNotFound,
+	} {
+		c.initState(state)
+		verifyHresult(t, c.checkState("exec", ContainerStateRunning), expected)
+	}
+}
+
+func Test_Container_Lifecycle(t *testing.T) {
+	ctx := context.Background()
+	c := newMockContainer(t)
+
+	if err := c.Pause(ctx); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if err := c.Kill(ctx, syscall.SIGKILL); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	verifyInvalidState(t, c.Delete(ctx))
+
+	c.setStopped(ctx)
+	verifyHresult(t, c.Kill(ctx, syscall.SIGKILL), gcserr.HrVmcomputeSystemNotFound)
+	_, err := c.ExecProcess(ctx, &oci.Process{}, stdio.ConnectionSettings{})
+	verifyHresult(t, err, gcserr.HrVmcomputeSystemNotFound)
+	if err := c.Delete(ctx); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	verifyHresult(t, c.Delete(ctx), gcserr.HrVmcomputeSystemNotFound)
+
+	info := c.GetState()
+	if info.State != "deleted" {
+		t.Fatalf("expected deleted state got: %s", info.State)
+	}
+	for _, s := range []string{"running", "paused", "stopped", "deleted"} {
+		if info.Timestamps[s] == "" {
+			t.Fatalf("expected a timestamp for %s got: %+v", s, info.Timestamps)
+		}
+	}
+}
+
+func Test_Container_Kill_Exited_NotFound(t *testing.T) {
+	ctx := context.Background()
+	h := NewHost(mockruntime.NewRuntime(""), nil)
+	c := addMockContainer(t, h, t.Name(), "")
+
+	if err := c.Kill(ctx, syscall.SIGKILL); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	c.initProcess.exitWg.Wait()
+	verifyHresult(t, c.Kill(ctx, syscall.SIGKILL), gcserr.HrVmcomputeSystemNotFound)
+	// By contract signaling a process that has exited is HrErrNotFound.
+	verifyHresult(t, c.initProcess.Kill(ctx, syscall.SIGKILL), gcserr.HrErrNotFound)
+}
@@ -0,0 +1,140 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	"golang.org/x/sys/unix"
+)
+
+// StopSignalAnnotation is the signal that gracefully stops a container, as
+// set by the `StopSignal` of its image config. It is a signal name, with or
+// without the "SIG" prefix, or number and defaults to SIGTERM.
+const StopSignalAnnotation = "io.microsoft.lcow.stop-signal"
+
+// parseSignal returns the signal named or numbered by `s`.
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || unix.SignalName(syscall.Signal(n)) == "" {
+			return 0, errors.Errorf("invalid signal number %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if signal := unix.SignalNum(name); signal != 0 {
+		return signal, nil
+	}
+	return 0, errors.Errorf("invalid signal name %q", s)
+}
+
+// getStopSignal returns the stop signal set by `StopSignalAnnotation`.
+func getStopSignal(annotations map[string]string) (syscall.Signal, error) {
+	v, ok := annotations[StopSignalAnnotation]
+	if !ok {
+		return syscall.SIGTERM, nil
+	}
+	signal, err := parseSignal(v)
+	if err != nil {
+		return 0, gcserr.WrapHresult(errors.Wrapf(err, "invalid '%s' annotation", StopSignalAnnotation), gcserr.HrErrInvalidArg)
+	}
+	return signal, nil
+}
+
+// StopContainer gracefully stops the container `id` by sending it `signal`, or
+// its stop signal if `signal` is 0. If it has not exited after `gracePeriod`
+// it is killed with SIGKILL. A `gracePeriod` of 0 never escalates.
+//
+// The `prot.StopReason` of the exit status of the container reports whether
+// it exited after the stop signal or was killed.
+func (h *Host) StopContainer(ctx context.Context, id string, signal syscall.Signal, gracePeriod time.Duration) (err error) {
+	ctx, span := trace.StartSpan(ctx, "opengcs::Host::StopContainer")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(
+		trace.StringAttribute("cid", id),
+		trace.Int64Attribute("gracePeriodMs", int64(gracePeriod/time.Millisecond)))
+
+	c, err := h.GetContainer(id)
+	if err != nil {
+		return err
+	}
+	if signal == 0 {
+		signal, err = getStopSignal(c.spec.Annotations)
+		if err != nil {
+			return err
+		}
+	}
+	span.AddAttributes(trace.Int64Attribute("signal", int64(signal)))
+
+	// The container can exit as soon as it is signaled so the reason must be
+	// recorded first.
+	restore := c.setStopReason(prot.SrStopSignal)
+	if err := h.KillContainer(ctx, id, signal); err != nil {
+		restore()
+		return err
+	}
+	if gracePeriod > 0 {
+		go h.escalateStop(c, gracePeriod)
+	}
+	return nil
+}
+
+// escalateStop kills `c` with SIGKILL if it has not exited after
+// `gracePeriod`.
+func (h *Host) escalateStop(c *Container, gracePeriod time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	if err := waitForExit(ctx, []*Container{c}); err == nil {
+		return
+	}
+
+	entry := log.G(ctx).WithFields(logrus.Fields{
+		"cid":         c.id,
+		"gracePeriod": gracePeriod,
+	})
+	entry.Info("container did not stop within its grace period, killing it")
+	restore := c.setStopReason(prot.SrEscalated)
+	// This fails if the container exited in the meantime.
+	if err := h.KillContainer(context.Background(), c.id, syscall.SIGKILL); err != nil {
+		restore()
+		entry.WithError(err).Debug("failed to kill container after its grace period")
+	}
+}
+
+// setStopReason records how the host stopped `c`. A container stopped by its
+// stop signal exits gracefully and one killed after its grace period is forced
+// to exit. It is called before `c` is signaled and returns a function that
+// restores the previous reason if the signal could not be sent.
+func (c *Container) setStopReason(reason prot.StopReason) (restore func()) {
+	c.etL.Lock()
+	defer c.etL.Unlock()
+
+	prevReason, prevType := c.stopReason, c.exitType
+	c.stopReason = reason
+	if reason == prot.SrEscalated {
+		c.exitType = prot.NtForcedExit
+	} else {
+		c.exitType = prot.NtGracefulExit
+	}
+	return func() {
+		c.etL.Lock()
+		defer c.etL.Unlock()
+
+		c.stopReason, c.exitType = prevReason, prevType
+	}
+}
@@ -0,0 +1,131 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+)
+
+func Test_parseSignal(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected syscall.Signal
+	}{
+		{"SIGINT", syscall.SIGINT},
+		{"quit", syscall.SIGQUIT},
+		{"9", syscall.SIGKILL},
+		{"0", 0},
+		{"SIGFOO", 0},
+	}
+	for _, test := range tests {
+		signal, err := parseSignal(test.value)
+		if test.expected == 0 {
+			if err == nil {
+				t.Fatalf("expected error for %q got: %v", test.value, signal)
+			}
+		} else if err != nil || signal != test.expected {
+			t.Fatalf("expected %v for %q got: %v %v", test.expected, test.value, signal, err)
+		}
+	}
+}
+
+func Test_getStopSignal(t *testing.T) {
+	if signal, err := getStopSignal(nil); err != nil || signal != syscall.SIGTERM {
+		t.Fatalf("expected SIGTERM got: %v %v", signal, err)
+	}
+	if signal, err := getStopSignal(map[string]string{StopSignalAnnotation: "SIGUSR1"}); err != nil || signal != syscall.SIGUSR1 {
+		t.Fatalf("expected SIGUSR1 got: %v %v", signal, err)
+	}
+	_, err := getStopSignal(map[string]string{StopSignalAnnotation: "-1"})
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrInvalidArg {
+		t.Fatalf("expected HrErrInvalidArg got: %v", err)
+	}
+}
+
+// signalContainer is a `runtime.Container` that records the stop reason of
+// `c` each time it is signaled, as a real container may exit as soon as it is.
+// If `err` is set signaling fails with it.
+type signalContainer struct {
+	runtime.Container
+	c   *Container
+	err error
+
+	reasons []prot.StopReason
+}
+
+func (s *signalContainer) Kill(signal syscall.Signal) error {
+	s.c.etL.Lock()
+	s.reasons = append(s.reasons, s.c.stopReason)
+	s.c.etL.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.Container.Kill(signal)
+}
+
+func addSignalContainer(t *testing.T, h *Host, err error) (*Container, *signalContainer) {
+	c := addMockContainer(t, h, t.Name(), "")
+	s := &signalContainer{Container: c.container, c: c, err: err}
+	c.container = s
+	return c, s
+}
+
+func Test_Host_StopContainer_StopSignal(t *testing.T) {
+	h := NewHost(mockruntime.NewRuntime(""), nil)
+	c, s := addSignalContainer(t, h, nil)
+	c.spec.Annotations = map[string]string{StopSignalAnnotation: "SIGINT"}
+
+	if err := h.StopContainer(context.Background(), t.Name(), 0, time.Minute); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	c.initProcess.exitWg.Wait()
+	if len(s.reasons) != 1 || s.reasons[0] != prot.SrStopSignal {
+		t.Fatalf("expected stop reason %s before the signal got: %v", prot.SrStopSignal, s.reasons)
+	}
+	if es := c.ExitStatus(); es.StopReason != prot.SrStopSignal {
+		t.Fatalf("expected stop reason %s got: %+v", prot.SrStopSignal, es)
+	}
+	if c.exitType != prot.NtGracefulExit {
+		t.Fatalf("expected graceful exit got: %s", c.exitType)
+	}
+}
+
+func Test_Host_StopContainer_KillFailure_NoStopReason(t *testing.T) {
+	h := NewHost(mockruntime.NewRuntime(""), nil)
+	c, _ := addSignalContainer(t, h, errors.New("kill failed"))
+	c.exitType = prot.NtUnexpectedExit
+
+	if err := h.StopContainer(context.Background(), t.Name(), syscall.SIGINT, 0); err == nil {
+		t.Fatal("expected an error for a failed stop signal")
+	}
+	if c.stopReason != "" || c.exitType != prot.NtUnexpectedExit {
+		t.Fatalf("expected no stop reason got: %s %s", c.stopReason, c.exitType)
+	}
+}
+
+func Test_Host_escalateStop(t *testing.T) {
+	h := NewHost(mockruntime.NewRuntime(""), nil)
+	c, s := addSignalContainer(t, h, nil)
+
+	// The container never got its stop signal so it only exits once killed.
+	h.escalateStop(c, 10*time.Millisecond)
+	c.initProcess.exitWg.Wait()
+	if len(s.reasons) != 1 || s.reasons[0] != prot.SrEscalated {
+		t.Fatalf("expected stop reason %s before the signal got: %v", prot.SrEscalated, s.reasons)
+	}
+	if es := c.ExitStatus(); es.StopReason != prot.SrEscalated {
+		t.Fatalf("expected stop reason %s got: %+v", prot.SrEscalated, es)
+	}
+	if c.exitType != prot.NtForcedExit {
+		t.Fatalf("expected forced exit got: %s", c.exitType)
+	}
+}
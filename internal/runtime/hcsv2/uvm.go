@@ -15,6 +15,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/memevents"
 	"github.com/Microsoft/opengcs/internal/storage"
 	"github.com/Microsoft/opengcs/internal/storage/overlay"
 	"github.com/Microsoft/opengcs/internal/storage/plan9"
@@ -26,13 +28,20 @@ import (
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
 	"github.com/Microsoft/opengcs/service/gcs/transport"
 	shellwords "github.com/mattn/go-shellwords"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // UVMContainerID is the ContainerID that will be sent on any prot.MessageBase
 // for V2 where the specific message is targeted at the UVM itself.
 const UVMContainerID = "00000000-0000-0000-0000-000000000000"
 
+// RuntimeAnnotation is the OCI annotation that selects the runtime, by the
+// name it was added to the `Host` with, used to create a container. Containers
+// without it use the default runtime passed to `NewHost`.
+const RuntimeAnnotation = "io.microsoft.lcow.runtime"
+
 // Host is the structure tracking all UVM host state including all containers
 // and processes.
 type Host struct {
@@ -44,23 +53,106 @@ type Host struct {
 
 	// Rtime is the Runtime interface used by the GCS core.
 	rtime runtime.Runtime
-	vsock transport.Transport
+	// runtimes are the runtimes that can be selected with
+	// `RuntimeAnnotation`.
+	runtimes map[string]runtime.Runtime
+	vsock    transport.Transport
+	// journal persists the containers and network namespaces so that they
+	// can be recovered if the GCS restarts. It is nil until `Recover` is
+	// called.
+	journal *journal
+	// memWatcher reports the memory events of the containers. It is nil
+	// unless `SetMemoryWatcher` is called.
+	memWatcher *memevents.Watcher
+
+	// orphansMutex serializes `CollectOrphans` and protects orphansSeen.
+	orphansMutex sync.Mutex
+	// orphansSeen is when each resource without an owner was first found by
+	// `CollectOrphans`.
+	orphansSeen map[prot.Orphan]time.Time
+	// hostMountsMutex protects hostMounts.
+	hostMountsMutex sync.Mutex
+	// hostMounts are the paths of the SCSI, pmem and plan9 mounts the host
+	// added and has not removed. Only these are collected by
+	// `CollectOrphans`.
+	hostMounts map[string]bool
 }
 
 func NewHost(rtime runtime.Runtime, vsock transport.Transport) *Host {
 	return &Host{
 		containers:        make(map[string]*Container),
 		externalProcesses: make(map[int]*externalProcess),
+		hostMounts:        make(map[string]bool),
 		rtime:             rtime,
+		runtimes:          make(map[string]runtime.Runtime),
 		vsock:             vsock,
 	}
 }
 
+// SetMemoryWatcher makes `h` watch the cgroup of every container it creates or
+// recovers with `w`. It must be called before any container is created.
+func (h *Host) SetMemoryWatcher(w *memevents.Watcher) {
+	h.memWatcher = w
+}
+
+// MemoryEvents returns the channel the memory events of the containers are
+// sent on. The `memevents.Event.ID` of a container event is its ID. It is nil
+// if there is no memory watcher.
+func (h *Host) MemoryEvents() <-chan memevents.Event {
+	return h.memWatcher.Events()
+}
+
+// watchMemory starts watching the cgroup of `c` for memory events.
+func (h *Host) watchMemory(ctx context.Context, c *Container) {
+	if c.spec.Linux == nil || c.spec.Linux.CgroupsPath == "" {
+		return
+	}
+	if err := h.memWatcher.Add(c.id, c.spec.Linux.CgroupsPath); err != nil {
+		log.G(ctx).WithError(err).WithField("cid", c.id).Warning("failed to watch container memory events")
+	}
+}
+
+// AddRuntime makes `rtime` available to containers that set
+// `RuntimeAnnotation` to `name`. It must be called before any container is
+// created.
+func (h *Host) AddRuntime(name string, rtime runtime.Runtime) {
+	h.runtimes[name] = rtime
+}
+
+// getRuntime returns the runtime selected by the annotations of `spec`.
+func (h *Host) getRuntime(spec *oci.Spec) (runtime.Runtime, error) {
+	name, ok := spec.Annotations[RuntimeAnnotation]
+	if !ok || name == "" {
+		return h.rtime, nil
+	}
+	rtime, ok := h.runtimes[name]
+	if !ok {
+		return nil, errors.Errorf("unsupported '%s': '%s'", RuntimeAnnotation, name)
+	}
+	return rtime, nil
+}
+
 func (h *Host) RemoveContainer(id string) {
 	h.containersMutex.Lock()
 	defer h.containersMutex.Unlock()
 
 	delete(h.containers, id)
+	h.memWatcher.Remove(id)
+	if err := h.journal.removeContainer(id); err != nil {
+		logrus.WithError(err).WithField("cid", id).Warning("failed to remove container from journal")
+	}
+}
+
+// ListContainers returns all containers known to the host.
+func (h *Host) ListContainers() []*Container {
+	h.containersMutex.Lock()
+	defer h.containersMutex.Unlock()
+
+	cs := make([]*Container, 0, len(h.containers))
+	for _, c := range h.containers {
+		cs = append(cs, c)
+	}
+	return cs
 }
 
 func (h *Host) getContainerLocked(id string) (*Container, error) {
@@ -78,6 +170,118 @@ func (h *Host) GetContainer(id string) (*Container, error) {
 	return h.getContainerLocked(id)
 }
 
+// getPodSandboxLocked returns the sandbox `sid` that a new container is to be
+// created in. It fails if the sandbox does not exist or is being stopped by
+// `KillContainer` or `DeleteContainer`.
+func (h *Host) getPodSandboxLocked(sid string) (*Container, error) {
+	sb, ok := h.containers[sid]
+	if !ok || !sb.isSandbox {
+		return nil, gcserr.WrapHresult(errors.Errorf("sandbox %s not found", sid), gcserr.HrVmcomputeSystemNotFound)
+	}
+	if sb.stopping {
+		return nil, gcserr.WrapHresult(errors.Errorf("sandbox %s is stopping", sid), gcserr.HrVmcomputeInvalidState)
+	}
+	return sb, nil
+}
+
+// stopPod prevents the creation of new containers in the pod of sandbox `sid`
+// and returns the containers in it other than the sandbox.
+func (h *Host) stopPod(sid string) []*Container {
+	h.containersMutex.Lock()
+	defer h.containersMutex.Unlock()
+
+	var workloads []*Container
+	for _, c := range h.containers {
+		if c.id == sid {
+			c.stopping = true
+		} else if c.sandboxID == sid {
+			workloads = append(workloads, c)
+		}
+	}
+	return workloads
+}
+
+// waitForExit waits for the init process of every container in `cs` to exit
+// or for `ctx` to be done.
+func waitForExit(ctx context.Context, cs []*Container) error {
+	for _, c := range cs {
+		done := make(chan struct{})
+		go func(c *Container) {
+			c.initProcess.exitWg.Wait()
+			close(done)
+		}(c)
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "failed waiting for container %s to exit", c.id)
+		}
+	}
+	return nil
+}
+
+// KillContainer sends `signal` to the container `id`. If `id` is a sandbox and
+// `signal` takes it down, no new containers can be created in its pod and the
+// other containers of the pod are signaled first. They are waited on before
+// the sandbox is killed with SIGKILL.
+func (h *Host) KillContainer(ctx context.Context, id string, signal syscall.Signal) error {
+	c, err := h.GetContainer(id)
+	if err != nil {
+		return err
+	}
+	if c.isSandbox && (signal == syscall.SIGTERM || signal == syscall.SIGKILL) {
+		workloads := h.stopPod(id)
+		for _, w := range workloads {
+			// This fails for the containers that have already exited.
+			if err := w.Kill(ctx, signal); err != nil {
+				log.G(ctx).WithError(err).WithField("cid", w.id).Debug("failed to signal pod container")
+			}
+		}
+		if signal == syscall.SIGKILL {
+			if err := waitForExit(ctx, workloads); err != nil {
+				return err
+			}
+		}
+	}
+	return c.Kill(ctx, signal)
+}
+
+// DeleteContainer deletes the stopped container `id` and removes it from `h`.
+// If `id` is a sandbox the other containers of its pod are killed, deleted and
+// removed first.
+func (h *Host) DeleteContainer(ctx context.Context, id string) error {
+	c, err := h.GetContainer(id)
+	if err != nil {
+		return err
+	}
+	if c.isSandbox {
+		// The pod is only torn down once the sandbox itself can be deleted.
+		if err := c.checkState("delete", ContainerStateCreated, ContainerStateStopped); err != nil {
+			return err
+		}
+		workloads := h.stopPod(id)
+		for _, w := range workloads {
+			// This fails for the containers that have already exited.
+			if err := w.Kill(ctx, syscall.SIGKILL); err != nil {
+				log.G(ctx).WithError(err).WithField("cid", w.id).Debug("failed to kill pod container")
+			}
+		}
+		if err := waitForExit(ctx, workloads); err != nil {
+			return err
+		}
+		for _, w := range workloads {
+			if err := w.Delete(ctx); err != nil {
+				return errors.Wrapf(err, "failed to delete container %s of sandbox %s", w.id, id)
+			}
+			h.RemoveContainer(w.id)
+		}
+	}
+	if err := c.Delete(ctx); err != nil {
+		return err
+	}
+	h.RemoveContainer(id)
+	return nil
+}
+
 func setupSandboxMountsPath(id string) error {
 	mountPath := getSandboxMountsDir(id)
 	if err := os.MkdirAll(mountPath, 0755); err != nil {
@@ -88,6 +292,22 @@ func setupSandboxMountsPath(id string) error {
 }
 
 func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VMHostedContainerSettingsV2) (_ *Container, err error) {
+	return h.createContainer(ctx, id, settings, nil)
+}
+
+// RestoreContainer restores the container checkpointed to `opts.ImagePath`
+// by `Container.Checkpoint` as the new container `id`. `settings` must
+// describe the same container with its layers already mounted.
+//
+// The restored container is running but the stdio of its init process is not
+// connected until `Container.Start` is called with the new stdio ports.
+func (h *Host) RestoreContainer(ctx context.Context, id string, settings *prot.VMHostedContainerSettingsV2, opts runtime.RestoreOptions) (_ *Container, err error) {
+	return h.createContainer(ctx, id, settings, &opts)
+}
+
+// createContainer creates the container `id` or, if `restore` is not nil,
+// restores it from a checkpoint.
+func (h *Host) createContainer(ctx context.Context, id string, settings *prot.VMHostedContainerSettingsV2, restore *runtime.RestoreOptions) (_ *Container, err error) {
 	h.containersMutex.Lock()
 	defer h.containersMutex.Unlock()
 
@@ -95,7 +315,13 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 		return nil, gcserr.NewHresultError(gcserr.HrVmcomputeSystemAlreadyExists)
 	}
 
-	var namespaceID string
+	rtime, err := h.getRuntime(settings.OCISpecification)
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaceID, sandboxID, targetID string
+	var target *Container
 	criType, isCRI := settings.OCISpecification.Annotations["io.kubernetes.cri.container-type"]
 	if isCRI {
 		switch criType {
@@ -106,20 +332,49 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 			defer func() {
 				if err != nil {
 					defer os.RemoveAll(getSandboxRootDir(id))
+					storage.UnmountPath(ctx, getSandboxShmPath(id), false)
 				}
 			}()
-			err = setupSandboxMountsPath(id)
+			if err == nil {
+				err = setupSandboxMountsPath(id)
+			}
 		case "container":
 			sid, ok := settings.OCISpecification.Annotations["io.kubernetes.cri.sandbox-id"]
 			if !ok || sid == "" {
 				return nil, errors.Errorf("unsupported 'io.kubernetes.cri.sandbox-id': '%s'", sid)
 			}
-			err = setupWorkloadContainerSpec(ctx, sid, id, settings.OCISpecification)
+			var sb *Container
+			sb, err = h.getPodSandboxLocked(sid)
+			if err != nil {
+				return nil, err
+			}
+			sandboxID = sid
+			err = setupWorkloadContainerSpec(ctx, sid, id, settings.OCISpecification, int(sb.initProcess.pid))
 			defer func() {
 				if err != nil {
 					defer os.RemoveAll(getWorkloadRootDir(id))
 				}
 			}()
+		case "ephemeral":
+			tid := settings.OCISpecification.Annotations[EphemeralTargetAnnotation]
+			if tid == "" || tid == id {
+				return nil, gcserr.WrapHresult(errors.Errorf("unsupported '%s': '%s'", EphemeralTargetAnnotation, tid), gcserr.HrErrInvalidArg)
+			}
+			target, err = h.getContainerLocked(tid)
+			if err != nil {
+				return nil, err
+			}
+			if err := validateEphemeralTarget(target); err != nil {
+				return nil, err
+			}
+			targetID = tid
+			sandboxID = target.podID()
+			if sandboxID != "" {
+				if _, err := h.getPodSandboxLocked(sandboxID); err != nil {
+					return nil, err
+				}
+			}
+			err = setupEphemeralContainerSpec(ctx, target, id, settings.OCISpecification)
 		default:
 			err = errors.Errorf("unsupported 'io.kubernetes.cri.container-type': '%s'", criType)
 		}
@@ -136,6 +391,16 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 	if err != nil {
 		return nil, err
 	}
+	if isCRI && criType == "sandbox" {
+		if err := createPodCgroup(id, settings.OCISpecification.Annotations); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				deleteCgroup(getPodCgroupPath(id))
+			}
+		}()
+	}
 
 	// Create the BundlePath
 	if err := os.MkdirAll(settings.OCIBundlePath, 0700); err != nil {
@@ -155,19 +420,36 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 		return nil, errors.Wrapf(err, "failed to flush writer for config.json at: '%s'", configFile)
 	}
 
-	con, err := h.rtime.CreateContainer(id, settings.OCIBundlePath, nil)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create container")
+	var con runtime.Container
+	if restore != nil {
+		con, err = rtime.RestoreContainer(id, settings.OCIBundlePath, *restore, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to restore container")
+		}
+	} else {
+		con, err = rtime.CreateContainer(id, settings.OCIBundlePath, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create container")
+		}
 	}
 
 	c := &Container{
-		id:        id,
-		vsock:     h.vsock,
-		spec:      settings.OCISpecification,
-		isSandbox: criType == "sandbox",
-		container: con,
-		exitType:  prot.NtUnexpectedExit,
-		processes: make(map[uint32]*containerProcess),
+		id:         id,
+		vsock:      h.vsock,
+		spec:       settings.OCISpecification,
+		bundlePath: settings.OCIBundlePath,
+		isSandbox:  criType == "sandbox",
+		sandboxID:  sandboxID,
+		targetID:   targetID,
+		restored:   restore != nil,
+		container:  con,
+		exitType:   prot.NtUnexpectedExit,
+		processes:  make(map[uint32]*containerProcess),
+	}
+	if restore != nil {
+		c.initState(ContainerStateRunning)
+	} else {
+		c.initState(ContainerStateCreated)
 	}
 	c.initProcess = newProcess(c, settings.OCISpecification.Process, con.(runtime.Process), uint32(c.container.Pid()), true)
 
@@ -185,28 +467,82 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 			if err := ns.Sync(ctx); err != nil {
 				return nil, err
 			}
+			c.namespaceID = ns.ID()
+			if err := h.journal.writeNamespace(ns.ID()); err != nil {
+				log.G(ctx).WithError(err).Warning("failed to journal network namespace")
+			}
 		}
 	}
 
 	h.containers[id] = c
+	if err := h.journal.writeContainer(c.record()); err != nil {
+		log.G(ctx).WithError(err).Warning("failed to journal container")
+	}
+	h.watchMemory(ctx, c)
+	if target != nil {
+		c.killWithTarget(target)
+	}
 	return c, nil
 }
 
-func (h *Host) ModifyHostSettings(ctx context.Context, settings *prot.ModifySettingRequest) error {
-	switch settings.ResourceType {
-	case prot.MrtMappedVirtualDisk:
-		return modifyMappedVirtualDisk(ctx, settings.RequestType, settings.Settings.(*prot.MappedVirtualDiskV2))
-	case prot.MrtMappedDirectory:
-		return modifyMappedDirectory(ctx, h.vsock, settings.RequestType, settings.Settings.(*prot.MappedDirectoryV2))
-	case prot.MrtVPMemDevice:
-		return modifyMappedVPMemDevice(ctx, settings.RequestType, settings.Settings.(*prot.MappedVPMemDeviceV2))
-	case prot.MrtCombinedLayers:
+// hostSettingsHandlers are the handlers of each resource type supported by
+// `Host.ModifyHostSettings`.
+var hostSettingsHandlers = map[prot.ModifyResourceType]func(ctx context.Context, h *Host, settings *prot.ModifySettingRequest) error{
+	prot.MrtMappedVirtualDisk: func(ctx context.Context, h *Host, settings *prot.ModifySettingRequest) error {
+		mvd := settings.Settings.(*prot.MappedVirtualDiskV2)
+		if err := modifyMappedVirtualDisk(ctx, settings.RequestType, mvd); err != nil {
+			return err
+		}
+		h.trackHostMount(settings.RequestType, mvd.MountPath)
+		return nil
+	},
+	prot.MrtMappedDirectory: func(ctx context.Context, h *Host, settings *prot.ModifySettingRequest) error {
+		md := settings.Settings.(*prot.MappedDirectoryV2)
+		if err := modifyMappedDirectory(ctx, h.vsock, settings.RequestType, md); err != nil {
+			return err
+		}
+		h.trackHostMount(settings.RequestType, md.MountPath)
+		return nil
+	},
+	prot.MrtVPMemDevice: func(ctx context.Context, h *Host, settings *prot.ModifySettingRequest) error {
+		vpd := settings.Settings.(*prot.MappedVPMemDeviceV2)
+		if err := modifyMappedVPMemDevice(ctx, settings.RequestType, vpd); err != nil {
+			return err
+		}
+		h.trackHostMount(settings.RequestType, vpd.MountPath)
+		return nil
+	},
+	prot.MrtCombinedLayers: func(ctx context.Context, h *Host, settings *prot.ModifySettingRequest) error {
 		return modifyCombinedLayers(ctx, settings.RequestType, settings.Settings.(*prot.CombinedLayersV2))
-	case prot.MrtNetwork:
-		return modifyNetwork(ctx, settings.RequestType, settings.Settings.(*prot.NetworkAdapterV2))
-	default:
+	},
+	prot.MrtNetwork: func(ctx context.Context, h *Host, settings *prot.ModifySettingRequest) error {
+		na := settings.Settings.(*prot.NetworkAdapterV2)
+		if err := modifyNetwork(ctx, settings.RequestType, na); err != nil {
+			return err
+		}
+		if err := h.journal.writeNamespace(na.NamespaceID); err != nil {
+			log.G(ctx).WithError(err).Warning("failed to journal network namespace")
+		}
+		return nil
+	},
+}
+
+// HostResourceTypes returns the resource types supported by
+// `Host.ModifyHostSettings`.
+func HostResourceTypes() []prot.ModifyResourceType {
+	types := make([]prot.ModifyResourceType, 0, len(hostSettingsHandlers))
+	for t := range hostSettingsHandlers {
+		types = append(types, t)
+	}
+	return types
+}
+
+func (h *Host) ModifyHostSettings(ctx context.Context, settings *prot.ModifySettingRequest) error {
+	handler, ok := hostSettingsHandlers[settings.ResourceType]
+	if !ok {
 		return errors.Errorf("the ResourceType \"%s\" is not supported", settings.ResourceType)
 	}
+	return handler(ctx, h, settings)
 }
 
 // Shutdown terminates this UVM. This is a destructive call and will destroy all
@@ -218,7 +554,7 @@ func (h *Host) Shutdown() {
 // RunExternalProcess runs a process in the utility VM.
 func (h *Host) RunExternalProcess(ctx context.Context, params prot.ProcessParameters, conSettings stdio.ConnectionSettings) (_ int, err error) {
 	var stdioSet *stdio.ConnectionSet
-	stdioSet, err = stdio.Connect(h.vsock, conSettings)
+	stdioSet, err = stdio.Connect(ctx, h.vsock, conSettings)
 	if err != nil {
 		return -1, err
 	}
@@ -227,6 +563,9 @@ func (h *Host) RunExternalProcess(ctx context.Context, params prot.ProcessParame
 			stdioSet.Close()
 		}
 	}()
+	if err = ctx.Err(); err != nil {
+		return -1, errors.Wrap(err, "run external process cancelled")
+	}
 
 	args := params.CommandArgs
 	if len(args) == 0 {
@@ -0,0 +1,162 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_Host_getRuntime(t *testing.T) {
+	def := mockruntime.NewRuntime("")
+	crun := mockruntime.NewRuntime("")
+	h := NewHost(def, nil)
+	h.AddRuntime("crun", crun)
+
+	rt, err := h.getRuntime(&oci.Spec{})
+	if err != nil || rt != def {
+		t.Fatalf("expected default runtime got: %v %v", rt, err)
+	}
+	rt, err = h.getRuntime(&oci.Spec{Annotations: map[string]string{RuntimeAnnotation: "crun"}})
+	if err != nil || rt != crun {
+		t.Fatalf("expected crun runtime got: %v %v", rt, err)
+	}
+	if _, err := h.getRuntime(&oci.Spec{Annotations: map[string]string{RuntimeAnnotation: "kata"}}); err == nil {
+		t.Fatal("expected error for unknown runtime got nil")
+	}
+}
+
+// addMockContainer adds a running mock container `id` in the pod of sandbox
+// `sbid` to `h`.
+func addMockContainer(t *testing.T, h *Host, id, sbid string) *Container {
+	con, err := mockruntime.NewRuntime("").CreateContainer(id, "", nil)
+	if err != nil {
+		t.Fatalf("failed to create mock container: %v", err)
+	}
+	c := &Container{
+		id:        id,
+		spec:      &oci.Spec{Process: &oci.Process{}},
+		isSandbox: id == sbid,
+		sandboxID: sbid,
+		container: con,
+		processes: make(map[uint32]*containerProcess),
+	}
+	c.initState(ContainerStateRunning)
+	c.initProcess = newProcess(c, c.spec.Process, con.(runtime.Process), uint32(con.Pid()), true)
+	h.containers[id] = c
+	return c
+}
+
+func Test_Host_getPodSandboxLocked(t *testing.T) {
+	h := NewHost(mockruntime.NewRuntime(""), nil)
+	sandbox := addMockContainer(t, h, "sandbox", "sandbox")
+	addMockContainer(t, h, "workload", "sandbox")
+
+	if sb, err := h.getPodSandboxLocked("sandbox"); err != nil || sb != sandbox {
+		t.Fatalf("expected sandbox got: %v %v", sb, err)
+	}
+	for _, sid := range []string{"missing", "workload"} {
+		_, err := h.getPodSandboxLocked(sid)
+		if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrVmcomputeSystemNotFound {
+			t.Fatalf("expected HrVmcomputeSystemNotFound for %s got: %v", sid, err)
+		}
+	}
+
+	if workloads := h.stopPod("sandbox"); len(workloads) != 1 || workloads[0].id != "workload" {
+		t.Fatalf("expected the workload of the pod got: %v", workloads)
+	}
+	_, err := h.getPodSandboxLocked("sandbox")
+	verifyInvalidState(t, err)
+}
+
+func Test_Host_DeleteContainer_Sandbox_DeletesWorkloads(t *testing.T) {
+	ctx := context.Background()
+	h := NewHost(mockruntime.NewRuntime(""), nil)
+	sandbox := addMockContainer(t, h, "sandbox", "sandbox")
+	workload := addMockContainer(t, h, "workload", "sandbox")
+	addMockContainer(t, h, "other", "other")
+
+	// Only the sandbox exited so the workload is killed with the pod.
+	if err := sandbox.Kill(ctx, syscall.SIGKILL); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	sandbox.initProcess.exitWg.Wait()
+	if err := h.DeleteContainer(ctx, "sandbox"); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	workload.initProcess.exitWg.Wait()
+	if s := workload.GetState().State; s != string(ContainerStateDeleted) {
+		t.Fatalf("expected workload to be deleted got: %s", s)
+	}
+	for _, id := range []string{"sandbox", "workload"} {
+		if _, err := h.GetContainer(id); err == nil {
+			t.Fatalf("expected container %s to be removed", id)
+		}
+	}
+	if _, err := h.GetContainer("other"); err != nil {
+		t.Fatalf("expected container of another pod to remain got: %v", err)
+	}
+}
+
+func Test_Host_DeleteContainer_RunningSandbox_InvalidState(t *testing.T) {
+	ctx := context.Background()
+	h := NewHost(mockruntime.NewRuntime(""), nil)
+	sandbox := addMockContainer(t, h, "sandbox", "sandbox")
+	workload := addMockContainer(t, h, "workload", "sandbox")
+
+	verifyInvalidState(t, h.DeleteContainer(ctx, "sandbox"))
+	if s := workload.GetState().State; s != string(ContainerStateRunning) {
+		t.Fatalf("expected workload to keep running got: %s", s)
+	}
+	if sandbox.stopping {
+		t.Fatal("expected the pod not to be stopping")
+	}
+	for _, id := range []string{"sandbox", "workload"} {
+		if _, err := h.GetContainer(id); err != nil {
+			t.Fatalf("expected container %s to remain got: %v", id, err)
+		}
+	}
+}
+
+func Test_Host_CreateContainer_InvalidIPCMode_RemovesRootDir(t *testing.T) {
+	h := NewHost(mockruntime.NewRuntime(""), nil)
+	addMockContainer(t, h, "sandbox", "sandbox")
+
+	// The host creates the workload root directory for the layers of the
+	// container before creating it.
+	id := t.Name()
+	if err := os.MkdirAll(getWorkloadRootDir(id), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(getWorkloadRootDir(id))
+
+	_, err := h.CreateContainer(context.Background(), id, &prot.VMHostedContainerSettingsV2{
+		OCIBundlePath: filepath.Join(getWorkloadRootDir(id), "bundle"),
+		OCISpecification: &oci.Spec{
+			Annotations: map[string]string{
+				"io.kubernetes.cri.container-type": "container",
+				"io.kubernetes.cri.sandbox-id":     "sandbox",
+				IPCModeAnnotation:                  "invalid",
+			},
+			Linux: &oci.Linux{},
+		},
+	})
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrInvalidArg {
+		t.Fatalf("expected HrErrInvalidArg got: %v", err)
+	}
+	if _, err := h.GetContainer(id); err == nil {
+		t.Fatal("expected the container not to be created")
+	}
+	if _, err := os.Stat(getWorkloadRootDir(id)); !os.IsNotExist(err) {
+		t.Fatalf("expected the workload root directory to be removed got: %v", err)
+	}
+}
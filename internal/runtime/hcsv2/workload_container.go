@@ -43,7 +43,10 @@ func updateSandboxMounts(sbid string, spec *oci.Spec) error {
 	return nil
 }
 
-func setupWorkloadContainerSpec(ctx context.Context, sbid, id string, spec *oci.Spec) (err error) {
+// setupWorkloadContainerSpec prepares `spec` to run the workload container `id`
+// in the pod of sandbox `sbid`. `sandboxPid` is the pid of the sandbox init
+// process.
+func setupWorkloadContainerSpec(ctx context.Context, sbid, id string, spec *oci.Spec, sandboxPid int) (err error) {
 	ctx, span := trace.StartSpan(ctx, "hcsv2::setupWorkloadContainerSpec")
 	defer span.End()
 	defer func() { oc.SetSpanStatus(span, err) }()
@@ -61,51 +64,32 @@ func setupWorkloadContainerSpec(ctx context.Context, sbid, id string, spec *oci.
 		return errors.Wrapf(err, "failed to update sandbox mounts for container %v in sandbox %v", id, sbid)
 	}
 
-	// Add /etc/hostname if the spec did not override it.
-	if !isInMounts("/etc/hostname", spec.Mounts) {
-		mt := oci.Mount{
-			Destination: "/etc/hostname",
-			Type:        "bind",
-			Source:      getSandboxHostnamePath(sbid),
-			Options:     []string{"bind"},
-		}
-		if isRootReadonly(spec) {
-			mt.Options = append(mt.Options, "ro")
-		}
-		spec.Mounts = append(spec.Mounts, mt)
-	}
+	// Add /etc/hostname, /etc/hosts and /etc/resolv.conf of the sandbox if
+	// the spec did not override them.
+	addEtcBindMounts(spec, getSandboxHostnamePath(sbid), getSandboxHostsPath(sbid), getSandboxResolvPath(sbid))
 
-	// Add /etc/hosts if the spec did not override it.
-	if !isInMounts("/etc/hosts", spec.Mounts) {
-		mt := oci.Mount{
-			Destination: "/etc/hosts",
-			Type:        "bind",
-			Source:      getSandboxHostsPath(sbid),
-			Options:     []string{"bind"},
-		}
-		if isRootReadonly(spec) {
-			mt.Options = append(mt.Options, "ro")
-		}
-		spec.Mounts = append(spec.Mounts, mt)
+	// Share the IPC namespace and /dev/shm of the pod
+	ipcMode, err := getIPCMode(spec.Annotations)
+	if err != nil {
+		return err
 	}
-
-	// Add /etc/resolv.conf if the spec did not override it.
-	if !isInMounts("/etc/resolv.conf", spec.Mounts) {
-		mt := oci.Mount{
-			Destination: "/etc/resolv.conf",
-			Type:        "bind",
-			Source:      getSandboxResolvPath(sbid),
-			Options:     []string{"bind"},
-		}
-		if isRootReadonly(spec) {
-			mt.Options = append(mt.Options, "ro")
-		}
-		spec.Mounts = append(spec.Mounts, mt)
+	switch ipcMode {
+	case IPCModePod:
+		setNamespace(spec, oci.IPCNamespace, sandboxPid)
+		setShmMount(spec, getSandboxShmPath(sbid))
+	case IPCModeNode:
+		setNamespace(spec, oci.IPCNamespace, 0)
+		setShmMount(spec, "/dev/shm")
 	}
 
-	// TODO: JTERRY75 /dev/shm is not properly setup for LCOW I believe. CRI
-	// also has a concept of a sandbox/shm file when the IPC NamespaceMode !=
-	// NODE.
+	// Share the PID namespace of the pod
+	pidMode, err := getPIDMode(spec.Annotations)
+	if err != nil {
+		return err
+	}
+	if pidMode == PIDModePod {
+		setNamespace(spec, oci.PIDNamespace, sandboxPid)
+	}
 
 	// Check if we need to do any capability/device mappings
 	if spec.Annotations["io.microsoft.virtualmachine.lcow.privileged"] == "true" {
@@ -160,8 +144,8 @@ func setupWorkloadContainerSpec(ctx context.Context, sbid, id string, spec *oci.
 		}
 	}
 
-	// Force the parent cgroup into our /containers root
-	spec.Linux.CgroupsPath = "/containers/" + id
+	// Force the cgroup into the pod cgroup of the sandbox
+	spec.Linux.CgroupsPath = getPodContainerCgroupPath(sbid, id)
 
 	// Clear the windows section as we dont want to forward to runc
 	spec.Windows = nil
@@ -6,6 +6,7 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"syscall"
@@ -89,25 +90,63 @@ func UnmountAllInPath(ctx context.Context, path string, removeTarget bool) (err
 	return nil
 }
 
+// ListMountPointsUnderPath returns the mount points in /proc/mounts that are
+// under `path` in the order they were mounted.
+func ListMountPointsUnderPath(path string) ([]string, error) {
+	return listMountPointsUnderPath(path)
+}
+
 func listMountPointsUnderPath(path string) ([]string, error) {
+	mounts, err := ListMounts()
+	if err != nil {
+		return nil, err
+	}
 	var mountPoints []string
+	for _, m := range mounts {
+		if strings.HasPrefix(m.Target, path) {
+			mountPoints = append(mountPoints, m.Target)
+		}
+	}
+	return mountPoints, nil
+}
+
+// MountInfo is a mount in /proc/mounts.
+type MountInfo struct {
+	Source  string
+	Target  string
+	FSType  string
+	Options []string
+}
+
+// ListMounts returns the mounts in /proc/mounts in the order they were
+// mounted.
+func ListMounts() ([]MountInfo, error) {
 	f, err := os.Open(procMountFile)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	scanner := bufio.NewScanner(f)
+	return parseMounts(f)
+}
+
+// parseMounts returns the mounts in `r` which is in the /proc/mounts format.
+func parseMounts(r io.Reader) ([]MountInfo, error) {
+	var mounts []MountInfo
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Split(line, " ")
+		fields := strings.Split(scanner.Text(), " ")
 		if len(fields) < numProcMountFields {
 			continue
 		}
-		destPath := fields[1]
-		if strings.HasPrefix(destPath, path) {
-			mountPoints = append(mountPoints, destPath)
-		}
+		mounts = append(mounts, MountInfo{
+			Source:  fields[0],
+			Target:  fields[1],
+			FSType:  fields[2],
+			Options: strings.Split(fields[3], ","),
+		})
 	}
-
-	return mountPoints, nil
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", procMountFile)
+	}
+	return mounts, nil
 }
@@ -5,6 +5,8 @@ package storage
 import (
 	"context"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -210,3 +212,20 @@ func Test_UnmountAllInPath_Unmount_Order(t *testing.T) {
 		t.Fatalf("expected nil error, got: %v", err)
 	}
 }
+
+func Test_parseMounts(t *testing.T) {
+	mounts, err := parseMounts(strings.NewReader(
+		"sysfs /sys sysfs rw,nosuid 0 0\n" +
+			"invalid line\n" +
+			"overlay /run/gcs/c/abc/rootfs overlay rw,lowerdir=/run/mounts/m1:/run/mounts/m2 0 0\n"))
+	if err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	expected := []MountInfo{
+		{Source: "sysfs", Target: "/sys", FSType: "sysfs", Options: []string{"rw", "nosuid"}},
+		{Source: "overlay", Target: "/run/gcs/c/abc/rootfs", FSType: "overlay", Options: []string{"rw", "lowerdir=/run/mounts/m1:/run/mounts/m2"}},
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("expected %+v, got: %+v", expected, mounts)
+	}
+}
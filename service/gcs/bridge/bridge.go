@@ -10,7 +10,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -62,21 +64,42 @@ func (f HandlerFunc) ServeMsg(r *Request) (RequestResponse, error) {
 type Mux struct {
 	mu sync.Mutex
 	m  map[prot.MessageIdentifier]map[prot.ProtocolVersion]Handler
+	// resources are the handlers of each `ModifyResourceType` at each
+	// protocol version.
+	resources map[prot.ProtocolVersion]map[prot.ModifyResourceType]ResourceHandler
+	// properties are the handlers of each `PropertyType` at each protocol
+	// version.
+	properties map[prot.ProtocolVersion]map[prot.PropertyType]PropertyHandler
 }
 
+// ResourceHandler applies the modification `settings` of a single resource
+// type to the container `id`.
+type ResourceHandler func(ctx context.Context, id string, settings *prot.ModifySettingRequest) error
+
+// PropertyHandler sets a single property type of the container `c` in
+// `properties`.
+type PropertyHandler func(ctx context.Context, c *hcsv2.Container, properties *prot.PropertiesV2) error
+
 // NewBridgeMux creates a default bridge multiplexer.
 func NewBridgeMux() *Mux {
-	return &Mux{m: make(map[prot.MessageIdentifier]map[prot.ProtocolVersion]Handler)}
+	return &Mux{
+		m:          make(map[prot.MessageIdentifier]map[prot.ProtocolVersion]Handler),
+		resources:  make(map[prot.ProtocolVersion]map[prot.ModifyResourceType]ResourceHandler),
+		properties: make(map[prot.ProtocolVersion]map[prot.PropertyType]PropertyHandler),
+	}
 }
 
 // Handle registers the handler for the given message id and protocol version.
-func (mux *Mux) Handle(id prot.MessageIdentifier, ver prot.ProtocolVersion, handler Handler) {
+// The handler is wrapped in `middleware` in order, the first being the
+// outermost.
+func (mux *Mux) Handle(id prot.MessageIdentifier, ver prot.ProtocolVersion, handler Handler, middleware ...Middleware) {
 	mux.mu.Lock()
 	defer mux.mu.Unlock()
 
 	if handler == nil {
 		panic("bridge: nil handler")
 	}
+	handler = Chain(handler, middleware...)
 
 	if _, ok := mux.m[id]; !ok {
 		mux.m[id] = make(map[prot.ProtocolVersion]Handler)
@@ -92,13 +115,105 @@ func (mux *Mux) Handle(id prot.MessageIdentifier, ver prot.ProtocolVersion, hand
 	mux.m[id][ver] = handler
 }
 
-// HandleFunc registers the handler function for the given message id and protocol version.
-func (mux *Mux) HandleFunc(id prot.MessageIdentifier, ver prot.ProtocolVersion, handler func(*Request) (RequestResponse, error)) {
+// HandleFunc registers the handler function for the given message id and
+// protocol version wrapped in `middleware`.
+func (mux *Mux) HandleFunc(id prot.MessageIdentifier, ver prot.ProtocolVersion, handler func(*Request) (RequestResponse, error), middleware ...Middleware) {
 	if handler == nil {
 		panic("bridge: nil handler func")
 	}
 
-	mux.Handle(id, ver, HandlerFunc(handler))
+	mux.Handle(id, ver, HandlerFunc(handler), middleware...)
+}
+
+// HandleResource registers the handler used by the
+// `ComputeSystemModifySettingsV1` handler for resource type `t` at the given
+// protocol version.
+func (mux *Mux) HandleResource(ver prot.ProtocolVersion, t prot.ModifyResourceType, handler ResourceHandler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if handler == nil {
+		panic("bridge: nil resource handler")
+	}
+	if _, ok := mux.resources[ver]; !ok {
+		mux.resources[ver] = make(map[prot.ModifyResourceType]ResourceHandler)
+	}
+	mux.resources[ver][t] = handler
+}
+
+// HandleProperty registers the handler used by the
+// `ComputeSystemGetPropertiesV1` handler for property type `t` at the given
+// protocol version.
+func (mux *Mux) HandleProperty(ver prot.ProtocolVersion, t prot.PropertyType, handler PropertyHandler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if handler == nil {
+		panic("bridge: nil property handler")
+	}
+	if _, ok := mux.properties[ver]; !ok {
+		mux.properties[ver] = make(map[prot.PropertyType]PropertyHandler)
+	}
+	mux.properties[ver][t] = handler
+}
+
+// ResourceHandler returns the handler registered for resource type `t` at the
+// given protocol version or nil if there is none.
+func (mux *Mux) ResourceHandler(ver prot.ProtocolVersion, t prot.ModifyResourceType) ResourceHandler {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	return mux.resources[ver][t]
+}
+
+// PropertyHandler returns the handler registered for property type `t` at the
+// given protocol version or nil if there is none.
+func (mux *Mux) PropertyHandler(ver prot.ProtocolVersion, t prot.PropertyType) PropertyHandler {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	return mux.properties[ver][t]
+}
+
+// Capabilities returns the guest defined capabilities of the handlers
+// registered for the given protocol version.
+func (mux *Mux) Capabilities(ver prot.ProtocolVersion) prot.GcsGuestCapabilities {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	handles := func(id prot.MessageIdentifier) bool {
+		_, ok := mux.m[id][ver]
+		return ok
+	}
+
+	caps := prot.GcsGuestCapabilities{
+		NamespaceAddRequestSupported:  handles(prot.ComputeSystemModifySettingsV1) && mux.resources[ver][prot.MrtNetwork] != nil,
+		SignalProcessSupported:        handles(prot.ComputeSystemSignalProcessV1),
+		DumpStacksSupported:           handles(prot.ComputeSystemDumpStacksV1),
+		DeleteContainerStateSupported: handles(prot.ComputeSystemDeleteContainerStateV1),
+		CancelRequestSupported:        handles(prot.ComputeSystemCancelRequestV1),
+		PauseResumeSupported:          handles(prot.ComputeSystemPauseV1) && handles(prot.ComputeSystemResumeV1),
+		CheckpointRestoreSupported:    handles(prot.ComputeSystemCheckpointV1) && handles(prot.ComputeSystemRestoreV1),
+		GracefulShutdownSupported:     ver >= prot.PvV4 && handles(prot.ComputeSystemShutdownGracefulV1),
+		CollectOrphansSupported:       handles(prot.ComputeSystemCollectOrphansV1),
+	}
+	if handles(prot.ComputeSystemModifySettingsV1) {
+		for t := range mux.resources[ver] {
+			caps.SupportedResourceTypes = append(caps.SupportedResourceTypes, t)
+		}
+		sort.Slice(caps.SupportedResourceTypes, func(i, j int) bool {
+			return caps.SupportedResourceTypes[i] < caps.SupportedResourceTypes[j]
+		})
+	}
+	if handles(prot.ComputeSystemGetPropertiesV1) {
+		for t := range mux.properties[ver] {
+			caps.SupportedPropertyTypes = append(caps.SupportedPropertyTypes, t)
+		}
+		sort.Slice(caps.SupportedPropertyTypes, func(i, j int) bool {
+			return caps.SupportedPropertyTypes[i] < caps.SupportedPropertyTypes[j]
+		})
+	}
+	return caps
 }
 
 // Handler returns the handler to use for the given request type.
@@ -143,11 +258,17 @@ type Request struct {
 	// ActivityID is the id of the specific activity for this request.
 	ActivityID string
 	// Message is the portion of the request that follows the `Header`. This is
-	// a json encoded string that MUST contain `prot.MessageBase`.
+	// a message in `Encoding` that MUST contain `prot.MessageBase`.
 	Message []byte
 	// Version is the version of the protocol that `Header` and `Message` were
 	// sent in.
 	Version prot.ProtocolVersion
+	// Encoding is the encoding `Message` was sent in. Handlers decode
+	// `Message` with `prot.Unmarshal` or the `Unmarshal` middleware.
+	Encoding prot.MessageEncoding
+	// Body is the message unmarshaled by the `Unmarshal` middleware the
+	// handler was registered with, if any.
+	Body interface{}
 }
 
 // RequestResponse is the base response for any bridge message request.
@@ -160,6 +281,8 @@ type bridgeResponse struct {
 	ctx      context.Context
 	header   *prot.MessageHeader
 	response interface{}
+	// encoding is the message encoding that `response` is written in.
+	encoding prot.MessageEncoding
 }
 
 // Bridge defines the bridge client in the GCS. It acts in many ways analogous
@@ -180,6 +303,39 @@ type Bridge struct {
 	Handler Handler
 	// EnableV4 enables the v4+ bridge and the schema v2+ interfaces.
 	EnableV4 bool
+	// Recorder if not nil captures every request read from and response or
+	// notification written to the bridge.
+	Recorder *Recorder
+	// OmitErrorStacks removes the full stack trace from the `ErrorRecords` of
+	// failed responses. The file, line and function of each error are still
+	// returned.
+	OmitErrorStacks bool
+	// MaxMessageSize is the largest message including its header that will be
+	// accepted from the host. Larger messages are discarded and failed with
+	// `HrVmcomputeInvalidJSON`. If 0 `DefaultMaxMessageSize` is used.
+	MaxMessageSize uint32
+	// MaxWorkers is the number of requests that are handled concurrently. If 0
+	// `DefaultMaxWorkers` is used. Waits for processes and request cancels do
+	// not use a worker and are never limited.
+	MaxWorkers int
+	// MaxQueuedRequests is the number of requests that can wait for a worker
+	// before requests are failed with `HrErrBusy`. If 0
+	// `DefaultMaxQueuedRequests` is used.
+	MaxQueuedRequests int
+	// ConcurrencyLimits is the number of requests of each message type that
+	// can be queued or handled at the same time before requests of that type
+	// are failed with `HrErrBusy`. If nil `DefaultConcurrencyLimits` is used.
+	ConcurrencyLimits map[prot.MessageIdentifier]int
+	// UnorderedMessages are the message types that are handled as soon as
+	// they are received. All other requests for the same container, other
+	// than the UVM itself, are handled one at a time in the order they are
+	// received. If nil
+	// `DefaultUnorderedMessages` is used.
+	UnorderedMessages map[prot.MessageIdentifier]bool
+	// MetricsLogInterval is how often the queue, rejection and latency
+	// metrics are logged at debug level to size the limits above. If 0 they
+	// are never logged.
+	MetricsLogInterval time.Duration
 
 	// responseChan is the response channel used for both request/response
 	// and publish notification workflows.
@@ -187,12 +343,34 @@ type Bridge struct {
 
 	coreint   core.Core
 	hostState *hcsv2.Host
+	// mux is the multiplexer passed to `AssignHandlers`. The capabilities
+	// returned by protocol negotiation are built from its handlers.
+	mux *Mux
+
+	// metrics are the request metrics for every handler registered by
+	// `AssignHandlers`.
+	metrics *Metrics
 
 	quitChan chan bool
 	// hasQuitPending when != 0 will cause no more requests to be Read.
 	hasQuitPending uint32
-
+	// memoryNotifications when != 0 publishes the memory events of the
+	// containers. It is set by protocol negotiation if the host asks for them.
+	memoryNotifications uint32
+
+	// pendingMu protects pending.
+	pendingMu sync.Mutex
+	// pending is the cancel func for the context of each request that has
+	// been read but not yet responded to, keyed by its `SequenceID`.
+	pending map[prot.SequenceID]context.CancelFunc
+
+	// protMu protects protVer and encoding which are set by the handler of
+	// the first request and read for every message.
+	protMu  sync.Mutex
 	protVer prot.ProtocolVersion
+	// encoding is the message encoding selected by protocol negotiation. If
+	// empty `prot.EncodingJSON` is used.
+	encoding prot.MessageEncoding
 }
 
 // AssignHandlers creates and assigns the appropriate bridge
@@ -201,58 +379,136 @@ type Bridge struct {
 func (b *Bridge) AssignHandlers(mux *Mux, gcs core.Core, host *hcsv2.Host) {
 	b.coreint = gcs
 	b.hostState = host
+	b.mux = mux
+	b.metrics = NewMetrics()
+
+	// Panics are recovered inside of the logging and metrics so that they are
+	// recorded as failed requests.
+	mw := []Middleware{
+		LogRequests,
+		RecordLatency(b.metrics),
+		RecoverPanics,
+		ValidateJSON,
+	}
+	// v2 returns `mw` followed by the middleware the V2 handlers opt in to: a
+	// span named `name` and, unless it is nil, unmarshaling the request message
+	// into a new value of the type of `message`.
+	v2 := func(name string, message interface{}) []Middleware {
+		v2mw := append(append([]Middleware{}, mw...), Trace(name))
+		if message != nil {
+			v2mw = append(v2mw, Unmarshal(message))
+		}
+		return v2mw
+	}
 
 	// These are PvInvalid because they will be called previous to any protocol
 	// negotiation so they respond only when the protocols are not known.
 	if b.EnableV4 {
-		mux.HandleFunc(prot.ComputeSystemNegotiateProtocolV1, prot.PvInvalid, b.negotiateProtocolV2)
+		mux.HandleFunc(prot.ComputeSystemNegotiateProtocolV1, prot.PvInvalid, b.negotiateProtocolV2, v2("negotiateProtocolV2", prot.NegotiateProtocol{})...)
 	} else {
-		mux.HandleFunc(prot.ComputeSystemCreateV1, prot.PvInvalid, b.createContainer)
+		mux.HandleFunc(prot.ComputeSystemCreateV1, prot.PvInvalid, b.createContainer, mw...)
 	}
 
 	// v3 specific handlers
-	mux.HandleFunc(prot.ComputeSystemExecuteProcessV1, prot.PvV3, b.execProcess)
-	mux.HandleFunc(prot.ComputeSystemShutdownForcedV1, prot.PvV3, b.killContainer)
-	mux.HandleFunc(prot.ComputeSystemShutdownGracefulV1, prot.PvV3, b.shutdownContainer)
-	mux.HandleFunc(prot.ComputeSystemSignalProcessV1, prot.PvV3, b.signalProcess)
-	mux.HandleFunc(prot.ComputeSystemGetPropertiesV1, prot.PvV3, b.getProperties)
-	mux.HandleFunc(prot.ComputeSystemWaitForProcessV1, prot.PvV3, b.waitOnProcess)
-	mux.HandleFunc(prot.ComputeSystemResizeConsoleV1, prot.PvV3, b.resizeConsole)
-	mux.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV3, b.modifySettings)
+	mux.HandleFunc(prot.ComputeSystemExecuteProcessV1, prot.PvV3, b.execProcess, mw...)
+	mux.HandleFunc(prot.ComputeSystemShutdownForcedV1, prot.PvV3, b.killContainer, mw...)
+	mux.HandleFunc(prot.ComputeSystemShutdownGracefulV1, prot.PvV3, b.shutdownContainer, mw...)
+	mux.HandleFunc(prot.ComputeSystemSignalProcessV1, prot.PvV3, b.signalProcess, mw...)
+	mux.HandleFunc(prot.ComputeSystemGetPropertiesV1, prot.PvV3, b.getProperties, mw...)
+	mux.HandleFunc(prot.ComputeSystemWaitForProcessV1, prot.PvV3, b.waitOnProcess, mw...)
+	mux.HandleFunc(prot.ComputeSystemResizeConsoleV1, prot.PvV3, b.resizeConsole, mw...)
+	mux.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV3, b.modifySettings, mw...)
 
 	if b.EnableV4 {
-		// v4 specific handlers
-		mux.HandleFunc(prot.ComputeSystemStartV1, prot.PvV4, b.startContainerV2)
-		mux.HandleFunc(prot.ComputeSystemCreateV1, prot.PvV4, b.createContainerV2)
-		mux.HandleFunc(prot.ComputeSystemExecuteProcessV1, prot.PvV4, b.execProcessV2)
-		mux.HandleFunc(prot.ComputeSystemShutdownForcedV1, prot.PvV4, b.killContainerV2)
-		mux.HandleFunc(prot.ComputeSystemShutdownGracefulV1, prot.PvV4, b.shutdownContainerV2)
-		mux.HandleFunc(prot.ComputeSystemSignalProcessV1, prot.PvV4, b.signalProcessV2)
-		mux.HandleFunc(prot.ComputeSystemGetPropertiesV1, prot.PvV4, b.getPropertiesV2)
-		mux.HandleFunc(prot.ComputeSystemWaitForProcessV1, prot.PvV4, b.waitOnProcessV2)
-		mux.HandleFunc(prot.ComputeSystemResizeConsoleV1, prot.PvV4, b.resizeConsoleV2)
-		mux.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV4, b.modifySettingsV2)
-		mux.HandleFunc(prot.ComputeSystemDumpStacksV1, prot.PvV4, b.dumpStacksV2)
-		mux.HandleFunc(prot.ComputeSystemDeleteContainerStateV1, prot.PvV4, b.deleteContainerStateV2)
+		// v4 specific handlers. v5 only changes the message encoding so every
+		// handler is shared with v4.
+		for _, pv := range []prot.ProtocolVersion{prot.PvV4, prot.PvV5} {
+			mux.HandleFunc(prot.ComputeSystemStartV1, pv, b.startContainerV2, v2("startContainerV2", prot.MessageBase{})...)
+			mux.HandleFunc(prot.ComputeSystemCreateV1, pv, b.createContainerV2, v2("createContainerV2", prot.ContainerCreate{})...)
+			mux.HandleFunc(prot.ComputeSystemExecuteProcessV1, pv, b.execProcessV2, v2("execProcessV2", prot.ContainerExecuteProcess{})...)
+			mux.HandleFunc(prot.ComputeSystemShutdownForcedV1, pv, b.killContainerV2, v2("killContainerV2", prot.MessageBase{})...)
+			mux.HandleFunc(prot.ComputeSystemShutdownGracefulV1, pv, b.shutdownContainerV2, v2("shutdownContainerV2", prot.ContainerShutdown{})...)
+			mux.HandleFunc(prot.ComputeSystemSignalProcessV1, pv, b.signalProcessV2, v2("signalProcessV2", prot.ContainerSignalProcess{})...)
+			mux.HandleFunc(prot.ComputeSystemGetPropertiesV1, pv, b.getPropertiesV2, v2("getPropertiesV2", prot.ContainerGetProperties{})...)
+			mux.HandleFunc(prot.ComputeSystemWaitForProcessV1, pv, b.waitOnProcessV2, v2("waitOnProcessV2", prot.ContainerWaitForProcess{})...)
+			mux.HandleFunc(prot.ComputeSystemResizeConsoleV1, pv, b.resizeConsoleV2, v2("resizeConsoleV2", prot.ContainerResizeConsole{})...)
+			mux.HandleFunc(prot.ComputeSystemModifySettingsV1, pv, b.modifySettingsV2, v2("modifySettingsV2", nil)...)
+			mux.HandleFunc(prot.ComputeSystemDumpStacksV1, pv, b.dumpStacksV2, v2("dumpStacksV2", nil)...)
+			mux.HandleFunc(prot.ComputeSystemDeleteContainerStateV1, pv, b.deleteContainerStateV2, v2("deleteContainerStateV2", prot.MessageBase{})...)
+			mux.HandleFunc(prot.ComputeSystemCancelRequestV1, pv, b.cancelRequestV2, v2("cancelRequestV2", prot.ContainerCancelRequest{})...)
+			mux.HandleFunc(prot.ComputeSystemPauseV1, pv, b.pauseContainerV2, v2("pauseContainerV2", prot.MessageBase{})...)
+			mux.HandleFunc(prot.ComputeSystemResumeV1, pv, b.resumeContainerV2, v2("resumeContainerV2", prot.MessageBase{})...)
+			mux.HandleFunc(prot.ComputeSystemCheckpointV1, pv, b.checkpointContainerV2, v2("checkpointContainerV2", prot.ContainerCheckpoint{})...)
+			mux.HandleFunc(prot.ComputeSystemCollectOrphansV1, pv, b.collectOrphansV2, v2("collectOrphansV2", prot.CollectOrphans{})...)
+			mux.HandleFunc(prot.ComputeSystemRestoreV1, pv, b.restoreContainerV2, v2("restoreContainerV2", prot.ContainerRestore{})...)
+
+			for _, t := range hcsv2.HostResourceTypes() {
+				mux.HandleResource(pv, t, b.modifyHostSettingsV2)
+			}
+			mux.HandleResource(pv, prot.MrtContainerResources, b.updateContainerResourcesV2)
+			mux.HandleProperty(pv, prot.PtProcessList, getProcessListV2)
+			mux.HandleProperty(pv, prot.PtStatistics, getStatisticsV2)
+			mux.HandleProperty(pv, prot.PtPodStatistics, getPodStatisticsV2)
+			mux.HandleProperty(pv, prot.PtContainerState, getContainerStateV2)
+		}
 	}
 }
 
+// Metrics returns the request metrics for the handlers registered by
+// `AssignHandlers`.
+func (b *Bridge) Metrics() *Metrics {
+	return b.metrics
+}
+
 // ListenAndServe connects to the bridge transport, listens for
 // messages and dispatches the appropriate handlers to handle each
 // event in an asynchronous manner.
 func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser) error {
 	requestChan := make(chan *Request)
-	requestErrChan := make(chan error)
+	// The error channels are buffered so that the loop that did not fail can
+	// still exit once the other has returned the error.
+	requestErrChan := make(chan error, 1)
 	b.responseChan = make(chan bridgeResponse)
-	responseErrChan := make(chan error)
+	responseErrChan := make(chan error, 1)
 	b.quitChan = make(chan bool)
+	b.pendingMu.Lock()
+	b.pending = make(map[prot.SequenceID]context.CancelFunc)
+	b.pendingMu.Unlock()
+	if b.metrics == nil {
+		b.metrics = NewMetrics()
+	}
+
+	maxMessageSize := b.MaxMessageSize
+	if maxMessageSize == 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	workers := b.MaxWorkers
+	if workers == 0 {
+		workers = DefaultMaxWorkers
+	}
+	queued := b.MaxQueuedRequests
+	if queued == 0 {
+		queued = DefaultMaxQueuedRequests
+	}
+	limits := b.ConcurrencyLimits
+	if limits == nil {
+		limits = DefaultConcurrencyLimits
+	}
+	unordered := b.UnorderedMessages
+	if unordered == nil {
+		unordered = DefaultUnorderedMessages
+	}
+	pool := newWorkerPool(workers, queued, limits, unordered, b.metrics, b.serveRequest)
+	if b.MetricsLogInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go b.metrics.logPeriodically(b.MetricsLogInterval, done)
+	}
 
 	defer close(b.quitChan)
 	defer bridgeOut.Close()
-	defer close(responseErrChan)
 	defer close(b.responseChan)
 	defer close(requestChan)
-	defer close(requestErrChan)
 	defer bridgeIn.Close()
 
 	// Receive bridge requests and schedule them to be processed.
@@ -268,6 +524,31 @@ func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser
 					recverr = errors.Wrap(err, "bridge: failed reading message header")
 					break
 				}
+				if header.Size < prot.MessageHeaderSize {
+					// There is no way to find the start of the next message.
+					recverr = errors.Errorf("bridge: invalid message size %d", header.Size)
+					break
+				}
+				if header.Size > maxMessageSize {
+					// Skip the payload without buffering it so that the
+					// connection remains usable.
+					if _, err := io.CopyN(ioutil.Discard, bridgeIn, int64(header.Size-prot.MessageHeaderSize)); err != nil {
+						recverr = errors.Wrap(err, "bridge: failed discarding message payload")
+						break
+					}
+					b.metrics.rejected()
+					version, encoding := b.protocol()
+					r := &Request{
+						Context:  context.Background(),
+						Header:   header,
+						Version:  version,
+						Encoding: encoding,
+					}
+					b.respond(r, nil, gcserr.WrapHresult(
+						errors.Errorf("bridge: message size %d exceeds the maximum of %d", header.Size, maxMessageSize),
+						gcserr.HrVmcomputeInvalidJSON))
+					continue
+				}
 				message := make([]byte, header.Size-prot.MessageHeaderSize)
 				if _, err := io.ReadFull(bridgeIn, message); err != nil {
 					if err == io.ErrUnexpectedEOF || err == os.ErrClosed {
@@ -276,14 +557,16 @@ func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser
 					recverr = errors.Wrap(err, "bridge: failed reading message payload")
 					break
 				}
+				if b.Recorder != nil {
+					b.Recorder.record(CaptureRequest, header, message)
+				}
+				version, encoding := b.protocol()
 
+				// Invalid messages are still forwarded to the handler.
+				// Handlers registered with the `ValidateJSON` middleware fail
+				// the request before it is dispatched.
 				base := prot.MessageBase{}
-				if err := json.Unmarshal(message, &base); err != nil {
-					// TODO: JTERRY75 - This should fail the request but right
-					// now we still forward to the method and let them return
-					// this error. Unify the JSON part previous to invoking a
-					// request.
-				}
+				_ = prot.Unmarshal(encoding, message, &base)
 
 				var ctx context.Context
 				var span *trace.Span
@@ -317,7 +600,14 @@ func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser
 					trace.StringAttribute("activityID", base.ActivityID),
 					trace.StringAttribute("cid", base.ContainerID))
 
-				log.G(ctx).WithField("message", string(message)).Debug("request read message")
+				log.G(ctx).WithField("message", messageString(encoding, message)).Debug("request read message")
+
+				// Register the cancel func before dispatch so that a cancel
+				// request that immediately follows this one always finds it.
+				ctx, cancel := context.WithCancel(ctx)
+				b.pendingMu.Lock()
+				b.pending[header.ID] = cancel
+				b.pendingMu.Unlock()
 
 				requestChan <- &Request{
 					Context:     ctx,
@@ -325,50 +615,47 @@ func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser
 					ContainerID: base.ContainerID,
 					ActivityID:  base.ActivityID,
 					Message:     message,
-					Version:     b.protVer,
+					Version:     version,
+					Encoding:    encoding,
 				}
 			}
 		}
 		requestErrChan <- recverr
 	}()
-	// Process each bridge request async and create the response writer.
+	// Queue each bridge request to be processed async by the worker pool.
+	// Requests that cannot be queued are failed immediately.
 	go func() {
 		for req := range requestChan {
-			go func(r *Request) {
-				br := bridgeResponse{
-					ctx: r.Context,
-					header: &prot.MessageHeader{
-						Type: prot.GetResponseIdentifier(r.Header.Type),
-						ID:   r.Header.ID,
-					},
-				}
-				resp, err := b.Handler.ServeMsg(r)
-				if resp == nil {
-					resp = &prot.MessageResponseBase{}
-				}
-				resp.Base().ActivityID = r.ActivityID
-				if err != nil {
-					span := trace.FromContext(r.Context)
-					if span != nil {
-						oc.SetSpanStatus(span, err)
-					}
-					setErrorForResponseBase(resp.Base(), err)
-				}
-				br.response = resp
-				b.responseChan <- br
-			}(req)
+			if err := pool.submit(req); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"message-id":    req.Header.ID,
+					"message-type":  req.Header.Type.String(),
+					"queue-depth":   b.metrics.Queue().Depth,
+					logrus.ErrorKey: err,
+				}).Warn("opengcs::bridge - rejected request")
+				b.respond(req, nil, err)
+			}
 		}
+		pool.close()
 	}()
 	// Process each bridge response sync. This channel is for request/response and publish workflows.
 	go func() {
 		var resperr error
 		for resp := range b.responseChan {
-			responseBytes, err := json.Marshal(resp.response)
+			responseBytes, err := prot.Marshal(resp.encoding, resp.response)
 			if err != nil {
-				resperr = errors.Wrapf(err, "bridge: failed to marshal JSON for response \"%v\"", resp.response)
+				resperr = errors.Wrapf(err, "bridge: failed to marshal response \"%v\"", resp.response)
 				break
 			}
+			log.G(resp.ctx).WithField("message", messageString(resp.encoding, responseBytes)).Debug("request write response")
 			resp.header.Size = uint32(len(responseBytes) + prot.MessageHeaderSize)
+			if b.Recorder != nil {
+				dir := CaptureResponse
+				if resp.header.Type == prot.ComputeSystemNotificationV1 {
+					dir = CaptureNotification
+				}
+				b.Recorder.record(dir, resp.header, responseBytes)
+			}
 			if err := binary.Write(bridgeOut, binary.LittleEndian, resp.header); err != nil {
 				resperr = errors.Wrap(err, "bridge: failed writing message header")
 				break
@@ -381,13 +668,26 @@ func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser
 
 			s := trace.FromContext(resp.ctx)
 			if s != nil {
-				log.G(resp.ctx).WithField("message", string(responseBytes)).Debug("request write response")
 				s.End()
 			}
 		}
 		responseErrChan <- resperr
 	}()
 
+	// Containers recovered by `hcsv2.Host.Recover` exist before the bridge
+	// serves. Publish their exit like that of containers created by
+	// `createContainerV2`.
+	if b.hostState != nil {
+		for _, c := range b.hostState.ListContainers() {
+			b.publishExitNotification(prot.MessageBase{ContainerID: c.ID()}, c)
+		}
+		if events := b.hostState.MemoryEvents(); events != nil {
+			done := make(chan struct{})
+			defer close(done)
+			go b.publishMemoryEvents(events, done)
+		}
+	}
+
 	select {
 	case err := <-requestErrChan:
 		return err
@@ -415,6 +715,111 @@ func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser
 	}
 }
 
+// serveRequest dispatches `r` to `b.Handler` and writes its response.
+func (b *Bridge) serveRequest(r *Request) {
+	// The request may have been cancelled while it was queued behind another
+	// request for the same container.
+	if err := r.Context.Err(); err != nil {
+		b.respond(r, nil, gcserr.WrapHresult(errors.Wrap(err, "bridge: request cancelled before dispatch"), gcserr.HrErrCancelled))
+		return
+	}
+	resp, err := b.Handler.ServeMsg(r)
+	if err != nil && r.Context.Err() == context.Canceled {
+		err = gcserr.WrapHresult(err, gcserr.HrErrCancelled)
+	}
+	b.respond(r, resp, err)
+}
+
+// respond writes `resp` or, if `err` is not nil, the failure `err` as the
+// response to `r`.
+func (b *Bridge) respond(r *Request, resp RequestResponse, err error) {
+	b.completeRequest(r.Header.ID)
+	if resp == nil {
+		resp = &prot.MessageResponseBase{}
+	}
+	resp.Base().ActivityID = r.ActivityID
+	if err != nil {
+		span := trace.FromContext(r.Context)
+		if span != nil {
+			oc.SetSpanStatus(span, err)
+		}
+		setErrorForResponseBase(resp.Base(), err, b.OmitErrorStacks)
+	}
+	b.responseChan <- bridgeResponse{
+		ctx: r.Context,
+		header: &prot.MessageHeader{
+			Type: prot.GetResponseIdentifier(r.Header.Type),
+			ID:   r.Header.ID,
+		},
+		response: resp,
+		encoding: r.Encoding,
+	}
+}
+
+// completeRequest removes the request `id` from the pending requests and
+// releases its context.
+func (b *Bridge) completeRequest(id prot.SequenceID) {
+	b.pendingMu.Lock()
+	cancel, ok := b.pending[id]
+	delete(b.pending, id)
+	b.pendingMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// cancelRequest cancels the context of the pending request `id`. It returns
+// false if `id` is not pending.
+func (b *Bridge) cancelRequest(id prot.SequenceID) bool {
+	b.pendingMu.Lock()
+	cancel, ok := b.pending[id]
+	b.pendingMu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// protocol returns the protocol version and message encoding selected for
+// the connection.
+func (b *Bridge) protocol() (prot.ProtocolVersion, prot.MessageEncoding) {
+	b.protMu.Lock()
+	defer b.protMu.Unlock()
+
+	if b.encoding == "" {
+		return b.protVer, prot.EncodingJSON
+	}
+	return b.protVer, b.encoding
+}
+
+// setProtocol sets the protocol version and message encoding used for all
+// messages read after the current request.
+func (b *Bridge) setProtocol(ver prot.ProtocolVersion, enc prot.MessageEncoding) {
+	b.protMu.Lock()
+	defer b.protMu.Unlock()
+
+	b.protVer = ver
+	b.encoding = enc
+}
+
+// messageString returns the message `message` in encoding `enc` for logging.
+// CBOR messages are returned as hex.
+func messageString(enc prot.MessageEncoding, message []byte) string {
+	if enc == prot.EncodingCBOR {
+		return hex.EncodeToString(message)
+	}
+	return string(message)
+}
+
+// wrapUnmarshalError wraps the error `err` returned unmarshaling the message of
+// `r`.
+func wrapUnmarshalError(err error, r *Request) error {
+	if r.Encoding == prot.EncodingCBOR {
+		return errors.Wrapf(err, "failed to unmarshal CBOR in message \"%x\"", r.Message)
+	}
+	return errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+}
+
 // PublishNotification writes a specific notification to the bridge.
 func (b *Bridge) PublishNotification(n *prot.ContainerNotification) {
 	ctx, span := trace.StartSpan(context.Background(), "opengcs::bridge::PublishNotification")
@@ -422,6 +827,7 @@ func (b *Bridge) PublishNotification(n *prot.ContainerNotification) {
 	// DONT defer span.End() here. Publish is odd because bridgeResponse calls
 	// `End` on the `ctx` after the response is sent.
 
+	_, encoding := b.protocol()
 	resp := bridgeResponse{
 		ctx: ctx,
 		header: &prot.MessageHeader{
@@ -429,6 +835,7 @@ func (b *Bridge) PublishNotification(n *prot.ContainerNotification) {
 			ID:   0,
 		},
 		response: n,
+		encoding: encoding,
 	}
 	b.responseChan <- resp
 }
@@ -447,7 +854,7 @@ func (b *Bridge) createContainer(r *Request) (RequestResponse, error) {
 	// The request contains a JSON string field which is equivalent to a
 	// CreateContainerInfo struct.
 	var settings prot.VMHostedContainerSettings
-	if err := commonutils.UnmarshalJSONWithHresult([]byte(request.ContainerConfig), &settings); err != nil {
+	if err := request.ContainerConfig.Decode(&settings); err != nil {
 		return nil, errors.Wrapf(err, "failed to unmarshal JSON for ContainerConfig \"%s\"", request.ContainerConfig)
 	}
 	if err := b.coreint.CreateContainer(request.ContainerID, settings); err != nil {
@@ -479,7 +886,7 @@ func (b *Bridge) createContainer(r *Request) (RequestResponse, error) {
 	}()
 
 	// Set our protocol selected version before return.
-	b.protVer = prot.PvV3
+	b.setProtocol(prot.PvV3, prot.EncodingJSON)
 	return response, nil
 }
 
@@ -497,7 +904,7 @@ func (b *Bridge) execProcess(r *Request) (RequestResponse, error) {
 	// The request contains a JSON string field which is equivalent to an
 	// ExecuteProcessInfo struct.
 	var params prot.ProcessParameters
-	if err := commonutils.UnmarshalJSONWithHresult([]byte(request.Settings.ProcessParameters), &params); err != nil {
+	if err := request.Settings.ProcessParameters.Decode(&params); err != nil {
 		return nil, errors.Wrapf(err, "failed to unmarshal JSON for ProcessParameters \"%s\"", request.Settings.ProcessParameters)
 	}
 
@@ -600,22 +1007,17 @@ func (b *Bridge) getProperties(r *Request) (RequestResponse, error) {
 		"cid":        request.ContainerID,
 	}).Info("opengcs::bridge::getProperties")
 
-	properties, err := b.coreint.GetProperties(request.ContainerID, request.Query)
+	properties, err := b.coreint.GetProperties(request.ContainerID, request.Query.String())
 	if err != nil {
 		return nil, err
 	}
 
-	propertyJSON := []byte("{}")
+	var v interface{} = map[string]interface{}{}
 	if properties != nil {
-		var err error
-		propertyJSON, err = json.Marshal(properties)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to marshal properties into JSON: %v", properties)
-		}
+		v = properties
 	}
-
 	return &prot.ContainerGetPropertiesResponse{
-		Properties: string(propertyJSON),
+		Properties: prot.NewNestedJSON(r.Version, v),
 	}, nil
 }
 
@@ -694,44 +1096,42 @@ func (b *Bridge) modifySettings(r *Request) (RequestResponse, error) {
 }
 
 // setErrorForResponseBase modifies the passed-in MessageResponseBase to
-// contain information pertaining to the given error.
-func setErrorForResponseBase(response *prot.MessageResponseBase, errForResponse error) {
-	errorMessage := errForResponse.Error()
-	stackString := ""
-	fileName := ""
-	lineNumber := -1
-	functionName := ""
-	if stack := gcserr.BaseStackTrace(errForResponse); stack != nil {
-		bottomFrame := stack[0]
-		stackString = fmt.Sprintf("%+v", stack)
-		fileName = fmt.Sprintf("%s", bottomFrame)
-		lineNumberStr := fmt.Sprintf("%d", bottomFrame)
-		var err error
-		lineNumber, err = strconv.Atoi(lineNumberStr)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"line-number":   lineNumberStr,
-				logrus.ErrorKey: err,
-			}).Error("opengcs::bridge::setErrorForResponseBase - failed to parse line number, using -1 instead")
-			lineNumber = -1
-		}
-		functionName = fmt.Sprintf("%n", bottomFrame)
-	}
+// contain information pertaining to the given error. One `ErrorRecord` is
+// added for each layer of the cause stack of `errForResponse`, outermost
+// first. If `omitStacks` is set the full stack trace of each layer is not
+// included but the file, line and function that created it still are.
+func setErrorForResponseBase(response *prot.MessageResponseBase, errForResponse error, omitStacks bool) {
 	hresult, err := gcserr.GetHresult(errForResponse)
 	if err != nil {
 		// Default to using the generic failure HRESULT.
 		hresult = gcserr.HrFail
 	}
 	response.Result = int32(hresult)
-	response.ErrorMessage = errorMessage
-	newRecord := prot.ErrorRecord{
-		Result:       int32(hresult),
-		Message:      errorMessage,
-		StackTrace:   stackString,
-		ModuleName:   "gcs",
-		FileName:     fileName,
-		Line:         uint32(lineNumber),
-		FunctionName: functionName,
-	}
-	response.ErrorRecords = append(response.ErrorRecords, newRecord)
+	response.ErrorMessage = errForResponse.Error()
+
+	for _, layer := range gcserr.Layers(errForResponse) {
+		record := prot.ErrorRecord{
+			Result:     int32(layer.Hresult),
+			Message:    layer.Message,
+			ModuleName: "gcs",
+		}
+		if len(layer.Stack) > 0 {
+			frame := layer.Stack[0]
+			if !omitStacks {
+				record.StackTrace = fmt.Sprintf("%+v", layer.Stack)
+			}
+			record.FileName = fmt.Sprintf("%s", frame)
+			record.FunctionName = fmt.Sprintf("%n", frame)
+			lineNumberStr := fmt.Sprintf("%d", frame)
+			if line, err := strconv.ParseUint(lineNumberStr, 10, 32); err == nil {
+				record.Line = uint32(line)
+			} else {
+				logrus.WithFields(logrus.Fields{
+					"line-number":   lineNumberStr,
+					logrus.ErrorKey: err,
+				}).Error("opengcs::bridge::setErrorForResponseBase - failed to parse line number, using 0 instead")
+			}
+		}
+		response.ErrorRecords = append(response.ErrorRecords, record)
+	}
 }
@@ -5,15 +5,23 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Microsoft/opengcs/internal/memevents"
 	"github.com/Microsoft/opengcs/internal/runtime/hcsv2"
 	"github.com/Microsoft/opengcs/service/gcs/core/mockcore"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	"github.com/Microsoft/opengcs/service/gcs/transport"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
@@ -92,11 +100,17 @@ func newMessageUVMBase() prot.MessageBase {
 	return b
 }
 
+// serveUnmarshaled serves `req` with `h` registered with the `Unmarshal`
+// middleware for `message`.
+func serveUnmarshaled(h HandlerFunc, message interface{}, req *Request) (RequestResponse, error) {
+	return Unmarshal(message)(h).ServeMsg(req)
+}
+
 func Test_NegotiateProtocol_DuplicateCall_Failure(t *testing.T) {
 	req := createRequest(t, prot.ComputeSystemNegotiateProtocolV1, prot.PvInvalid, nil)
 
 	tb := new(Bridge)
-	resp, err := tb.negotiateProtocolV2(req)
+	resp, err := serveUnmarshaled(tb.negotiateProtocolV2, prot.NegotiateProtocol{}, req)
 
 	verifyResponseJSONError(t, resp, err)
 }
@@ -105,7 +119,7 @@ func Test_NegotiateProtocol_InvalidJson_Failure(t *testing.T) {
 	req := createRequest(t, prot.ComputeSystemNegotiateProtocolV1, prot.PvInvalid, nil)
 
 	tb := new(Bridge)
-	resp, err := tb.negotiateProtocolV2(req)
+	resp, err := serveUnmarshaled(tb.negotiateProtocolV2, prot.NegotiateProtocol{}, req)
 
 	verifyResponseJSONError(t, resp, err)
 }
@@ -120,7 +134,7 @@ func Test_NegotiateProtocol_InvalidRange_Low_Failure(t *testing.T) {
 	req := createRequest(t, prot.ComputeSystemNegotiateProtocolV1, prot.PvInvalid, r)
 
 	tb := new(Bridge)
-	resp, err := tb.negotiateProtocolV2(req)
+	resp, err := serveUnmarshaled(tb.negotiateProtocolV2, prot.NegotiateProtocol{}, req)
 
 	verifyResponseError(t, resp, err)
 }
@@ -135,7 +149,7 @@ func Test_NegotiateProtocol_InvalidRange_High_Failure(t *testing.T) {
 	req := createRequest(t, prot.ComputeSystemNegotiateProtocolV1, prot.PvInvalid, r)
 
 	tb := new(Bridge)
-	resp, err := tb.negotiateProtocolV2(req)
+	resp, err := serveUnmarshaled(tb.negotiateProtocolV2, prot.NegotiateProtocol{}, req)
 
 	verifyResponseError(t, resp, err)
 }
@@ -150,7 +164,7 @@ func Test_NegotiateProtocol_ValidRange_Success(t *testing.T) {
 	req := createRequest(t, prot.ComputeSystemNegotiateProtocolV1, prot.PvInvalid, r)
 
 	tb := new(Bridge)
-	resp, err := tb.negotiateProtocolV2(req)
+	resp, err := serveUnmarshaled(tb.negotiateProtocolV2, prot.NegotiateProtocol{}, req)
 
 	verifyResponseSuccess(t, resp, err)
 
@@ -164,6 +178,78 @@ func Test_NegotiateProtocol_ValidRange_Success(t *testing.T) {
 	}
 }
 
+func Test_NegotiateProtocol_MemoryNotifications(t *testing.T) {
+	w, err := memevents.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	h := hcsv2.NewHost(nil, nil)
+	h.SetMemoryWatcher(w)
+
+	for _, optIn := range []bool{false, true} {
+		r := &prot.NegotiateProtocol{
+			MessageBase:         newMessageBase(),
+			MinimumVersion:      4,
+			MaximumVersion:      uint32(prot.PvMax),
+			MemoryNotifications: optIn,
+		}
+		req := createRequest(t, prot.ComputeSystemNegotiateProtocolV1, prot.PvInvalid, r)
+		tb := &Bridge{hostState: h}
+		resp, err := serveUnmarshaled(tb.negotiateProtocolV2, prot.NegotiateProtocol{}, req)
+
+		verifyResponseSuccess(t, resp, err)
+		if !resp.(*prot.NegotiateProtocolResponse).Capabilities.GuestDefinedCapabilities.MemoryNotificationsSupported {
+			t.Fatal("expected MemoryNotificationsSupported capability")
+		}
+		if enabled := tb.memoryNotifications != 0; enabled != optIn {
+			t.Fatalf("expected memory notifications enabled %v got: %v", optIn, enabled)
+		}
+	}
+
+	// Without a watcher there are no memory events to send.
+	r := &prot.NegotiateProtocol{
+		MessageBase:         newMessageBase(),
+		MinimumVersion:      4,
+		MaximumVersion:      uint32(prot.PvMax),
+		MemoryNotifications: true,
+	}
+	req := createRequest(t, prot.ComputeSystemNegotiateProtocolV1, prot.PvInvalid, r)
+	tb := &Bridge{hostState: hcsv2.NewHost(nil, nil)}
+	resp, err := serveUnmarshaled(tb.negotiateProtocolV2, prot.NegotiateProtocol{}, req)
+
+	verifyResponseSuccess(t, resp, err)
+	if resp.(*prot.NegotiateProtocolResponse).Capabilities.GuestDefinedCapabilities.MemoryNotificationsSupported || tb.memoryNotifications != 0 {
+		t.Fatal("expected memory notifications to be unsupported")
+	}
+}
+
+func Test_PublishMemoryEvents_OptIn(t *testing.T) {
+	tb := &Bridge{responseChan: make(chan bridgeResponse, 1)}
+	publish := func(e memevents.Event) {
+		events := make(chan memevents.Event, 1)
+		events <- e
+		close(events)
+		tb.publishMemoryEvents(events, nil)
+	}
+
+	// The event is dropped until the host opts in.
+	publish(memevents.Event{ID: "abcdef", Group: "/containers/abcdef", Kind: memevents.OOM})
+	select {
+	case resp := <-tb.responseChan:
+		t.Fatalf("expected no notification got: %+v", resp.response)
+	default:
+	}
+
+	atomic.StoreUint32(&tb.memoryNotifications, 1)
+	publish(memevents.Event{ID: "abcdef", Group: "/containers/abcdef", Kind: memevents.CriticalPressure})
+	resp := <-tb.responseChan
+	n := resp.response.(*prot.ContainerNotification)
+	if n.ContainerID != "abcdef" || n.Type != prot.NtMemoryPressure || n.ResultInfo != "/containers/abcdef" {
+		t.Fatalf("expected a memory pressure notification for abcdef got: %+v", n)
+	}
+}
+
 func Test_CreateContainer_InvalidJson_Failure(t *testing.T) {
 	req := createRequest(t, prot.ComputeSystemCreateV1, prot.PvInvalid, nil)
 
@@ -189,7 +275,7 @@ func Test_CreateContainer_InvalidHostedJson_Failure(t *testing.T) {
 func Test_CreateContainer_CoreCreateContainerFails_Failure(t *testing.T) {
 	r := &prot.ContainerCreate{
 		MessageBase:     newMessageBase(),
-		ContainerConfig: "{}", // Just unmarshal to defaults
+		ContainerConfig: prot.NewNestedJSON(prot.PvV3, struct{}{}), // Just unmarshal to defaults
 	}
 
 	req := createRequest(t, prot.ComputeSystemCreateV1, prot.PvInvalid, r)
@@ -231,10 +317,9 @@ func createContainerConfig() (*prot.ContainerCreate, prot.VMHostedContainerSetti
 		},
 	}
 
-	hsb, _ := json.Marshal(hs)
 	r := &prot.ContainerCreate{
 		MessageBase:     newMessageBase(),
-		ContainerConfig: string(hsb),
+		ContainerConfig: prot.NewNestedJSON(prot.PvV3, hs),
 	}
 
 	return r, hs
@@ -327,7 +412,7 @@ func Test_StartContainer_InvalidJson_Failure(t *testing.T) {
 	req := createRequest(t, prot.ComputeSystemStartV1, prot.PvV4, nil)
 
 	b := new(Bridge)
-	resp, err := b.startContainerV2(req)
+	resp, err := serveUnmarshaled(b.startContainerV2, prot.MessageBase{}, req)
 
 	verifyResponseJSONError(t, resp, err)
 }
@@ -340,7 +425,7 @@ func Test_StartContainer_Success(t *testing.T) {
 	b.responseChan = make(chan bridgeResponse)
 	defer close(b.responseChan)
 
-	resp, err := b.startContainerV2(req)
+	resp, err := serveUnmarshaled(b.startContainerV2, prot.MessageBase{}, req)
 	verifyResponseSuccess(t, resp, err)
 }
 
@@ -357,7 +442,7 @@ func Test_ExecProcess_InvalidProcessParameters_Failure(t *testing.T) {
 	r := &prot.ContainerExecuteProcess{
 		MessageBase: newMessageBase(),
 		Settings: prot.ExecuteProcessSettings{
-			ProcessParameters: "",
+			ProcessParameters: prot.NestedJSON{},
 		},
 	}
 
@@ -373,11 +458,10 @@ func Test_ExecProcess_External_CoreFails_Failure(t *testing.T) {
 	pp := prot.ProcessParameters{
 		IsExternal: true,
 	}
-	ppbytes, _ := json.Marshal(pp)
 	r := &prot.ContainerExecuteProcess{
 		MessageBase: newMessageBase(),
 		Settings: prot.ExecuteProcessSettings{
-			ProcessParameters: string(ppbytes),
+			ProcessParameters: prot.NewNestedJSON(prot.PvV3, pp),
 		},
 	}
 
@@ -397,11 +481,10 @@ func Test_ExecProcess_External_CoreSucceeds_Success(t *testing.T) {
 	pp := prot.ProcessParameters{
 		IsExternal: true,
 	}
-	ppbytes, _ := json.Marshal(pp)
 	r := &prot.ContainerExecuteProcess{
 		MessageBase: newMessageBase(),
 		Settings: prot.ExecuteProcessSettings{
-			ProcessParameters: string(ppbytes),
+			ProcessParameters: prot.NewNestedJSON(prot.PvV3, pp),
 		},
 	}
 
@@ -422,7 +505,7 @@ func Test_ExecProcess_Container_CoreFails_Failure(t *testing.T) {
 	r := &prot.ContainerExecuteProcess{
 		MessageBase: newMessageBase(),
 		Settings: prot.ExecuteProcessSettings{
-			ProcessParameters: "{}", // Default
+			ProcessParameters: prot.NewNestedJSON(prot.PvV3, struct{}{}), // Default
 		},
 	}
 
@@ -444,11 +527,10 @@ func Test_ExecProcess_Container_CoreSucceeds_Success(t *testing.T) {
 	pp := prot.ProcessParameters{
 		CommandLine: "test",
 	}
-	ppbytes, _ := json.Marshal(pp)
 	r := &prot.ContainerExecuteProcess{
 		MessageBase: newMessageBase(),
 		Settings: prot.ExecuteProcessSettings{
-			ProcessParameters: string(ppbytes),
+			ProcessParameters: prot.NewNestedJSON(prot.PvV3, pp),
 		},
 	}
 
@@ -626,7 +708,7 @@ func Test_GetProperties_InvalidJson_Failure(t *testing.T) {
 func Test_GetProperties_CoreFails_Failure(t *testing.T) {
 	r := &prot.ContainerGetProperties{
 		MessageBase: newMessageBase(),
-		Query:       "",
+		Query:       prot.NestedJSON{},
 	}
 
 	req := createRequest(t, prot.ComputeSystemGetPropertiesV1, prot.PvV3, r)
@@ -646,7 +728,7 @@ func Test_GetProperties_CoreFails_Failure(t *testing.T) {
 func Test_GetProperties_CoreSucceeds_Success(t *testing.T) {
 	r := &prot.ContainerGetProperties{
 		MessageBase: newMessageBase(),
-		Query:       "{\"PropertyTypes\":[\"ProcessList\"]}",
+		Query:       prot.NewNestedJSON(prot.PvV3, prot.PropertyQuery{PropertyTypes: []prot.PropertyType{prot.PtProcessList}}),
 	}
 
 	req := createRequest(t, prot.ComputeSystemGetPropertiesV1, prot.PvV3, r)
@@ -666,7 +748,7 @@ func Test_GetProperties_CoreSucceeds_Success(t *testing.T) {
 	}
 
 	var properties prot.Properties
-	json.Unmarshal([]byte(cgpr.Properties), &properties)
+	cgpr.Properties.Decode(&properties)
 	numProcesses := len(properties.ProcessList)
 	if numProcesses != 1 {
 		t.Fatalf("get properties returned an incorrect number of processes: %d", numProcesses)
@@ -1007,3 +1089,163 @@ func Test_ModifySettings_NeitherV1V2_Fails(t *testing.T) {
 
 	verifyResponseError(t, resp, err)
 }
+
+func Test_ModifySettingsV2_RegisteredResource_Success(t *testing.T) {
+	r := &prot.ContainerModifySettings{
+		MessageBase: newMessageBase(),
+		Request: &prot.ModifySettingRequest{
+			ResourceType: prot.MrtMappedDirectory,
+			Settings:     &prot.MappedDirectoryV2{MountPath: "/mnt"},
+		},
+	}
+	req := createRequest(t, prot.ComputeSystemModifySettingsV1, prot.PvV4, r)
+
+	var called *prot.ModifySettingRequest
+	mux := NewBridgeMux()
+	mux.HandleResource(prot.PvV4, prot.MrtMappedDirectory, func(ctx context.Context, id string, settings *prot.ModifySettingRequest) error {
+		if id != r.ContainerID {
+			t.Errorf("expected container %s got: %s", r.ContainerID, id)
+		}
+		called = settings
+		return nil
+	})
+	tb := &Bridge{mux: mux}
+	resp, err := tb.modifySettingsV2(req)
+
+	verifyResponseSuccess(t, resp, err)
+	if called == nil || called.Settings.(*prot.MappedDirectoryV2).MountPath != "/mnt" {
+		t.Fatalf("expected the MappedDirectory handler to be called got: %+v", called)
+	}
+}
+
+func Test_ModifySettingsV2_UnregisteredResource_NotImpl(t *testing.T) {
+	r := &prot.ContainerModifySettings{
+		MessageBase: newMessageBase(),
+		Request: &prot.ModifySettingRequest{
+			ResourceType: prot.MrtMappedDirectory,
+			Settings:     &prot.MappedDirectoryV2{},
+		},
+	}
+	// The handler is only registered at a different protocol version.
+	req := createRequest(t, prot.ComputeSystemModifySettingsV1, prot.PvV4, r)
+	mux := NewBridgeMux()
+	mux.HandleResource(prot.PvV5, prot.MrtMappedDirectory, func(context.Context, string, *prot.ModifySettingRequest) error {
+		t.Error("expected the handler not to be called")
+		return nil
+	})
+	tb := &Bridge{mux: mux}
+	resp, err := tb.modifySettingsV2(req)
+
+	verifyResponseError(t, resp, err)
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrNotImpl {
+		t.Fatalf("expected HrNotImpl got: %v", err)
+	}
+}
+
+// restoreMockContainer restores the standalone container `id` with its bundle
+// in `bundle` on a host with the mock runtime. Stdio connections made by the
+// host are sent on `conns`.
+func restoreMockContainer(t *testing.T, id, bundle string, conns chan *transport.MockConnection) (*Bridge, *hcsv2.Container) {
+	r := &prot.ContainerRestore{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		ContainerConfig: prot.NewNestedJSON(prot.PvV4, &prot.VMHostedContainerSettingsV2{
+			SchemaVersion:    prot.SchemaVersion{Major: 2, Minor: 1},
+			OCIBundlePath:    bundle,
+			OCISpecification: &oci.Spec{
+				Process: &oci.Process{},
+				Linux:   &oci.Linux{},
+				// The standalone container adds its own network namespace.
+				Windows: &oci.Windows{Network: &oci.WindowsNetwork{NetworkNamespace: id}},
+			},
+		}),
+		ImagePath: bundle,
+	}
+	req := createRequest(t, prot.ComputeSystemRestoreV1, prot.PvV4, r)
+
+	h := hcsv2.NewHost(mockruntime.NewRuntime(""), &transport.MockTransport{Channel: conns})
+	tb := &Bridge{hostState: h}
+	resp, err := serveUnmarshaled(tb.restoreContainerV2, prot.ContainerRestore{}, req)
+	verifyResponseSuccess(t, resp, err)
+
+	c, err := h.GetContainer(id)
+	if err != nil {
+		t.Fatalf("expected restored container got: %v", err)
+	}
+	return tb, c
+}
+
+func Test_RestoreContainerV2_Running_Success(t *testing.T) {
+	// Network namespaces outlive the host so each run needs a new id.
+	id := newMessageBase().ContainerID
+	bundle, err := ioutil.TempDir("", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+	defer os.RemoveAll(filepath.Join("/run/gcs/c", id))
+	_, c := restoreMockContainer(t, id, bundle, nil)
+
+	// The restored init process is already running before its stdio is
+	// connected.
+	if state := c.GetState().State; state != string(hcsv2.ContainerStateRunning) {
+		t.Fatalf("expected state %s got: %s", hcsv2.ContainerStateRunning, state)
+	}
+}
+
+func Test_RestoreContainerV2_Start_ConnectsStdio(t *testing.T) {
+	// Network namespaces outlive the host so each run needs a new id.
+	id := newMessageBase().ContainerID
+	bundle, err := ioutil.TempDir("", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+	defer os.RemoveAll(filepath.Join("/run/gcs/c", id))
+	conns := make(chan *transport.MockConnection, 1)
+	tb, c := restoreMockContainer(t, id, bundle, conns)
+
+	r := &prot.ContainerExecuteProcess{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		Settings: prot.ExecuteProcessSettings{
+			ProcessParameters:       prot.NewNestedJSON(prot.PvV4, prot.ProcessParameters{CreateStdOutPipe: true}),
+			VsockStdioRelaySettings: prot.ExecuteProcessVsockStdioRelaySettings{StdOut: 1},
+		},
+	}
+	req := createRequest(t, prot.ComputeSystemExecuteProcessV1, prot.PvV4, r)
+	resp, err := serveUnmarshaled(tb.execProcessV2, prot.ContainerExecuteProcess{}, req)
+	verifyResponseSuccess(t, resp, err)
+	// 101 is the pid of every mock init process.
+	if pid := resp.(*prot.ContainerExecuteProcessResponse).ProcessID; pid != 101 {
+		t.Fatalf("expected the init process pid 101 got: %d", pid)
+	}
+	select {
+	case conn := <-conns:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stdout of the restored container to be connected")
+	}
+	if state := c.GetState().State; state != string(hcsv2.ContainerStateRunning) {
+		t.Fatalf("expected state %s got: %s", hcsv2.ContainerStateRunning, state)
+	}
+
+	// The stdio of the restored container can only be connected once.
+	req = createRequest(t, prot.ComputeSystemExecuteProcessV1, prot.PvV4, r)
+	_, err = serveUnmarshaled(tb.execProcessV2, prot.ContainerExecuteProcess{}, req)
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrVmcomputeInvalidState {
+		t.Fatalf("expected HrVmcomputeInvalidState got: %v", err)
+	}
+}
+
+func Test_RestoreContainerV2_NoImagePath_InvalidArg(t *testing.T) {
+	r := &prot.ContainerRestore{
+		MessageBase: newMessageBase(),
+	}
+	req := createRequest(t, prot.ComputeSystemRestoreV1, prot.PvV4, r)
+	tb := &Bridge{hostState: hcsv2.NewHost(nil, nil)}
+	resp, err := serveUnmarshaled(tb.restoreContainerV2, prot.ContainerRestore{}, req)
+
+	verifyResponseError(t, resp, err)
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrInvalidArg {
+		t.Fatalf("expected HrErrInvalidArg got: %v", err)
+	}
+}
@@ -1,15 +1,18 @@
 package bridge
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
 
+	"github.com/Microsoft/opengcs/internal/runtime/hcsv2"
 	"github.com/Microsoft/opengcs/service/gcs/gcserr"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/Microsoft/opengcs/service/gcs/transport"
@@ -335,6 +338,68 @@ func Test_Bridge_Mux_ServeMsg_Added_NotMatched(t *testing.T) {
 	}
 }
 
+func Test_Bridge_Mux_Capabilities(t *testing.T) {
+	m := NewBridgeMux()
+	th := &thandler{}
+
+	m.Handle(prot.ComputeSystemDumpStacksV1, prot.PvV4, th)
+	m.Handle(prot.ComputeSystemModifySettingsV1, prot.PvV4, th)
+	rh := func(context.Context, string, *prot.ModifySettingRequest) error { return nil }
+	m.HandleResource(prot.PvV4, prot.MrtNetwork, rh)
+	m.HandleResource(prot.PvV4, prot.MrtMappedDirectory, rh)
+	// Property types without a GetProperties handler are not advertised.
+	m.HandleProperty(prot.PvV4, prot.PtStatistics, func(context.Context, *hcsv2.Container, *prot.PropertiesV2) error { return nil })
+	m.Handle(prot.ComputeSystemSignalProcessV1, prot.PvV5, th)
+
+	caps := m.Capabilities(prot.PvV4)
+	expected := prot.GcsGuestCapabilities{
+		NamespaceAddRequestSupported: true,
+		DumpStacksSupported:          true,
+		SupportedResourceTypes:       []prot.ModifyResourceType{prot.MrtMappedDirectory, prot.MrtNetwork},
+	}
+	if !reflect.DeepEqual(caps, expected) {
+		t.Fatalf("expected capabilities %+v got: %+v", expected, caps)
+	}
+
+	caps = m.Capabilities(prot.PvV5)
+	expected = prot.GcsGuestCapabilities{
+		SignalProcessSupported: true,
+	}
+	if !reflect.DeepEqual(caps, expected) {
+		t.Fatalf("expected capabilities %+v got: %+v", expected, caps)
+	}
+}
+
+func Test_Bridge_AssignHandlers_Capabilities(t *testing.T) {
+	mux := NewBridgeMux()
+	b := &Bridge{EnableV4: true}
+	b.AssignHandlers(mux, nil, hcsv2.NewHost(nil, nil))
+
+	// Every registered resource and property handler is advertised.
+	for _, pv := range []prot.ProtocolVersion{prot.PvV4, prot.PvV5} {
+		caps := mux.Capabilities(pv)
+		for _, rt := range append(hcsv2.HostResourceTypes(), prot.MrtContainerResources) {
+			found := false
+			for _, st := range caps.SupportedResourceTypes {
+				found = found || st == rt
+			}
+			if !found || mux.ResourceHandler(pv, rt) == nil {
+				t.Fatalf("expected resource type %s to be supported at version %d got: %v", rt, pv, caps.SupportedResourceTypes)
+			}
+		}
+		if len(caps.SupportedResourceTypes) != len(hcsv2.HostResourceTypes())+1 {
+			t.Fatalf("expected only the registered resource types got: %v", caps.SupportedResourceTypes)
+		}
+		expected := []prot.PropertyType{prot.PtContainerState, prot.PtPodStatistics, prot.PtProcessList, prot.PtStatistics}
+		if !reflect.DeepEqual(caps.SupportedPropertyTypes, expected) {
+			t.Fatalf("expected property types %v at version %d got: %v", expected, pv, caps.SupportedPropertyTypes)
+		}
+	}
+	if caps := mux.Capabilities(prot.PvV3); caps.SupportedResourceTypes != nil || caps.SupportedPropertyTypes != nil {
+		t.Fatalf("expected no resource or property types at version 3 got: %+v", caps)
+	}
+}
+
 func Test_Bridge_Mux_ServeMsg_Success(t *testing.T) {
 	m := NewBridgeMux()
 	th := &thandler{
@@ -661,3 +726,134 @@ func Test_Bridge_ListenAndServe_HandlersAreAsync_Success(t *testing.T) {
 		t.Error("Incorrect response order for 1st request")
 	}
 }
+
+func Test_Bridge_ListenAndServe_CancelRequest_Success(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	lc := newLoopbackConnection()
+	defer lc.close()
+
+	mux := NewBridgeMux()
+	b := &Bridge{
+		Handler: mux,
+		protVer: prot.PvV4,
+	}
+	waitFn := func(r *Request) (RequestResponse, error) {
+		// Block until cancelled.
+		<-r.Context.Done()
+		return nil, errors.Wrap(r.Context.Err(), "wait cancelled")
+	}
+	mux.HandleFunc(prot.ComputeSystemWaitForProcessV1, prot.PvV4, waitFn)
+	mux.HandleFunc(prot.ComputeSystemCancelRequestV1, prot.PvV4, b.cancelRequestV2, Unmarshal(prot.ContainerCancelRequest{}))
+
+	go func() {
+		if err := b.ListenAndServe(lc.SRead(), lc.SWrite()); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		b.quitChan <- true
+	}()
+
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemWaitForProcessV1, prot.SequenceID(1), &prot.ContainerWaitForProcess{}); err != nil {
+		t.Fatal("Failed to send wait message to server")
+	}
+	cancel := &prot.ContainerCancelRequest{SequenceID: prot.SequenceID(1)}
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemCancelRequestV1, prot.SequenceID(2), cancel); err != nil {
+		t.Fatal("Failed to send cancel message to server")
+	}
+
+	results := make(map[prot.MessageIdentifier]*prot.MessageResponseBase)
+	for i := 0; i < 2; i++ {
+		header, body, err := serverRead(lc.CRead())
+		if err != nil {
+			t.Fatal("Failed to read response from server")
+		}
+		response := &prot.MessageResponseBase{}
+		if err := json.Unmarshal(body, response); err != nil {
+			t.Fatal("Failed to unmarshal response body from server")
+		}
+		results[header.Type] = response
+	}
+
+	if r, ok := results[prot.ComputeSystemResponseCancelRequestV1]; !ok || r.Result != 0 {
+		t.Errorf("expected successful cancel response got: %+v", r)
+	}
+	if r, ok := results[prot.ComputeSystemResponseWaitForProcessV1]; !ok || r.Result != int32(gcserr.HrErrCancelled) {
+		t.Errorf("expected cancelled wait response got: %+v", r)
+	}
+}
+
+func Test_Bridge_ListenAndServe_CancelRequest_NotFound(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	lc := newLoopbackConnection()
+	defer lc.close()
+
+	mux := NewBridgeMux()
+	b := &Bridge{
+		Handler: mux,
+		protVer: prot.PvV4,
+	}
+	mux.HandleFunc(prot.ComputeSystemCancelRequestV1, prot.PvV4, b.cancelRequestV2, Unmarshal(prot.ContainerCancelRequest{}))
+
+	go func() {
+		if err := b.ListenAndServe(lc.SRead(), lc.SWrite()); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		b.quitChan <- true
+	}()
+
+	cancel := &prot.ContainerCancelRequest{SequenceID: prot.SequenceID(10)}
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemCancelRequestV1, prot.SequenceID(1), cancel); err != nil {
+		t.Fatal("Failed to send cancel message to server")
+	}
+	_, body, err := serverRead(lc.CRead())
+	if err != nil {
+		t.Fatal("Failed to read response from server")
+	}
+	response := &prot.MessageResponseBase{}
+	if err := json.Unmarshal(body, response); err != nil {
+		t.Fatal("Failed to unmarshal response body from server")
+	}
+	if response.Result != int32(gcserr.HrErrNotFound) {
+		t.Fatalf("expected HrErrNotFound got: 0x%x", uint32(response.Result))
+	}
+}
+
+func Test_SetErrorForResponseBase_RecordPerLayer(t *testing.T) {
+	err := errors.Wrap(gcserr.WrapHresult(errors.New("root"), gcserr.HrErrNotFound), "outer")
+
+	for _, omitStacks := range []bool{false, true} {
+		response := &prot.MessageResponseBase{}
+		setErrorForResponseBase(response, err, omitStacks)
+
+		if response.Result != int32(gcserr.HrErrNotFound) {
+			t.Fatalf("expected HrErrNotFound got: 0x%x", uint32(response.Result))
+		}
+		if len(response.ErrorRecords) != 2 {
+			t.Fatalf("expected 2 error records got: %+v", response.ErrorRecords)
+		}
+		for i, record := range response.ErrorRecords {
+			if record.Result != int32(gcserr.HrErrNotFound) {
+				t.Errorf("record %d: expected HrErrNotFound got: 0x%x", i, uint32(record.Result))
+			}
+			if record.FileName != "bridge_unit_test.go" || record.Line == 0 {
+				t.Errorf("record %d: expected source location in test got: %s:%d", i, record.FileName, record.Line)
+			}
+			if record.FunctionName != "Test_SetErrorForResponseBase_RecordPerLayer" {
+				t.Errorf("record %d: expected test function got: %s", i, record.FunctionName)
+			}
+			if omitStacks != (record.StackTrace == "") {
+				t.Errorf("record %d: expected stack omitted %v got: %q", i, omitStacks, record.StackTrace)
+			}
+		}
+		if response.ErrorRecords[1].Message != "root" {
+			t.Errorf("expected root cause message got: %q", response.ErrorRecords[1].Message)
+		}
+	}
+}
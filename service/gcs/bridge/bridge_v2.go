@@ -2,24 +2,26 @@ package bridge
 
 import (
 	"context"
-	"encoding/json"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/Microsoft/opengcs/internal/debug"
 	"github.com/Microsoft/opengcs/internal/log"
-	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/memevents"
 	"github.com/Microsoft/opengcs/internal/runtime/hcsv2"
 	"github.com/Microsoft/opengcs/service/gcs/gcserr"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
-	"github.com/Microsoft/opengcs/service/libs/commonutils"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 	"golang.org/x/sys/unix"
 )
 
-// The capabilities of this GCS.
+// The capabilities of this GCS. `GuestDefinedCapabilities` are filled in from
+// the handlers registered for the negotiated protocol version.
 var capabilities = prot.GcsCapabilities{
 	SendHostCreateMessage:   false,
 	SendHostStartMessage:    false,
@@ -31,26 +33,12 @@ var capabilities = prot.GcsCapabilities{
 		},
 	},
 	RuntimeOsType: prot.OsTypeLinux,
-	GuestDefinedCapabilities: prot.GcsGuestCapabilities{
-		NamespaceAddRequestSupported:  true,
-		SignalProcessSupported:        true,
-		DumpStacksSupported:           true,
-		DeleteContainerStateSupported: true,
-	},
 }
 
 // negotiateProtocolV2 was introduced in v4 so will not be called with a minimum
 // lower than that.
-func (b *Bridge) negotiateProtocolV2(r *Request) (_ RequestResponse, err error) {
-	_, span := trace.StartSpan(r.Context, "opengcs::bridge::negotiateProtocolV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
-	var request prot.NegotiateProtocol
-	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
-	}
+func (b *Bridge) negotiateProtocolV2(r *Request) (RequestResponse, error) {
+	request := r.Body.(*prot.NegotiateProtocol)
 
 	if request.MaximumVersion < uint32(prot.PvV4) || uint32(prot.PvMax) < request.MinimumVersion {
 		return nil, gcserr.NewHresultError(gcserr.HrVmcomputeUnsupportedProtocolVersion)
@@ -65,32 +53,68 @@ func (b *Bridge) negotiateProtocolV2(r *Request) (_ RequestResponse, err error)
 
 	major := min(uint32(prot.PvMax), request.MaximumVersion)
 
+	// Select the first encoding requested by the host that we support. The
+	// response to this request is always sent in JSON.
+	encoding := prot.EncodingJSON
+	if prot.ProtocolVersion(major) >= prot.PvV5 {
+		for _, e := range request.Encodings {
+			if e == prot.EncodingJSON || e == prot.EncodingCBOR {
+				encoding = e
+				break
+			}
+		}
+	}
+
 	// Set our protocol selected version before return.
-	b.protVer = prot.ProtocolVersion(major)
+	b.setProtocol(prot.ProtocolVersion(major), encoding)
 
-	return &prot.NegotiateProtocolResponse{
+	caps := capabilities
+	if b.mux != nil {
+		caps.GuestDefinedCapabilities = b.mux.Capabilities(prot.ProtocolVersion(major))
+	}
+	if b.hostState != nil && b.hostState.MemoryEvents() != nil {
+		caps.GuestDefinedCapabilities.MemoryNotificationsSupported = true
+		if request.MemoryNotifications {
+			atomic.StoreUint32(&b.memoryNotifications, 1)
+		}
+	}
+	response := &prot.NegotiateProtocolResponse{
 		Version:      major,
-		Capabilities: capabilities,
-	}, nil
+		Capabilities: caps,
+	}
+	if prot.ProtocolVersion(major) >= prot.PvV5 {
+		response.Encoding = encoding
+	}
+	return response, nil
 }
 
 // createContainerV2 creates a container based on the settings passed in `r`.
 //
 // This is allowed only for protocol version 4+, schema version 2.1+
-func (b *Bridge) createContainerV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::createContainerV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+func (b *Bridge) createContainerV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
+	request := r.Body.(*prot.ContainerCreate)
 
-	var request prot.ContainerCreate
-	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+	settingsV2, err := unmarshalContainerConfigV2(request.ContainerConfig)
+	if err != nil {
+		return nil, err
 	}
 
+	c, err := b.hostState.CreateContainer(ctx, request.ContainerID, settingsV2)
+	if err != nil {
+		return nil, err
+	}
+	b.publishExitNotification(request.MessageBase, c)
+
+	return &prot.ContainerCreateResponse{}, nil
+}
+
+// unmarshalContainerConfigV2 unmarshals the `ContainerConfig` of a create or
+// restore request.
+func unmarshalContainerConfigV2(config prot.NestedJSON) (*prot.VMHostedContainerSettingsV2, error) {
 	var settingsV2 prot.VMHostedContainerSettingsV2
-	if err := commonutils.UnmarshalJSONWithHresult([]byte(request.ContainerConfig), &settingsV2); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON for ContainerConfig \"%s\"", request.ContainerConfig)
+	if err := config.Decode(&settingsV2); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal JSON for ContainerConfig \"%s\"", config)
 	}
 
 	if settingsV2.SchemaVersion.Cmp(prot.SchemaVersion{Major: 2, Minor: 1}) < 0 {
@@ -98,11 +122,12 @@ func (b *Bridge) createContainerV2(r *Request) (_ RequestResponse, err error) {
 			errors.Errorf("invalid schema version: %v", settingsV2.SchemaVersion),
 			gcserr.HrVmcomputeInvalidJSON)
 	}
+	return &settingsV2, nil
+}
 
-	c, err := b.hostState.CreateContainer(ctx, request.ContainerID, &settingsV2)
-	if err != nil {
-		return nil, err
-	}
+// publishExitNotification publishes the exit notification for `c` once its
+// init process exits.
+func (b *Bridge) publishExitNotification(request prot.MessageBase, c *hcsv2.Container) {
 	waitFn := func() prot.NotificationType {
 		return c.Wait()
 	}
@@ -118,11 +143,10 @@ func (b *Bridge) createContainerV2(r *Request) (_ RequestResponse, err error) {
 			Operation:  prot.AoNone,
 			Result:     0,
 			ResultInfo: "",
+			ExitStatus: c.ExitStatus(),
 		}
 		b.PublishNotification(notification)
 	}()
-
-	return &prot.ContainerCreateResponse{}, nil
 }
 
 // startContainerV2 doesn't have a great correlation to LCOW. On Windows this is
@@ -130,19 +154,9 @@ func (b *Bridge) createContainerV2(r *Request) (_ RequestResponse, err error) {
 // wait until the exec process of the init process to actually issue the start.
 //
 // This is allowed only for protocol version 4+, schema version 2.1+
-func (b *Bridge) startContainerV2(r *Request) (_ RequestResponse, err error) {
-	_, span := trace.StartSpan(r.Context, "opengcs::bridge::startContainerV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
+func (b *Bridge) startContainerV2(r *Request) (RequestResponse, error) {
 	// This is just a noop, but needs to be handled so that an error isn't
 	// returned to the HCS.
-	var request prot.MessageBase
-	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
-	}
-
 	return &prot.MessageResponseBase{}, nil
 }
 
@@ -162,20 +176,13 @@ func (b *Bridge) startContainerV2(r *Request) (_ RequestResponse, err error) {
 //
 // This is allowed only for protocol version 4+, schema version 2.1+
 func (b *Bridge) execProcessV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::execProcessV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
-	var request prot.ContainerExecuteProcess
-	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
-	}
+	ctx := r.Context
+	request := r.Body.(*prot.ContainerExecuteProcess)
 
 	// The request contains a JSON string field which is equivalent to an
 	// ExecuteProcessInfo struct.
 	var params prot.ProcessParameters
-	if err := commonutils.UnmarshalJSONWithHresult([]byte(request.Settings.ProcessParameters), &params); err != nil {
+	if err := request.Settings.ProcessParameters.Decode(&params); err != nil {
 		return nil, errors.Wrapf(err, "failed to unmarshal JSON for ProcessParameters \"%s\"", request.Settings.ProcessParameters)
 	}
 
@@ -218,42 +225,43 @@ func (b *Bridge) execProcessV2(r *Request) (_ RequestResponse, err error) {
 //
 // This is allowed only for protocol version 4+, schema version 2.1+
 func (b *Bridge) killContainerV2(r *Request) (RequestResponse, error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::killContainerV2")
-	defer span.End()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
-	return b.signalContainerV2(ctx, span, r, unix.SIGKILL)
+	request := r.Body.(*prot.MessageBase)
+	return b.signalContainerV2(r.Context, request.ContainerID, unix.SIGKILL)
 }
 
 // shutdownContainerV2 is a user requested shutdown of the container and all
-// processes in the container. It is equivalent to sending SIGTERM to the init
-// process and all exec'd processes.
+// processes in the container. It sends the requested signal, or the stop
+// signal of the container which defaults to SIGTERM, to the init process and
+// all exec'd processes. If the request has a grace period the container is
+// killed once it expires.
 //
 // This is allowed only for protocol version 4+, schema version 2.1+
 func (b *Bridge) shutdownContainerV2(r *Request) (RequestResponse, error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::shutdownContainerV2")
-	defer span.End()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+	ctx := r.Context
+	request := r.Body.(*prot.ContainerShutdown)
+	if request.ContainerID == hcsv2.UVMContainerID {
+		return b.signalContainerV2(ctx, request.ContainerID, unix.SIGTERM)
+	}
 
-	return b.signalContainerV2(ctx, span, r, unix.SIGTERM)
+	trace.FromContext(ctx).AddAttributes(
+		trace.Int64Attribute("signal", int64(request.Signal)),
+		trace.Int64Attribute("gracePeriodMs", int64(request.GracePeriodInMs)))
+
+	gracePeriod := time.Duration(request.GracePeriodInMs) * time.Millisecond
+	if err := b.hostState.StopContainer(ctx, request.ContainerID, syscall.Signal(request.Signal), gracePeriod); err != nil {
+		return nil, err
+	}
+	return &prot.MessageResponseBase{}, nil
 }
 
 // signalContainerV2 is not a handler func. This is because the actual signal is
 // implied based on the message type of either `killContainerV2` or
 // `shutdownContainerV2`.
-func (b *Bridge) signalContainerV2(ctx context.Context, span *trace.Span, r *Request, signal syscall.Signal) (_ RequestResponse, err error) {
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(
-		trace.StringAttribute("cid", r.ContainerID),
-		trace.Int64Attribute("signal", int64(signal)))
-
-	var request prot.MessageBase
-	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
-	}
+func (b *Bridge) signalContainerV2(ctx context.Context, id string, signal syscall.Signal) (RequestResponse, error) {
+	trace.FromContext(ctx).AddAttributes(trace.Int64Attribute("signal", int64(signal)))
 
 	// If this is targeting the UVM send the request to the host itself.
-	if request.ContainerID == hcsv2.UVMContainerID {
+	if id == hcsv2.UVMContainerID {
 		// We are asking to shutdown the UVM itself.
 		if signal != unix.SIGTERM {
 			log.G(ctx).Error("invalid signal for uvm")
@@ -262,13 +270,7 @@ func (b *Bridge) signalContainerV2(ctx context.Context, span *trace.Span, r *Req
 		b.quitChan <- true
 		b.hostState.Shutdown()
 	} else {
-		c, err := b.hostState.GetContainer(request.ContainerID)
-		if err != nil {
-			return nil, err
-		}
-
-		err = c.Kill(ctx, signal)
-		if err != nil {
+		if err := b.hostState.KillContainer(ctx, id, signal); err != nil {
 			return nil, err
 		}
 	}
@@ -276,18 +278,11 @@ func (b *Bridge) signalContainerV2(ctx context.Context, span *trace.Span, r *Req
 	return &prot.MessageResponseBase{}, nil
 }
 
-func (b *Bridge) signalProcessV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::signalProcessV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+func (b *Bridge) signalProcessV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
+	request := r.Body.(*prot.ContainerSignalProcess)
 
-	var request prot.ContainerSignalProcess
-	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
-	}
-
-	span.AddAttributes(
+	trace.FromContext(ctx).AddAttributes(
 		trace.Int64Attribute("pid", int64(request.ProcessID)),
 		trace.Int64Attribute("signal", int64(request.Options.Signal)))
 
@@ -315,23 +310,15 @@ func (b *Bridge) signalProcessV2(r *Request) (_ RequestResponse, err error) {
 }
 
 func (b *Bridge) getPropertiesV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::getPropertiesV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
-	var request prot.ContainerGetProperties
-	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
-	}
+	ctx := r.Context
+	request := r.Body.(*prot.ContainerGetProperties)
 
 	properties := &prot.PropertiesV2{}
 
 	var query prot.PropertyQuery
-	if len(request.Query) != 0 {
-		if err := json.Unmarshal([]byte(request.Query), &query); err != nil {
-			e := gcserr.WrapHresult(err, gcserr.HrVmcomputeInvalidJSON)
-			return nil, errors.Wrapf(e, "The query could not be unmarshaled: '%s'", query)
+	if !request.Query.IsZero() {
+		if err := request.Query.Decode(&query); err != nil {
+			return nil, errors.Wrapf(err, "The query could not be unmarshaled: '%s'", request.Query)
 		}
 	}
 
@@ -344,74 +331,75 @@ func (b *Bridge) getPropertiesV2(r *Request) (_ RequestResponse, err error) {
 		return nil, err
 	}
 
+	// Property types without a registered handler are ignored.
 	for _, requestedProperty := range query.PropertyTypes {
-		if requestedProperty == prot.PtProcessList {
-			pids, err := c.GetAllProcessPids(ctx)
-			if err != nil {
-				return nil, err
-			}
-			properties.ProcessList = make([]prot.ProcessDetails, len(pids))
-			for i, pid := range pids {
-				properties.ProcessList[i].ProcessID = uint32(pid)
-			}
-		} else if requestedProperty == prot.PtStatistics {
-			cgroupMetrics, err := c.GetStats(ctx)
-			if err != nil {
+		if h := b.mux.PropertyHandler(r.Version, requestedProperty); h != nil {
+			if err := h(ctx, c, properties); err != nil {
 				return nil, err
 			}
-			properties.Metrics = cgroupMetrics
-		}
-	}
-
-	propertyJSON := []byte("{}")
-	if properties != nil {
-		var err error
-		propertyJSON, err = json.Marshal(properties)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%+v\"", properties)
 		}
 	}
 
 	return &prot.ContainerGetPropertiesResponse{
-		Properties: string(propertyJSON),
+		Properties: prot.NewNestedJSON(r.Version, properties),
 	}, nil
 }
 
-func (b *Bridge) waitOnProcessV2(r *Request) (_ RequestResponse, err error) {
-	_, span := trace.StartSpan(r.Context, "opengcs::bridge::waitOnProcessV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
-	var request prot.ContainerWaitForProcess
-	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+func getProcessListV2(ctx context.Context, c *hcsv2.Container, properties *prot.PropertiesV2) error {
+	pids, err := c.GetAllProcessPids(ctx)
+	if err != nil {
+		return err
+	}
+	properties.ProcessList = make([]prot.ProcessDetails, len(pids))
+	for i, pid := range pids {
+		properties.ProcessList[i].ProcessID = uint32(pid)
 	}
+	return nil
+}
 
-	span.AddAttributes(
+func getStatisticsV2(ctx context.Context, c *hcsv2.Container, properties *prot.PropertiesV2) (err error) {
+	properties.Metrics, err = c.GetStats(ctx)
+	return err
+}
+
+func getPodStatisticsV2(ctx context.Context, c *hcsv2.Container, properties *prot.PropertiesV2) (err error) {
+	properties.PodMetrics, err = c.GetPodStats(ctx)
+	return err
+}
+
+func getContainerStateV2(ctx context.Context, c *hcsv2.Container, properties *prot.PropertiesV2) error {
+	properties.State = c.GetState()
+	return nil
+}
+
+func (b *Bridge) waitOnProcessV2(r *Request) (_ RequestResponse, err error) {
+	ctx := r.Context
+	request := r.Body.(*prot.ContainerWaitForProcess)
+
+	trace.FromContext(ctx).AddAttributes(
 		trace.Int64Attribute("pid", int64(request.ProcessID)),
 		trace.Int64Attribute("timeout-ms", int64(request.TimeoutInMs)))
 
-	var exitCodeChan <-chan int
-	var doneChan chan<- bool
-
+	var p hcsv2.Process
 	if request.ContainerID == hcsv2.UVMContainerID {
-		p, err := b.hostState.GetExternalProcess(int(request.ProcessID))
+		p, err = b.hostState.GetExternalProcess(int(request.ProcessID))
 		if err != nil {
 			return nil, err
 		}
-		exitCodeChan, doneChan = p.Wait()
 	} else {
 		c, err := b.hostState.GetContainer(request.ContainerID)
 		if err != nil {
 			return nil, err
 		}
-		p, err := c.GetProcess(request.ProcessID)
+		if err := c.CheckNotPaused("wait on process"); err != nil {
+			return nil, err
+		}
+		p, err = c.GetProcess(request.ProcessID)
 		if err != nil {
 			return nil, err
 		}
-		exitCodeChan, doneChan = p.Wait()
 	}
+	exitCodeChan, doneChan := p.Wait()
 
 	// If we timed out or if we got the exit code. Acknowledge we no longer want to wait.
 	defer close(doneChan)
@@ -421,25 +409,21 @@ func (b *Bridge) waitOnProcessV2(r *Request) (_ RequestResponse, err error) {
 	select {
 	case exitCode := <-exitCodeChan:
 		return &prot.ContainerWaitForProcessResponse{
-			ExitCode: uint32(exitCode),
+			ExitCode:   uint32(exitCode),
+			ExitStatus: p.ExitStatus(),
 		}, nil
 	case <-t.C:
 		return nil, gcserr.NewHresultError(gcserr.HvVmcomputeTimeout)
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "wait for process cancelled")
 	}
 }
 
 func (b *Bridge) resizeConsoleV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::resizeConsoleV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+	ctx := r.Context
+	request := r.Body.(*prot.ContainerResizeConsole)
 
-	var request prot.ContainerResizeConsole
-	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
-	}
-
-	span.AddAttributes(
+	trace.FromContext(ctx).AddAttributes(
 		trace.Int64Attribute("pid", int64(request.ProcessID)),
 		trace.Int64Attribute("height", int64(request.Height)),
 		trace.Int64Attribute("width", int64(request.Width)))
@@ -463,33 +447,64 @@ func (b *Bridge) resizeConsoleV2(r *Request) (_ RequestResponse, err error) {
 }
 
 func (b *Bridge) modifySettingsV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::modifySettingsV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
-	request, err := prot.UnmarshalContainerModifySettings(r.Message)
+	ctx := r.Context
+	// The settings of the request are unmarshaled based on its resource type
+	// so this is not registered with the `Unmarshal` middleware.
+	request, err := prot.UnmarshalContainerModifySettingsV2(r.Encoding, r.Message)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+		return nil, wrapUnmarshalError(err, r)
 	}
 
-	if request.ContainerID != hcsv2.UVMContainerID {
-		return nil, errors.New("V2 Modify request not supported on anything but UVM")
+	settings, ok := request.Request.(*prot.ModifySettingRequest)
+	if !ok {
+		return nil, gcserr.NewHresultError(gcserr.HrErrInvalidArg)
 	}
 
-	err = b.hostState.ModifyHostSettings(ctx, request.Request.(*prot.ModifySettingRequest))
-	if err != nil {
+	h := b.mux.ResourceHandler(r.Version, settings.ResourceType)
+	if h == nil {
+		return nil, gcserr.WrapHresult(
+			errors.Errorf("the ResourceType \"%s\" is not supported", settings.ResourceType),
+			gcserr.HrNotImpl)
+	}
+	if err := h(ctx, request.ContainerID, settings); err != nil {
 		return nil, err
 	}
 
 	return &prot.MessageResponseBase{}, nil
 }
 
-func (b *Bridge) dumpStacksV2(r *Request) (_ RequestResponse, err error) {
-	_, span := trace.StartSpan(r.Context, "opengcs::bridge::dumpStacksV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
+// modifyHostSettingsV2 applies `settings` to the UVM. Only the UVM supports
+// resource types other than `MrtContainerResources`.
+func (b *Bridge) modifyHostSettingsV2(ctx context.Context, id string, settings *prot.ModifySettingRequest) error {
+	if id != hcsv2.UVMContainerID {
+		return gcserr.WrapHresult(
+			errors.Errorf("V2 Modify request %s of %s not supported on container %s", settings.RequestType, settings.ResourceType, id),
+			gcserr.HrNotImpl)
+	}
+	return b.hostState.ModifyHostSettings(ctx, settings)
+}
 
+// updateContainerResourcesV2 updates the resources of container `id`. It is
+// the only modification supported against a container.
+func (b *Bridge) updateContainerResourcesV2(ctx context.Context, id string, settings *prot.ModifySettingRequest) error {
+	if id == hcsv2.UVMContainerID {
+		return gcserr.WrapHresult(
+			errors.New("V2 Modify request of ContainerResources not supported on the UVM"),
+			gcserr.HrErrInvalidArg)
+	}
+	if settings.RequestType != prot.MreqtUpdate {
+		return gcserr.WrapHresult(
+			errors.Errorf("V2 Modify request %s of %s not supported on container %s", settings.RequestType, settings.ResourceType, id),
+			gcserr.HrNotImpl)
+	}
+	c, err := b.hostState.GetContainer(id)
+	if err != nil {
+		return err
+	}
+	return c.Update(ctx, settings.Settings.(*oci.LinuxResources))
+}
+
+func (b *Bridge) dumpStacksV2(r *Request) (RequestResponse, error) {
 	stacks := debug.DumpStacks()
 
 	return &prot.DumpStacksResponse{
@@ -497,27 +512,205 @@ func (b *Bridge) dumpStacksV2(r *Request) (_ RequestResponse, err error) {
 	}, nil
 }
 
-func (b *Bridge) deleteContainerStateV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::deleteContainerStateV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
+// collectOrphansV2 reports, and unless it is a dry run cleans up, the
+// resources in the UVM that are not owned by any container.
+func (b *Bridge) collectOrphansV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
+	request := r.Body.(*prot.CollectOrphans)
+
+	trace.FromContext(ctx).AddAttributes(
+		trace.BoolAttribute("dryRun", request.DryRun),
+		trace.Int64Attribute("minAgeMs", int64(request.MinAgeInMs)))
+
+	minAge := time.Duration(request.MinAgeInMs) * time.Millisecond
+	orphans, err := b.hostState.CollectOrphans(ctx, minAge, request.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &prot.CollectOrphansResponse{
+		Orphans: orphans,
+	}, nil
+}
+
+func (b *Bridge) deleteContainerStateV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
+	request := r.Body.(*prot.MessageBase)
 
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+	if err := b.hostState.DeleteContainer(ctx, request.ContainerID); err != nil {
+		return nil, err
+	}
+	return &prot.MessageResponseBase{}, nil
+}
 
-	var request prot.MessageBase
-	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+// publishMemoryEvents publishes a `prot.NtOomKilled` or
+// `prot.NtMemoryPressure` notification for every event on `events` until it is
+// closed or `done` is closed. Events are dropped unless the host asked for
+// them during protocol negotiation.
+func (b *Bridge) publishMemoryEvents(events <-chan memevents.Event, done <-chan struct{}) {
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if atomic.LoadUint32(&b.memoryNotifications) == 0 {
+				continue
+			}
+			nt := prot.NtMemoryPressure
+			if e.Kind == memevents.OOM {
+				nt = prot.NtOomKilled
+			}
+			b.PublishNotification(&prot.ContainerNotification{
+				MessageBase: prot.MessageBase{
+					ContainerID: e.ID,
+				},
+				Type:       nt,
+				Operation:  prot.AoNone,
+				ResultInfo: e.Group,
+			})
+		case <-done:
+			return
+		}
+	}
+}
+
+// pauseContainerV2 freezes all processes in the container and publishes a
+// `prot.NtPaused` notification.
+//
+// This is allowed only for protocol version 4+, schema version 2.1+
+func (b *Bridge) pauseContainerV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
+	request := r.Body.(*prot.MessageBase)
+
+	if request.ContainerID == hcsv2.UVMContainerID {
+		return nil, errors.New("pauseContainerV2 is not supported against the UVM")
 	}
 
 	c, err := b.hostState.GetContainer(request.ContainerID)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.Pause(ctx); err != nil {
+		return nil, err
+	}
 
-	if err := c.Delete(ctx); err != nil {
+	b.PublishNotification(&prot.ContainerNotification{
+		MessageBase: prot.MessageBase{
+			ContainerID: request.ContainerID,
+			ActivityID:  request.ActivityID,
+		},
+		Type:      prot.NtPaused,
+		Operation: prot.AoPause,
+	})
+	return &prot.MessageResponseBase{}, nil
+}
+
+// resumeContainerV2 thaws all processes in a container paused by
+// `pauseContainerV2` and publishes a `prot.NtResumed` notification.
+//
+// This is allowed only for protocol version 4+, schema version 2.1+
+func (b *Bridge) resumeContainerV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
+	request := r.Body.(*prot.MessageBase)
+
+	if request.ContainerID == hcsv2.UVMContainerID {
+		return nil, errors.New("resumeContainerV2 is not supported against the UVM")
+	}
+
+	c, err := b.hostState.GetContainer(request.ContainerID)
+	if err != nil {
 		return nil, err
 	}
+	if err := c.Resume(ctx); err != nil {
+		return nil, err
+	}
+
+	b.PublishNotification(&prot.ContainerNotification{
+		MessageBase: prot.MessageBase{
+			ContainerID: request.ContainerID,
+			ActivityID:  request.ActivityID,
+		},
+		Type:      prot.NtResumed,
+		Operation: prot.AoResume,
+	})
+	return &prot.MessageResponseBase{}, nil
+}
+
+// cancelRequestV2 cancels the context of the in-flight request with the
+// `SequenceID` in `r`. The cancelled request still writes its own response with
+// `gcserr.HrErrCancelled` once its handler has unwound.
+//
+// This is allowed only for protocol version 4+, schema version 2.1+
+func (b *Bridge) cancelRequestV2(r *Request) (RequestResponse, error) {
+	request := r.Body.(*prot.ContainerCancelRequest)
+
+	trace.FromContext(r.Context).AddAttributes(trace.Int64Attribute("sequence-id", int64(request.SequenceID)))
+
+	if !b.cancelRequest(request.SequenceID) {
+		return nil, gcserr.WrapHresult(
+			errors.Errorf("request with sequence id %d is not in flight", request.SequenceID),
+			gcserr.HrErrNotFound)
+	}
+	return &prot.MessageResponseBase{}, nil
+}
+
+// checkpointContainerV2 writes the state of a container to the directory in
+// the request using CRIU.
+//
+// This is allowed only for protocol version 4+, schema version 2.1+
+func (b *Bridge) checkpointContainerV2(r *Request) (_ RequestResponse, err error) {
+	ctx := r.Context
+	request := r.Body.(*prot.ContainerCheckpoint)
+
+	if request.ContainerID == hcsv2.UVMContainerID {
+		return nil, errors.New("checkpointContainerV2 is not supported against the UVM")
+	}
 
-	b.hostState.RemoveContainer(request.ContainerID)
+	c, err := b.hostState.GetContainer(request.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Checkpoint(ctx, runtime.CheckpointOptions{
+		ImagePath:      request.ImagePath,
+		LeaveRunning:   request.LeaveRunning,
+		TCPEstablished: request.TCPEstablished,
+	})
+	if err != nil {
+		return nil, err
+	}
 	return &prot.MessageResponseBase{}, nil
 }
+
+// restoreContainerV2 restores a container checkpointed by
+// `checkpointContainerV2` as the container in the request. Like
+// `createContainerV2` the init process stdio is connected to the ports of the
+// following `execProcessV2` for the init process.
+//
+// This is allowed only for protocol version 4+, schema version 2.1+
+func (b *Bridge) restoreContainerV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
+	request := r.Body.(*prot.ContainerRestore)
+
+	if request.ContainerID == hcsv2.UVMContainerID {
+		return nil, errors.New("restoreContainerV2 is not supported against the UVM")
+	}
+	if request.ImagePath == "" {
+		return nil, gcserr.WrapHresult(errors.New("restore requires an image path"), gcserr.HrErrInvalidArg)
+	}
+
+	settingsV2, err := unmarshalContainerConfigV2(request.ContainerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := b.hostState.RestoreContainer(ctx, request.ContainerID, settingsV2, runtime.RestoreOptions{
+		ImagePath:      request.ImagePath,
+		TCPEstablished: request.TCPEstablished,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.publishExitNotification(request.MessageBase, c)
+
+	return &prot.ContainerCreateResponse{}, nil
+}
@@ -0,0 +1,101 @@
+package bridge
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CaptureDirection is the direction of a message captured from the bridge.
+type CaptureDirection string
+
+const (
+	// CaptureRequest is a request read from the host.
+	CaptureRequest = CaptureDirection("Request")
+	// CaptureResponse is a response written to the host.
+	CaptureResponse = CaptureDirection("Response")
+	// CaptureNotification is a notification written to the host that was not
+	// initiated by a request.
+	CaptureNotification = CaptureDirection("Notification")
+)
+
+// CaptureRecord is a single message read from or written to the bridge.
+type CaptureRecord struct {
+	Timestamp time.Time
+	Direction CaptureDirection
+	Header    prot.MessageHeader
+	// Message is the JSON payload that followed `Header`.
+	Message json.RawMessage `json:",omitempty"`
+	// RawMessage is set instead of `Message` when the payload was not valid
+	// JSON. This is common for malformed requests.
+	RawMessage []byte `json:",omitempty"`
+}
+
+// Payload returns the payload bytes of the record as they were on the wire.
+func (cr *CaptureRecord) Payload() []byte {
+	if cr.Message != nil {
+		return cr.Message
+	}
+	return cr.RawMessage
+}
+
+// Recorder writes every message passed through a `Bridge` to a capture stream
+// as a sequence of JSON encoded `CaptureRecord`'s. It is safe for concurrent
+// use.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewRecorder creates a Recorder that writes to `w`.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// record writes `header` and `message` to the capture stream. Failures are
+// logged but never fail the bridge itself.
+func (r *Recorder) record(dir CaptureDirection, header *prot.MessageHeader, message []byte) {
+	cr := CaptureRecord{
+		Timestamp: time.Now().UTC(),
+		Direction: dir,
+		Header:    *header,
+	}
+	if json.Valid(message) {
+		cr.Message = json.RawMessage(message)
+	} else {
+		cr.RawMessage = message
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(&cr); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"message-id":    header.ID,
+			"message-type":  header.Type.String(),
+			logrus.ErrorKey: err,
+		}).Error("opengcs::bridge::Recorder - failed to write capture record")
+	}
+}
+
+// ReadCapture reads all `CaptureRecord`'s from a capture stream written by a
+// Recorder.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	var records []CaptureRecord
+	dec := json.NewDecoder(r)
+	for {
+		var cr CaptureRecord
+		if err := dec.Decode(&cr); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.Wrapf(err, "failed to decode capture record %d", len(records))
+		}
+		records = append(records, cr)
+	}
+	return records, nil
+}
@@ -0,0 +1,149 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/sirupsen/logrus"
+)
+
+func newResizeBridge(result int32) *Bridge {
+	mux := NewBridgeMux()
+	mux.HandleFunc(prot.ComputeSystemResizeConsoleV1, prot.PvV3, func(r *Request) (RequestResponse, error) {
+		return &prot.MessageResponseBase{
+			Result:     result,
+			ActivityID: r.ActivityID,
+		}, nil
+	})
+	return &Bridge{
+		Handler: mux,
+		protVer: prot.PvV3,
+	}
+}
+
+func recordResizeSession(t *testing.T) []CaptureRecord {
+	lc := newLoopbackConnection()
+	defer lc.close()
+
+	var buf bytes.Buffer
+	b := newResizeBridge(1)
+	b.Recorder = NewRecorder(&buf)
+
+	go b.ListenAndServe(lc.SRead(), lc.SWrite())
+
+	message := &prot.ContainerResizeConsole{
+		MessageBase: prot.MessageBase{
+			ContainerID: "01234567-89ab-cdef-0123-456789abcdef",
+			ActivityID:  "00000000-0000-0000-0000-000000000001",
+		},
+	}
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemResizeConsoleV1, prot.SequenceID(1), message); err != nil {
+		t.Fatalf("failed to send message to server: %v", err)
+	}
+	if _, _, err := serverRead(lc.CRead()); err != nil {
+		t.Fatalf("failed to read message response from server: %v", err)
+	}
+	b.quitChan <- true
+
+	records, err := ReadCapture(&buf)
+	if err != nil {
+		t.Fatalf("failed to read capture: %v", err)
+	}
+	return records
+}
+
+func Test_Bridge_Recorder_CapturesRequestAndResponse(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	records := recordResizeSession(t)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records got: %d", len(records))
+	}
+	if records[0].Direction != CaptureRequest || records[0].Header.Type != prot.ComputeSystemResizeConsoleV1 {
+		t.Fatalf("expected resize request got: %+v", records[0])
+	}
+	if records[1].Direction != CaptureResponse || records[1].Header.Type != prot.ComputeSystemResponseResizeConsoleV1 {
+		t.Fatalf("expected resize response got: %+v", records[1])
+	}
+	response := &prot.MessageResponseBase{}
+	if err := json.Unmarshal(records[1].Message, response); err != nil {
+		t.Fatalf("failed to unmarshal captured response: %v", err)
+	}
+	if response.Result != 1 {
+		t.Fatalf("expected captured result 1 got: %d", response.Result)
+	}
+}
+
+func Test_Bridge_Replay_Matches_Success(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	records := recordResizeSession(t)
+	mismatches, err := Replay(newResizeBridge(1), records, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("expected no mismatches got: %+v", mismatches)
+	}
+}
+
+func Test_Bridge_Replay_Differs_Mismatch(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	records := recordResizeSession(t)
+	mismatches, err := Replay(newResizeBridge(2), records, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if len(mismatches) != 1 {
+		t.Fatalf("expected 1 mismatch got: %+v", mismatches)
+	}
+	if mismatches[0].Expected.Header.ID != prot.SequenceID(1) {
+		t.Fatalf("expected mismatch for sequence id 1 got: %d", mismatches[0].Expected.Header.ID)
+	}
+}
+
+func Test_Bridge_Replay_NoRequests_Failure(t *testing.T) {
+	if _, err := Replay(newResizeBridge(1), nil, time.Second); err == nil {
+		t.Fatal("expected error got nil")
+	}
+}
+
+func Test_readReplayMessage_InvalidSize_Failure(t *testing.T) {
+	var buf bytes.Buffer
+	header := prot.MessageHeader{
+		Type: prot.ComputeSystemResponseResizeConsoleV1,
+		Size: prot.MessageHeaderSize - 1,
+		ID:   prot.SequenceID(1),
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readReplayMessage(&buf); err == nil {
+		t.Fatal("expected error got nil")
+	}
+}
+
+func Test_readReplayMessage_Truncated_Failure(t *testing.T) {
+	var buf bytes.Buffer
+	header := prot.MessageHeader{
+		Type: prot.ComputeSystemResponseResizeConsoleV1,
+		Size: prot.MessageHeaderSize + 10,
+		ID:   prot.SequenceID(1),
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("{}")
+	if _, err := readReplayMessage(&buf); err == nil {
+		t.Fatal("expected error got nil")
+	}
+}
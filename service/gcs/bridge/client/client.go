@@ -0,0 +1,467 @@
+// Package client defines a host side client of the GCS bridge protocol. It is
+// the counterpart to the guest side `bridge` package and can be used to drive
+// a GCS from a Linux test harness or tool rather than through the HCS.
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrClosed is returned for any call issued after, or pending at the time of,
+// the bridge connection being closed.
+var ErrClosed = errors.New("bridge client: connection closed")
+
+// cancelRequestTimeout bounds the wait for the GCS to acknowledge the cancel of
+// a request whose context is done.
+const cancelRequestTimeout = 5 * time.Second
+
+// responseBase is implemented by all response message types via the embedded
+// `prot.MessageResponseBase`.
+type responseBase interface {
+	Base() *prot.MessageResponseBase
+}
+
+type rpc struct {
+	resp responseBase
+	err  error
+	done chan struct{}
+	// encoding is the message encoding the request was sent in and so that
+	// the response is read in.
+	encoding prot.MessageEncoding
+}
+
+// Client is a connection to the GCS bridge. It frames `prot.MessageHeader` and
+// messages in the negotiated encoding, assigns a unique `prot.SequenceID` to
+// every request and correlates each response back to its caller. Calls may be
+// issued concurrently.
+type Client struct {
+	conn io.ReadWriteCloser
+
+	// writeMu serializes the writes of header and payload to `conn`.
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  prot.SequenceID
+	pending map[prot.SequenceID]*rpc
+	closed  bool
+	// version and encoding are the protocol version and message encoding
+	// selected by `NegotiateProtocol`.
+	version  prot.ProtocolVersion
+	encoding prot.MessageEncoding
+
+	notifications chan *prot.ContainerNotification
+	readDone      chan struct{}
+	readErr       error
+}
+
+// New creates a client over `conn` and starts processing responses and
+// notifications from the GCS. The caller must call `NegotiateProtocol` before
+// issuing any V2 call.
+func New(conn io.ReadWriteCloser) *Client {
+	c := &Client{
+		conn:          conn,
+		nextID:        1,
+		pending:       make(map[prot.SequenceID]*rpc),
+		encoding:      prot.EncodingJSON,
+		notifications: make(chan *prot.ContainerNotification, 16),
+		readDone:      make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Notifications returns the channel on which every `ContainerNotification`
+// published by the GCS is delivered. The channel is closed when the connection
+// is closed. The caller must drain this channel or responses will stop being
+// processed once its buffer is full.
+func (c *Client) Notifications() <-chan *prot.ContainerNotification {
+	return c.notifications
+}
+
+// Close closes the bridge connection and fails all pending calls.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	err := c.conn.Close()
+	<-c.readDone
+	return err
+}
+
+// Wait blocks until the connection is closed and returns the error that caused
+// the response loop to exit, if any.
+func (c *Client) Wait() error {
+	<-c.readDone
+	return c.readErr
+}
+
+// readLoop reads every message sent by the GCS and dispatches it to either the
+// pending call with the matching `SequenceID` or the notification channel.
+func (c *Client) readLoop() {
+	defer close(c.readDone)
+	defer close(c.notifications)
+
+	var err error
+	for {
+		header := &prot.MessageHeader{}
+		if err = binary.Read(c.conn, binary.LittleEndian, header); err != nil {
+			err = errors.Wrap(err, "bridge client: failed reading message header")
+			break
+		}
+		if header.Size < prot.MessageHeaderSize {
+			err = errors.Errorf("bridge client: invalid message size %d", header.Size)
+			break
+		}
+		message := make([]byte, header.Size-prot.MessageHeaderSize)
+		if _, err = io.ReadFull(c.conn, message); err != nil {
+			err = errors.Wrap(err, "bridge client: failed reading message payload")
+			break
+		}
+
+		if header.Type == prot.ComputeSystemNotificationV1 {
+			c.mu.Lock()
+			encoding := c.encoding
+			c.mu.Unlock()
+			var n prot.ContainerNotification
+			if err := prot.Unmarshal(encoding, message, &n); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"message":       message,
+					logrus.ErrorKey: err,
+				}).Error("opengcs::client - failed to unmarshal notification")
+				continue
+			}
+			c.notifications <- &n
+			continue
+		}
+
+		c.mu.Lock()
+		call, ok := c.pending[header.ID]
+		delete(c.pending, header.ID)
+		c.mu.Unlock()
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"message-id":   header.ID,
+				"message-type": header.Type.String(),
+			}).Warn("opengcs::client - response for unknown request")
+			continue
+		}
+		if err := prot.Unmarshal(call.encoding, message, call.resp); err != nil {
+			call.err = errors.Wrap(err, "failed to unmarshal response")
+		}
+		close(call.done)
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		err = nil
+	}
+	c.closed = true
+	c.readErr = err
+	for id, call := range c.pending {
+		call.err = ErrClosed
+		close(call.done)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+}
+
+// call sends `req` as message type `id` and waits for the response to be
+// unmarshaled into `resp`. If the GCS returned a failure the error is returned
+// with the response HRESULT.
+func (c *Client) call(ctx context.Context, id prot.MessageIdentifier, req interface{}, resp responseBase) error {
+	c.mu.Lock()
+	encoding := c.encoding
+	c.mu.Unlock()
+	message, err := prot.Marshal(encoding, req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal request \"%+v\"", req)
+	}
+
+	call := &rpc{
+		resp:     resp,
+		done:     make(chan struct{}),
+		encoding: encoding,
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	seq := c.nextID
+	c.nextID++
+	c.pending[seq] = call
+	c.mu.Unlock()
+
+	header := &prot.MessageHeader{
+		Type: id,
+		Size: uint32(len(message) + prot.MessageHeaderSize),
+		ID:   seq,
+	}
+	if err := c.write(header, message); err != nil {
+		c.mu.Lock()
+		delete(c.pending, seq)
+		c.mu.Unlock()
+		return err
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, seq)
+		c.mu.Unlock()
+		if id != prot.ComputeSystemCancelRequestV1 {
+			// Ask the GCS to abandon the request as well. This is best effort
+			// as the request may have already completed, so don't wait on a
+			// GCS that never answers.
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), cancelRequestTimeout)
+				defer cancel()
+				c.CancelRequest(ctx, seq)
+			}()
+		}
+		return ctx.Err()
+	}
+	if call.err != nil {
+		return call.err
+	}
+	return responseError(resp.Base())
+}
+
+func (c *Client) write(header *prot.MessageHeader, message []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := binary.Write(c.conn, binary.LittleEndian, header); err != nil {
+		return errors.Wrap(err, "bridge client: failed writing message header")
+	}
+	if _, err := c.conn.Write(message); err != nil {
+		return errors.Wrap(err, "bridge client: failed writing message payload")
+	}
+	return nil
+}
+
+// responseError converts a failed response into an error carrying its
+// HRESULT. It returns nil if the response was successful.
+func responseError(base *prot.MessageResponseBase) error {
+	if base.Result == 0 {
+		return nil
+	}
+	message := base.ErrorMessage
+	if message == "" && len(base.ErrorRecords) > 0 {
+		message = base.ErrorRecords[0].Message
+	}
+	return gcserr.WrapHresult(errors.New(message), gcserr.Hresult(base.Result))
+}
+
+// NegotiateProtocol negotiates the protocol version to use for the remainder
+// of the connection and returns the version and capabilities selected by the
+// GCS. At `prot.PvV5` and above the GCS selects the first of `encodings` it
+// supports for all following messages.
+func (c *Client) NegotiateProtocol(ctx context.Context, min, max prot.ProtocolVersion, encodings ...prot.MessageEncoding) (*prot.NegotiateProtocolResponse, error) {
+	req := &prot.NegotiateProtocol{
+		MinimumVersion: uint32(min),
+		MaximumVersion: uint32(max),
+		Encodings:      encodings,
+	}
+	resp := &prot.NegotiateProtocolResponse{}
+	if err := c.call(ctx, prot.ComputeSystemNegotiateProtocolV1, req, resp); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.version = prot.ProtocolVersion(resp.Version)
+	c.encoding = prot.EncodingJSON
+	if resp.Encoding != "" {
+		c.encoding = resp.Encoding
+	}
+	c.mu.Unlock()
+	return resp, nil
+}
+
+// nestedJSON returns the document `v` to be nested in a request at the
+// negotiated protocol version.
+func (c *Client) nestedJSON(v interface{}) prot.NestedJSON {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return prot.NewNestedJSON(c.version, v)
+}
+
+// CreateContainer creates the container `id` with `settings`.
+func (c *Client) CreateContainer(ctx context.Context, id string, settings *prot.VMHostedContainerSettingsV2) error {
+	req := &prot.ContainerCreate{
+		MessageBase:     prot.MessageBase{ContainerID: id},
+		ContainerConfig: c.nestedJSON(settings),
+	}
+	return c.call(ctx, prot.ComputeSystemCreateV1, req, &prot.ContainerCreateResponse{})
+}
+
+// ExecProcess executes `params` in container `id` and returns the pid of the
+// created process. The first call for a container starts its init process.
+// Stdio is relayed over the ports in `stdio` for each pipe requested in
+// `params`.
+func (c *Client) ExecProcess(ctx context.Context, id string, params *prot.ProcessParameters, stdio prot.ExecuteProcessVsockStdioRelaySettings) (uint32, error) {
+	req := &prot.ContainerExecuteProcess{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		Settings: prot.ExecuteProcessSettings{
+			ProcessParameters:       c.nestedJSON(params),
+			VsockStdioRelaySettings: stdio,
+		},
+	}
+	resp := &prot.ContainerExecuteProcessResponse{}
+	if err := c.call(ctx, prot.ComputeSystemExecuteProcessV1, req, resp); err != nil {
+		return 0, err
+	}
+	return resp.ProcessID, nil
+}
+
+// WaitForProcess waits up to `timeout` for process `pid` in container `id` to
+// exit and returns its exit code.
+func (c *Client) WaitForProcess(ctx context.Context, id string, pid uint32, timeout time.Duration) (uint32, error) {
+	req := &prot.ContainerWaitForProcess{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		ProcessID:   pid,
+		TimeoutInMs: uint32(timeout / time.Millisecond),
+	}
+	resp := &prot.ContainerWaitForProcessResponse{}
+	if err := c.call(ctx, prot.ComputeSystemWaitForProcessV1, req, resp); err != nil {
+		return 0, err
+	}
+	return resp.ExitCode, nil
+}
+
+// SignalProcess sends `signal` to process `pid` in container `id`.
+func (c *Client) SignalProcess(ctx context.Context, id string, pid uint32, signal int32) error {
+	req := &prot.ContainerSignalProcess{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		ProcessID:   pid,
+		Options:     prot.SignalProcessOptions{Signal: signal},
+	}
+	return c.call(ctx, prot.ComputeSystemSignalProcessV1, req, &prot.MessageResponseBase{})
+}
+
+// ModifySettings applies `request` to container `id`.
+func (c *Client) ModifySettings(ctx context.Context, id string, request *prot.ModifySettingRequest) error {
+	req := &prot.ContainerModifySettings{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		Request:     request,
+	}
+	return c.call(ctx, prot.ComputeSystemModifySettingsV1, req, &prot.MessageResponseBase{})
+}
+
+// GetProperties returns the properties in `query` for container `id`.
+func (c *Client) GetProperties(ctx context.Context, id string, query prot.PropertyQuery) (*prot.PropertiesV2, error) {
+	req := &prot.ContainerGetProperties{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		Query:       c.nestedJSON(query),
+	}
+	resp := &prot.ContainerGetPropertiesResponse{}
+	if err := c.call(ctx, prot.ComputeSystemGetPropertiesV1, req, resp); err != nil {
+		return nil, err
+	}
+	properties := &prot.PropertiesV2{}
+	if err := resp.Properties.Decode(properties); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal Properties \"%s\"", resp.Properties)
+	}
+	return properties, nil
+}
+
+// DumpStacks returns the stacks of all goroutines in the GCS.
+func (c *Client) DumpStacks(ctx context.Context) (string, error) {
+	req := &prot.MessageBase{}
+	resp := &prot.DumpStacksResponse{}
+	if err := c.call(ctx, prot.ComputeSystemDumpStacksV1, req, resp); err != nil {
+		return "", err
+	}
+	return resp.GuestStacks, nil
+}
+
+// CancelRequest cancels the in-flight request `seq`. The cancelled request
+// completes with `gcserr.HrErrCancelled`. Calls made through this client are
+// cancelled automatically when their context is done.
+func (c *Client) CancelRequest(ctx context.Context, seq prot.SequenceID) error {
+	req := &prot.ContainerCancelRequest{SequenceID: seq}
+	return c.call(ctx, prot.ComputeSystemCancelRequestV1, req, &prot.MessageResponseBase{})
+}
+
+// DeleteContainerState releases all guest resources held by container `id`.
+// The container must have already exited.
+func (c *Client) DeleteContainerState(ctx context.Context, id string) error {
+	req := &prot.MessageBase{ContainerID: id}
+	return c.call(ctx, prot.ComputeSystemDeleteContainerStateV1, req, &prot.MessageResponseBase{})
+}
+
+// ShutdownContainer sends `signal`, or the stop signal of container `id` if 0,
+// to the container. If `gracePeriod` is not 0 the GCS kills the container once
+// it expires. The exit notification of the container reports which of the two
+// stopped it.
+func (c *Client) ShutdownContainer(ctx context.Context, id string, signal uint32, gracePeriod time.Duration) error {
+	req := &prot.ContainerShutdown{
+		MessageBase:     prot.MessageBase{ContainerID: id},
+		Signal:          signal,
+		GracePeriodInMs: uint32(gracePeriod / time.Millisecond),
+	}
+	return c.call(ctx, prot.ComputeSystemShutdownGracefulV1, req, &prot.MessageResponseBase{})
+}
+
+// CollectOrphans returns the resources in the UVM that have not been owned by
+// any container for at least `minAge`. Unless `dryRun` is set the GCS also
+// cleans them up.
+func (c *Client) CollectOrphans(ctx context.Context, minAge time.Duration, dryRun bool) ([]prot.Orphan, error) {
+	req := &prot.CollectOrphans{
+		DryRun:     dryRun,
+		MinAgeInMs: uint32(minAge / time.Millisecond),
+	}
+	resp := &prot.CollectOrphansResponse{}
+	if err := c.call(ctx, prot.ComputeSystemCollectOrphansV1, req, resp); err != nil {
+		return nil, err
+	}
+	return resp.Orphans, nil
+}
+
+// PauseContainer freezes all processes in container `id`. A `prot.NtPaused`
+// notification is published once the container is paused.
+func (c *Client) PauseContainer(ctx context.Context, id string) error {
+	req := &prot.MessageBase{ContainerID: id}
+	return c.call(ctx, prot.ComputeSystemPauseV1, req, &prot.MessageResponseBase{})
+}
+
+// ResumeContainer thaws all processes in container `id`. A `prot.NtResumed`
+// notification is published once the container is resumed.
+func (c *Client) ResumeContainer(ctx context.Context, id string) error {
+	req := &prot.MessageBase{ContainerID: id}
+	return c.call(ctx, prot.ComputeSystemResumeV1, req, &prot.MessageResponseBase{})
+}
+
+// CheckpointContainer writes the state of container `id` to `imagePath` in
+// the UVM. Unless `leaveRunning` is set the container exits once the
+// checkpoint is written.
+func (c *Client) CheckpointContainer(ctx context.Context, id, imagePath string, leaveRunning bool) error {
+	req := &prot.ContainerCheckpoint{
+		MessageBase:  prot.MessageBase{ContainerID: id},
+		ImagePath:    imagePath,
+		LeaveRunning: leaveRunning,
+	}
+	return c.call(ctx, prot.ComputeSystemCheckpointV1, req, &prot.MessageResponseBase{})
+}
+
+// RestoreContainer restores the checkpoint at `imagePath` in the UVM as
+// container `id`. The init process is running once this returns but its stdio
+// is only connected by the following ExecProcess with nil process parameters.
+func (c *Client) RestoreContainer(ctx context.Context, id, imagePath string, settings *prot.VMHostedContainerSettingsV2) error {
+	req := &prot.ContainerRestore{
+		MessageBase:     prot.MessageBase{ContainerID: id},
+		ContainerConfig: c.nestedJSON(settings),
+		ImagePath:       imagePath,
+	}
+	return c.call(ctx, prot.ComputeSystemRestoreV1, req, &prot.ContainerCreateResponse{})
+}
@@ -0,0 +1,341 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/runtime/hcsv2"
+	"github.com/Microsoft/opengcs/service/gcs/bridge"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestClient returns a client connected to a V4 bridge with no runtime.
+// Each of `handlers` replaces the bridge handler of its message at every V2
+// protocol version so that the bridge acts as a mock host.
+//
+// The returned func closes the client and waits for the bridge to stop.
+func newTestClient(t *testing.T, handlers map[prot.MessageIdentifier]bridge.HandlerFunc) (*Client, func()) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	hostConn, guestConn := net.Pipe()
+	mux := bridge.NewBridgeMux()
+	b := &bridge.Bridge{
+		Handler:  mux,
+		EnableV4: true,
+	}
+	b.AssignHandlers(mux, nil, hcsv2.NewHost(nil, nil))
+	for id, h := range handlers {
+		for pv := prot.PvV4; pv <= prot.PvMax; pv++ {
+			mux.Handle(id, pv, h)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		// The bridge fails once the client closes the connection.
+		b.ListenAndServe(guestConn, guestConn)
+		close(done)
+	}()
+
+	c := New(hostConn)
+	return c, func() {
+		c.Close()
+		<-done
+	}
+}
+
+// decodeRequest decodes the message of `r` into `v`.
+func decodeRequest(t *testing.T, r *bridge.Request, v interface{}) {
+	if err := prot.Unmarshal(r.Encoding, r.Message, v); err != nil {
+		t.Errorf("expected nil error decoding %s got: %v", r.Header.Type, err)
+	}
+}
+
+func Test_Client_NegotiateProtocol_Success(t *testing.T) {
+	c, closeClient := newTestClient(t, nil)
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := c.NegotiateProtocol(ctx, prot.PvV4, prot.PvMax)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if resp.Version != uint32(prot.PvMax) {
+		t.Fatalf("expected version %d got: %d", prot.PvMax, resp.Version)
+	}
+	if !resp.Capabilities.GuestDefinedCapabilities.DumpStacksSupported {
+		t.Fatal("expected DumpStacksSupported capability")
+	}
+
+	stacks, err := c.DumpStacks(ctx)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if stacks == "" {
+		t.Fatal("expected non-empty stacks")
+	}
+}
+
+func Test_Client_NegotiateProtocol_InvalidRange_Failure(t *testing.T) {
+	c, closeClient := newTestClient(t, nil)
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.NegotiateProtocol(ctx, prot.PvV3, prot.PvV3)
+	if err == nil {
+		t.Fatal("expected error got nil")
+	}
+	hr, herr := gcserr.GetHresult(err)
+	if herr != nil {
+		t.Fatalf("expected HRESULT in error: %v", herr)
+	}
+	if hr != gcserr.HrVmcomputeUnsupportedProtocolVersion {
+		t.Fatalf("expected HrVmcomputeUnsupportedProtocolVersion got: %v", err)
+	}
+}
+
+func Test_Client_DeleteContainerState_NotFound_Failure(t *testing.T) {
+	c, closeClient := newTestClient(t, nil)
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.NegotiateProtocol(ctx, prot.PvV4, prot.PvMax); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	err := c.DeleteContainerState(ctx, t.Name())
+	if err == nil {
+		t.Fatal("expected error got nil")
+	}
+	hr, herr := gcserr.GetHresult(err)
+	if herr != nil || hr != gcserr.HrVmcomputeSystemNotFound {
+		t.Fatalf("expected HrVmcomputeSystemNotFound got: %v", err)
+	}
+}
+
+func Test_Client_NegotiateProtocol_CBOR_Success(t *testing.T) {
+	c, closeClient := newTestClient(t, nil)
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := c.NegotiateProtocol(ctx, prot.PvV5, prot.PvV5, prot.EncodingCBOR, prot.EncodingJSON)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if resp.Version != uint32(prot.PvV5) || resp.Encoding != prot.EncodingCBOR {
+		t.Fatalf("expected version %d encoding %s got: %d %s", prot.PvV5, prot.EncodingCBOR, resp.Version, resp.Encoding)
+	}
+
+	if stacks, err := c.DumpStacks(ctx); err != nil || stacks == "" {
+		t.Fatalf("expected non-empty stacks got: %q %v", stacks, err)
+	}
+	err = c.DeleteContainerState(ctx, t.Name())
+	hr, herr := gcserr.GetHresult(err)
+	if herr != nil || hr != gcserr.HrVmcomputeSystemNotFound {
+		t.Fatalf("expected HrVmcomputeSystemNotFound got: %v", err)
+	}
+
+	// The nested ContainerConfig is decoded from the CBOR message so the
+	// schema version is validated.
+	err = c.CreateContainer(ctx, t.Name(), &prot.VMHostedContainerSettingsV2{
+		SchemaVersion: prot.SchemaVersion{Major: 2, Minor: 0},
+	})
+	if err == nil || !strings.Contains(err.Error(), "invalid schema version") {
+		t.Fatalf("expected invalid schema version error got: %v", err)
+	}
+}
+
+// containerRequests are the client requests on an existing container.
+var containerRequests = []struct {
+	name string
+	// message is the message type sent by `call`.
+	message prot.MessageIdentifier
+	// supported returns the capability advertising the request.
+	supported func(prot.GcsGuestCapabilities) bool
+	call      func(ctx context.Context, c *Client, id string) error
+	// verify checks the request received by the mock host.
+	verify func(t *testing.T, r *bridge.Request, id string)
+	// failure is the result of the request on a GCS with no containers.
+	failure gcserr.Hresult
+}{
+	{
+		name:      "PauseContainer",
+		message:   prot.ComputeSystemPauseV1,
+		supported: func(c prot.GcsGuestCapabilities) bool { return c.PauseResumeSupported },
+		call: func(ctx context.Context, c *Client, id string) error {
+			return c.PauseContainer(ctx, id)
+		},
+		verify:  verifyContainerID,
+		failure: gcserr.HrVmcomputeSystemNotFound,
+	},
+	{
+		name:      "ResumeContainer",
+		message:   prot.ComputeSystemResumeV1,
+		supported: func(c prot.GcsGuestCapabilities) bool { return c.PauseResumeSupported },
+		call: func(ctx context.Context, c *Client, id string) error {
+			return c.ResumeContainer(ctx, id)
+		},
+		verify:  verifyContainerID,
+		failure: gcserr.HrVmcomputeSystemNotFound,
+	},
+	{
+		name:      "CheckpointContainer",
+		message:   prot.ComputeSystemCheckpointV1,
+		supported: func(c prot.GcsGuestCapabilities) bool { return c.CheckpointRestoreSupported },
+		call: func(ctx context.Context, c *Client, id string) error {
+			return c.CheckpointContainer(ctx, id, "/checkpoint", true)
+		},
+		verify: func(t *testing.T, r *bridge.Request, id string) {
+			var req prot.ContainerCheckpoint
+			decodeRequest(t, r, &req)
+			if req.ContainerID != id || req.ImagePath != "/checkpoint" || !req.LeaveRunning {
+				t.Errorf("expected container %s checkpointed to /checkpoint and left running got: %+v", id, req)
+			}
+		},
+		failure: gcserr.HrVmcomputeSystemNotFound,
+	},
+	{
+		name:      "RestoreContainer",
+		message:   prot.ComputeSystemRestoreV1,
+		supported: func(c prot.GcsGuestCapabilities) bool { return c.CheckpointRestoreSupported },
+		call: func(ctx context.Context, c *Client, id string) error {
+			return c.RestoreContainer(ctx, id, "/checkpoint", &prot.VMHostedContainerSettingsV2{
+				SchemaVersion: prot.SchemaVersion{Major: 2, Minor: 0},
+				OCIBundlePath: "/bundle",
+			})
+		},
+		verify: func(t *testing.T, r *bridge.Request, id string) {
+			var req prot.ContainerRestore
+			decodeRequest(t, r, &req)
+			if req.ContainerID != id || req.ImagePath != "/checkpoint" {
+				t.Errorf("expected container %s restored from /checkpoint got: %+v", id, req)
+			}
+			var settings prot.VMHostedContainerSettingsV2
+			if err := req.ContainerConfig.Decode(&settings); err != nil || settings.OCIBundlePath != "/bundle" {
+				t.Errorf("expected bundle /bundle got: %+v %v", settings, err)
+			}
+		},
+		// The GCS only supports schema 2.1 and above.
+		failure: gcserr.HrVmcomputeInvalidJSON,
+	},
+	{
+		name:      "ShutdownContainer",
+		message:   prot.ComputeSystemShutdownGracefulV1,
+		supported: func(c prot.GcsGuestCapabilities) bool { return c.GracefulShutdownSupported },
+		call: func(ctx context.Context, c *Client, id string) error {
+			return c.ShutdownContainer(ctx, id, 15, 10*time.Second)
+		},
+		verify: func(t *testing.T, r *bridge.Request, id string) {
+			var req prot.ContainerShutdown
+			decodeRequest(t, r, &req)
+			if req.ContainerID != id || req.Signal != 15 || req.GracePeriodInMs != 10000 {
+				t.Errorf("expected container %s shut down with signal 15 and a 10000ms grace period got: %+v", id, req)
+			}
+		},
+		failure: gcserr.HrVmcomputeSystemNotFound,
+	},
+}
+
+func verifyContainerID(t *testing.T, r *bridge.Request, id string) {
+	var req prot.MessageBase
+	decodeRequest(t, r, &req)
+	if req.ContainerID != id {
+		t.Errorf("expected container %s got: %s", id, req.ContainerID)
+	}
+}
+
+func Test_Client_ContainerRequests_Failure(t *testing.T) {
+	for _, test := range containerRequests {
+		t.Run(test.name, func(t *testing.T) {
+			c, closeClient := newTestClient(t, nil)
+			defer closeClient()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			resp, err := c.NegotiateProtocol(ctx, prot.PvV4, prot.PvMax)
+			if err != nil {
+				t.Fatalf("expected nil error got: %v", err)
+			}
+			if !test.supported(resp.Capabilities.GuestDefinedCapabilities) {
+				t.Fatalf("expected %s to be supported", test.name)
+			}
+			err = test.call(ctx, c, t.Name())
+			if hr, herr := gcserr.GetHresult(err); herr != nil || hr != test.failure {
+				t.Fatalf("expected 0x%x got: %v", uint32(test.failure), err)
+			}
+		})
+	}
+}
+
+func Test_Client_ContainerRequests_Success(t *testing.T) {
+	for _, test := range containerRequests {
+		for _, enc := range []prot.MessageEncoding{prot.EncodingJSON, prot.EncodingCBOR} {
+			t.Run(fmt.Sprintf("%s-%s", test.name, enc), func(t *testing.T) {
+				handled := make(chan struct{}, 1)
+				c, closeClient := newTestClient(t, map[prot.MessageIdentifier]bridge.HandlerFunc{
+					test.message: func(r *bridge.Request) (bridge.RequestResponse, error) {
+						test.verify(t, r, "abcdef")
+						handled <- struct{}{}
+						return &prot.MessageResponseBase{}, nil
+					},
+				})
+				defer closeClient()
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				if _, err := c.NegotiateProtocol(ctx, prot.PvV5, prot.PvV5, enc); err != nil {
+					t.Fatalf("expected nil error got: %v", err)
+				}
+				if err := test.call(ctx, c, "abcdef"); err != nil {
+					t.Fatalf("expected nil error got: %v", err)
+				}
+				select {
+				case <-handled:
+				default:
+					t.Fatalf("expected %s to be handled by the mock host", test.message)
+				}
+			})
+		}
+	}
+}
+
+func Test_Client_Close_FailsPendingCalls(t *testing.T) {
+	hostConn, guestConn := net.Pipe()
+	defer guestConn.Close()
+
+	c := New(hostConn)
+	go func() {
+		// Consume the request but never respond.
+		header := &prot.MessageHeader{}
+		if err := binary.Read(guestConn, binary.LittleEndian, header); err == nil {
+			io.ReadFull(guestConn, make([]byte, header.Size-prot.MessageHeaderSize))
+		}
+		c.Close()
+	}()
+
+	_, err := c.DumpStacks(context.Background())
+	if err != ErrClosed {
+		t.Fatalf("expected ErrClosed got: %v", err)
+	}
+	if _, ok := <-c.Notifications(); ok {
+		t.Fatal("expected notifications channel to be closed")
+	}
+}
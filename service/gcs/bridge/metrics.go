@@ -0,0 +1,162 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/sirupsen/logrus"
+)
+
+// MessageMetrics are the latency metrics for a single message type.
+type MessageMetrics struct {
+	// Count is the number of requests that have completed.
+	Count uint64
+	// Errors is the number of requests that completed with an error.
+	Errors uint64
+	// Total is the sum of the latency of all completed requests.
+	Total time.Duration
+	// Max is the highest latency of any completed request.
+	Max time.Duration
+}
+
+// Mean returns the average latency of all completed requests.
+func (mm MessageMetrics) Mean() time.Duration {
+	if mm.Count == 0 {
+		return 0
+	}
+	return mm.Total / time.Duration(mm.Count)
+}
+
+// QueueMetrics are the metrics for the bridge request queue and workers.
+type QueueMetrics struct {
+	// Depth is the number of requests waiting for a worker.
+	Depth int
+	// MaxDepth is the highest `Depth` seen.
+	MaxDepth int
+	// Working is the number of requests being handled by a worker.
+	Working int
+	// MaxWorking is the highest `Working` seen.
+	MaxWorking int
+	// Rejected is the number of requests that were failed without being
+	// handled because they were too large or over a limit.
+	Rejected uint64
+}
+
+// Metrics collects per message type request metrics for the bridge. It is
+// safe for concurrent use.
+type Metrics struct {
+	mu       sync.Mutex
+	messages map[prot.MessageIdentifier]*MessageMetrics
+	queue    QueueMetrics
+}
+
+// NewMetrics creates an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		messages: make(map[prot.MessageIdentifier]*MessageMetrics),
+	}
+}
+
+func (m *Metrics) observe(id prot.MessageIdentifier, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mm, ok := m.messages[id]
+	if !ok {
+		mm = &MessageMetrics{}
+		m.messages[id] = mm
+	}
+	mm.Count++
+	if err != nil {
+		mm.Errors++
+	}
+	mm.Total += d
+	if d > mm.Max {
+		mm.Max = d
+	}
+}
+
+func (m *Metrics) setQueueDepth(depth int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queue.Depth = depth
+	if depth > m.queue.MaxDepth {
+		m.queue.MaxDepth = depth
+	}
+}
+
+func (m *Metrics) addWorking(delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queue.Working += delta
+	if m.queue.Working > m.queue.MaxWorking {
+		m.queue.MaxWorking = m.queue.Working
+	}
+}
+
+func (m *Metrics) rejected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queue.Rejected++
+}
+
+// Queue returns a copy of the current queue metrics.
+func (m *Metrics) Queue() QueueMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.queue
+}
+
+// Snapshot returns a copy of the current metrics for every message type that
+// has completed at least one request.
+func (m *Metrics) Snapshot() map[prot.MessageIdentifier]MessageMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := make(map[prot.MessageIdentifier]MessageMetrics, len(m.messages))
+	for id, mm := range m.messages {
+		s[id] = *mm
+	}
+	return s
+}
+
+// log logs the queue metrics and the metrics of every message type at debug
+// level.
+func (m *Metrics) log() {
+	q := m.Queue()
+	logrus.WithFields(logrus.Fields{
+		"queue-depth":     q.Depth,
+		"max-queue-depth": q.MaxDepth,
+		"working":         q.Working,
+		"max-working":     q.MaxWorking,
+		"rejected":        q.Rejected,
+	}).Debug("opengcs::bridge - queue metrics")
+	for id, mm := range m.Snapshot() {
+		logrus.WithFields(logrus.Fields{
+			"message-type": id.String(),
+			"count":        mm.Count,
+			"errors":       mm.Errors,
+			"mean-latency": mm.Mean().String(),
+			"max-latency":  mm.Max.String(),
+		}).Debug("opengcs::bridge - request metrics")
+	}
+}
+
+// logPeriodically calls `log` every `interval` until `done` is closed.
+func (m *Metrics) logPeriodically(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		m.log()
+	}
+}
@@ -0,0 +1,136 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+// Middleware wraps a Handler to run common logic before and/or after it is
+// invoked.
+type Middleware func(Handler) Handler
+
+// Chain wraps `h` in `middleware`. The first middleware is the outermost and
+// is the first to see each request.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// RecoverPanics converts a panic in `h` into an `HrFail` error response rather
+// than allowing it to take down the GCS. The stack of the panic is returned to
+// the host in the response `ErrorRecords`.
+func RecoverPanics(h Handler) Handler {
+	return HandlerFunc(func(r *Request) (resp RequestResponse, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				// `errors.Errorf` records the stack while the panicking frames
+				// are still on it.
+				err = gcserr.WrapHresult(errors.Errorf("bridge: handler panic: %v", p), gcserr.HrFail)
+				resp = nil
+				log.G(r.Context).WithFields(logrus.Fields{
+					"message-type":  r.Header.Type.String(),
+					"cid":           r.ContainerID,
+					logrus.ErrorKey: err,
+					"stack":         fmt.Sprintf("%+v", gcserr.BaseStackTrace(err)),
+				}).Error("opengcs::bridge::RecoverPanics - recovered handler panic")
+			}
+		}()
+		return h.ServeMsg(r)
+	})
+}
+
+// LogRequests logs the completion of every request with its duration and
+// result at debug level.
+func LogRequests(h Handler) Handler {
+	return HandlerFunc(func(r *Request) (RequestResponse, error) {
+		start := time.Now()
+		resp, err := h.ServeMsg(r)
+		entry := log.G(r.Context).WithFields(logrus.Fields{
+			"message-type": r.Header.Type.String(),
+			"message-id":   r.Header.ID,
+			"activityID":   r.ActivityID,
+			"cid":          r.ContainerID,
+			"duration":     time.Since(start).String(),
+		})
+		if err != nil {
+			entry.WithError(err).Debug("opengcs::bridge - request failed")
+		} else {
+			entry.Debug("opengcs::bridge - request completed")
+		}
+		return resp, err
+	})
+}
+
+// RecordLatency returns a Middleware that records the latency and result of
+// every request in `m`.
+func RecordLatency(m *Metrics) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(r *Request) (RequestResponse, error) {
+			start := time.Now()
+			resp, err := h.ServeMsg(r)
+			m.observe(r.Header.Type, time.Since(start), err)
+			return resp, err
+		})
+	}
+}
+
+// ValidateJSON fails any request whose message is not valid JSON with
+// `HrVmcomputeInvalidJSON` before it reaches `h`. Messages in any other
+// encoding are validated as they are unmarshaled.
+func ValidateJSON(h Handler) Handler {
+	return HandlerFunc(func(r *Request) (RequestResponse, error) {
+		if (r.Encoding == "" || r.Encoding == prot.EncodingJSON) && !json.Valid(r.Message) {
+			return nil, gcserr.WrapHresult(
+				errors.Errorf("bridge: invalid JSON in message \"%s\"", r.Message),
+				gcserr.HrVmcomputeInvalidJSON)
+		}
+		return h.ServeMsg(r)
+	})
+}
+
+// Trace returns a Middleware that runs every request in a span named
+// "opengcs::bridge::<name>". The span is the current span of the
+// `Request.Context` passed to the handler, which can add its own attributes
+// with `trace.FromContext`.
+func Trace(name string) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(r *Request) (_ RequestResponse, err error) {
+			ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::"+name)
+			defer span.End()
+			defer func() { oc.SetSpanStatus(span, err) }()
+			span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+
+			r.Context = ctx
+			return h.ServeMsg(r)
+		})
+	}
+}
+
+// Unmarshal returns a Middleware that unmarshals the message of every request
+// into a new value of the type of `message` and sets a pointer to it as the
+// `Request.Body` passed to the handler.
+func Unmarshal(message interface{}) Middleware {
+	t := reflect.TypeOf(message)
+	return func(h Handler) Handler {
+		return HandlerFunc(func(r *Request) (RequestResponse, error) {
+			body := reflect.New(t).Interface()
+			if err := prot.Unmarshal(r.Encoding, r.Message, body); err != nil {
+				return nil, wrapUnmarshalError(err, r)
+			}
+			r.Body = body
+			return h.ServeMsg(r)
+		})
+	}
+}
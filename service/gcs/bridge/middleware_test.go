@@ -0,0 +1,226 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+func newMiddlewareRequest(message string) *Request {
+	return &Request{
+		Context: context.Background(),
+		Header: &prot.MessageHeader{
+			Type: prot.ComputeSystemResizeConsoleV1,
+			ID:   prot.SequenceID(1),
+		},
+		Message: []byte(message),
+	}
+}
+
+func Test_Chain_Order(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(h Handler) Handler {
+			return HandlerFunc(func(r *Request) (RequestResponse, error) {
+				order = append(order, name)
+				return h.ServeMsg(r)
+			})
+		}
+	}
+	h := Chain(HandlerFunc(func(r *Request) (RequestResponse, error) {
+		order = append(order, "handler")
+		return nil, nil
+	}), mw("first"), mw("second"))
+
+	if _, err := h.ServeMsg(newMiddlewareRequest("{}")); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if strings.Join(order, ",") != "first,second,handler" {
+		t.Fatalf("expected order first,second,handler got: %v", order)
+	}
+}
+
+func Test_RecoverPanics_ReturnsHrFail(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	h := RecoverPanics(HandlerFunc(func(r *Request) (RequestResponse, error) {
+		panic("boom")
+	}))
+
+	resp, err := h.ServeMsg(newMiddlewareRequest("{}"))
+	if resp != nil {
+		t.Fatalf("expected nil response got: %+v", resp)
+	}
+	if err == nil {
+		t.Fatal("expected error got nil")
+	}
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrFail {
+		t.Fatalf("expected HrFail got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expected panic value in error got: %v", err)
+	}
+	if gcserr.BaseStackTrace(err) == nil {
+		t.Fatal("expected stack trace in error")
+	}
+}
+
+func Test_ValidateJSON_InvalidJSON_Failure(t *testing.T) {
+	called := false
+	h := ValidateJSON(HandlerFunc(func(r *Request) (RequestResponse, error) {
+		called = true
+		return nil, nil
+	}))
+
+	_, err := h.ServeMsg(newMiddlewareRequest("{not json"))
+	if called {
+		t.Fatal("expected handler not to be called")
+	}
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrVmcomputeInvalidJSON {
+		t.Fatalf("expected HrVmcomputeInvalidJSON got: %v", err)
+	}
+
+	if _, err := h.ServeMsg(newMiddlewareRequest("{}")); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if !called {
+		t.Fatal("expected handler to be called")
+	}
+}
+
+func Test_RecordLatency_CountsRequests(t *testing.T) {
+	m := NewMetrics()
+	fail := false
+	h := RecordLatency(m)(HandlerFunc(func(r *Request) (RequestResponse, error) {
+		if fail {
+			return nil, errors.New("failed")
+		}
+		return nil, nil
+	}))
+
+	h.ServeMsg(newMiddlewareRequest("{}"))
+	fail = true
+	h.ServeMsg(newMiddlewareRequest("{}"))
+
+	mm, ok := m.Snapshot()[prot.ComputeSystemResizeConsoleV1]
+	if !ok {
+		t.Fatal("expected metrics for ComputeSystemResizeConsoleV1")
+	}
+	if mm.Count != 2 || mm.Errors != 1 {
+		t.Fatalf("expected 2 requests and 1 error got: %+v", mm)
+	}
+	if mm.Max > mm.Total || mm.Mean() > mm.Max {
+		t.Fatalf("inconsistent latency metrics: %+v", mm)
+	}
+}
+
+func Test_Metrics_Log(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(ioutil.Discard)
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.DebugLevel)
+	defer logrus.SetLevel(level)
+
+	m := NewMetrics()
+	m.setQueueDepth(3)
+	m.rejected()
+	m.observe(prot.ComputeSystemResizeConsoleV1, time.Millisecond, nil)
+	m.log()
+
+	for _, s := range []string{"max-queue-depth=3", "rejected=1", "message-type=ComputeSystemResizeConsoleV1", "count=1"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("expected %q to be logged got: %s", s, buf.String())
+		}
+	}
+}
+
+func Test_Unmarshal_SetsBody(t *testing.T) {
+	var body *prot.ContainerResizeConsole
+	h := Unmarshal(prot.ContainerResizeConsole{})(HandlerFunc(func(r *Request) (RequestResponse, error) {
+		body = r.Body.(*prot.ContainerResizeConsole)
+		return nil, nil
+	}))
+
+	if _, err := h.ServeMsg(newMiddlewareRequest(`{"ProcessId":101,"Height":24}`)); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if body == nil || body.ProcessID != 101 || body.Height != 24 {
+		t.Fatalf("expected unmarshaled body got: %+v", body)
+	}
+
+	_, err := h.ServeMsg(newMiddlewareRequest(`{"Height":"24"}`))
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrVmcomputeInvalidJSON {
+		t.Fatalf("expected HrVmcomputeInvalidJSON got: %v", err)
+	}
+}
+
+func Test_Trace_StartsSpan(t *testing.T) {
+	var span *trace.Span
+	h := Trace("resizeConsoleV2")(HandlerFunc(func(r *Request) (RequestResponse, error) {
+		span = trace.FromContext(r.Context)
+		return nil, nil
+	}))
+
+	if _, err := h.ServeMsg(newMiddlewareRequest("{}")); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if span == nil {
+		t.Fatal("expected the handler context to carry a span")
+	}
+}
+
+func Test_Bridge_ListenAndServe_HandlerPanic_HrFail(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	lc := newLoopbackConnection()
+	defer lc.close()
+
+	mux := NewBridgeMux()
+	mux.HandleFunc(prot.ComputeSystemResizeConsoleV1, prot.PvV3, func(r *Request) (RequestResponse, error) {
+		panic("boom")
+	}, RecoverPanics)
+	b := &Bridge{
+		Handler: mux,
+		protVer: prot.PvV3,
+	}
+
+	go func() {
+		if err := b.ListenAndServe(lc.SRead(), lc.SWrite()); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		b.quitChan <- true
+	}()
+
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemResizeConsoleV1, prot.SequenceID(1), &prot.ContainerResizeConsole{}); err != nil {
+		t.Fatal("Failed to send message to server")
+	}
+	_, body, err := serverRead(lc.CRead())
+	if err != nil {
+		t.Fatal("Failed to read response from server")
+	}
+	response := &prot.MessageResponseBase{}
+	if err := json.Unmarshal(body, response); err != nil {
+		t.Fatal("Failed to unmarshal response body from server")
+	}
+	if response.Result != int32(gcserr.HrFail) {
+		t.Fatalf("expected HrFail got: 0x%x", uint32(response.Result))
+	}
+	if len(response.ErrorRecords) == 0 || response.ErrorRecords[0].StackTrace == "" {
+		t.Fatalf("expected stack in error records got: %+v", response.ErrorRecords)
+	}
+}
@@ -0,0 +1,190 @@
+package bridge
+
+import (
+	"sync"
+
+	"github.com/Microsoft/opengcs/internal/runtime/hcsv2"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaxMessageSize is the largest message, including its header,
+	// accepted from the host when `Bridge.MaxMessageSize` is not set.
+	DefaultMaxMessageSize = 1024 * 1024
+	// DefaultMaxWorkers is the number of requests that are handled
+	// concurrently when `Bridge.MaxWorkers` is not set.
+	DefaultMaxWorkers = 256
+	// DefaultMaxQueuedRequests is the number of requests that can wait for a
+	// worker when `Bridge.MaxQueuedRequests` is not set.
+	DefaultMaxQueuedRequests = 64
+)
+
+// DefaultConcurrencyLimits are the per message type limits used when
+// `Bridge.ConcurrencyLimits` is not set.
+var DefaultConcurrencyLimits = map[prot.MessageIdentifier]int{
+	prot.ComputeSystemCreateV1:           16,
+	prot.ComputeSystemExecuteProcessV1:   32,
+	prot.ComputeSystemModifySettingsV1:   32,
+	prot.ComputeSystemGetPropertiesV1:    32,
+	prot.ComputeSystemDumpStacksV1:       1,
+	prot.ComputeSystemPauseV1:            32,
+	prot.ComputeSystemResumeV1:           32,
+	prot.ComputeSystemCheckpointV1:       4,
+	prot.ComputeSystemRestoreV1:          4,
+	prot.ComputeSystemCollectOrphansV1:   1,
+	prot.ComputeSystemSignalProcessV1:    32,
+	prot.ComputeSystemResizeConsoleV1:    32,
+	prot.ComputeSystemShutdownForcedV1:   32,
+	prot.ComputeSystemShutdownGracefulV1: 32,
+}
+
+// DefaultUnorderedMessages are the message types that are not ordered with the
+// other requests to the same container when `Bridge.UnorderedMessages` is not
+// set. Read-only requests are safe to run at any time.
+var DefaultUnorderedMessages = map[prot.MessageIdentifier]bool{
+	prot.ComputeSystemGetPropertiesV1: true,
+	prot.ComputeSystemDumpStacksV1:    true,
+}
+
+// unpooledMessages are the message types that are handled as soon as they are
+// read, outside of the workers, queue, limits and ordering of the pool.
+// `ComputeSystemWaitForProcessV1` would otherwise hold a worker for as long as
+// the process runs and a wait only completes when a later request causes the
+// process to exit. `ComputeSystemCancelRequestV1` must be able to cancel the
+// requests of a saturated pool.
+var unpooledMessages = map[prot.MessageIdentifier]bool{
+	prot.ComputeSystemWaitForProcessV1: true,
+	prot.ComputeSystemCancelRequestV1:  true,
+}
+
+// workerPool runs requests on a fixed number of workers. Requests that arrive
+// while all workers are busy wait in a bounded queue.
+//
+// Requests for the same container are handled one at a time in the order they
+// were submitted. Requests for different containers, requests without a
+// container, requests to the UVM itself and requests in `unordered` run in
+// parallel.
+type workerPool struct {
+	queue     chan *Request
+	handle    func(*Request)
+	metrics   *Metrics
+	unordered map[prot.MessageIdentifier]bool
+
+	mu sync.Mutex
+	// limits is the maximum number of requests of each type that may be queued
+	// or running at the same time. Types without a limit are only bound by the
+	// queue and workers.
+	limits map[prot.MessageIdentifier]int
+	// active is the number of requests of each type queued or running.
+	active map[prot.MessageIdentifier]int
+	// containers has an entry for every container with an ordered request
+	// queued or running. The entry holds the ordered requests waiting for that
+	// request to complete.
+	containers map[string][]*Request
+	// waiting is the total number of requests held in `containers`.
+	waiting int
+}
+
+func newWorkerPool(workers, queued int, limits map[prot.MessageIdentifier]int, unordered map[prot.MessageIdentifier]bool, metrics *Metrics, handle func(*Request)) *workerPool {
+	p := &workerPool{
+		queue:      make(chan *Request, queued),
+		handle:     handle,
+		metrics:    metrics,
+		unordered:  unordered,
+		limits:     limits,
+		active:     make(map[prot.MessageIdentifier]int),
+		containers: make(map[string][]*Request),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// ordered returns true if `r` must wait for the earlier requests to the same
+// container. Requests to the UVM, such as the mounts and network adapters of
+// every pod, are not ordered.
+func (p *workerPool) ordered(r *Request) bool {
+	return r.ContainerID != "" && r.ContainerID != hcsv2.UVMContainerID && !p.unordered[r.Header.Type]
+}
+
+func (p *workerPool) work() {
+	for r := range p.queue {
+		p.mu.Lock()
+		p.metrics.setQueueDepth(len(p.queue) + p.waiting)
+		p.mu.Unlock()
+
+		// Keep handling the requests for the same container that queued up
+		// behind `r` so that they run in order.
+		for r != nil {
+			p.metrics.addWorking(1)
+			p.handle(r)
+			p.metrics.addWorking(-1)
+
+			p.mu.Lock()
+			p.active[r.Header.Type]--
+			var next *Request
+			if p.ordered(r) {
+				if waiting := p.containers[r.ContainerID]; len(waiting) > 0 {
+					next = waiting[0]
+					p.containers[r.ContainerID] = waiting[1:]
+					p.waiting--
+					p.metrics.setQueueDepth(len(p.queue) + p.waiting)
+				} else {
+					delete(p.containers, r.ContainerID)
+				}
+			}
+			p.mu.Unlock()
+			r = next
+		}
+	}
+}
+
+// submit queues `r` to be handled by the next free worker, or behind the
+// request already queued or running for the same container. It returns an
+// `HrErrBusy` error without queuing `r` if its message type is at its limit or
+// the queue is full. Requests in `unpooledMessages` are always handled
+// immediately on their own goroutine.
+func (p *workerPool) submit(r *Request) error {
+	t := r.Header.Type
+	if unpooledMessages[t] {
+		go p.handle(r)
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if limit, ok := p.limits[t]; ok && p.active[t] >= limit {
+		p.metrics.rejected()
+		return gcserr.WrapHresult(errors.Errorf("bridge: too many concurrent %s requests", t), gcserr.HrErrBusy)
+	}
+	if len(p.queue)+p.waiting >= cap(p.queue) {
+		p.metrics.rejected()
+		return gcserr.WrapHresult(errors.New("bridge: request queue is full"), gcserr.HrErrBusy)
+	}
+
+	p.active[t]++
+	if p.ordered(r) {
+		if waiting, ok := p.containers[r.ContainerID]; ok {
+			p.containers[r.ContainerID] = append(waiting, r)
+			p.waiting++
+			p.metrics.setQueueDepth(len(p.queue) + p.waiting)
+			return nil
+		}
+		p.containers[r.ContainerID] = nil
+	}
+	// Only `submit` sends on the queue and the space was checked above so this
+	// will not block.
+	p.queue <- r
+	p.metrics.setQueueDepth(len(p.queue) + p.waiting)
+	return nil
+}
+
+// close stops accepting requests. The workers exit once all queued requests
+// have been handled.
+func (p *workerPool) close() {
+	close(p.queue)
+}
@@ -0,0 +1,280 @@
+package bridge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/runtime/hcsv2"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/sirupsen/logrus"
+)
+
+func readResponseBase(t *testing.T, lc *loopbackConnection) (*prot.MessageHeader, *prot.MessageResponseBase) {
+	header, body, err := serverRead(lc.CRead())
+	if err != nil {
+		t.Fatalf("Failed to read response from server: %v", err)
+	}
+	response := &prot.MessageResponseBase{}
+	if err := json.Unmarshal(body, response); err != nil {
+		t.Fatalf("Failed to unmarshal response body from server: %v", err)
+	}
+	return header, response
+}
+
+func Test_Bridge_ListenAndServe_MessageTooLarge_InvalidJSON(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	lc := newLoopbackConnection()
+	defer lc.close()
+
+	mux := NewBridgeMux()
+	mux.HandleFunc(prot.ComputeSystemResizeConsoleV1, prot.PvV3, func(r *Request) (RequestResponse, error) {
+		return &prot.MessageResponseBase{}, nil
+	})
+	b := &Bridge{
+		Handler:        mux,
+		MaxMessageSize: 256,
+		protVer:        prot.PvV3,
+	}
+
+	go func() {
+		if err := b.ListenAndServe(lc.SRead(), lc.SWrite()); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		b.quitChan <- true
+	}()
+
+	large := &prot.ContainerResizeConsole{
+		MessageBase: prot.MessageBase{
+			ContainerID: strings.Repeat("a", 512),
+		},
+	}
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemResizeConsoleV1, prot.SequenceID(1), large); err != nil {
+		t.Fatal("Failed to send message to server")
+	}
+	header, response := readResponseBase(t, lc)
+	if header.ID != prot.SequenceID(1) || response.Result != int32(gcserr.HrVmcomputeInvalidJSON) {
+		t.Fatalf("expected HrVmcomputeInvalidJSON for sequence id 1 got: %d 0x%x", header.ID, uint32(response.Result))
+	}
+
+	// The connection is still usable after the large message.
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemResizeConsoleV1, prot.SequenceID(2), &prot.ContainerResizeConsole{}); err != nil {
+		t.Fatal("Failed to send message to server")
+	}
+	header, response = readResponseBase(t, lc)
+	if header.ID != prot.SequenceID(2) || response.Result != 0 {
+		t.Fatalf("expected success for sequence id 2 got: %d 0x%x", header.ID, uint32(response.Result))
+	}
+	if rejected := b.Metrics().Queue().Rejected; rejected != 1 {
+		t.Fatalf("expected 1 rejected request got: %d", rejected)
+	}
+}
+
+func Test_Bridge_ListenAndServe_ConcurrencyLimit_Busy(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	lc := newLoopbackConnection()
+	defer lc.close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := NewBridgeMux()
+	mux.HandleFunc(prot.ComputeSystemGetPropertiesV1, prot.PvV3, func(r *Request) (RequestResponse, error) {
+		close(started)
+		<-release
+		return &prot.MessageResponseBase{}, nil
+	})
+	b := &Bridge{
+		Handler: mux,
+		ConcurrencyLimits: map[prot.MessageIdentifier]int{
+			prot.ComputeSystemGetPropertiesV1: 1,
+		},
+		protVer: prot.PvV3,
+	}
+
+	go func() {
+		if err := b.ListenAndServe(lc.SRead(), lc.SWrite()); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		b.quitChan <- true
+	}()
+
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemGetPropertiesV1, prot.SequenceID(1), &prot.ContainerGetProperties{}); err != nil {
+		t.Fatal("Failed to send message to server")
+	}
+	<-started
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemGetPropertiesV1, prot.SequenceID(2), &prot.ContainerGetProperties{}); err != nil {
+		t.Fatal("Failed to send message to server")
+	}
+	header, response := readResponseBase(t, lc)
+	if header.ID != prot.SequenceID(2) || response.Result != int32(gcserr.HrErrBusy) {
+		t.Fatalf("expected HrErrBusy for sequence id 2 got: %d 0x%x", header.ID, uint32(response.Result))
+	}
+
+	close(release)
+	header, response = readResponseBase(t, lc)
+	if header.ID != prot.SequenceID(1) || response.Result != 0 {
+		t.Fatalf("expected success for sequence id 1 got: %d 0x%x", header.ID, uint32(response.Result))
+	}
+}
+
+func Test_WorkerPool_QueueFull_Busy(t *testing.T) {
+	m := NewMetrics()
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	done := make(chan struct{}, 2)
+	p := newWorkerPool(1, 1, nil, nil, m, func(r *Request) {
+		started <- struct{}{}
+		<-release
+		done <- struct{}{}
+	})
+	defer p.close()
+
+	r := newMiddlewareRequest("{}")
+	// The first request is taken by the worker and the second fills the queue
+	// so the third must be rejected.
+	if err := p.submit(r); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	<-started
+	if err := p.submit(r); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	err := p.submit(r)
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrBusy {
+		t.Fatalf("expected HrErrBusy got: %v", err)
+	}
+
+	q := m.Queue()
+	if q.Depth != 1 || q.MaxDepth != 1 || q.Rejected != 1 {
+		t.Fatalf("unexpected queue metrics: %+v", q)
+	}
+	close(release)
+	<-done
+	<-done
+}
+
+func newContainerRequest(t prot.MessageIdentifier, cid string, id prot.SequenceID) *Request {
+	r := newMiddlewareRequest("{}")
+	r.Header.Type = t
+	r.Header.ID = id
+	r.ContainerID = cid
+	return r
+}
+
+func Test_WorkerPool_SameContainer_Ordered(t *testing.T) {
+	started := make(chan prot.SequenceID, 4)
+	release := make(map[prot.SequenceID]chan struct{})
+	for id := prot.SequenceID(1); id <= 4; id++ {
+		release[id] = make(chan struct{})
+	}
+	p := newWorkerPool(4, 4, nil, DefaultUnorderedMessages, NewMetrics(), func(r *Request) {
+		started <- r.Header.ID
+		<-release[r.Header.ID]
+	})
+	defer p.close()
+
+	requests := []*Request{
+		newContainerRequest(prot.ComputeSystemExecuteProcessV1, "a", 1),
+		newContainerRequest(prot.ComputeSystemDeleteContainerStateV1, "a", 2),
+		newContainerRequest(prot.ComputeSystemExecuteProcessV1, "b", 3),
+		newContainerRequest(prot.ComputeSystemGetPropertiesV1, "a", 4),
+	}
+	for _, r := range requests {
+		if err := p.submit(r); err != nil {
+			t.Fatalf("expected nil error got: %v", err)
+		}
+	}
+
+	// 1, 3 and 4 can all run in parallel but 2 must wait for 1.
+	running := map[prot.SequenceID]bool{}
+	for i := 0; i < 3; i++ {
+		running[<-started] = true
+	}
+	if !running[1] || !running[3] || !running[4] {
+		t.Fatalf("expected requests 1, 3 and 4 to be running got: %v", running)
+	}
+	select {
+	case id := <-started:
+		t.Fatalf("expected request %d to wait for request 1", id)
+	default:
+	}
+
+	close(release[1])
+	if id := <-started; id != 2 {
+		t.Fatalf("expected request 2 to start after request 1 got: %d", id)
+	}
+	for _, id := range []prot.SequenceID{2, 3, 4} {
+		close(release[id])
+	}
+}
+
+func Test_WorkerPool_UVM_Unordered(t *testing.T) {
+	started := make(chan prot.SequenceID, 2)
+	release := make(chan struct{})
+	p := newWorkerPool(2, 2, nil, DefaultUnorderedMessages, NewMetrics(), func(r *Request) {
+		started <- r.Header.ID
+		<-release
+	})
+	defer p.close()
+	defer close(release)
+
+	// Two mounts of different pods are both sent to the UVM.
+	for id := prot.SequenceID(1); id <= 2; id++ {
+		if err := p.submit(newContainerRequest(prot.ComputeSystemModifySettingsV1, hcsv2.UVMContainerID, id)); err != nil {
+			t.Fatalf("expected nil error got: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected both UVM requests to run in parallel")
+		}
+	}
+}
+
+func Test_WorkerPool_Unpooled_NotLimited(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	handled := make(chan *Request)
+	p := newWorkerPool(0, 0, map[prot.MessageIdentifier]int{
+		prot.ComputeSystemWaitForProcessV1: 0,
+		prot.ComputeSystemCancelRequestV1:  0,
+	}, nil, NewMetrics(), func(r *Request) {
+		handled <- r
+		<-release
+	})
+	defer p.close()
+
+	// There are no workers and no space in the queue so only requests that
+	// bypass the pool are handled.
+	for i, mt := range []prot.MessageIdentifier{
+		prot.ComputeSystemWaitForProcessV1,
+		prot.ComputeSystemWaitForProcessV1,
+		prot.ComputeSystemCancelRequestV1,
+	} {
+		r := newContainerRequest(mt, "a", prot.SequenceID(i))
+		if err := p.submit(r); err != nil {
+			t.Fatalf("expected nil error for %s got: %v", mt, err)
+		}
+		if h := <-handled; h != r {
+			t.Fatalf("expected request %d to be handled got: %d", i, h.Header.ID)
+		}
+	}
+
+	err := p.submit(newContainerRequest(prot.ComputeSystemExecuteProcessV1, "a", 3))
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrBusy {
+		t.Fatalf("expected HrErrBusy for a pooled request got: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+)
+
+// replayIgnoredFields are the top level response fields that are expected to
+// differ between the captured session and a replay, such as stacks which
+// depend on the build and timing of the GCS.
+var replayIgnoredFields = []string{
+	"ErrorRecords",
+	"GuestStacks",
+}
+
+// ReplayMismatch describes a captured response or notification that was not
+// reproduced by the replay.
+type ReplayMismatch struct {
+	// Expected is the captured response or notification.
+	Expected CaptureRecord
+	// Actual is the payload written by the bridge during replay. It is `nil`
+	// if no matching message was written within the timeout.
+	Actual json.RawMessage `json:",omitempty"`
+	// Reason describes why the messages were considered different.
+	Reason string
+}
+
+type replayMessage struct {
+	header  prot.MessageHeader
+	message []byte
+}
+
+// readReplayMessage reads the next message written by the bridge from `r`.
+func readReplayMessage(r io.Reader) (m replayMessage, err error) {
+	if err := binary.Read(r, binary.LittleEndian, &m.header); err != nil {
+		return m, errors.Wrap(err, "failed reading message header")
+	}
+	if m.header.Size < prot.MessageHeaderSize {
+		return m, errors.Errorf("invalid message size %d", m.header.Size)
+	}
+	m.message = make([]byte, m.header.Size-prot.MessageHeaderSize)
+	if _, err := io.ReadFull(r, m.message); err != nil {
+		return m, errors.Wrap(err, "failed reading message payload")
+	}
+	return m, nil
+}
+
+// Replay feeds the requests in `records` to `b` and compares every response
+// and notification written by `b` to the captured one.
+//
+// Requests are sent in capture order and each captured response is waited on
+// at the same point in the sequence it was originally written. This preserves
+// the original interleaving of requests and responses so that the replay is
+// deterministic. Each wait is limited to `timeout`.
+//
+// `b` is served over an in-memory connection and must not already be serving.
+// It cannot be reused after Replay returns.
+func Replay(b *Bridge, records []CaptureRecord, timeout time.Duration) (_ []ReplayMismatch, err error) {
+	hasRequest := false
+	for _, r := range records {
+		if r.Direction == CaptureRequest {
+			hasRequest = true
+			break
+		}
+	}
+	if !hasRequest {
+		return nil, errors.New("capture contains no requests")
+	}
+
+	// Format is host-read, guest-write, guest-read, host-write
+	hostIn, guestOut, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create replay pipe")
+	}
+	guestIn, hostOut, err := os.Pipe()
+	if err != nil {
+		hostIn.Close()
+		guestOut.Close()
+		return nil, errors.Wrap(err, "failed to create replay pipe")
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- b.ListenAndServe(guestIn, guestOut)
+	}()
+
+	received := make(chan replayMessage)
+	// readErr is the reason `received` was closed. It is only read once the
+	// channel is closed.
+	var readErr error
+	go func() {
+		defer close(received)
+		for {
+			m, err := readReplayMessage(hostIn)
+			if err != nil {
+				readErr = err
+				return
+			}
+			received <- m
+		}
+	}()
+
+	responses := make(map[prot.SequenceID][]byte)
+	var notifications [][]byte
+	// next waits for the response to request `id`, or for the next
+	// notification, that has not already been consumed.
+	next := func(dir CaptureDirection, id prot.SequenceID) ([]byte, error) {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		for {
+			if dir == CaptureNotification && len(notifications) > 0 {
+				n := notifications[0]
+				notifications = notifications[1:]
+				return n, nil
+			}
+			if m, ok := responses[id]; dir == CaptureResponse && ok {
+				delete(responses, id)
+				return m, nil
+			}
+			select {
+			case m, ok := <-received:
+				if !ok {
+					return nil, errors.Wrap(readErr, "bridge connection closed")
+				}
+				if m.header.Type == prot.ComputeSystemNotificationV1 {
+					notifications = append(notifications, m.message)
+				} else {
+					responses[m.header.ID] = m.message
+				}
+			case err := <-serveErr:
+				return nil, errors.Wrap(err, "bridge exited")
+			case <-t.C:
+				return nil, errors.New("timed out waiting for message")
+			}
+		}
+	}
+
+	defer func() {
+		// Stop the request loop and unblock any pending reads and writes.
+		// The bridge does not return on quit so it is not waited on.
+		select {
+		case b.quitChan <- true:
+		case <-serveErr:
+		}
+		hostOut.Close()
+		hostIn.Close()
+	}()
+
+	var mismatches []ReplayMismatch
+	for _, r := range records {
+		switch r.Direction {
+		case CaptureRequest:
+			payload := r.Payload()
+			header := r.Header
+			header.Size = uint32(len(payload) + prot.MessageHeaderSize)
+			if err := binary.Write(hostOut, binary.LittleEndian, &header); err != nil {
+				return nil, errors.Wrap(err, "failed writing message header")
+			}
+			if _, err := hostOut.Write(payload); err != nil {
+				return nil, errors.Wrap(err, "failed writing message payload")
+			}
+		case CaptureResponse, CaptureNotification:
+			actual, err := next(r.Direction, r.Header.ID)
+			if err != nil {
+				mismatches = append(mismatches, ReplayMismatch{
+					Expected: r,
+					Reason:   err.Error(),
+				})
+				continue
+			}
+			if !reflect.DeepEqual(normalizeReplayMessage(r.Payload()), normalizeReplayMessage(actual)) {
+				mismatches = append(mismatches, ReplayMismatch{
+					Expected: r,
+					Actual:   json.RawMessage(actual),
+					Reason:   "payload differs",
+				})
+			}
+		default:
+			return nil, errors.Errorf("unknown capture direction '%s'", r.Direction)
+		}
+	}
+	return mismatches, nil
+}
+
+// normalizeReplayMessage decodes `message` for comparison and removes any
+// fields in `replayIgnoredFields`. If `message` is not JSON it is compared as
+// a string.
+func normalizeReplayMessage(message []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(message, &v); err != nil {
+		return string(message)
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		for _, f := range replayIgnoredFields {
+			delete(m, f)
+		}
+	}
+	return v
+}
@@ -302,7 +302,7 @@ func (c *gcsCore) CreateContainer(id string, settings prot.VMHostedContainerSett
 // process's stdio through the members of the core.StdioSet provided.
 func (c *gcsCore) ExecProcess(id string, params prot.ProcessParameters, connection stdio.ConnectionSettings) (_ int, _ chan<- struct{}, err error) {
 	var stdioSet *stdio.ConnectionSet
-	stdioSet, err = stdio.Connect(c.vsock, connection)
+	stdioSet, err = stdio.Connect(context.Background(), c.vsock, connection)
 	if err != nil {
 		return -1, nil, err
 	}
@@ -551,7 +551,7 @@ func (c *gcsCore) GetProperties(id string, query string) (*prot.Properties, erro
 // state.
 func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, conSettings stdio.ConnectionSettings) (_ int, err error) {
 	var stdioSet *stdio.ConnectionSet
-	stdioSet, err = stdio.Connect(c.vsock, conSettings)
+	stdioSet, err = stdio.Connect(context.Background(), c.vsock, conSettings)
 	if err != nil {
 		return -1, err
 	}
@@ -17,6 +17,19 @@ const (
 	HrFail = Hresult(-2147467259) // 0x80004005
 	// HrErrNotFound is the HRESULT for an invalid process id.
 	HrErrNotFound = Hresult(-2147023728) // 0x80070490
+	// HrErrCancelled is the HRESULT for an operation that was cancelled by the
+	// host before it completed.
+	HrErrCancelled = Hresult(-2147023673) // 0x800704C7
+	// HrErrInvalidArg is the HRESULT for a request with invalid parameters.
+	HrErrInvalidArg = Hresult(-2147024809) // 0x80070057
+	// HrErrBusy is the HRESULT for a request that was rejected because the GCS
+	// is already handling too many requests.
+	HrErrBusy = Hresult(-2147024726) // 0x800700AA
+	// HrVmcomputeInvalidState is the HRESULT for:
+	//
+	// The requested virtual machine or container operation is not valid in the
+	// current state.
+	HrVmcomputeInvalidState = Hresult(-1070137083) // 0xC0370105
 	// HvVmcomputeTimeout is the HRESULT for operations that timed out.
 	HvVmcomputeTimeout = Hresult(-1070137079) // 0xC0370109
 	// HrVmcomputeInvalidJSON is the HRESULT for failing to unmarshal a json
@@ -162,3 +175,74 @@ func GetHresult(e error) (Hresult, error) {
 	}
 	return -1, errors.Errorf("no HRESULT found in cause stack for error %s", e)
 }
+
+// Layer is a single error in the cause stack of an error.
+type Layer struct {
+	// Message is the `Error()` string of this layer including all of its
+	// causes.
+	Message string
+	// Hresult is the HRESULT of this layer. If this layer was not created
+	// with an HRESULT it is the HRESULT of the first cause that has one, or
+	// `HrFail` if none do.
+	Hresult Hresult
+	// Stack is the stack trace recorded when this layer was created, or nil if
+	// this layer did not record one.
+	Stack errors.StackTrace
+}
+
+// Layers walks the cause stack of `e` from the outermost error to the root
+// cause and returns one Layer for each distinct error.
+//
+// Errors that only add an HRESULT to their cause do not form their own layer;
+// the HRESULT is instead applied to the cause. Consecutive errors with the same
+// message, such as the stack and message pair created by `errors.Wrap`, are
+// combined into a single layer.
+func Layers(e error) []Layer {
+	type causer interface {
+		Cause() error
+	}
+	var layers []Layer
+	var pending *Hresult
+	for cause := e; cause != nil; {
+		if herr, ok := cause.(*wrappingHresultError); ok {
+			if pending == nil {
+				hr := herr.Hresult()
+				pending = &hr
+			}
+			cause = herr.Cause()
+			continue
+		}
+
+		var stack errors.StackTrace
+		if serr, ok := cause.(StackTracer); ok {
+			stack = serr.StackTrace()
+		}
+		message := cause.Error()
+		if n := len(layers); n > 0 && layers[n-1].Message == message {
+			if layers[n-1].Stack == nil {
+				layers[n-1].Stack = stack
+			}
+		} else {
+			l := Layer{
+				Message: message,
+				Stack:   stack,
+			}
+			if pending != nil {
+				l.Hresult = *pending
+			} else if hr, err := GetHresult(cause); err == nil {
+				l.Hresult = hr
+			} else {
+				l.Hresult = HrFail
+			}
+			layers = append(layers, l)
+		}
+		pending = nil
+
+		cerr, ok := cause.(causer)
+		if !ok {
+			break
+		}
+		cause = cerr.Cause()
+	}
+	return layers
+}
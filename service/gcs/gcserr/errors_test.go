@@ -0,0 +1,49 @@
+package gcserr
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Layers_NoCause(t *testing.T) {
+	layers := Layers(NewHresultError(HrErrNotFound))
+	if len(layers) != 1 {
+		t.Fatalf("expected 1 layer got: %+v", layers)
+	}
+	if layers[0].Hresult != HrErrNotFound {
+		t.Fatalf("expected HrErrNotFound got: 0x%x", uint32(layers[0].Hresult))
+	}
+	if layers[0].Stack != nil {
+		t.Fatal("expected no stack")
+	}
+}
+
+func Test_Layers_WrappedChain(t *testing.T) {
+	root := errors.New("root")
+	err := errors.Wrap(WrapHresult(errors.Wrap(root, "middle"), HrVmcomputeInvalidJSON), "outer")
+
+	layers := Layers(err)
+	if len(layers) != 3 {
+		t.Fatalf("expected 3 layers got: %+v", layers)
+	}
+	expected := []struct {
+		message string
+		hresult Hresult
+	}{
+		{err.Error(), HrVmcomputeInvalidJSON},
+		{"middle: root", HrVmcomputeInvalidJSON},
+		{"root", HrFail},
+	}
+	for i, e := range expected {
+		if layers[i].Message != e.message {
+			t.Errorf("layer %d: expected message %q got: %q", i, e.message, layers[i].Message)
+		}
+		if layers[i].Hresult != e.hresult {
+			t.Errorf("layer %d: expected HRESULT 0x%x got: 0x%x", i, uint32(e.hresult), uint32(layers[i].Hresult))
+		}
+		if layers[i].Stack == nil {
+			t.Errorf("layer %d: expected stack", i)
+		}
+	}
+}
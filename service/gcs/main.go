@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -8,10 +9,13 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Microsoft/opengcs/internal/cgroup2"
+	"github.com/Microsoft/opengcs/internal/memevents"
 	"github.com/Microsoft/opengcs/internal/oc"
 	"github.com/Microsoft/opengcs/internal/runtime/hcsv2"
 	"github.com/Microsoft/opengcs/service/gcs/bridge"
 	"github.com/Microsoft/opengcs/service/gcs/core/gcs"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/Microsoft/opengcs/service/gcs/runtime/runc"
 	"github.com/Microsoft/opengcs/service/gcs/transport"
 	"github.com/containerd/cgroups"
@@ -28,6 +32,16 @@ func main() {
 	v4 := flag.Bool("v4", false, "enable the v4 protocol support and v2 schema")
 	rootMemReserveBytes := flag.Uint64("root-mem-reserve-bytes", 75*1024*1024, "the amount of memory reserved for the orchestration, the rest will be assigned to containers")
 	gcsMemLimitBytes := flag.Uint64("gcs-mem-limit-bytes", 50*1024*1024, "the maximum amount of memory the gcs can use")
+	unixSocketDir := flag.String("unix-socket-dir", "", "If set, dial the host over the unix domain sockets in this directory instead of vsock. Used to run outside of a utility VM")
+	omitErrorStacks := flag.Bool("omit-error-stacks", false, "If true, do not return guest stack traces to the host in failed responses")
+	maxMessageSize := flag.Uint("max-message-size", bridge.DefaultMaxMessageSize, "the largest bridge message in bytes accepted from the host")
+	maxWorkers := flag.Int("max-workers", bridge.DefaultMaxWorkers, "the number of bridge requests handled concurrently")
+	maxQueuedRequests := flag.Int("max-queued-requests", bridge.DefaultMaxQueuedRequests, "the number of bridge requests that can wait for a worker before the host is told the GCS is busy")
+	metricsLogInterval := flag.Duration("metrics-log-interval", 0, "how often to log the bridge queue, rejection and latency metrics at debug level, or 0 to never")
+	captureFile := flag.String("capture-file", "", "If set, record all bridge traffic to this file for later replay with gcsreplay")
+	orphanGCInterval := flag.Duration("orphan-gc-interval", 0, "how often to clean up the resources in the UVM that are not owned by any container, or 0 to never")
+	orphanGCDryRun := flag.Bool("orphan-gc-dry-run", false, "If true, only log the resources in the UVM that are not owned by any container instead of cleaning them up")
+	defaultRuntime := flag.String("runtime", runc.RuncDialect.Name, "the OCI runtime used for containers that do not select one with the "+hcsv2.RuntimeAnnotation+" annotation: runc, crun or runsc")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "\nUsage of %s:\n", os.Args[0])
@@ -35,6 +49,7 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Examples:\n")
 		fmt.Fprintf(os.Stderr, "    %s -loglevel=debug -logfile=/run/gcs/gcs.log\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "    %s -loglevel=info -logfile=stdout\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "    %s -v4 -unix-socket-dir=/tmp/gcs\n", os.Args[0])
 	}
 
 	flag.Parse()
@@ -81,19 +96,69 @@ func main() {
 	baseStoragePath := "/run/gcs/c"
 
 	logrus.Info("GCS started")
-	tport := &transport.VsockTransport{}
-	rtime, err := runc.NewRuntime(baseLogPath)
-	if err != nil {
-		logrus.WithError(err).Fatal("opengcs::main - failed to initialize new runc runtime")
+	var tport transport.Transport
+	if *unixSocketDir != "" {
+		tport = &transport.UnixTransport{Dir: *unixSocketDir}
+	} else {
+		tport = &transport.VsockTransport{}
+	}
+	if _, err := runc.LookupDialect(*defaultRuntime); err != nil {
+		logrus.WithError(err).Fatal("opengcs::main - unknown default runtime")
 	}
+	runtimes := make(map[string]runtime.Runtime)
+	for name, dialect := range runc.Dialects {
+		rt, err := runc.NewCLIRuntime(baseLogPath, dialect)
+		if err != nil {
+			entry := logrus.WithFields(logrus.Fields{
+				"runtime":       name,
+				logrus.ErrorKey: err,
+			})
+			if name == *defaultRuntime {
+				entry.Fatal("opengcs::main - failed to initialize new runtime")
+			}
+			// Runtimes other than the default are optional in the image.
+			entry.Warning("opengcs::main - runtime is not available")
+			continue
+		}
+		runtimes[name] = rt
+	}
+	rtime := runtimes[*defaultRuntime]
 	coreint := gcs.NewGCSCore(baseLogPath, baseStoragePath, rtime, tport)
 	mux := bridge.NewBridgeMux()
 	b := bridge.Bridge{
-		Handler:  mux,
-		EnableV4: *v4,
+		Handler:            mux,
+		EnableV4:           *v4,
+		OmitErrorStacks:    *omitErrorStacks,
+		MaxMessageSize:     uint32(*maxMessageSize),
+		MaxWorkers:         *maxWorkers,
+		MaxQueuedRequests:  *maxQueuedRequests,
+		MetricsLogInterval: *metricsLogInterval,
 	}
 	h := hcsv2.NewHost(rtime, tport)
+	for name, rt := range runtimes {
+		h.AddRuntime(name, rt)
+	}
+	memWatcher, err := memevents.NewWatcher()
+	if err != nil {
+		logrus.WithError(err).Fatal("opengcs::main - failed to create memory event watcher")
+	}
+	defer memWatcher.Close()
+	h.SetMemoryWatcher(memWatcher)
+	if err := h.Recover(context.Background(), hcsv2.DefaultJournalPath); err != nil {
+		logrus.WithError(err).Fatal("opengcs::main - failed to recover host state")
+	}
 	b.AssignHandlers(mux, coreint, h)
+	if *captureFile != "" {
+		f, err := os.OpenFile(*captureFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"path":          *captureFile,
+				logrus.ErrorKey: err,
+			}).Fatal("opengcs::main - failed to open capture file")
+		}
+		defer f.Close()
+		b.Recorder = bridge.NewRecorder(f)
+	}
 
 	var bridgeIn io.ReadCloser
 	var bridgeOut io.WriteCloser
@@ -107,7 +172,7 @@ func main() {
 			logrus.WithFields(logrus.Fields{
 				"port":          commandPort,
 				logrus.ErrorKey: err,
-			}).Fatal("opengcs::main - failed to dial host vsock connection")
+			}).Fatal("opengcs::main - failed to dial host bridge connection")
 		}
 		bridgeIn = bridgeCon
 		bridgeOut = bridgeCon
@@ -126,28 +191,62 @@ func main() {
 	if err := syscall.Sysinfo(&sinfo); err != nil {
 		logrus.WithError(err).Fatal("opengcs::main - failed to get sys info")
 	}
+	//
+	// Newer kernels only mount the cgroup v2 unified hierarchy in which case
+	// the same cgroups are created there.
 	containersLimit := int64(sinfo.Totalram - *rootMemReserveBytes)
-	containersControl, err := cgroups.New(cgroups.V1, cgroups.StaticPath("/containers"), &oci.LinuxResources{
+	containersResources := &oci.LinuxResources{
 		Memory: &oci.LinuxMemory{
 			Limit: &containersLimit,
 		},
-	})
-	if err != nil {
-		logrus.WithError(err).Fatal("opengcs::main - failed to create containers cgroup")
 	}
-	defer containersControl.Delete()
 	gcsLimit := int64(*gcsMemLimitBytes)
-	gcsControl, err := cgroups.New(cgroups.V1, cgroups.StaticPath("/gcs"), &oci.LinuxResources{
+	gcsResources := &oci.LinuxResources{
 		Memory: &oci.LinuxMemory{
 			Limit: &gcsLimit,
 		},
-	})
-	if err != nil {
-		logrus.WithError(err).Fatal("opengcs::main - failed to create gcs cgroup")
 	}
-	defer gcsControl.Delete()
-	if err := gcsControl.Add(cgroups.Process{Pid: os.Getpid()}); err != nil {
-		logrus.WithError(err).Fatal("opengcs::main - failed add gcs pid to gcs cgroup")
+	if cgroup2.IsUnified() {
+		containersControl, err := cgroup2.New("/containers", containersResources)
+		if err != nil {
+			logrus.WithError(err).Fatal("opengcs::main - failed to create containers cgroup")
+		}
+		defer containersControl.Delete()
+		gcsControl, err := cgroup2.New("/gcs", gcsResources)
+		if err != nil {
+			logrus.WithError(err).Fatal("opengcs::main - failed to create gcs cgroup")
+		}
+		defer gcsControl.Delete()
+		if err := gcsControl.AddProc(os.Getpid()); err != nil {
+			logrus.WithError(err).Fatal("opengcs::main - failed add gcs pid to gcs cgroup")
+		}
+	} else {
+		containersControl, err := cgroups.New(cgroups.V1, cgroups.StaticPath("/containers"), containersResources)
+		if err != nil {
+			logrus.WithError(err).Fatal("opengcs::main - failed to create containers cgroup")
+		}
+		defer containersControl.Delete()
+		gcsControl, err := cgroups.New(cgroups.V1, cgroups.StaticPath("/gcs"), gcsResources)
+		if err != nil {
+			logrus.WithError(err).Fatal("opengcs::main - failed to create gcs cgroup")
+		}
+		defer gcsControl.Delete()
+		if err := gcsControl.Add(cgroups.Process{Pid: os.Getpid()}); err != nil {
+			logrus.WithError(err).Fatal("opengcs::main - failed add gcs pid to gcs cgroup")
+		}
+	}
+	// Report when the containers or the GCS itself run out of memory.
+	for _, group := range []string{"/containers", "/gcs"} {
+		if err := memWatcher.Add(hcsv2.UVMContainerID, group); err != nil {
+			logrus.WithError(err).WithField("cgroup", group).Warning("opengcs::main - failed to watch cgroup memory events")
+		}
+	}
+
+	// Clean up what failed creates and host crashes leave behind.
+	if *orphanGCInterval > 0 {
+		gcCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go h.CollectOrphansPeriodically(gcCtx, *orphanGCInterval, hcsv2.DefaultOrphanMinAge, *orphanGCDryRun)
 	}
 
 	err = b.ListenAndServe(bridgeIn, bridgeOut)
@@ -0,0 +1,209 @@
+package prot
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/libs/commonutils"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+)
+
+// MessageEncoding is the encoding of the message that follows each
+// `MessageHeader` on the wire.
+type MessageEncoding string
+
+const (
+	// EncodingJSON is the JSON encoding used by all protocol versions. It is
+	// used when no encoding was negotiated.
+	EncodingJSON = MessageEncoding("json")
+	// EncodingCBOR is the RFC 7049 CBOR encoding of the same message types.
+	// Field names are the same as in JSON. It is only available at `PvV5` and
+	// above.
+	EncodingCBOR = MessageEncoding("cbor")
+)
+
+// Marshal encodes the message `v` in encoding `enc`.
+func Marshal(enc MessageEncoding, v interface{}) ([]byte, error) {
+	switch enc {
+	case EncodingJSON, "":
+		return json.Marshal(v)
+	case EncodingCBOR:
+		return cbor.Marshal(v)
+	default:
+		return nil, errors.Errorf("unsupported message encoding '%s'", enc)
+	}
+}
+
+// Unmarshal decodes the message `data` in encoding `enc` into `v`. Any
+// failure to decode `data` is returned as `HrVmcomputeInvalidJSON` regardless
+// of the encoding.
+func Unmarshal(enc MessageEncoding, data []byte, v interface{}) error {
+	switch enc {
+	case EncodingJSON, "":
+		return commonutils.UnmarshalJSONWithHresult(data, v)
+	case EncodingCBOR:
+		if err := cbor.Unmarshal(data, v); err != nil {
+			return gcserr.WrapHresult(err, gcserr.HrVmcomputeInvalidJSON)
+		}
+		return nil
+	default:
+		return errors.Errorf("unsupported message encoding '%s'", enc)
+	}
+}
+
+// NestedJSON is a document, such as a `ContainerConfig`, that is nested in a
+// message. Before `PvV5` it is sent as a JSON encoded string. At `PvV5` and
+// above it is sent as the document itself, a JSON object or CBOR map, and is
+// decoded directly from the message with `Decode`.
+//
+// The zero value is an empty document, which is sent as an empty string.
+type NestedJSON struct {
+	// v is the document to be sent.
+	v interface{}
+	// flat is true if the document is not sent as a string.
+	flat bool
+	// data is the document as it was received in encoding `enc`.
+	data []byte
+	enc  MessageEncoding
+}
+
+// NewNestedJSON returns the document `v` to be sent in a message at protocol
+// version `ver`.
+func NewNestedJSON(ver ProtocolVersion, v interface{}) NestedJSON {
+	return NestedJSON{v: v, flat: ver >= PvV5}
+}
+
+// IsZero returns true if the document is empty.
+func (n NestedJSON) IsZero() bool {
+	return n.v == nil && len(n.data) == 0
+}
+
+// Decode decodes the document into `v`. Any failure is returned as
+// `HrVmcomputeInvalidJSON`.
+func (n NestedJSON) Decode(v interface{}) error {
+	if n.v != nil {
+		b, err := json.Marshal(n.v)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal nested document")
+		}
+		return commonutils.UnmarshalJSONWithHresult(b, v)
+	}
+	return Unmarshal(n.enc, n.data, v)
+}
+
+// String returns the document for logging. A CBOR document is returned as
+// hex.
+func (n NestedJSON) String() string {
+	if n.v == nil {
+		if n.enc == EncodingCBOR {
+			return hex.EncodeToString(n.data)
+		}
+		return string(n.data)
+	}
+	b, err := json.Marshal(n.v)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+// MarshalJSON implements `json.Marshaler`.
+func (n NestedJSON) MarshalJSON() ([]byte, error) {
+	var b []byte
+	switch {
+	case n.v != nil:
+		var err error
+		if b, err = json.Marshal(n.v); err != nil {
+			return nil, err
+		}
+	case n.enc == EncodingCBOR:
+		return nil, errors.New("cannot marshal a CBOR document as JSON")
+	default:
+		b = n.data
+	}
+	if n.flat && len(b) != 0 {
+		return b, nil
+	}
+	return json.Marshal(string(b))
+}
+
+// UnmarshalJSON implements `json.Unmarshaler`.
+func (n *NestedJSON) UnmarshalJSON(b []byte) error {
+	*n = NestedJSON{enc: EncodingJSON}
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		n.data = []byte(s)
+		return nil
+	}
+	n.data = append([]byte(nil), b...)
+	n.flat = true
+	return nil
+}
+
+// MarshalCBOR implements `cbor.Marshaler`.
+func (n NestedJSON) MarshalCBOR() ([]byte, error) {
+	switch {
+	case n.v != nil:
+		return cbor.Marshal(n.v)
+	case n.enc == EncodingCBOR:
+		return n.data, nil
+	default:
+		// The JSON document, if any, is sent as a string.
+		return cbor.Marshal(string(n.data))
+	}
+}
+
+// UnmarshalCBOR implements `cbor.Unmarshaler`.
+func (n *NestedJSON) UnmarshalCBOR(b []byte) error {
+	if len(b) > 0 && b[0]>>5 == cborTextString {
+		// The document was sent as a JSON string.
+		var s string
+		if err := cbor.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*n = NestedJSON{data: []byte(s), enc: EncodingJSON}
+		return nil
+	}
+	*n = NestedJSON{data: append([]byte(nil), b...), enc: EncodingCBOR, flat: true}
+	return nil
+}
+
+const (
+	// cborTextString is the major type of a CBOR text string.
+	cborTextString = 3
+	// cborNull is the encoding of the CBOR null value.
+	cborNull = 0xf6
+)
+
+// rawMessage is part of a message whose type is only known once the rest of
+// the message is decoded. It is decoded later with `unmarshal`.
+type rawMessage struct {
+	data []byte
+	enc  MessageEncoding
+}
+
+// unmarshal decodes the message into `v`.
+func (r *rawMessage) unmarshal(v interface{}) error {
+	return Unmarshal(r.enc, r.data, v)
+}
+
+// UnmarshalJSON implements `json.Unmarshaler`.
+func (r *rawMessage) UnmarshalJSON(b []byte) error {
+	if string(b) != "null" {
+		*r = rawMessage{data: append([]byte(nil), b...), enc: EncodingJSON}
+	}
+	return nil
+}
+
+// UnmarshalCBOR implements `cbor.Unmarshaler`.
+func (r *rawMessage) UnmarshalCBOR(b []byte) error {
+	if len(b) != 1 || b[0] != cborNull {
+		*r = rawMessage{data: append([]byte(nil), b...), enc: EncodingCBOR}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package prot
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func Test_Marshal_Unmarshal_RoundTrip(t *testing.T) {
+	pp := ProcessParameters{
+		CommandLine: "sh -c exit",
+		Environment: map[string]string{"PATH": "/bin"},
+	}
+	for _, ver := range []ProtocolVersion{PvV4, PvV5} {
+		for _, enc := range []MessageEncoding{EncodingJSON, EncodingCBOR} {
+			if ver < PvV5 && enc != EncodingJSON {
+				continue
+			}
+			t.Run(fmt.Sprintf("%s-%d", enc, ver), func(t *testing.T) {
+				message, err := Marshal(enc, &ContainerExecuteProcess{
+					MessageBase: MessageBase{ContainerID: "abc"},
+					Settings: ExecuteProcessSettings{
+						ProcessParameters:       NewNestedJSON(ver, &pp),
+						VsockStdioRelaySettings: ExecuteProcessVsockStdioRelaySettings{StdOut: 2},
+					},
+				})
+				if err != nil {
+					t.Fatalf("expected nil error got: %v", err)
+				}
+				var request ContainerExecuteProcess
+				if err := Unmarshal(enc, message, &request); err != nil {
+					t.Fatalf("expected nil error got: %v", err)
+				}
+				if request.ContainerID != "abc" || request.Settings.VsockStdioRelaySettings.StdOut != 2 {
+					t.Fatalf("expected container abc with stdout 2 got: %+v", request)
+				}
+				var actual ProcessParameters
+				if err := request.Settings.ProcessParameters.Decode(&actual); err != nil {
+					t.Fatalf("expected nil error got: %v", err)
+				}
+				if !reflect.DeepEqual(pp, actual) {
+					t.Fatalf("expected %+v got: %+v", pp, actual)
+				}
+			})
+		}
+	}
+}
+
+func Test_NestedJSON_MarshalJSON_Version(t *testing.T) {
+	config := map[string]string{"Hostname": "h"}
+	tests := []struct {
+		ver      ProtocolVersion
+		expected string
+	}{
+		{PvV4, `{"ContainerConfig":"{\"Hostname\":\"h\"}"}`},
+		{PvV5, `{"ContainerConfig":{"Hostname":"h"}}`},
+	}
+	for _, test := range tests {
+		b, err := json.Marshal(struct{ ContainerConfig NestedJSON }{NewNestedJSON(test.ver, config)})
+		if err != nil {
+			t.Fatalf("expected nil error got: %v", err)
+		}
+		if string(b) != test.expected {
+			t.Fatalf("expected %s at version %d got: %s", test.expected, test.ver, b)
+		}
+	}
+}
+
+func Test_NestedJSON_MarshalCBOR_Map(t *testing.T) {
+	message, err := Marshal(EncodingCBOR, &ContainerCreate{
+		ContainerConfig: NewNestedJSON(PvV5, map[string]string{"Hostname": "h"}),
+	})
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	var v map[string]interface{}
+	if err := cbor.Unmarshal(message, &v); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	config, ok := v["ContainerConfig"].(map[interface{}]interface{})
+	if !ok || config["Hostname"] != "h" {
+		t.Fatalf("expected ContainerConfig to be a map got: %+v", v["ContainerConfig"])
+	}
+}
+
+func Test_NestedJSON_UnmarshalCBOR_String(t *testing.T) {
+	message, err := cbor.Marshal(map[string]string{"Query": `{"PropertyTypes":["ProcessList"]}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request ContainerGetProperties
+	if err := Unmarshal(EncodingCBOR, message, &request); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	var query PropertyQuery
+	if err := request.Query.Decode(&query); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if len(query.PropertyTypes) != 1 || query.PropertyTypes[0] != PtProcessList {
+		t.Fatalf("expected ProcessList got: %+v", query)
+	}
+}
+
+func Test_NestedJSON_Empty(t *testing.T) {
+	var request ContainerGetProperties
+	if err := Unmarshal(EncodingJSON, []byte(`{"Query":""}`), &request); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if !request.Query.IsZero() {
+		t.Fatalf("expected an empty query got: %s", request.Query)
+	}
+}
+
+func Test_Unmarshal_InvalidCBOR(t *testing.T) {
+	var request ContainerCreate
+	err := Unmarshal(EncodingCBOR, []byte{0xff}, &request)
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrVmcomputeInvalidJSON {
+		t.Fatalf("expected HrVmcomputeInvalidJSON got: %v", err)
+	}
+}
@@ -4,10 +4,8 @@
 package prot
 
 import (
-	"encoding/json"
 	"strconv"
 
-	"github.com/Microsoft/opengcs/service/libs/commonutils"
 	v1 "github.com/containerd/cgroups/stats/v1"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
@@ -104,6 +102,19 @@ const (
 	ComputeSystemDumpStacksV1 = 0x10100c01
 	// ComputeSystemDeleteContainerStateV1 is the delete container request.
 	ComputeSystemDeleteContainerStateV1 = 0x10100d01
+	// ComputeSystemCancelRequestV1 is the cancel in-flight request request.
+	ComputeSystemCancelRequestV1 = 0x10100e01
+	// ComputeSystemPauseV1 is the pause container request.
+	ComputeSystemPauseV1 = 0x10100f01
+	// ComputeSystemResumeV1 is the resume container request.
+	ComputeSystemResumeV1 = 0x10101001
+	// ComputeSystemCheckpointV1 is the checkpoint container request.
+	ComputeSystemCheckpointV1 = 0x10101101
+	// ComputeSystemRestoreV1 is the restore container request.
+	ComputeSystemRestoreV1 = 0x10101201
+	// ComputeSystemCollectOrphansV1 is the orphaned resource collection
+	// request.
+	ComputeSystemCollectOrphansV1 = 0x10101301
 
 	// ComputeSystemResponseCreateV1 is the create container response.
 	ComputeSystemResponseCreateV1 = 0x20100101
@@ -134,6 +145,20 @@ const (
 	ComputeSystemResponseNegotiateProtocolV1 = 0x20100b01
 	// ComputeSystemDumpStackV1 is the dump stack response
 	ComputeSystemResponseDumpStacksV1 = 0x20100c01
+	// ComputeSystemResponseCancelRequestV1 is the cancel in-flight request
+	// response.
+	ComputeSystemResponseCancelRequestV1 = 0x20100e01
+	// ComputeSystemResponsePauseV1 is the pause container response.
+	ComputeSystemResponsePauseV1 = 0x20100f01
+	// ComputeSystemResponseResumeV1 is the resume container response.
+	ComputeSystemResponseResumeV1 = 0x20101001
+	// ComputeSystemResponseCheckpointV1 is the checkpoint container response.
+	ComputeSystemResponseCheckpointV1 = 0x20101101
+	// ComputeSystemResponseRestoreV1 is the restore container response.
+	ComputeSystemResponseRestoreV1 = 0x20101201
+	// ComputeSystemResponseCollectOrphansV1 is the orphaned resource
+	// collection response.
+	ComputeSystemResponseCollectOrphansV1 = 0x20101301
 
 	// ComputeSystemNotificationV1 is the notification identifier.
 	ComputeSystemNotificationV1 = 0x30100101
@@ -170,6 +195,18 @@ func (mi MessageIdentifier) String() string {
 		return "ComputeSystemDumpStacksV1"
 	case ComputeSystemDeleteContainerStateV1:
 		return "ComputeSystemDeleteContainerStateV1"
+	case ComputeSystemCancelRequestV1:
+		return "ComputeSystemCancelRequestV1"
+	case ComputeSystemPauseV1:
+		return "ComputeSystemPauseV1"
+	case ComputeSystemResumeV1:
+		return "ComputeSystemResumeV1"
+	case ComputeSystemCheckpointV1:
+		return "ComputeSystemCheckpointV1"
+	case ComputeSystemRestoreV1:
+		return "ComputeSystemRestoreV1"
+	case ComputeSystemCollectOrphansV1:
+		return "ComputeSystemCollectOrphansV1"
 	case ComputeSystemResponseCreateV1:
 		return "ComputeSystemResponseCreateV1"
 	case ComputeSystemResponseStartV1:
@@ -194,6 +231,18 @@ func (mi MessageIdentifier) String() string {
 		return "ComputeSystemResponseNegotiateProtocolV1"
 	case ComputeSystemResponseDumpStacksV1:
 		return "ComputeSystemResponseDumpStacksV1"
+	case ComputeSystemResponseCancelRequestV1:
+		return "ComputeSystemResponseCancelRequestV1"
+	case ComputeSystemResponsePauseV1:
+		return "ComputeSystemResponsePauseV1"
+	case ComputeSystemResponseResumeV1:
+		return "ComputeSystemResponseResumeV1"
+	case ComputeSystemResponseCheckpointV1:
+		return "ComputeSystemResponseCheckpointV1"
+	case ComputeSystemResponseRestoreV1:
+		return "ComputeSystemResponseRestoreV1"
+	case ComputeSystemResponseCollectOrphansV1:
+		return "ComputeSystemResponseCollectOrphansV1"
 	case ComputeSystemNotificationV1:
 		return "ComputeSystemNotificationV1"
 	default:
@@ -225,7 +274,8 @@ const (
 	PvInvalid ProtocolVersion = 0
 	PvV3      ProtocolVersion = 3
 	PvV4      ProtocolVersion = 4
-	PvMax     ProtocolVersion = PvV4
+	PvV5      ProtocolVersion = 5
+	PvMax     ProtocolVersion = PvV5
 )
 
 // ProtocolSupport specifies the protocol versions to be used for HCS-GCS
@@ -272,6 +322,23 @@ type GcsGuestCapabilities struct {
 	SignalProcessSupported        bool `json:",omitempty"`
 	DumpStacksSupported           bool `json:",omitempty"`
 	DeleteContainerStateSupported bool `json:",omitempty"`
+	CancelRequestSupported        bool `json:",omitempty"`
+	PauseResumeSupported          bool `json:",omitempty"`
+	CheckpointRestoreSupported    bool `json:",omitempty"`
+	// GracefulShutdownSupported is true if a `ContainerShutdown` request with
+	// a grace period is escalated by the GCS.
+	GracefulShutdownSupported bool `json:",omitempty"`
+	CollectOrphansSupported   bool `json:",omitempty"`
+	// MemoryNotificationsSupported is true if the GCS watches the memory
+	// events of the containers and can send them to a host that asked for
+	// them with `NegotiateProtocol.MemoryNotifications`.
+	MemoryNotificationsSupported bool `json:",omitempty"`
+	// SupportedResourceTypes are the resource types accepted by
+	// ModifySettings.
+	SupportedResourceTypes []ModifyResourceType `json:",omitempty"`
+	// SupportedPropertyTypes are the property types returned by
+	// GetProperties.
+	SupportedPropertyTypes []PropertyType `json:",omitempty"`
 }
 
 // ocspancontext is the internal JSON representation of the OpenCensus
@@ -317,6 +384,13 @@ type NegotiateProtocol struct {
 	MessageBase
 	MinimumVersion uint32
 	MaximumVersion uint32
+	// Encodings are the message encodings supported by the host in order of
+	// preference. It is only used if `PvV5` or above is selected.
+	Encodings []MessageEncoding `json:",omitempty"`
+	// MemoryNotifications is true if the host wants `NtOomKilled` and
+	// `NtMemoryPressure` notifications. It is ignored unless the GCS reports
+	// `MemoryNotificationsSupported`.
+	MemoryNotifications bool `json:",omitempty"`
 }
 
 // ContainerCreate is the message from the HCS specifying to create a container
@@ -325,10 +399,31 @@ type NegotiateProtocol struct {
 // once the container's initial process is executed.
 type ContainerCreate struct {
 	MessageBase
-	ContainerConfig   string
+	ContainerConfig   NestedJSON
 	SupportedVersions ProtocolSupport `json:",omitempty"`
 }
 
+// ContainerCheckpoint is the message from the HCS specifying to checkpoint a
+// container to a directory in the UVM, such as a mapped virtual disk.
+type ContainerCheckpoint struct {
+	MessageBase
+	ImagePath string
+	// LeaveRunning keeps the container running once the checkpoint is
+	// written. Otherwise the container exits.
+	LeaveRunning   bool `json:",omitempty"`
+	TCPEstablished bool `json:"TcpEstablished,omitempty"`
+}
+
+// ContainerRestore is the message from the HCS specifying to restore a
+// checkpoint written by `ContainerCheckpoint` as the container `ContainerID`.
+// `ContainerConfig` is the same as for `ContainerCreate`.
+type ContainerRestore struct {
+	MessageBase
+	ContainerConfig NestedJSON
+	ImagePath       string
+	TCPEstablished  bool `json:"TcpEstablished,omitempty"`
+}
+
 // NotificationType defines a type of notification to be sent back to the HCS.
 type NotificationType string
 
@@ -353,8 +448,18 @@ const (
 	NtStarted = NotificationType("Started")
 	// NtPaused indicates a paused notification to be sent back to the HCS
 	NtPaused = NotificationType("Paused")
+	// NtResumed indicates a resumed notification to be sent back to the HCS
+	NtResumed = NotificationType("Resumed")
 	// NtUnknown indicates an unknown notification to be sent back to the HCS
 	NtUnknown = NotificationType("Unknown")
+	// NtOomKilled indicates that the OOM killer killed a process in a cgroup
+	// that reached its memory limit. The ContainerID is that of the container
+	// or, for the UVM cgroups, the UVM and ResultInfo is the cgroup path.
+	NtOomKilled = NotificationType("OomKilled")
+	// NtMemoryPressure indicates that a cgroup is under critical memory
+	// pressure close to its memory limit. The ContainerID and ResultInfo are
+	// as for NtOomKilled.
+	NtMemoryPressure = NotificationType("MemoryPressure")
 )
 
 // ActiveOperation defines an operation to be associated with a notification
@@ -379,14 +484,16 @@ const (
 )
 
 // ContainerNotification is a message sent from the GCS to the HCS to indicate
-// some kind of event. At the moment, it is only used for container exit
-// notifications.
+// some kind of event such as a container exiting or running out of memory.
 type ContainerNotification struct {
 	MessageBase
 	Type       NotificationType
 	Operation  ActiveOperation
 	Result     int32
 	ResultInfo string `json:",omitempty"`
+	// ExitStatus is the exit status of the init process for the exit
+	// notifications of V2 containers.
+	ExitStatus *ExitStatus `json:",omitempty"`
 }
 
 // ExecuteProcessVsockStdioRelaySettings defines the port numbers for each
@@ -400,7 +507,7 @@ type ExecuteProcessVsockStdioRelaySettings struct {
 // ExecuteProcessSettings defines the settings for a single process to be
 // executed either inside or outside the container namespace.
 type ExecuteProcessSettings struct {
-	ProcessParameters       string
+	ProcessParameters       NestedJSON
 	VsockStdioRelaySettings ExecuteProcessVsockStdioRelaySettings
 }
 
@@ -420,6 +527,15 @@ type ContainerResizeConsole struct {
 	Width     uint16
 }
 
+// ContainerCancelRequest is the message from the HCS specifying to cancel a
+// request that is still being processed. The cancelled request completes with
+// `gcserr.HrErrCancelled`.
+type ContainerCancelRequest struct {
+	MessageBase
+	// SequenceID is the `MessageHeader.ID` of the request to cancel.
+	SequenceID SequenceID `json:"SequenceId"`
+}
+
 // ContainerWaitForProcess is the message from the HCS specifying to wait until
 // the given process exits. After receiving this message, the corresponding
 // response should not be sent until the process has exited.
@@ -431,6 +547,32 @@ type ContainerWaitForProcess struct {
 	TimeoutInMs uint32
 }
 
+// ContainerShutdown is the message from the HCS specifying to gracefully shut
+// down a container. The fields are optional so that the message can also be
+// sent as a `MessageBase`.
+type ContainerShutdown struct {
+	MessageBase
+	// Signal is sent to the container. If 0 the stop signal of the container
+	// is sent, which defaults to SIGTERM.
+	Signal uint32 `json:",omitempty"`
+	// GracePeriodInMs is how long the GCS waits for the container to exit
+	// after the signal before killing it with SIGKILL. If 0 the container is
+	// never killed.
+	GracePeriodInMs uint32 `json:",omitempty"`
+}
+
+// CollectOrphans is the message from the HCS specifying to find the resources
+// in the UVM that are not owned by any container and clean them up.
+type CollectOrphans struct {
+	MessageBase
+	// DryRun only reports the orphaned resources.
+	DryRun bool `json:",omitempty"`
+	// MinAgeInMs is how long a resource must have been found without an owner
+	// to be an orphan. The resources of a container the host is still
+	// preparing have no owner until the container is created.
+	MinAgeInMs uint32 `json:",omitempty"`
+}
+
 // ContainerSignalProcess is the message from the HCS specifying to send a
 // signal to the given process.
 type ContainerSignalProcess struct {
@@ -443,7 +585,7 @@ type ContainerSignalProcess struct {
 // properties of the container, such as a list of its processes.
 type ContainerGetProperties struct {
 	MessageBase
-	Query string
+	Query NestedJSON
 }
 
 // PropertyType is the type of property, such as memory or virtual disk, which
@@ -475,6 +617,12 @@ const (
 	PtMappedPipe = PropertyType("MappedPipe")
 	// PtMappedVirtualDisk is the property type for mapped virtual disks
 	PtMappedVirtualDisk = PropertyType("MappedVirtualDisk")
+	// PtPodStatistics is the property type for the statistics aggregated over
+	// all containers in the pod of a sandbox container
+	PtPodStatistics = PropertyType("PodStatistics")
+	// PtContainerState is the property type for the lifecycle state of a
+	// container
+	PtContainerState = PropertyType("ContainerState")
 )
 
 // RequestType is the type of operation to perform on a given property type.
@@ -514,6 +662,10 @@ const (
 	MrtVPMemDevice = ModifyResourceType("VPMemDevice")
 	// MrtNetwork is the modify resource type for the `NetworkAdapterV2` device.
 	MrtNetwork = ModifyResourceType("Network")
+	// MrtContainerResources is the modify resource type for the
+	// `oci.LinuxResources` of a running container. It is only valid with
+	// `MreqtUpdate` and a container id other than the UVM.
+	MrtContainerResources = ModifyResourceType("ContainerResources")
 )
 
 // ModifyRequestType is the type of operation to perform on a given modify
@@ -557,41 +709,59 @@ type ContainerModifySettings struct {
 // such as `Settings` can be of many types identified by the `ResourceType` and
 // require dynamic unmarshalling.
 func UnmarshalContainerModifySettings(b []byte) (*ContainerModifySettings, error) {
+	return unmarshalContainerModifySettings(EncodingJSON, b, false)
+}
+
+// UnmarshalContainerModifySettingsV2 is the same as
+// UnmarshalContainerModifySettings except that `b` is in encoding `enc` and
+// `Request` is always a *ModifySettingRequest. It is used by the V2 bridge
+// where requests may target a container rather than the UVM.
+func UnmarshalContainerModifySettingsV2(enc MessageEncoding, b []byte) (*ContainerModifySettings, error) {
+	return unmarshalContainerModifySettings(enc, b, true)
+}
+
+func unmarshalContainerModifySettings(enc MessageEncoding, b []byte, forceV2 bool) (*ContainerModifySettings, error) {
 	// Unmarshal the message.
-	var request ContainerModifySettings
-	var requestRawSettings json.RawMessage
-	var requestV2RawSettings json.RawMessage
-	request.Request = &requestRawSettings
-	request.V2Request = &requestV2RawSettings
-	if err := commonutils.UnmarshalJSONWithHresult(b, &request); err != nil {
+	var raw struct {
+		MessageBase
+		Request   rawMessage
+		V2Request rawMessage `json:"v2Request"`
+	}
+	if err := Unmarshal(enc, b, &raw); err != nil {
 		return nil, errors.Wrap(err, "failed to unmarshal ContainerModifySettings")
 	}
+	request := ContainerModifySettings{MessageBase: raw.MessageBase}
+	requestRawSettings := raw.Request
 
 	isV2 := false
 
 	// RS3 or RS5
-	if len(requestRawSettings) > 0 {
+	if len(requestRawSettings.data) > 0 {
 		// RS5
-		// TODO: JTERRY75 this will only work as long as we dont target a V2
-		// container and only do V2 UVM
-		if request.ContainerID == "00000000-0000-0000-0000-000000000000" {
+		// The V1 bridge cannot tell a V2 request for a container apart from
+		// an RS3 request so only requests for the UVM are V2 unless the
+		// caller knows otherwise.
+		if forceV2 || request.ContainerID == "00000000-0000-0000-0000-000000000000" {
 			isV2 = true
 		}
-	} else if len(requestV2RawSettings) > 0 {
+	} else if len(raw.V2Request.data) > 0 {
 		// RS4
-		requestRawSettings = requestV2RawSettings
+		requestRawSettings = raw.V2Request
 		isV2 = true
 	} else {
 		return &request, errors.New("neither request.Request nor request.V2Request was passed")
 	}
 
 	if !isV2 {
-		var rmrr ResourceModificationRequestResponse
-		var rmrrRawSettings json.RawMessage
-		rmrr.Settings = &rmrrRawSettings
-		if err := commonutils.UnmarshalJSONWithHresult(requestRawSettings, &rmrr); err != nil {
+		var rawRmrr struct {
+			ResourceModificationRequestResponse
+			Settings rawMessage
+		}
+		if err := requestRawSettings.unmarshal(&rawRmrr); err != nil {
 			return &request, errors.Wrap(err, "failed to unmarshal request.Settings as ResourceModificationRequestResponse")
 		}
+		rmrr := rawRmrr.ResourceModificationRequestResponse
+		rmrrRawSettings := rawRmrr.Settings
 
 		if rmrr.RequestType == "" {
 			rmrr.RequestType = RtAdd
@@ -601,13 +771,13 @@ func UnmarshalContainerModifySettings(b []byte) (*ContainerModifySettings, error
 		switch rmrr.ResourceType {
 		case PtMappedVirtualDisk:
 			mvd := &MappedVirtualDisk{}
-			if err := commonutils.UnmarshalJSONWithHresult(rmrrRawSettings, mvd); err != nil {
+			if err := rmrrRawSettings.unmarshal(mvd); err != nil {
 				return &request, errors.Wrap(err, "failed to unmarshal settings as MappedVirtualDisk")
 			}
 			rmrr.Settings = mvd
 		case PtMappedDirectory:
 			md := &MappedDirectory{}
-			if err := commonutils.UnmarshalJSONWithHresult(rmrrRawSettings, md); err != nil {
+			if err := rmrrRawSettings.unmarshal(md); err != nil {
 				return &request, errors.Wrap(err, "failed to unmarshal settings as MappedDirectory")
 			}
 			rmrr.Settings = md
@@ -616,12 +786,15 @@ func UnmarshalContainerModifySettings(b []byte) (*ContainerModifySettings, error
 		}
 		request.Request = &rmrr
 	} else {
-		var msr ModifySettingRequest
-		var msrRawSettings json.RawMessage
-		msr.Settings = &msrRawSettings
-		if err := commonutils.UnmarshalJSONWithHresult(requestRawSettings, &msr); err != nil {
+		var rawMsr struct {
+			ModifySettingRequest
+			Settings rawMessage
+		}
+		if err := requestRawSettings.unmarshal(&rawMsr); err != nil {
 			return &request, errors.Wrap(err, "failed to unmarshal request.Settings as ModifySettingRequest")
 		}
+		msr := rawMsr.ModifySettingRequest
+		msrRawSettings := rawMsr.Settings
 
 		if msr.RequestType == "" {
 			msr.RequestType = MreqtAdd
@@ -631,41 +804,46 @@ func UnmarshalContainerModifySettings(b []byte) (*ContainerModifySettings, error
 		switch msr.ResourceType {
 		case MrtMappedVirtualDisk:
 			mvd := &MappedVirtualDiskV2{}
-			if err := commonutils.UnmarshalJSONWithHresult(msrRawSettings, mvd); err != nil {
+			if err := msrRawSettings.unmarshal(mvd); err != nil {
 				return &request, errors.Wrap(err, "failed to unmarshal settings as MappedVirtualDiskV2")
 			}
 			msr.Settings = mvd
 		case MrtMappedDirectory:
 			md := &MappedDirectoryV2{}
-			if err := commonutils.UnmarshalJSONWithHresult(msrRawSettings, md); err != nil {
+			if err := msrRawSettings.unmarshal(md); err != nil {
 				return &request, errors.Wrap(err, "failed to unmarshal settings as MappedDirectoryV2")
 			}
 			msr.Settings = md
 		case MrtVPMemDevice:
 			vpd := &MappedVPMemDeviceV2{}
-			if err := commonutils.UnmarshalJSONWithHresult(msrRawSettings, vpd); err != nil {
+			if err := msrRawSettings.unmarshal(vpd); err != nil {
 				return &request, errors.Wrap(err, "failed to unmarshal hosted settings as MappedVPMemDeviceV2")
 			}
 			msr.Settings = vpd
 		case MrtCombinedLayers:
 			cl := &CombinedLayersV2{}
-			if err := commonutils.UnmarshalJSONWithHresult(msrRawSettings, cl); err != nil {
+			if err := msrRawSettings.unmarshal(cl); err != nil {
 				return &request, errors.Wrap(err, "failed to unmarshal settings as CombinedLayersV2")
 			}
 			msr.Settings = cl
 		case MrtNetwork:
 			na := &NetworkAdapterV2{}
-			if err := commonutils.UnmarshalJSONWithHresult(msrRawSettings, na); err != nil {
+			if err := msrRawSettings.unmarshal(na); err != nil {
 				return &request, errors.Wrap(err, "failed to unmarshal settings as NetworkAdapterV2")
 			}
 			msr.Settings = na
+		case MrtContainerResources:
+			lr := &oci.LinuxResources{}
+			if err := msrRawSettings.unmarshal(lr); err != nil {
+				return &request, errors.Wrap(err, "failed to unmarshal settings as LinuxResources")
+			}
+			msr.Settings = lr
 		default:
 			return &request, errors.Errorf("invalid ResourceType '%s'", msr.ResourceType)
 		}
 		request.Request = &msr
 	}
 
-	request.V2Request = nil
 	return &request, nil
 }
 
@@ -703,6 +881,9 @@ type NegotiateProtocolResponse struct {
 	MessageResponseBase
 	Version      uint32
 	Capabilities GcsCapabilities
+	// Encoding is the encoding of every message after this response. It is
+	// only set if `Version` is `PvV5` or above.
+	Encoding MessageEncoding `json:",omitempty"`
 }
 
 type DumpStacksResponse struct {
@@ -710,6 +891,39 @@ type DumpStacksResponse struct {
 	GuestStacks string
 }
 
+// OrphanKind is the kind of resource an `Orphan` is.
+type OrphanKind string
+
+const (
+	// OkDirectory is a bundle or sandbox root directory.
+	OkDirectory = OrphanKind("Directory")
+	// OkMount is an overlay, SCSI or other mount.
+	OkMount = OrphanKind("Mount")
+	// OkCgroup is a container or pod cgroup under /containers.
+	OkCgroup = OrphanKind("Cgroup")
+	// OkNetworkNamespace is a network namespace of an exited container.
+	OkNetworkNamespace = OrphanKind("NetworkNamespace")
+)
+
+// Orphan is a resource in the UVM that is not owned by any container.
+type Orphan struct {
+	Kind OrphanKind
+	// ID is the path of a directory, mount or cgroup or the ID of a network
+	// namespace.
+	ID string
+	// Removed is true if the resource was cleaned up.
+	Removed bool `json:",omitempty"`
+	// Error is why the resource could not be cleaned up.
+	Error string `json:",omitempty"`
+}
+
+// CollectOrphansResponse is the message to the HCS responding to a
+// CollectOrphans message.
+type CollectOrphansResponse struct {
+	MessageResponseBase
+	Orphans []Orphan `json:",omitempty"`
+}
+
 // ContainerCreateResponse is the message to the HCS responding to a
 // ContainerCreate message. It serves a protocol negotiation function as well
 // for protocol versions 3 and lower, returning protocol version information to
@@ -731,15 +945,46 @@ type ContainerExecuteProcessResponse struct {
 // ContainerWaitForProcess message. It is only sent when the process has exited.
 type ContainerWaitForProcessResponse struct {
 	MessageResponseBase
+	ExitCode   uint32
+	ExitStatus *ExitStatus `json:",omitempty"`
+}
+
+// ExitStatus describes how a process exited.
+type ExitStatus struct {
+	// ExitCode is the same as `ContainerWaitForProcessResponse.ExitCode`.
 	ExitCode uint32
+	// Signal is the signal that killed the process or 0 if it exited
+	// normally.
+	Signal int32 `json:",omitempty"`
+	// OOMKilled is true if the process was killed by the kernel because its
+	// container ran out of memory.
+	OOMKilled bool `json:"OomKilled,omitempty"`
+	// StartTime and ExitTime are RFC 3339 timestamps. StartTime is omitted if
+	// it is not known.
+	StartTime string `json:",omitempty"`
+	ExitTime  string `json:",omitempty"`
+	// StopReason is how a container stopped by a `ContainerShutdown` request
+	// ended. It is omitted for any other exit.
+	StopReason StopReason `json:",omitempty"`
 }
 
+// StopReason is how a container stopped by a `ContainerShutdown` request
+// ended.
+type StopReason string
+
+const (
+	// SrStopSignal is a container that exited after its stop signal.
+	SrStopSignal = StopReason("StopSignal")
+	// SrEscalated is a container that was killed with SIGKILL because it did
+	// not exit within its grace period.
+	SrEscalated = StopReason("Escalated")
+)
+
 // ContainerGetPropertiesResponse is the message to the HCS responding to a
-// ContainerGetProperties message. It contains a string representing the
-// properties requested.
+// ContainerGetProperties message. It contains the properties requested.
 type ContainerGetPropertiesResponse struct {
 	MessageResponseBase
-	Properties string
+	Properties NestedJSON
 }
 
 /* types added on to the current official protocol types */
@@ -942,4 +1187,18 @@ type Properties struct {
 type PropertiesV2 struct {
 	ProcessList []ProcessDetails `json:"ProcessList,omitempty"`
 	Metrics     *v1.Metrics      `json:"LCOWMetrics,omitempty"`
+	// PodMetrics are the metrics of the pod cgroup of a sandbox container.
+	PodMetrics *v1.Metrics `json:"LCOWPodMetrics,omitempty"`
+	// State is the lifecycle state of the container.
+	State *ContainerStateInfo `json:"LCOWContainerState,omitempty"`
+}
+
+// ContainerStateInfo is the lifecycle state of a container.
+type ContainerStateInfo struct {
+	// State is one of "created", "running", "paused", "stopped" or
+	// "deleted".
+	State string
+	// Timestamps are the RFC 3339 times the container last entered each state
+	// keyed by the state.
+	Timestamps map[string]string `json:",omitempty"`
 }
@@ -0,0 +1,59 @@
+package prot
+
+import (
+	"testing"
+
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_UnmarshalContainerModifySettingsV2_ContainerResources(t *testing.T) {
+	limit, shares := int64(1048576), uint64(512)
+	for _, enc := range []MessageEncoding{EncodingJSON, EncodingCBOR} {
+		t.Run(string(enc), func(t *testing.T) {
+			message, err := Marshal(enc, &ContainerModifySettings{
+				MessageBase: MessageBase{ContainerID: "abc"},
+				Request: &ModifySettingRequest{
+					ResourceType: MrtContainerResources,
+					RequestType:  MreqtUpdate,
+					Settings: &oci.LinuxResources{
+						Memory: &oci.LinuxMemory{Limit: &limit},
+						CPU:    &oci.LinuxCPU{Shares: &shares},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			request, err := UnmarshalContainerModifySettingsV2(enc, message)
+			if err != nil {
+				t.Fatalf("expected nil error got: %v", err)
+			}
+			msr, ok := request.Request.(*ModifySettingRequest)
+			if !ok {
+				t.Fatalf("expected *ModifySettingRequest got: %T", request.Request)
+			}
+			if msr.ResourceType != MrtContainerResources || msr.RequestType != MreqtUpdate {
+				t.Fatalf("expected ContainerResources Update got: %s %s", msr.ResourceType, msr.RequestType)
+			}
+			lr, ok := msr.Settings.(*oci.LinuxResources)
+			if !ok {
+				t.Fatalf("expected *oci.LinuxResources got: %T", msr.Settings)
+			}
+			if lr.Memory == nil || lr.Memory.Limit == nil || *lr.Memory.Limit != 1048576 {
+				t.Fatalf("expected memory limit 1048576 got: %+v", lr.Memory)
+			}
+			if lr.CPU == nil || lr.CPU.Shares == nil || *lr.CPU.Shares != 512 {
+				t.Fatalf("expected cpu shares 512 got: %+v", lr.CPU)
+			}
+		})
+	}
+}
+
+func Test_UnmarshalContainerModifySettings_ContainerIsV1(t *testing.T) {
+	// Without the V2 bridge a request for a container is an RS3 request.
+	message := []byte(`{"ContainerId":"abc","Request":{"ResourceType":"ContainerResources","RequestType":"Update","Settings":{}}}`)
+	request, err := UnmarshalContainerModifySettings(message)
+	if err == nil {
+		t.Fatalf("expected error got request: %+v", request)
+	}
+}
@@ -27,12 +27,25 @@ func NewRuntime(_ string) runtime.Runtime {
 type container struct {
 	id string
 	r  *mockRuntime
+	// killed is protected by the lock of `r.killed`.
+	killed bool
+
+	relayOnce sync.Once
+	relay     *stdio.PipeRelay
 }
 
 func (r *mockRuntime) CreateContainer(id string, bundlePath string, stdioSet *stdio.ConnectionSet) (c runtime.Container, err error) {
 	return &container{id: id, r: r}, nil
 }
 
+func (r *mockRuntime) RestoreContainer(id string, bundlePath string, opts runtime.RestoreOptions, stdioSet *stdio.ConnectionSet) (c runtime.Container, err error) {
+	return &container{id: id, r: r}, nil
+}
+
+func (r *mockRuntime) LoadContainer(id string) (c runtime.Container, err error) {
+	return &container{id: id, r: r}, nil
+}
+
 func (c *container) Start() error {
 	return nil
 }
@@ -50,7 +63,11 @@ func (c *container) Tty() *stdio.TtyRelay {
 }
 
 func (c *container) PipeRelay() *stdio.PipeRelay {
-	return nil
+	// The relay pipes are only created for containers whose stdio is used.
+	c.relayOnce.Do(func() {
+		c.relay, _ = stdio.NewPipeRelay(nil)
+	})
+	return c.relay
 }
 
 func (c *container) ExecProcess(process *oci.Process, stdioSet *stdio.ConnectionSet) (p runtime.Process, err error) {
@@ -60,6 +77,7 @@ func (c *container) ExecProcess(process *oci.Process, stdioSet *stdio.Connection
 func (c *container) Kill(signal syscall.Signal) error {
 	c.r.killed.L.Lock()
 	defer c.r.killed.L.Unlock()
+	c.killed = true
 	c.r.killed.Broadcast()
 	return nil
 }
@@ -76,6 +94,10 @@ func (c *container) Resume() error {
 	return nil
 }
 
+func (c *container) Checkpoint(opts runtime.CheckpointOptions) error {
+	return nil
+}
+
 func (c *container) GetState() (*runtime.ContainerState, error) {
 	state := &runtime.ContainerState{
 		OCIVersion: "v1",
@@ -132,9 +154,15 @@ func (c *container) GetAllProcesses() ([]runtime.ContainerProcessState, error) {
 	return states, nil
 }
 
+func (c *container) ExitStatus() *runtime.ExitStatus {
+	return &runtime.ExitStatus{Code: 123}
+}
+
 func (c *container) Wait() (int, error) {
 	c.r.killed.L.Lock()
 	defer c.r.killed.L.Unlock()
-	c.r.killed.Wait()
+	for !c.killed {
+		c.r.killed.Wait()
+	}
 	return 123, nil
 }
@@ -0,0 +1,63 @@
+package runc
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Dialect describes an OCI runtime whose command line follows runC closely
+// enough to be driven by the runcRuntime.
+//
+// Every dialect must accept the global `--log` and `--log-format json` flags,
+// write its log as one JSON object per line, and support the `create`,
+// `start`, `exec --detach --process`, `kill --all`, `delete`, `pause`,
+// `resume`, `state`, `list --format json` and `ps --format json` commands.
+type Dialect struct {
+	// Name is the name used to select the runtime.
+	Name string
+	// Binary is the path or name of the runtime executable.
+	Binary string
+	// GlobalArgs are passed to the runtime before the command on every
+	// invocation.
+	GlobalArgs []string
+	// NoPivot is true if `create` should be passed `--no-pivot`. The UVM root
+	// filesystem is not a mount so pivot_root cannot be used on it.
+	NoPivot bool
+}
+
+var (
+	// RuncDialect runs containers with runC.
+	RuncDialect = Dialect{
+		Name:    "runc",
+		Binary:  "runc",
+		NoPivot: true,
+	}
+	// CrunDialect runs containers with crun.
+	CrunDialect = Dialect{
+		Name:    "crun",
+		Binary:  "crun",
+		NoPivot: true,
+	}
+	// RunscDialect runs containers in a gVisor sandbox with runsc. runsc does
+	// not pivot_root in the host so `--no-pivot` is not supported.
+	RunscDialect = Dialect{
+		Name:   "runsc",
+		Binary: "runsc",
+	}
+)
+
+// Dialects are the runtimes supported by the runcRuntime keyed by their
+// `Name`.
+var Dialects = map[string]Dialect{
+	RuncDialect.Name:  RuncDialect,
+	CrunDialect.Name:  CrunDialect,
+	RunscDialect.Name: RunscDialect,
+}
+
+// LookupDialect returns the dialect in `Dialects` with `name`.
+func LookupDialect(name string) (Dialect, error) {
+	d, ok := Dialects[name]
+	if !ok {
+		return Dialect{}, errors.Errorf("unsupported container runtime '%s'", name)
+	}
+	return d, nil
+}
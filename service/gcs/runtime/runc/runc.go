@@ -1,5 +1,6 @@
 // Package runc defines an implementation of the Runtime interface which uses
-// runC as the container runtime.
+// runC, or any OCI runtime with a runC compatible command line such as crun or
+// runsc, as the container runtime.
 package runc
 
 import (
@@ -7,11 +8,13 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/Microsoft/opengcs/service/gcs/gcserr"
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
@@ -23,16 +26,29 @@ import (
 )
 
 const (
-	containerFilesDir = "/var/run/gcsrunc"
-	initPidFilename   = "initpid"
+	// containerFilesDirPrefix is joined with the dialect name to form the
+	// directory holding the state of each container run by that dialect.
+	containerFilesDirPrefix = "/var/run/gcs"
+	initPidFilename         = "initpid"
+
+	// nonChildPollInterval is how often a process that is not a child of the
+	// GCS is checked for exit.
+	nonChildPollInterval = 100 * time.Millisecond
 )
 
-// runcRuntime is an implementation of the Runtime interface which uses runC as
-// the container runtime.
+// runcRuntime is an implementation of the Runtime interface which uses runC, or
+// the runtime described by `dialect`, as the container runtime.
 type runcRuntime struct {
-	runcLogBasePath string
+	runcLogBasePath   string
+	containerFilesDir string
+	dialect           Dialect
 }
 
+// Test dependencies
+var (
+	lookPath = exec.LookPath
+)
+
 var _ runtime.Runtime = &runcRuntime{}
 
 type container struct {
@@ -41,6 +57,10 @@ type container struct {
 	init *process
 }
 
+func (c *container) ExitStatus() *runtime.ExitStatus {
+	return c.init.status
+}
+
 func (c *container) ID() string {
 	return c.id
 }
@@ -62,6 +82,12 @@ type process struct {
 	pid       int
 	ttyRelay  *stdio.TtyRelay
 	pipeRelay *stdio.PipeRelay
+	// status is set once Wait returns.
+	status *runtime.ExitStatus
+}
+
+func (p *process) ExitStatus() *runtime.ExitStatus {
+	return p.status
 }
 
 func (p *process) Pid() int {
@@ -76,19 +102,46 @@ func (p *process) PipeRelay() *stdio.PipeRelay {
 	return p.pipeRelay
 }
 
-// NewRuntime instantiates a new runcRuntime struct.
+// NewRuntime instantiates a new runcRuntime struct. Unlike `NewCLIRuntime` it
+// does not require runC to be installed until a container is run.
 func NewRuntime(logBasePath string) (runtime.Runtime, error) {
+	rtime := newRuntime(logBasePath, RuncDialect)
+	if err := rtime.initialize(); err != nil {
+		return nil, err
+	}
+	return rtime, nil
+}
 
-	rtime := &runcRuntime{runcLogBasePath: logBasePath}
+// NewCLIRuntime instantiates a new runcRuntime struct which runs the runtime
+// described by `dialect`. It fails if the dialect's binary cannot be found.
+func NewCLIRuntime(logBasePath string, dialect Dialect) (runtime.Runtime, error) {
+	if _, err := lookPath(dialect.Binary); err != nil {
+		return nil, errors.Wrapf(err, "failed to find %s binary", dialect.Name)
+	}
+	rtime := newRuntime(logBasePath, dialect)
 	if err := rtime.initialize(); err != nil {
 		return nil, err
 	}
 	return rtime, nil
 }
 
+// newRuntime returns a runcRuntime for `dialect` with its own state and log
+// directories. runC keeps the log directory it used before other dialects
+// were supported.
+func newRuntime(logBasePath string, dialect Dialect) *runcRuntime {
+	if dialect.Name != RuncDialect.Name {
+		logBasePath = filepath.Join(logBasePath, dialect.Name)
+	}
+	return &runcRuntime{
+		runcLogBasePath:   logBasePath,
+		containerFilesDir: containerFilesDirPrefix + dialect.Name,
+		dialect:           dialect,
+	}
+}
+
 // initialize sets up any state necessary for the runcRuntime to function.
 func (r *runcRuntime) initialize() error {
-	paths := [2]string{containerFilesDir, r.runcLogBasePath}
+	paths := [2]string{r.containerFilesDir, r.runcLogBasePath}
 	for _, p := range paths {
 		_, err := os.Stat(p)
 		if err != nil {
@@ -117,17 +170,42 @@ func (r *runcRuntime) CreateContainer(id string, bundlePath string, stdioSet *st
 	return c, nil
 }
 
+// RestoreContainer restores the container checkpointed to `opts.ImagePath` as
+// a new container with the given ID and bundlePath. The restored init process
+// is connected to `stdioSet` rather than the stdio it was checkpointed with.
+func (r *runcRuntime) RestoreContainer(id string, bundlePath string, opts runtime.RestoreOptions, stdioSet *stdio.ConnectionSet) (c runtime.Container, err error) {
+	c, err = r.runRestoreCommand(id, bundlePath, opts, stdioSet)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadContainer returns the container with the given ID that was created by a
+// previous instance of this runtime, for example before the GCS restarted. The
+// stdio of its processes is not connected and their exit codes cannot be
+// known.
+func (r *runcRuntime) LoadContainer(id string) (runtime.Container, error) {
+	c := &container{r: r, id: id}
+	pid, err := r.readPidFile(filepath.Join(r.getContainerDir(id), initPidFilename))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read init pid for container %s", id)
+	}
+	c.init = &process{c: c, pid: pid}
+	return c, nil
+}
+
 // Start unblocks the container's init process created by the call to
 // CreateContainer.
 func (c *container) Start() error {
 	logPath := c.r.getLogPath(c.id)
 	args := []string{"start", c.id}
-	cmd := createRuncCommand(logPath, args...)
+	cmd := c.r.command(logPath, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
 		c.r.cleanupContainer(c.id)
-		return errors.Wrapf(err, "runc start failed with %v: %s", runcErr, string(out))
+		return errors.Wrapf(err, "%s start failed with %v: %s", c.r.dialect.Name, runcErr, string(out))
 	}
 	return nil
 }
@@ -150,7 +228,7 @@ func (c *container) Kill(signal syscall.Signal) error {
 		args = append(args, "--all")
 	}
 	args = append(args, c.id, strconv.Itoa(int(signal)))
-	cmd := createRuncCommand(logPath, args...)
+	cmd := c.r.command(logPath, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		if strings.Contains(err.Error(), "os: process already finished") ||
@@ -160,7 +238,7 @@ func (c *container) Kill(signal syscall.Signal) error {
 		}
 
 		runcErr := getRuncLogError(logPath)
-		return errors.Wrapf(err, "unknown runc error after kill %v: %s", runcErr, string(out))
+		return errors.Wrapf(err, "unknown %s error after kill %v: %s", c.r.dialect.Name, runcErr, string(out))
 	}
 	return nil
 }
@@ -170,11 +248,11 @@ func (c *container) Kill(signal syscall.Signal) error {
 func (c *container) Delete() error {
 	logPath := c.r.getLogPath(c.id)
 	args := []string{"delete", c.id}
-	cmd := createRuncCommand(logPath, args...)
+	cmd := c.r.command(logPath, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
-		return errors.Wrapf(err, "runc delete failed with %v: %s", runcErr, string(out))
+		return errors.Wrapf(err, "%s delete failed with %v: %s", c.r.dialect.Name, runcErr, string(out))
 	}
 	if err := c.r.cleanupContainer(c.id); err != nil {
 		return err
@@ -195,11 +273,11 @@ func (p *process) Delete() error {
 func (c *container) Pause() error {
 	logPath := c.r.getLogPath(c.id)
 	args := []string{"pause", c.id}
-	cmd := createRuncCommand(logPath, args...)
+	cmd := c.r.command(logPath, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
-		return errors.Wrapf(err, "runc pause failed with %v: %s", runcErr, string(out))
+		return errors.Wrapf(err, "%s pause failed with %v: %s", c.r.dialect.Name, runcErr, string(out))
 	}
 	return nil
 }
@@ -208,24 +286,53 @@ func (c *container) Pause() error {
 func (c *container) Resume() error {
 	logPath := c.r.getLogPath(c.id)
 	args := []string{"resume", c.id}
-	cmd := createRuncCommand(logPath, args...)
+	cmd := c.r.command(logPath, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		runcErr := getRuncLogError(logPath)
+		return errors.Wrapf(err, "%s resume failed with %v: %s", c.r.dialect.Name, runcErr, string(out))
+	}
+	return nil
+}
+
+// Checkpoint writes the state of all processes in the container to
+// `opts.ImagePath` using CRIU.
+func (c *container) Checkpoint(opts runtime.CheckpointOptions) error {
+	if err := os.MkdirAll(opts.ImagePath, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create checkpoint directory %s", opts.ImagePath)
+	}
+	logPath := c.r.getLogPath(c.id)
+	cmd := c.r.command(logPath, checkpointArgs(c.id, opts)...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
-		return errors.Wrapf(err, "runc resume failed with %v: %s", runcErr, string(out))
+		return errors.Wrapf(err, "%s checkpoint failed with %v: %s", c.r.dialect.Name, runcErr, string(out))
 	}
 	return nil
 }
 
+// checkpointArgs returns the arguments for calling checkpoint on container
+// `id`.
+func checkpointArgs(id string, opts runtime.CheckpointOptions) []string {
+	args := []string{"checkpoint", "--image-path", opts.ImagePath}
+	if opts.LeaveRunning {
+		args = append(args, "--leave-running")
+	}
+	if opts.TCPEstablished {
+		args = append(args, "--tcp-established")
+	}
+	return append(args, id)
+}
+
 // GetState returns information about the given container.
 func (c *container) GetState() (*runtime.ContainerState, error) {
 	logPath := c.r.getLogPath(c.id)
 	args := []string{"state", c.id}
-	cmd := createRuncCommand(logPath, args...)
+	cmd := c.r.command(logPath, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
-		return nil, errors.Wrapf(err, "runc state failed with %v: %s", runcErr, string(out))
+		return nil, errors.Wrapf(err, "%s state failed with %v: %s", c.r.dialect.Name, runcErr, string(out))
 	}
 	var state runtime.ContainerState
 	if err := json.Unmarshal(out, &state); err != nil {
@@ -256,13 +363,13 @@ func (c *container) Exists() (bool, error) {
 // ListContainerStates returns ContainerState structs for all existing
 // containers, whether they're running or not.
 func (r *runcRuntime) ListContainerStates() ([]runtime.ContainerState, error) {
-	logPath := filepath.Join(r.runcLogBasePath, "global-runc.log")
-	args := []string{"list", "-f", "json"}
-	cmd := createRuncCommand(logPath, args...)
+	logPath := filepath.Join(r.runcLogBasePath, "global-"+r.dialect.Name+".log")
+	args := []string{"list", "--format", "json"}
+	cmd := r.command(logPath, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
-		return nil, errors.Wrapf(err, "runc list failed with %v: %s", runcErr, string(out))
+		return nil, errors.Wrapf(err, "%s list failed with %v: %s", r.dialect.Name, runcErr, string(out))
 	}
 	var states []runtime.ContainerState
 	if err := json.Unmarshal(out, &states); err != nil {
@@ -292,9 +399,9 @@ func (c *container) GetRunningProcesses() ([]runtime.ContainerProcessState, erro
 
 	// For each process state directory which corresponds to a running pid, set
 	// that the process was created by the Runtime.
-	processDirs, err := ioutil.ReadDir(filepath.Join(containerFilesDir, c.id))
+	processDirs, err := ioutil.ReadDir(filepath.Join(c.r.containerFilesDir, c.id))
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to read the contents of container directory %s", filepath.Join(containerFilesDir, c.id))
+		return nil, errors.Wrapf(err, "failed to read the contents of container directory %s", filepath.Join(c.r.containerFilesDir, c.id))
 	}
 	for _, processDir := range processDirs {
 		if processDir.Name() != initPidFilename {
@@ -330,9 +437,9 @@ func (c *container) GetAllProcesses() ([]runtime.ContainerProcessState, error) {
 		pidMap[pid] = &runtime.ContainerProcessState{Pid: pid, Command: command, CreatedByRuntime: false, IsZombie: false}
 	}
 
-	processDirs, err := ioutil.ReadDir(filepath.Join(containerFilesDir, c.id))
+	processDirs, err := ioutil.ReadDir(filepath.Join(c.r.containerFilesDir, c.id))
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to read the contents of container directory %s", filepath.Join(containerFilesDir, c.id))
+		return nil, errors.Wrapf(err, "failed to read the contents of container directory %s", filepath.Join(c.r.containerFilesDir, c.id))
 	}
 	// Loop over every process state directory. Since these processes have
 	// process state directories, CreatedByRuntime will be true for all of them.
@@ -367,12 +474,12 @@ func (c *container) GetAllProcesses() ([]runtime.ContainerProcessState, error) {
 // running.
 func (r *runcRuntime) getRunningPids(id string) ([]int, error) {
 	logPath := r.getLogPath(id)
-	args := []string{"ps", "-f", "json", id}
-	cmd := createRuncCommand(logPath, args...)
+	args := []string{"ps", "--format", "json", id}
+	cmd := r.command(logPath, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
-		return nil, errors.Wrapf(err, "runc ps failed with %v: %s", runcErr, string(out))
+		return nil, errors.Wrapf(err, "%s ps failed with %v: %s", r.dialect.Name, runcErr, string(out))
 	}
 	var pids []int
 	if err := json.Unmarshal(out, &pids); err != nil {
@@ -407,33 +514,50 @@ func (r *runcRuntime) pidMapToProcessStates(pidMap map[int]*runtime.ContainerPro
 	return processStates
 }
 
-// waitOnProcess waits for the process to exit, and returns its exit code.
-func (r *runcRuntime) waitOnProcess(pid int) (int, error) {
+// waitOnProcess waits for the process to exit, and returns its exit status.
+func (r *runcRuntime) waitOnProcess(pid int) (*runtime.ExitStatus, error) {
+	es := &runtime.ExitStatus{Code: -1}
+	// The start time must be read while the process exists.
+	if startTime, err := getProcessStartTime(pid); err == nil {
+		es.StartTime = startTime
+	}
 	process, err := os.FindProcess(pid)
 	if err != nil {
-		return -1, errors.Wrapf(err, "failed to find process %d", pid)
+		return es, errors.Wrapf(err, "failed to find process %d", pid)
 	}
 	state, err := process.Wait()
 	if err != nil {
-		return -1, errors.Wrapf(err, "failed waiting on process %d", pid)
+		if serr, ok := err.(*os.SyscallError); ok && serr.Err == syscall.ECHILD {
+			// The process was started by a previous instance of the GCS and
+			// reparented away from this one so its exit code is lost.
+			waitOnNonChild(pid, nonChildPollInterval)
+			es.ExitTime = time.Now()
+			return es, nil
+		}
+		return es, errors.Wrapf(err, "failed waiting on process %d", pid)
 	}
+	es.ExitTime = time.Now()
 
 	status := state.Sys().(syscall.WaitStatus)
 	if status.Signaled() {
-		return 128 + int(status.Signal()), nil
+		es.Signal = status.Signal()
+		es.Code = 128 + int(status.Signal())
+	} else {
+		es.Code = status.ExitStatus()
 	}
-	return status.ExitStatus(), nil
+	return es, nil
 }
 
 func (p *process) Wait() (int, error) {
-	exitCode, err := p.c.r.waitOnProcess(p.pid)
+	status, err := p.c.r.waitOnProcess(p.pid)
+	p.status = status
 	if p.ttyRelay != nil {
 		p.ttyRelay.Wait()
 	}
 	if p.pipeRelay != nil {
 		p.pipeRelay.Wait()
 	}
-	return exitCode, err
+	return status.Code, err
 }
 
 // Wait waits on every non-init process in the container, and then performs a
@@ -468,7 +592,7 @@ func (r *runcRuntime) runCreateCommand(id string, bundlePath string, stdioSet *s
 		return nil, err
 	}
 	// Create a temporary random directory to store the process's files.
-	tempProcessDir, err := ioutil.TempDir(containerFilesDir, id)
+	tempProcessDir, err := ioutil.TempDir(r.containerFilesDir, id)
 	if err != nil {
 		return nil, err
 	}
@@ -492,8 +616,7 @@ func (r *runcRuntime) runCreateCommand(id string, bundlePath string, stdioSet *s
 		}
 	}
 
-	args := []string{"create", "-b", bundlePath, "--no-pivot"}
-	p, err := c.startProcess(tempProcessDir, hasTerminal, stdioSet, args...)
+	p, err := c.startProcess(tempProcessDir, hasTerminal, stdioSet, r.createArgs(bundlePath)...)
 	if err != nil {
 		return nil, err
 	}
@@ -508,6 +631,64 @@ func (r *runcRuntime) runCreateCommand(id string, bundlePath string, stdioSet *s
 	return c, nil
 }
 
+// createArgs returns the arguments for calling create on the bundle at
+// `bundlePath`.
+func (r *runcRuntime) createArgs(bundlePath string) []string {
+	args := []string{"create", "--bundle", bundlePath}
+	if r.dialect.NoPivot {
+		args = append(args, "--no-pivot")
+	}
+	return args
+}
+
+// runRestoreCommand sets up the arguments for calling runc restore.
+func (r *runcRuntime) runRestoreCommand(id string, bundlePath string, opts runtime.RestoreOptions, stdioSet *stdio.ConnectionSet) (runtime.Container, error) {
+	if _, err := os.Stat(opts.ImagePath); err != nil {
+		return nil, errors.Wrapf(err, "failed to find checkpoint directory %s", opts.ImagePath)
+	}
+	c := &container{r: r, id: id}
+	if err := r.makeContainerDir(id); err != nil {
+		return nil, err
+	}
+	// Create a temporary random directory to store the process's files.
+	tempProcessDir, err := ioutil.TempDir(r.containerFilesDir, id)
+	if err != nil {
+		return nil, err
+	}
+
+	hasTerminal, err := r.hasTerminal(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := c.startProcess(tempProcessDir, hasTerminal, stdioSet, r.restoreArgs(bundlePath, opts)...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write pid to initpid file for container.
+	containerDir := r.getContainerDir(id)
+	if err := ioutil.WriteFile(filepath.Join(containerDir, initPidFilename), []byte(strconv.Itoa(p.pid)), 0777); err != nil {
+		return nil, err
+	}
+
+	c.init = p
+	return c, nil
+}
+
+// restoreArgs returns the arguments for calling restore on the bundle at
+// `bundlePath`.
+func (r *runcRuntime) restoreArgs(bundlePath string, opts runtime.RestoreOptions) []string {
+	args := []string{"restore", "--detach", "--bundle", bundlePath, "--image-path", opts.ImagePath}
+	if r.dialect.NoPivot {
+		args = append(args, "--no-pivot")
+	}
+	if opts.TCPEstablished {
+		args = append(args, "--tcp-established")
+	}
+	return args
+}
+
 // hasTerminal looks at the config.json in the bundlePath, and determines
 // whether its process's terminal value is true or false.
 func (r *runcRuntime) hasTerminal(bundlePath string) (bool, error) {
@@ -526,7 +707,7 @@ func (r *runcRuntime) hasTerminal(bundlePath string) (bool, error) {
 // runExecCommand sets up the arguments for calling runc exec.
 func (c *container) runExecCommand(processDef *oci.Process, stdioSet *stdio.ConnectionSet) (p runtime.Process, err error) {
 	// Create a temporary random directory to store the process's files.
-	tempProcessDir, err := ioutil.TempDir(containerFilesDir, c.id)
+	tempProcessDir, err := ioutil.TempDir(c.r.containerFilesDir, c.id)
 	if err != nil {
 		return nil, err
 	}
@@ -541,15 +722,15 @@ func (c *container) runExecCommand(processDef *oci.Process, stdioSet *stdio.Conn
 	}
 
 	args := []string{"exec"}
-	args = append(args, "-d", "--process", filepath.Join(tempProcessDir, "process.json"))
+	args = append(args, "--detach", "--process", filepath.Join(tempProcessDir, "process.json"))
 	return c.startProcess(tempProcessDir, processDef.Terminal, stdioSet, args...)
 }
 
 // startProcess performs the operations necessary to start a container process
-// and properly handle its stdio. This function is used by both CreateContainer
-// and ExecProcess. For V2 container creation stdioSet will be nil, in this case
-// it is expected that the caller starts the relay previous to calling Start on
-// the container.
+// and properly handle its stdio. This function is used by CreateContainer,
+// ExecProcess and RestoreContainer. For V2 container creation stdioSet will be
+// nil, in this case it is expected that the caller starts the relay previous to
+// calling Start on the container.
 func (c *container) startProcess(tempProcessDir string, hasTerminal bool, stdioSet *stdio.ConnectionSet, initialArgs ...string) (p *process, err error) {
 	args := initialArgs
 
@@ -575,7 +756,7 @@ func (c *container) startProcess(tempProcessDir string, hasTerminal bool, stdioS
 	}
 	args = append(args, c.id)
 
-	cmd := createRuncCommand(logPath, args...)
+	cmd := c.r.command(logPath, args...)
 
 	var pipeRelay *stdio.PipeRelay
 	if !hasTerminal {
@@ -601,7 +782,7 @@ func (c *container) startProcess(tempProcessDir string, hasTerminal bool, stdioS
 
 	if err := cmd.Run(); err != nil {
 		runcErr := getRuncLogError(logPath)
-		return nil, errors.Wrapf(err, "failed to run runc create/exec call for container %s with %v", c.id, runcErr)
+		return nil, errors.Wrapf(err, "failed to run %s create/exec/restore call for container %s with %v", c.r.dialect.Name, c.id, runcErr)
 	}
 
 	var ttyRelay *stdio.TtyRelay
@@ -0,0 +1,137 @@
+package runc
+
+import (
+	"errors"
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+)
+
+func Test_Dialect_CreateArgs(t *testing.T) {
+	tests := []struct {
+		dialect  Dialect
+		expected []string
+	}{
+		{RuncDialect, []string{"create", "--bundle", "/b", "--no-pivot"}},
+		{CrunDialect, []string{"create", "--bundle", "/b", "--no-pivot"}},
+		{RunscDialect, []string{"create", "--bundle", "/b"}},
+	}
+	for _, test := range tests {
+		r := newRuntime("/logs", test.dialect)
+		if args := r.createArgs("/b"); !reflect.DeepEqual(args, test.expected) {
+			t.Fatalf("expected %s create args %v got: %v", test.dialect.Name, test.expected, args)
+		}
+	}
+}
+
+func Test_Dialect_RestoreArgs(t *testing.T) {
+	tests := []struct {
+		dialect  Dialect
+		opts     runtime.RestoreOptions
+		expected []string
+	}{
+		{
+			RuncDialect,
+			runtime.RestoreOptions{ImagePath: "/i"},
+			[]string{"restore", "--detach", "--bundle", "/b", "--image-path", "/i", "--no-pivot"},
+		},
+		{
+			RuncDialect,
+			runtime.RestoreOptions{ImagePath: "/i", TCPEstablished: true},
+			[]string{"restore", "--detach", "--bundle", "/b", "--image-path", "/i", "--no-pivot", "--tcp-established"},
+		},
+		{
+			RunscDialect,
+			runtime.RestoreOptions{ImagePath: "/i", TCPEstablished: true},
+			[]string{"restore", "--detach", "--bundle", "/b", "--image-path", "/i", "--tcp-established"},
+		},
+	}
+	for _, test := range tests {
+		r := newRuntime("/logs", test.dialect)
+		if args := r.restoreArgs("/b", test.opts); !reflect.DeepEqual(args, test.expected) {
+			t.Fatalf("expected %s restore args %v got: %v", test.dialect.Name, test.expected, args)
+		}
+	}
+}
+
+func Test_CheckpointArgs(t *testing.T) {
+	tests := []struct {
+		opts     runtime.CheckpointOptions
+		expected []string
+	}{
+		{
+			runtime.CheckpointOptions{ImagePath: "/i"},
+			[]string{"checkpoint", "--image-path", "/i", "c"},
+		},
+		{
+			runtime.CheckpointOptions{ImagePath: "/i", LeaveRunning: true},
+			[]string{"checkpoint", "--image-path", "/i", "--leave-running", "c"},
+		},
+		{
+			runtime.CheckpointOptions{ImagePath: "/i", LeaveRunning: true, TCPEstablished: true},
+			[]string{"checkpoint", "--image-path", "/i", "--leave-running", "--tcp-established", "c"},
+		},
+	}
+	for _, test := range tests {
+		if args := checkpointArgs("c", test.opts); !reflect.DeepEqual(args, test.expected) {
+			t.Fatalf("expected checkpoint args %v got: %v", test.expected, args)
+		}
+	}
+}
+
+func Test_Dialect_Command(t *testing.T) {
+	withGlobalArgs := RunscDialect
+	withGlobalArgs.GlobalArgs = []string{"--platform", "ptrace"}
+	tests := []struct {
+		dialect  Dialect
+		expected []string
+	}{
+		{RuncDialect, []string{"runc", "--log", "/l.log", "--log-format", "json", "start", "c"}},
+		{CrunDialect, []string{"crun", "--log", "/l.log", "--log-format", "json", "start", "c"}},
+		{RunscDialect, []string{"runsc", "--log", "/l.log", "--log-format", "json", "start", "c"}},
+		{withGlobalArgs, []string{"runsc", "--log", "/l.log", "--log-format", "json", "--platform", "ptrace", "start", "c"}},
+	}
+	for _, test := range tests {
+		r := newRuntime("/logs", test.dialect)
+		cmd := r.command("/l.log", "start", "c")
+		if !reflect.DeepEqual(cmd.Args, test.expected) {
+			t.Fatalf("expected %s command %v got: %v", test.dialect.Name, test.expected, cmd.Args)
+		}
+	}
+}
+
+func Test_Dialect_Directories(t *testing.T) {
+	tests := []struct {
+		dialect  Dialect
+		stateDir string
+		logDir   string
+	}{
+		{RuncDialect, "/var/run/gcsrunc/c", "/logs/c"},
+		{CrunDialect, "/var/run/gcscrun/c", "/logs/crun/c"},
+		{RunscDialect, "/var/run/gcsrunsc/c", "/logs/runsc/c"},
+	}
+	for _, test := range tests {
+		r := newRuntime("/logs", test.dialect)
+		if dir := r.getContainerDir("c"); dir != test.stateDir {
+			t.Fatalf("expected %s state directory %s got: %s", test.dialect.Name, test.stateDir, dir)
+		}
+		if dir := r.getLogDir("c"); dir != test.logDir {
+			t.Fatalf("expected %s log directory %s got: %s", test.dialect.Name, test.logDir, dir)
+		}
+	}
+}
+
+func Test_NewCLIRuntime_MissingBinary(t *testing.T) {
+	lookPath = func(file string) (string, error) {
+		return "", errors.New("not found")
+	}
+	defer func() {
+		lookPath = exec.LookPath
+	}()
+
+	if _, err := NewCLIRuntime("/logs", CrunDialect); err == nil {
+		t.Fatal("expected an error for a missing binary")
+	}
+}
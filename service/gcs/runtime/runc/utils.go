@@ -7,7 +7,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -53,7 +55,7 @@ func (r *runcRuntime) getProcessDir(id string, pid int) string {
 // getContainerDir returns the path to the state directory of the given
 // container.
 func (r *runcRuntime) getContainerDir(id string) string {
-	return filepath.Join(containerFilesDir, id)
+	return filepath.Join(r.containerFilesDir, id)
 }
 
 // makeContainerDir creates the state directory for the given container.
@@ -93,6 +95,82 @@ func (r *runcRuntime) processExists(pid int) bool {
 	return !os.IsNotExist(err)
 }
 
+// getProcessStat returns the state and start time fields of /proc/<pid>/stat.
+func getProcessStat(pid int) (state, startTime string, err error) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", "", err
+	}
+	// The command name can contain spaces and parentheses so the fields are
+	// parsed from after its closing parenthesis starting with the state.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return "", "", errors.Errorf("invalid stat for process %d", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return "", "", errors.Errorf("invalid stat for process %d", pid)
+	}
+	return fields[0], fields[19], nil
+}
+
+// clockTicks is the USER_HZ of the kernel which /proc reports times in. It is
+// 100 on every architecture Linux supports.
+const clockTicks = 100
+
+// getProcessStartTime returns when `pid` started.
+func getProcessStartTime(pid int) (time.Time, error) {
+	_, startTime, err := getProcessStat(pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ticks, err := strconv.ParseUint(startTime, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid start time for process %d", pid)
+	}
+	boot, err := getBootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
+
+// getBootTime returns the boot time of the system from /proc/stat.
+func getBootTime() (time.Time, error) {
+	data, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			secs, err := strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+			if err != nil {
+				return time.Time{}, errors.Wrap(err, "invalid boot time in /proc/stat")
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("no boot time in /proc/stat")
+}
+
+// waitOnNonChild polls every `interval` until `pid`, which is not a child of
+// this process and so cannot be waited on, has exited. This is the case for
+// processes started by a previous instance of the GCS.
+func waitOnNonChild(pid int, interval time.Duration) {
+	_, startTime, err := getProcessStat(pid)
+	if err != nil {
+		return
+	}
+	for {
+		state, st, err := getProcessStat(pid)
+		// The pid was reused if the start time changed.
+		if err != nil || state == "Z" || st != startTime {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
 type standardLogEntry struct {
 	Level   logrus.Level `json:"level"`
 	Message string       `json:"msg"`
@@ -123,7 +201,10 @@ func getRuncLogError(logPath string) error {
 	return lastErr
 }
 
-func createRuncCommand(logPath string, args ...string) *exec.Cmd {
-	args = append([]string{"--log", logPath, "--log-format", "json"}, args...)
-	return exec.Command("runc", args...)
+// command returns the command to run the runtime binary with `args` logging
+// to `logPath`.
+func (r *runcRuntime) command(logPath string, args ...string) *exec.Cmd {
+	global := []string{"--log", logPath, "--log-format", "json"}
+	global = append(global, r.dialect.GlobalArgs...)
+	return exec.Command(r.dialect.Binary, append(global, args...)...)
 }
@@ -5,6 +5,7 @@ package runtime
 import (
 	"io"
 	"syscall"
+	"time"
 
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
@@ -30,6 +31,19 @@ type ContainerProcessState struct {
 	IsZombie         bool
 }
 
+// ExitStatus describes how a process created by a Runtime exited.
+type ExitStatus struct {
+	// Code is the exit code of the process, 128 plus the signal number if it
+	// was killed by a signal, or -1 if it is not known.
+	Code int
+	// Signal is the signal that killed the process or 0 if it exited.
+	Signal syscall.Signal
+	// StartTime is when the process started. It is zero if not known.
+	StartTime time.Time
+	// ExitTime is when the exit of the process was seen.
+	ExitTime time.Time
+}
+
 // StdioPipes contain the interfaces for reading from and writing to a
 // process's stdio.
 type StdioPipes struct {
@@ -38,9 +52,37 @@ type StdioPipes struct {
 	Err io.ReadCloser
 }
 
+// CheckpointOptions are the options for checkpointing a container with
+// `Container.Checkpoint`.
+type CheckpointOptions struct {
+	// ImagePath is the directory the checkpoint images are written to. It is
+	// created if it does not exist.
+	ImagePath string
+	// LeaveRunning is true if the container should keep running after the
+	// checkpoint. Otherwise all of its processes are stopped.
+	LeaveRunning bool
+	// TCPEstablished is true if established TCP connections should be
+	// checkpointed.
+	TCPEstablished bool
+}
+
+// RestoreOptions are the options for restoring a container with
+// `Runtime.RestoreContainer`.
+type RestoreOptions struct {
+	// ImagePath is the directory holding the images written by
+	// `Container.Checkpoint`.
+	ImagePath string
+	// TCPEstablished is true if established TCP connections in the checkpoint
+	// should be restored.
+	TCPEstablished bool
+}
+
 // Process is an interface to manipulate process state.
 type Process interface {
 	Wait() (int, error)
+	// ExitStatus returns how the process exited. It is nil until Wait has
+	// returned.
+	ExitStatus() *ExitStatus
 	Pid() int
 	Delete() error
 	Tty() *stdio.TtyRelay
@@ -57,6 +99,7 @@ type Container interface {
 	Kill(signal syscall.Signal) error
 	Pause() error
 	Resume() error
+	Checkpoint(opts CheckpointOptions) error
 	GetState() (*ContainerState, error)
 	GetRunningProcesses() ([]ContainerProcessState, error)
 	GetAllProcesses() ([]ContainerProcessState, error)
@@ -66,5 +109,12 @@ type Container interface {
 // such as runC.
 type Runtime interface {
 	CreateContainer(id string, bundlePath string, stdioSet *stdio.ConnectionSet) (c Container, err error)
+	// RestoreContainer restores a container checkpointed by
+	// `Container.Checkpoint` as `id` with the bundle at `bundlePath`. Unlike
+	// CreateContainer the returned container is already running.
+	RestoreContainer(id string, bundlePath string, opts RestoreOptions, stdioSet *stdio.ConnectionSet) (c Container, err error)
 	ListContainerStates() ([]ContainerState, error)
+	// LoadContainer returns the existing container `id` created by a previous
+	// instance of the runtime. The stdio of its processes is not connected.
+	LoadContainer(id string) (c Container, err error)
 }
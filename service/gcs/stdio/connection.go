@@ -1,6 +1,7 @@
 package stdio
 
 import (
+	"context"
 	"os"
 
 	"github.com/Microsoft/opengcs/service/gcs/transport"
@@ -59,10 +60,36 @@ func (lc *logConnection) File() (*os.File, error) {
 
 var _ = (transport.Connection)(&logConnection{})
 
+// dial connects to `port` on `tport`. It returns early if `ctx` is done, in
+// which case the connection is closed once the dial completes.
+func dial(ctx context.Context, tport transport.Transport, port uint32) (transport.Connection, error) {
+	type result struct {
+		c   transport.Connection
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := tport.Dial(port)
+		done <- result{c, err}
+	}()
+	select {
+	case r := <-done:
+		return r.c, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.err == nil {
+				r.c.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
 // Connect returns new transport.Connection instances, one for each stdio pipe
 // to be used. If CreateStd*Pipe for a given pipe is false, the given Connection
-// is set to nil.
-func Connect(tport transport.Transport, settings ConnectionSettings) (_ *ConnectionSet, err error) {
+// is set to nil. Dialing the host can block so it is abandoned if `ctx` is
+// done before all of the connections are made.
+func Connect(ctx context.Context, tport transport.Transport, settings ConnectionSettings) (_ *ConnectionSet, err error) {
 	connSet := &ConnectionSet{}
 	defer func() {
 		if err != nil {
@@ -70,7 +97,7 @@ func Connect(tport transport.Transport, settings ConnectionSettings) (_ *Connect
 		}
 	}()
 	if settings.StdIn != nil {
-		c, err := tport.Dial(*settings.StdIn)
+		c, err := dial(ctx, tport, *settings.StdIn)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed creating stdin Connection")
 		}
@@ -80,7 +107,7 @@ func Connect(tport transport.Transport, settings ConnectionSettings) (_ *Connect
 		}
 	}
 	if settings.StdOut != nil {
-		c, err := tport.Dial(*settings.StdOut)
+		c, err := dial(ctx, tport, *settings.StdOut)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed creating stdout Connection")
 		}
@@ -90,7 +117,7 @@ func Connect(tport transport.Transport, settings ConnectionSettings) (_ *Connect
 		}
 	}
 	if settings.StdErr != nil {
-		c, err := tport.Dial(*settings.StdErr)
+		c, err := dial(ctx, tport, *settings.StdErr)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed creating stderr Connection")
 		}
@@ -99,5 +126,8 @@ func Connect(tport transport.Transport, settings ConnectionSettings) (_ *Connect
 			port: *settings.StdErr,
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return connSet, nil
 }
@@ -0,0 +1,51 @@
+package stdio
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/transport"
+)
+
+// blockingTransport never completes a dial until `release` is closed.
+type blockingTransport struct {
+	release chan struct{}
+}
+
+func (t *blockingTransport) Dial(port uint32) (transport.Connection, error) {
+	<-t.release
+	return (&transport.MockTransport{}).Dial(port)
+}
+
+func Test_Connect_Cancelled_Failure(t *testing.T) {
+	tport := &blockingTransport{release: make(chan struct{})}
+	defer close(tport.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	port := uint32(1)
+	done := make(chan error, 1)
+	go func() {
+		_, err := Connect(ctx, tport, ConnectionSettings{StdOut: &port})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected error got nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Connect to return once the context was done")
+	}
+}
+
+func Test_Connect_NoPorts_Success(t *testing.T) {
+	cs, err := Connect(context.Background(), &blockingTransport{}, ConnectionSettings{})
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if cs.In != nil || cs.Out != nil || cs.Err != nil {
+		t.Fatalf("expected no connections got: %+v", cs)
+	}
+}
@@ -0,0 +1,43 @@
+package transport
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// UnixTransport is an implementation of Transport which uses Unix domain
+// sockets. It allows the GCS to be run on a plain Linux host where vsock is
+// not available, for example on a developer machine or in CI.
+type UnixTransport struct {
+	// Dir is the directory containing the sockets. A call to Dial(port)
+	// connects to the socket at `Path(port)`.
+	Dir string
+}
+
+var _ Transport = &UnixTransport{}
+
+// Path returns the socket path that `port` maps to. Any listener acting as
+// the host for a given port is expected to be listening on this path.
+func (t *UnixTransport) Path(port uint32) string {
+	return filepath.Join(t.Dir, strconv.FormatUint(uint64(port), 10)+".sock")
+}
+
+// Dial connects to the Unix domain socket that `port` maps to and returns the
+// connected connection.
+func (t *UnixTransport) Dial(port uint32) (Connection, error) {
+	path := t.Path(port)
+	logrus.WithFields(logrus.Fields{
+		"port": port,
+		"path": path,
+	}).Info("opengcs::UnixTransport::Dial - unix dial port")
+
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unix Dial port (%d) failed", port)
+	}
+	return conn, nil
+}
@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func Test_UnixTransport_Dial_Success(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tport := &UnixTransport{Dir: dir}
+	const port uint32 = 0x40000000
+	l, err := net.Listen("unix", tport.Path(port))
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", tport.Path(port), err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	conn, err := tport.Dial(port)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	defer conn.Close()
+
+	sconn, ok := <-accepted
+	if !ok {
+		t.Fatal("listener failed to accept connection")
+	}
+	defer sconn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatalf("failed to close write: %v", err)
+	}
+	b, err := ioutil.ReadAll(sconn)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(b) != "ping" {
+		t.Fatalf("expected 'ping' got: '%s'", b)
+	}
+}
+
+func Test_UnixTransport_Dial_NoListener_Failure(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tport := &UnixTransport{Dir: dir}
+	conn, err := tport.Dial(1)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected error got nil")
+	}
+}
@@ -11,6 +11,7 @@ var commands = map[string]func(){
 	"exportSandbox": exportSandboxMain,
 	"netnscfg":      netnsConfigMain,
 	"remotefs":      remotefsMain,
+	"gcsreplay":     replayMain,
 }
 
 func main() {
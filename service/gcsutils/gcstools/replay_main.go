@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/runtime/hcsv2"
+	"github.com/Microsoft/opengcs/service/gcs/bridge"
+	"github.com/Microsoft/opengcs/service/gcs/core/mockcore"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	"github.com/Microsoft/opengcs/service/gcs/transport"
+	"github.com/Microsoft/opengcs/service/gcsutils/gcstools/commoncli"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// replay feeds a bridge capture written by the gcs `-capture-file` flag into a
+// bridge backed by a mock core and runtime and writes every response that
+// differs from the capture to stdout.
+func replay() error {
+	logArgs := commoncli.SetFlagsForLogging()
+	captureFile := flag.String("capture", "", "The capture file to replay")
+	v4 := flag.Bool("v4", true, "enable the v4 protocol support and v2 schema")
+	timeout := flag.Duration("timeout", 5*time.Second, "The maximum time to wait for each captured response")
+	flag.Parse()
+
+	if err := commoncli.SetupLogging(logArgs...); err != nil {
+		logrus.Infof("error: %s. Please use -h for params", err)
+		return err
+	}
+	if *captureFile == "" {
+		return errors.New("-capture is required")
+	}
+
+	f, err := os.Open(*captureFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open capture file %s", *captureFile)
+	}
+	defer f.Close()
+	records, err := bridge.ReadCapture(f)
+	if err != nil {
+		return err
+	}
+
+	mux := bridge.NewBridgeMux()
+	b := &bridge.Bridge{
+		Handler:  mux,
+		EnableV4: *v4,
+	}
+	tport := &transport.MockTransport{}
+	b.AssignHandlers(mux, &mockcore.MockCore{Behavior: mockcore.Success}, hcsv2.NewHost(mockruntime.NewRuntime(""), tport))
+
+	mismatches, err := bridge.Replay(b, records, *timeout)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	for _, m := range mismatches {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	if len(mismatches) > 0 {
+		return errors.Errorf("%d captured messages did not match the replay", len(mismatches))
+	}
+	return nil
+}
+
+func replayMain() {
+	if err := replay(); err != nil {
+		logrus.Errorf("error in replay: %v", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}